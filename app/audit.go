@@ -0,0 +1,103 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// messageTypeAudit is the control message type carrying the audit events,
+// the body is encoded with the negotiated codec
+const messageTypeAudit = "audit"
+
+// auditProtoStats holds the traffic of a protocol within a session
+type auditProtoStats struct {
+	Protocol         ws.ProtoType `msgpack:"protocol" json:"protocol"`
+	MessagesReceived uint64       `msgpack:"messages_received" json:"messages_received"`
+	BytesReceived    uint64       `msgpack:"bytes_received" json:"bytes_received"`
+	MessagesSent     uint64       `msgpack:"messages_sent" json:"messages_sent"`
+	BytesSent        uint64       `msgpack:"bytes_sent" json:"bytes_sent"`
+}
+
+// auditMessage is the body of the messageTypeAudit control message
+type auditMessage struct {
+	// One of the session.HookEvent* events
+	Event     string            `msgpack:"event" json:"event"`
+	Timestamp string            `msgpack:"timestamp" json:"timestamp"`
+	SessionID string            `msgpack:"session_id" json:"session_id"`
+	StreamID  string            `msgpack:"stream_id,omitempty" json:"stream_id,omitempty"`
+	UserID    string            `msgpack:"user_id" json:"user_id"`
+	Protocol  ws.ProtoType      `msgpack:"protocol" json:"protocol"`
+	Reason    string            `msgpack:"reason,omitempty" json:"reason,omitempty"`
+	Stats     []auditProtoStats `msgpack:"stats,omitempty" json:"stats,omitempty"`
+	// Command line entered, for the auditEventCommand events
+	Command string `msgpack:"command,omitempty" json:"command,omitempty"`
+	Denied  bool   `msgpack:"denied,omitempty" json:"denied,omitempty"`
+}
+
+func newAuditMessage(event string, s *session.MenderShellSession, proto ws.ProtoType) *auditMessage {
+	audit := &auditMessage{
+		Event:     event,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		SessionID: s.GetSessionId(),
+		StreamID:  s.GetStreamId(),
+		UserID:    s.GetUserId(),
+		Protocol:  proto,
+	}
+	if event == session.HookEventSessionClose {
+		audit.Reason = string(s.GetCloseReason())
+		for proto, stats := range s.Stats() {
+			audit.Stats = append(audit.Stats, auditProtoStats{
+				Protocol:         proto,
+				MessagesReceived: stats.MessagesReceived,
+				BytesReceived:    stats.BytesReceived,
+				MessagesSent:     stats.MessagesSent,
+				BytesSent:        stats.BytesSent,
+			})
+		}
+	}
+	return audit
+}
+
+// auditEvent reports the session lifecycle event to the server
+func (d *MenderShellDaemon) auditEvent(event string, s *session.MenderShellSession, proto ws.ProtoType) {
+	d.sendAuditMessage(newAuditMessage(event, s, proto), s)
+}
+
+// sendAuditMessage sends the audit event of the session to the server
+func (d *MenderShellDaemon) sendAuditMessage(audit *auditMessage, s *session.MenderShellSession) {
+	event := audit.Event
+	body, err := d.bodyCodec().Marshal(audit)
+	if err != nil {
+		log.Errorf("failed to encode the %s audit event of session %s: %s", event, s.GetId(), err.Error())
+		return
+	}
+	msg := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:      protoTypeControl,
+			MsgType:    messageTypeAudit,
+			SessionID:  s.GetSessionId(),
+			Properties: map[string]interface{}{},
+		},
+		Body: body,
+	}
+	if err = d.sendQueued(msg); err != nil {
+		log.Errorf("failed to send the %s audit event of session %s: %s", event, s.GetId(), err.Error())
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+func TestNewAuditMessage(t *testing.T) {
+	s, err := session.NewMenderShellSessionStream("audit-session-id", "stream-id", "audit-user-id",
+		session.NoExpirationTimeout, session.NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer session.MenderShellDeleteById(s.GetId())
+
+	audit := newAuditMessage(session.HookEventSessionOpen, s, ws.ProtoTypeShell)
+	assert.Equal(t, session.HookEventSessionOpen, audit.Event)
+	assert.Equal(t, "audit-session-id", audit.SessionID)
+	assert.Equal(t, "stream-id", audit.StreamID)
+	assert.Equal(t, "audit-user-id", audit.UserID)
+	assert.Equal(t, ws.ProtoTypeShell, audit.Protocol)
+	assert.NotEmpty(t, audit.Timestamp)
+	assert.Empty(t, audit.Stats)
+
+	s.RecordMessageReceived(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto: ws.ProtoTypeShell,
+		},
+		Body: []byte("ls\n"),
+	})
+	audit = newAuditMessage(session.HookEventSessionClose, s, ws.ProtoTypeShell)
+	assert.Equal(t, []auditProtoStats{{
+		Protocol:         ws.ProtoTypeShell,
+		MessagesReceived: 1,
+		BytesReceived:    3,
+	}}, audit.Stats)
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// bannerData holds the variables of the banner template
+type bannerData struct {
+	DeviceID  string
+	UserID    string
+	SessionID string
+	Hostname  string
+}
+
+// tokenClaims holds the claims of the JWT token of the device used by
+// the daemon
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// parseTokenClaims returns the claims of the JWT token of the device; the
+// token is not verified, it comes from the client
+func parseTokenClaims(token string) tokenClaims {
+	var claims tokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return tokenClaims{}
+	}
+	return claims
+}
+
+// deviceIDFromToken returns the device id, the subject of the JWT token
+// of the device
+func deviceIDFromToken(token string) string {
+	return parseTokenClaims(token).Subject
+}
+
+// setDeviceID sets the device id from the JWT token of the device
+func (d *MenderShellDaemon) setDeviceID(token string) {
+	d.deviceID.Store(deviceIDFromToken(token))
+}
+
+func (d *MenderShellDaemon) getDeviceID() string {
+	deviceID, _ := d.deviceID.Load().(string)
+	return deviceID
+}
+
+// renderBanner returns the banner of the session, with the line feeds
+// the terminal needs; it is empty if there is no banner or it fails to
+// render
+func (d *MenderShellDaemon) renderBanner(s *session.MenderShellSession) string {
+	text := d.bannerText
+	if d.bannerFile != "" {
+		data, err := ioutil.ReadFile(d.bannerFile)
+		if err != nil {
+			log.Errorf("failed to read the banner: %s", err.Error())
+			return ""
+		}
+		text = string(data)
+	}
+	if text == "" {
+		return ""
+	}
+	tmpl, err := template.New("banner").Parse(text)
+	if err != nil {
+		log.Errorf("failed to parse the banner: %s", err.Error())
+		return ""
+	}
+	hostname, _ := os.Hostname()
+	var banner bytes.Buffer
+	err = tmpl.Execute(&banner, bannerData{
+		DeviceID:  d.getDeviceID(),
+		UserID:    s.GetUserId(),
+		SessionID: s.GetSessionId(),
+		Hostname:  hostname,
+	})
+	if err != nil {
+		log.Errorf("failed to render the banner: %s", err.Error())
+		return ""
+	}
+	lines := strings.Split(strings.Replace(banner.String(), "\r\n", "\n", -1), "\n")
+	return strings.Join(lines, "\r\n")
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+func newToken(payload string) string {
+	return "eyJhbGciOiJSUzI1NiIsInR5cCI6IkpXVCJ9." +
+		base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2lnbmF0dXJl"
+}
+
+func TestDeviceIDFromToken(t *testing.T) {
+	testCases := map[string]struct {
+		token    string
+		deviceID string
+	}{
+		"ok": {
+			token:    newToken(`{"sub":"4ea0c1a5-6a0d-4aca-a4df-3fae69b4cdb5","mender.device":true}`),
+			deviceID: "4ea0c1a5-6a0d-4aca-a4df-3fae69b4cdb5",
+		},
+		"no subject": {
+			token: newToken(`{"mender.device":true}`),
+		},
+		"not json": {
+			token: newToken(`sub`),
+		},
+		"not a token": {
+			token: "token",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.deviceID, deviceIDFromToken(tc.token))
+		})
+	}
+}
+
+func TestRenderBanner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRenderBanner")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	bannerFile := path.Join(dir, "banner")
+	assert.NoError(t, ioutil.WriteFile(bannerFile, []byte("Authorized use only\r\n"), 0644))
+
+	s, err := session.NewMenderShellSession("banner-session-id", "banner-user-id",
+		session.NoExpirationTimeout, session.NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer session.MenderShellDeleteById(s.GetId())
+
+	testCases := map[string]struct {
+		banner config.BannerConfig
+		result string
+	}{
+		"no banner": {},
+		"text": {
+			banner: config.BannerConfig{
+				Text: "Device {{.DeviceID}}\nUser {{.UserID}}, session {{.SessionID}}\n",
+			},
+			result: "Device device-id\r\nUser banner-user-id, session banner-session-id\r\n",
+		},
+		"file": {
+			banner: config.BannerConfig{
+				File: bannerFile,
+			},
+			result: "Authorized use only\r\n",
+		},
+		"file not found": {
+			banner: config.BannerConfig{
+				File: path.Join(dir, "not-found"),
+			},
+		},
+		"invalid template": {
+			banner: config.BannerConfig{
+				Text: "{{.DeviceID",
+			},
+		},
+		"unknown variable": {
+			banner: config.BannerConfig{
+				Text: "{{.Device}}",
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					ShellCommand: "/bin/sh",
+					User:         "mender",
+					Banner:       tc.banner,
+				},
+			})
+			d.setDeviceID(newToken(`{"sub":"device-id"}`))
+			assert.Equal(t, tc.result, d.renderBanner(s))
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"os"
+	"strings"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// auditEventCommand is the event of the audit messages carrying the
+// command lines entered at the shell prompts
+const auditEventCommand = "command"
+
+// commandAuditor logs the command lines entered at the shell prompts,
+// giving a "who ran what" trail lighter than the full recordings
+type commandAuditor struct {
+	logger *log.Logger
+	// report the command lines to the server with send, if set
+	send func(audit *auditMessage, s *session.MenderShellSession)
+}
+
+// newCommandAuditor returns an auditor logging in JSON to path, appending
+// to the file, or to the log of the daemon if path is empty
+func newCommandAuditor(path string) (*commandAuditor, error) {
+	logger := log.New()
+	logger.SetFormatter(&log.JSONFormatter{})
+	if path == "" {
+		logger.SetOutput(log.StandardLogger().Out)
+	} else {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		logger.SetOutput(file)
+	}
+	return &commandAuditor{
+		logger: logger,
+	}, nil
+}
+
+// commandEntered logs the command line entered in the shell of s
+func (a *commandAuditor) commandEntered(s *session.MenderShellSession, commandLine string, denied bool) {
+	commandLine = strings.TrimSpace(commandLine)
+	a.logger.WithFields(log.Fields{
+		"session_id": s.GetSessionId(),
+		"stream_id":  s.GetStreamId(),
+		"user_id":    s.GetUserId(),
+		"command":    commandLine,
+		"denied":     denied,
+	}).Info("command entered")
+	if a.send != nil {
+		audit := newAuditMessage(auditEventCommand, s, ws.ProtoTypeShell)
+		audit.Command = commandLine
+		audit.Denied = denied
+		a.send(audit, s)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+func TestCommandAuditor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCommandAuditor")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "commands.log")
+
+	s, err := session.NewMenderShellSessionStream("command-session-id", "stream-id", "command-user-id",
+		session.NoExpirationTimeout, session.NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer session.MenderShellDeleteById(s.GetId())
+
+	auditor, err := newCommandAuditor(path)
+	assert.NoError(t, err)
+	var sent []*auditMessage
+	auditor.send = func(audit *auditMessage, s *session.MenderShellSession) {
+		sent = append(sent, audit)
+	}
+	auditor.commandEntered(s, "ls -l ", false)
+	auditor.commandEntered(s, "reboot", true)
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Len(t, lines, 2) {
+		entry := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+		assert.Equal(t, "command entered", entry["msg"])
+		assert.Equal(t, "command-session-id", entry["session_id"])
+		assert.Equal(t, "stream-id", entry["stream_id"])
+		assert.Equal(t, "command-user-id", entry["user_id"])
+		assert.Equal(t, "reboot", entry["command"])
+		assert.Equal(t, true, entry["denied"])
+		assert.NotEmpty(t, entry["time"])
+	}
+
+	if assert.Len(t, sent, 2) {
+		assert.Equal(t, auditEventCommand, sent[0].Event)
+		assert.Equal(t, "command-session-id", sent[0].SessionID)
+		assert.Equal(t, "command-user-id", sent[0].UserID)
+		assert.Equal(t, "ls -l", sent[0].Command)
+		assert.False(t, sent[0].Denied)
+		assert.True(t, sent[1].Denied)
+	}
+
+	_, err = newCommandAuditor(filepath.Join(dir, "missing", "commands.log"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// consentAnswer is the outcome of the consent script for a spawn shell
+// message, nil err approves the shell
+type consentAnswer struct {
+	message *ws.ProtoMsg
+	id      uint64
+	err     error
+}
+
+// pendingConsent is a spawn shell message waiting for its consent
+type pendingConsent struct {
+	id     uint64
+	userID string
+}
+
+// pendingConsents tracks the spawn shell messages waiting for the consent
+// script, keyed by stream; the answers to the ones dropped meanwhile, as
+// the shell was stopped or the session closed, are ignored
+type pendingConsents struct {
+	mutex   sync.Mutex
+	lastID  uint64
+	pending map[string]pendingConsent
+}
+
+func newPendingConsents() *pendingConsents {
+	return &pendingConsents{
+		pending: map[string]pendingConsent{},
+	}
+}
+
+// add records a consent request, replacing the one of the stream if any,
+// and returns its id
+func (c *pendingConsents) add(key string, userID string) uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lastID++
+	c.pending[key] = pendingConsent{id: c.lastID, userID: userID}
+	return c.lastID
+}
+
+// answered tells if the consent request is still pending, and forgets it
+func (c *pendingConsents) answered(key string, id uint64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if pending, ok := c.pending[key]; !ok || pending.id != id {
+		return false
+	}
+	delete(c.pending, key)
+	return true
+}
+
+// drop forgets the consent requests of the stream, or of all the streams
+// of the session if streamID is empty, and returns their number
+func (c *pendingConsents) drop(sessionID string, streamID string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	count := 0
+	for key := range c.pending {
+		if key == session.StreamKey(sessionID, streamID) ||
+			(streamID == "" && strings.HasPrefix(key, sessionID+"/")) {
+			delete(c.pending, key)
+			count++
+		}
+	}
+	return count
+}
+
+// dropUser forgets the consent requests of the user, and returns their
+// number
+func (c *pendingConsents) dropUser(userID string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	count := 0
+	for key, pending := range c.pending {
+		if pending.userID == userID {
+			delete(c.pending, key)
+			count++
+		}
+	}
+	return count
+}
+
+// requestConsent runs the consent script without blocking the message
+// loop, which gets the answer through d.consentAnswers
+func (d *MenderShellDaemon) requestConsent(message *ws.ProtoMsg) {
+	sessionID := message.Header.SessionID
+	streamID := getStreamIdFromMessage(message)
+	userID := getUserIdFromSessionOrMessage(message)
+	id := d.consents.add(session.StreamKey(sessionID, streamID), userID)
+	log.Infof("asking for the consent to the shell of session %s", sessionID)
+	go func() {
+		err := session.AskConsent(d.consentScript, sessionID, streamID, userID, d.consentTimeout)
+		d.consentAnswers <- consentAnswer{
+			message: message,
+			id:      id,
+			err:     err,
+		}
+	}()
+}
+
+// consentAnswered spawns the shell once approved, or tells the server it
+// was refused; the answers to the requests dropped meanwhile are ignored
+func (d *MenderShellDaemon) consentAnswered(answer consentAnswer) error {
+	sessionID := answer.message.Header.SessionID
+	key := session.StreamKey(sessionID, getStreamIdFromMessage(answer.message))
+	if !d.consents.answered(key, answer.id) {
+		log.Infof("ignoring the consent to the shell of session %s, no longer requested", sessionID)
+		return nil
+	}
+	if answer.err == nil {
+		log.Infof("the shell of session %s was approved", sessionID)
+		return d.spawnShell(answer.message)
+	}
+	response := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     answer.message.Header.Proto,
+			MsgType:   answer.message.Header.MsgType,
+			SessionID: sessionID,
+			Properties: map[string]interface{}{
+				"status": wsshell.NormalMessage,
+			},
+		},
+		Body: []byte{},
+	}
+	copyStreamId(response, answer.message)
+	d.routeMessageResponse(response, answer.err)
+	return answer.err
+}
+
+// dropSessionConsents forgets the consent requests of a session when it
+// closes
+func (d *MenderShellDaemon) dropSessionConsents(event string, s *session.MenderShellSession, proto ws.ProtoType) {
+	if event == session.HookEventSessionClose {
+		d.consents.drop(s.GetSessionId(), s.GetStreamId())
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+func TestMenderShellSpawnShellConsent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMenderShellSpawnShellConsent")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	testCases := map[string]struct {
+		script string
+		err    error
+	}{
+		"approved": {
+			script: "#!/bin/sh\nexit 0\n",
+		},
+		"refused": {
+			script: "#!/bin/sh\nexit 1\n",
+			err:    session.ErrConsentRefused,
+		},
+		"timeout": {
+			script: "#!/bin/sh\nexec sleep 10\n",
+			err:    session.ErrConsentTimeout,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			script := path.Join(dir, name)
+			err := ioutil.WriteFile(script, []byte(tc.script), 0755)
+			assert.NoError(t, err)
+
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					ShellCommand: "/bin/sh",
+					User:         "mender",
+					Hooks: config.HooksConfig{
+						Consent:               script,
+						ConsentTimeoutSeconds: 1,
+					},
+				},
+			})
+			sessionID := "consent-session-" + name
+			err = d.routeMessageSpawnShell(&ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:     ws.ProtoTypeShell,
+					MsgType:   wsshell.MessageTypeSpawnShell,
+					SessionID: sessionID,
+					Properties: map[string]interface{}{
+						"user_id": "consent-user-id",
+					},
+				},
+			})
+			assert.NoError(t, err)
+			// nothing spawns before the answer
+			assert.Nil(t, session.MenderShellSessionGetById(sessionID))
+
+			select {
+			case answer := <-d.consentAnswers:
+				assert.Equal(t, tc.err, answer.err)
+				err = d.consentAnswered(answer)
+			case <-time.After(5 * time.Second):
+				t.Fatal("the consent script was not answered")
+			}
+			s := session.MenderShellSessionGetById(sessionID)
+			if tc.err != nil {
+				assert.Equal(t, tc.err, err)
+				assert.Nil(t, s)
+				return
+			}
+			assert.NoError(t, err)
+			if assert.NotNil(t, s) {
+				if err := s.StopShell(); err != nil {
+					assert.EqualError(t, err, "error waiting for the process: signal: interrupt")
+				}
+				session.MenderShellDeleteById(sessionID)
+			}
+		})
+	}
+}
+
+func TestMenderShellSpawnShellConsentStopped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMenderShellSpawnShellConsentStopped")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	script := path.Join(dir, "approve")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\nexit 0\n"), 0755)
+	assert.NoError(t, err)
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+			Hooks: config.HooksConfig{
+				Consent: script,
+			},
+		},
+	})
+	defer d.removeListeners()
+	sessionID := "consent-stopped-session"
+	header := ws.ProtoHdr{
+		Proto:     ws.ProtoTypeShell,
+		MsgType:   wsshell.MessageTypeSpawnShell,
+		SessionID: sessionID,
+		Properties: map[string]interface{}{
+			"user_id": "consent-user-id",
+		},
+	}
+	assert.NoError(t, d.routeMessageSpawnShell(&ws.ProtoMsg{Header: header}))
+
+	// stopped before the answer, the approval spawns nothing
+	header.MsgType = wsshell.MessageTypeStopShell
+	header.Properties = map[string]interface{}{}
+	assert.NoError(t, d.routeMessageStopShell(&ws.ProtoMsg{Header: header}))
+	select {
+	case answer := <-d.consentAnswers:
+		assert.NoError(t, answer.err)
+		assert.NoError(t, d.consentAnswered(answer))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the consent script was not answered")
+	}
+	assert.Nil(t, session.MenderShellSessionGetById(sessionID))
+	assert.Equal(t, uint(0), d.shellsSpawned)
+}
+
+func TestPendingConsents(t *testing.T) {
+	c := newPendingConsents()
+	first := c.add("session-id", "user-id")
+	second := c.add("session-id/stream-id", "user-id")
+	replaced := c.add("other-session-id", "other-user-id")
+	other := c.add("other-session-id", "other-user-id")
+
+	assert.False(t, c.answered("other-session-id", replaced))
+	assert.True(t, c.answered("other-session-id", other))
+	assert.False(t, c.answered("other-session-id", other))
+
+	assert.Equal(t, 0, c.drop("session-id", "other-stream-id"))
+	assert.Equal(t, 2, c.drop("session-id", ""))
+	assert.False(t, c.answered("session-id", first))
+	assert.False(t, c.answered("session-id/stream-id", second))
+
+	first = c.add("session-id", "user-id")
+	c.add("other-session-id", "other-user-id")
+	assert.Equal(t, 1, c.dropUser("user-id"))
+	assert.False(t, c.answered("session-id", first))
+}
@@ -0,0 +1,186 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mender-connect/codec"
+	"github.com/mendersoftware/mender-connect/config"
+)
+
+// The control protocol is not part of the vendored ws package yet, the
+// values match the ones used by the deviceconnect service.
+const (
+	protoTypeControl ws.ProtoType = 0xFFFF
+
+	messageTypeOpen   = "open"
+	messageTypeAccept = "accept"
+)
+
+// protocolVersions lists the versions of the protocol the daemon speaks,
+// in order of preference
+var protocolVersions = []int{1}
+
+// openMessage is the body of the messageTypeOpen control message, the
+// open and accept messages are always msgpack encoded
+type openMessage struct {
+	// Versions supported by the peer
+	Versions []int `msgpack:"versions"`
+	// Body encodings supported by the peer, msgpack if empty
+	Encodings []string `msgpack:"encodings"`
+}
+
+// acceptMessage is the body of the messageTypeAccept control message
+type acceptMessage struct {
+	// Version chosen for the connection
+	Version int `msgpack:"version"`
+	// Protocols the device is willing to handle
+	Protocols []ws.ProtoType `msgpack:"protocols"`
+	// Encoding of the bodies of the following messages
+	Encoding string `msgpack:"encoding"`
+}
+
+// protocolsByName maps the protocol names from the configuration
+// to their protocol types, names are validated with the configuration
+func protocolsByName(names []string) map[ws.ProtoType]bool {
+	protocols := make(map[ws.ProtoType]bool, len(names))
+	for _, name := range names {
+		if proto, ok := config.ProtocolsByName[name]; ok {
+			protocols[proto] = true
+		}
+	}
+	return protocols
+}
+
+// supportedProtocols returns the protocols advertised to the peer,
+// i.e.: the ones the daemon implements and the configuration allows
+func (d *MenderShellDaemon) supportedProtocols() []ws.ProtoType {
+	protocols := []ws.ProtoType{}
+	implemented := []ws.ProtoType{ws.ProtoTypeShell}
+	if d.processes.Enabled {
+		implemented = append(implemented, config.ProtoTypeProcesses)
+	}
+	for _, proto := range append(implemented, registeredProtocols()...) {
+		if d.allowedProtocols == nil || d.allowedProtocols[proto] {
+			protocols = append(protocols, proto)
+		}
+	}
+	return protocols
+}
+
+func (d *MenderShellDaemon) isProtocolSupported(proto ws.ProtoType) bool {
+	return proto == ws.ProtoTypeShell ||
+		(proto == config.ProtoTypeProcesses && d.processes.Enabled) ||
+		isProtoHandlerRegistered(proto)
+}
+
+// isProtocolAllowed tells if the user may use the protocol; per user
+// settings take precedence over the device wide AllowedProtocols. An
+// empty device wide list allows all the protocols, it cannot be told from
+// a list not set, while an empty per user list allows none. The roles of
+// the user are left out, only the spawn shell messages carry them
+func (d *MenderShellDaemon) isProtocolAllowed(proto ws.ProtoType, userID string) bool {
+	if protocols, ok := d.userAllowedProtocols[userID]; ok {
+		return protocols[proto]
+	}
+	return d.allowedProtocols == nil || d.allowedProtocols[proto]
+}
+
+// negotiateCodec picks the configured body encoding if the peer supports
+// it, falling back to msgpack otherwise
+func (d *MenderShellDaemon) negotiateCodec(encodings []string) codec.Codec {
+	for _, name := range encodings {
+		if name == d.bodyEncoding {
+			if c, err := codec.Get(name); err == nil {
+				return c
+			}
+		}
+	}
+	return codec.Msgpack
+}
+
+// bodyCodec returns the codec of the message bodies negotiated on the
+// current connection
+func (d *MenderShellDaemon) bodyCodec() codec.Codec {
+	d.codecMutex.Lock()
+	defer d.codecMutex.Unlock()
+	if d.codec == nil {
+		return codec.Msgpack
+	}
+	return d.codec
+}
+
+// setBodyCodec sets the codec of the message bodies; it is reset to
+// msgpack whenever the connection changes, until negotiated again
+func (d *MenderShellDaemon) setBodyCodec(c codec.Codec) {
+	d.codecMutex.Lock()
+	defer d.codecMutex.Unlock()
+	d.codec = c
+}
+
+// routeMessageOpen answers the open handshake with the highest protocol
+// version both sides support and the list of protocols the device handles
+func (d *MenderShellDaemon) routeMessageOpen(message *ws.ProtoMsg) error {
+	response := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     protoTypeControl,
+			MsgType:   messageTypeAccept,
+			SessionID: message.Header.SessionID,
+			Properties: map[string]interface{}{
+				"status": wsshell.NormalMessage,
+			},
+		},
+	}
+
+	open := &openMessage{}
+	if err := codec.Msgpack.Unmarshal(message.Body, open); err != nil {
+		err = errors.Wrap(err, "malformed open message")
+		d.routeMessageResponse(response, err)
+		return err
+	}
+
+	version := 0
+	for _, supported := range protocolVersions {
+		for _, requested := range open.Versions {
+			if supported == requested && supported > version {
+				version = supported
+			}
+		}
+	}
+	if version == 0 {
+		err := errors.New(fmt.Sprintf("none of the protocol versions %v is supported", open.Versions))
+		d.routeMessageResponse(response, err)
+		return err
+	}
+
+	bodyCodec := d.negotiateCodec(open.Encodings)
+	body, err := codec.Msgpack.Marshal(&acceptMessage{
+		Version:   version,
+		Protocols: d.supportedProtocols(),
+		Encoding:  bodyCodec.Name(),
+	})
+	if err != nil {
+		d.routeMessageResponse(response, err)
+		return err
+	}
+	d.setBodyCodec(bodyCodec)
+	response.Body = body
+	d.routeMessageResponse(response, nil)
+	return nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+
+	"github.com/mendersoftware/mender-connect/codec"
+	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/connectionmanager"
+)
+
+func TestRouteMessageOpen(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+		},
+	})
+
+	testCases := map[string]struct {
+		versions []int
+		body     []byte
+		err      string
+	}{
+		"ok": {
+			versions: []int{1, 2},
+		},
+		"error, no common version": {
+			versions: []int{2, 3},
+			err:      "none of the protocol versions [2 3] is supported",
+		},
+		"error, malformed body": {
+			body: []byte("not msgpack"),
+			err:  "malformed open message",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			body := tc.body
+			if body == nil {
+				body, _ = msgpack.Marshal(&openMessage{Versions: tc.versions})
+			}
+			err := d.routeMessage(&ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:   protoTypeControl,
+					MsgType: messageTypeOpen,
+				},
+				Body: body,
+			})
+			if tc.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRouteMessageUnsupportedProtocol(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+		},
+	})
+
+	assert.True(t, d.isProtocolSupported(ws.ProtoTypeShell))
+	assert.False(t, d.isProtocolSupported(ws.ProtoType(2)))
+
+	err := d.routeMessage(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:   ws.ProtoType(2),
+			MsgType: "any",
+		},
+	})
+	assert.EqualError(t, err, "protocol 2 is not supported")
+}
+
+func TestRouteMessageProtocolNotAllowed(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand:     "/bin/sh",
+			User:             "mender",
+			AllowedProtocols: []string{},
+			UserAllowedProtocols: map[string][]string{
+				"admin":   {"shell"},
+				"support": {},
+			},
+		},
+	})
+	assert.True(t, d.isProtocolAllowed(ws.ProtoTypeShell, "anyone"))
+	assert.True(t, d.isProtocolAllowed(ws.ProtoTypeShell, "admin"))
+	assert.False(t, d.isProtocolAllowed(ws.ProtoTypeShell, "support"))
+
+	d = NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand:     "/bin/sh",
+			User:             "mender",
+			AllowedProtocols: []string{"none-yet"},
+			UserAllowedProtocols: map[string][]string{
+				"admin": {"shell"},
+			},
+		},
+	})
+	assert.Empty(t, d.supportedProtocols())
+	assert.False(t, d.isProtocolAllowed(ws.ProtoTypeShell, "anyone"))
+	assert.True(t, d.isProtocolAllowed(ws.ProtoTypeShell, "admin"))
+
+	err := d.routeMessage(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:   ws.ProtoTypeShell,
+			MsgType: "new",
+			Properties: map[string]interface{}{
+				"user_id": "anyone",
+			},
+		},
+	})
+	assert.EqualError(t, err, "protocol 1 is not allowed")
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+			BodyEncoding: codec.NameJSON,
+		},
+	})
+	assert.Equal(t, codec.Msgpack, d.bodyCodec())
+	assert.Equal(t, codec.Msgpack, d.negotiateCodec(nil))
+	assert.Equal(t, codec.Msgpack, d.negotiateCodec([]string{codec.NameMsgpack}))
+	assert.Equal(t, codec.JSON, d.negotiateCodec([]string{codec.NameMsgpack, codec.NameJSON}))
+
+	body, _ := msgpack.Marshal(&openMessage{
+		Versions:  []int{1},
+		Encodings: []string{codec.NameJSON},
+	})
+	err := d.routeMessage(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:   protoTypeControl,
+			MsgType: messageTypeOpen,
+		},
+		Body: body,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, codec.JSON, d.bodyCodec())
+}
+
+func TestBodyCodecResetOnReconnect(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+			BodyEncoding: codec.NameCBOR,
+		},
+	})
+	assert.Equal(t, codec.CBOR, d.negotiateCodec([]string{codec.NameCBOR}))
+	d.setBodyCodec(codec.CBOR)
+
+	// the connection is gone, the next one negotiates its own codec
+	connectionmanager.Close(ws.ProtoTypeShell)
+	done := make(chan struct{})
+	defer close(done)
+	go d.readLoop(make(chan *ws.ProtoMsg, 1), make(chan *ws.ProtoMsg, 1), done)
+	select {
+	case <-d.reconnectChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reconnect requested")
+	}
+	assert.Equal(t, codec.Msgpack, d.bodyCodec())
+	d.StopDaemon()
+}
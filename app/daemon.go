@@ -15,9 +15,16 @@ package app
 
 import (
 	"fmt"
-	"os/user"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -26,28 +33,41 @@ import (
 	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
 	"github.com/pkg/errors"
 
+	"github.com/mendersoftware/mender-connect/cgroup"
 	"github.com/mendersoftware/mender-connect/client/dbus"
 	"github.com/mendersoftware/mender-connect/client/mender"
+	"github.com/mendersoftware/mender-connect/codec"
 	configuration "github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/connection"
 	"github.com/mendersoftware/mender-connect/connectionmanager"
+	"github.com/mendersoftware/mender-connect/limits"
+	"github.com/mendersoftware/mender-connect/notify"
 	"github.com/mendersoftware/mender-connect/procps"
 	"github.com/mendersoftware/mender-connect/session"
+	"github.com/mendersoftware/mender-connect/shell"
+	"github.com/mendersoftware/mender-connect/tracing"
 	"github.com/mendersoftware/mender-connect/utils"
 )
 
 var lastExpiredSessionSweep = time.Now()
 var expiredSessionsSweepFrequency = time.Second * 32
 
+// number of data messages read ahead while a message is being handled
+var messageQueueSize = 64
+
 const (
 	EventReconnect             = "reconnect"
 	EventReconnectRequest      = "reconnect-req"
 	EventConnectionEstablished = "connected"
+	EventTokenRefreshed        = "token-refreshed"
+	EventTLSReload             = "tls-reload"
 )
 
 const (
 	propertyTerminalHeight = "terminal_height"
 	propertyTerminalWidth  = "terminal_width"
 	propertyUserID         = "user_id"
+	propertyConnectionID   = "connection_id"
 )
 
 type MenderShellDaemonEvent struct {
@@ -67,22 +87,151 @@ type MenderShellDaemon struct {
 	printStatus             bool
 	username                string
 	shell                   string
+	userShells              map[string]string
+	allowedRunAsUsers       []string
+	consentScript           string
+	consentTimeout          time.Duration
+	consentAnswers          chan consentAnswer
+	consents                *pendingConsents
+	restrictedShell         configuration.RestrictedShellConfig
+	multiplexer             configuration.MultiplexerConfig
+	processes               configuration.ProcessesConfig
+	takeover                configuration.TakeoverConfig
+	observe                 configuration.ObserveConfig
+	debugShellSocket        string
+	allowedTerminalTypes    []string
+	allowedLocales          []string
 	serverUrl               string
 	serverCertificate       string
 	skipVerify              bool
 	deviceConnectUrl        string
 	expireSessionsAfter     time.Duration
 	expireSessionsAfterIdle time.Duration
+	tokenExpiryAction       string
+	tokenExpiryGracePeriod  time.Duration
+	tokenExpiresAt          atomic.Value
+	authToken               atomic.Value
+	tokenRefreshRequested   int32
+	authExpiryChanged       int32
+	tlsFiles                []string
+	tlsFilesState           string
+	tlsFilesCheckedAt       time.Time
+	tlsReloadWatch          bool
+	tlsReloadInterval       time.Duration
+	tlsReloadRequested      int32
+	authClient              mender.AuthProvider
+	auth                    configuration.AuthConfig
+	allowedProtocols        map[ws.ProtoType]bool
+	userAllowedProtocols    map[string]map[ws.ProtoType]bool
+	drainSessionsTimeout    time.Duration
+	messageLoopRunning      sync.WaitGroup
+	bodyEncoding            string
+	rateLimiter             *rateLimiter
+	deduplicator            *deduplicator
+	tracer                  *sessionTracer
+	removeEventListeners    []func()
+	codecMutex              sync.Mutex
+	codec                   codec.Codec
+	exportDBusStatus        bool
+	statusFile              string
+	statusFileInterval      time.Duration
+	statusFileWrittenAt     time.Time
+	notifiedStatus          string
+	outbox                  *outbox
+	bandwidth               *limits.Budget
+	startedAt               time.Time
 	terminalString          string
+	warmShells              int
 	terminalWidth           uint16
 	terminalHeight          uint16
 	uid                     uint64
 	gid                     uint64
 	homeDir                 string
+	bannerText              string
+	bannerFile              string
+	deviceID                atomic.Value
 	shellsSpawned           uint
+	shellsSpawnedMutex      sync.Mutex
 	debug                   bool
 }
 
+// serverURLProvider is implemented by the auth providers which tell the
+// server URL the token was issued by
+type serverURLProvider interface {
+	ServerURL() (string, error)
+}
+
+// newAuthProvider returns the provider of the token of the file or http
+// auth backend, taking the server URL from it if it tells one
+func (d *MenderShellDaemon) newAuthProvider() (mender.AuthProvider, error) {
+	var provider mender.AuthProvider
+	if d.auth.Backend == configuration.AuthBackendHTTP {
+		client, err := mender.NewAuthClientHTTP(d.auth.URL)
+		if err != nil {
+			return nil, err
+		}
+		provider = client
+	} else {
+		provider = mender.NewAuthClientFile(d.auth.TokenFile, d.auth.ServerURLFile)
+	}
+	err := provider.Connect()
+	if err != nil {
+		log.Errorf("failed to connect to the %s auth backend: %s", d.auth.Backend, err.Error())
+		return nil, err
+	}
+	serverURL, err := provider.(serverURLProvider).ServerURL()
+	if err != nil {
+		log.Errorf("failed to get the server URL from the %s auth backend: %s",
+			d.auth.Backend, err.Error())
+		return nil, err
+	} else if serverURL != "" {
+		d.serverUrl = serverURL
+		connectionmanager.SetFailoverServers(nil, false)
+	}
+	return provider, nil
+}
+
+// proxyFromConfig returns the proxy to the servers, nil for the one of
+// the environment
+func proxyFromConfig(config configuration.ProxyConfig) *connection.Proxy {
+	if config.URL == "" {
+		return nil
+	}
+	proxyURL, err := url.Parse(config.URL)
+	if err != nil {
+		log.Errorf("failed to parse the proxy URL: %s", err.Error())
+		return nil
+	}
+	if config.Username != "" {
+		proxyURL.User = url.UserPassword(config.Username, config.Password)
+	}
+	return &connection.Proxy{
+		URL:     proxyURL,
+		NoProxy: config.NoProxy,
+	}
+}
+
+// keepAliveFromConfig returns the TCP keepalive of the connections to the
+// servers, nil for the Go defaults
+func keepAliveFromConfig(config configuration.TCPKeepAliveConfig) *connection.KeepAlive {
+	if config == (configuration.TCPKeepAliveConfig{}) {
+		return nil
+	}
+	keepAlive := &connection.KeepAlive{
+		Disabled: config.Disabled,
+		Idle:     time.Second * time.Duration(config.IdleSeconds),
+		Interval: time.Second * time.Duration(config.IntervalSeconds),
+		Count:    config.Count,
+	}
+	if keepAlive.Idle == 0 {
+		keepAlive.Idle = configuration.DefaultTCPKeepAlive
+	}
+	if keepAlive.Interval == 0 {
+		keepAlive.Interval = configuration.DefaultTCPKeepAlive
+	}
+	return keepAlive
+}
+
 func NewDaemon(config *configuration.MenderShellConfig) *MenderShellDaemon {
 	daemon := MenderShellDaemon{
 		writeMutex:              &sync.Mutex{},
@@ -94,26 +243,283 @@ func NewDaemon(config *configuration.MenderShellConfig) *MenderShellDaemon {
 		authorized:              false,
 		username:                config.User,
 		shell:                   config.ShellCommand,
+		userShells:              config.UserShells,
+		allowedRunAsUsers:       config.AllowedRunAsUsers,
+		consentScript:           config.Hooks.Consent,
+		consentTimeout:          configuration.DefaultConsentTimeout,
+		tokenExpiryAction:       config.Sessions.TokenExpiryAction,
+		tokenExpiryGracePeriod:  configuration.DefaultTokenExpiryGracePeriod,
+		consentAnswers:          make(chan consentAnswer, messageQueueSize),
+		consents:                newPendingConsents(),
+		restrictedShell:         config.RestrictedShell,
+		multiplexer:             config.Multiplexer,
+		processes:               config.Processes,
+		takeover:                config.Takeover,
+		observe:                 config.Observe,
+		allowedTerminalTypes:    config.Terminal.AllowedTypes,
+		allowedLocales:          config.Terminal.AllowedLocales,
 		serverUrl:               config.ServerURL,
 		serverCertificate:       config.ServerCertificate,
+		tlsReloadWatch:          config.TLSReload.Watch,
+		tlsReloadInterval:       time.Second * time.Duration(config.TLSReload.IntervalSeconds),
 		skipVerify:              config.SkipVerify,
 		expireSessionsAfter:     time.Second * time.Duration(config.Sessions.ExpireAfter),
 		expireSessionsAfterIdle: time.Second * time.Duration(config.Sessions.ExpireAfterIdle),
+		drainSessionsTimeout:    time.Second * time.Duration(config.Sessions.DrainTimeout),
+		bodyEncoding:            config.BodyEncoding,
+		codec:                   codec.Msgpack,
+		exportDBusStatus:        config.DBusStatus,
+		statusFile:              config.StatusFile.Path,
+		statusFileInterval:      time.Second * time.Duration(config.StatusFile.IntervalSeconds),
+		startedAt:               time.Now(),
+		auth:                    config.Auth,
 		deviceConnectUrl:        configuration.DefaultDeviceConnectPath,
 		terminalString:          configuration.DefaultTerminalString,
+		warmShells:              int(config.Terminal.WarmShells),
 		terminalWidth:           config.Terminal.Width,
 		terminalHeight:          config.Terminal.Height,
+		bannerText:              config.Banner.Text,
+		bannerFile:              config.Banner.File,
 		shellsSpawned:           0,
 		debug:                   config.Debug,
 	}
 
+	if len(daemon.allowedTerminalTypes) == 0 {
+		daemon.allowedTerminalTypes = configuration.DefaultAllowedTerminalTypes
+	}
+	if len(daemon.allowedLocales) == 0 {
+		daemon.allowedLocales = configuration.DefaultAllowedLocales
+	}
+	if len(config.AllowedProtocols) > 0 {
+		daemon.allowedProtocols = protocolsByName(config.AllowedProtocols)
+	}
+	if len(config.UserAllowedProtocols) > 0 {
+		daemon.userAllowedProtocols = map[string]map[ws.ProtoType]bool{}
+		for userID, names := range config.UserAllowedProtocols {
+			daemon.userAllowedProtocols[userID] = protocolsByName(names)
+		}
+	}
+
+	if daemon.drainSessionsTimeout == 0 {
+		daemon.drainSessionsTimeout = configuration.DefaultDrainSessionsTimeout
+	}
+	if daemon.statusFileInterval == 0 {
+		daemon.statusFileInterval = defaultStatusFileInterval
+	}
+	if daemon.tlsReloadInterval == 0 {
+		daemon.tlsReloadInterval = defaultTLSReloadInterval
+	}
+
 	connectionmanager.SetReconnectIntervalSeconds(config.ReconnectIntervalSeconds)
+	connectionmanager.SetCircuitBreaker(config.ReconnectCircuitBreaker.Failures,
+		time.Second*time.Duration(config.ReconnectCircuitBreaker.QuietPeriodSeconds))
+	if config.PingIntervalSeconds > 0 {
+		connectionmanager.SetPingInterval(time.Second * time.Duration(config.PingIntervalSeconds))
+	}
+	if config.PongTimeoutSeconds > 0 {
+		connectionmanager.SetPongTimeout(time.Second * time.Duration(config.PongTimeoutSeconds))
+	}
+	if config.MaxMessageSize > 0 {
+		connectionmanager.SetMaxMessageSize(config.MaxMessageSize)
+	}
+	var failoverServers []string
+	if len(config.Servers) > 1 {
+		for _, server := range config.Servers {
+			if server.ServerURL != "" {
+				failoverServers = append(failoverServers, server.ServerURL)
+			}
+		}
+	}
+	connectionmanager.SetFailoverServers(failoverServers, config.ServerFailover.Sticky)
+	connection.SetProxy(proxyFromConfig(config.Proxy))
+	connection.SetBind(config.Bind.Interface, net.ParseIP(config.Bind.Address))
+	connection.SetKeepAlive(keepAliveFromConfig(config.TCPKeepAlive))
+	connection.SetCompression(config.Compression.Enabled, config.Compression.Level)
+	connection.SetHandshakeHeaders(config.Handshake.UserAgent, config.Handshake.Headers)
+	if config.Bandwidth.HourlyBytes > 0 || config.Bandwidth.DailyBytes > 0 {
+		daemon.bandwidth = limits.NewBudget(config.Bandwidth.HourlyBytes, config.Bandwidth.DailyBytes)
+	}
+	connection.SetBudget(daemon.bandwidth)
+	if client := config.GetHTTPConfig().Client; client == nil {
+		connection.SetClientCertificate("", "")
+	} else if strings.HasPrefix(client.Key, "pkcs11:") {
+		log.Errorf("loading the client key from %s is not supported, "+
+			"connecting without the client certificate", client.Key)
+		connection.SetClientCertificate("", "")
+	} else {
+		connection.SetClientCertificate(client.Certificate, client.Key)
+		daemon.tlsFiles = append(daemon.tlsFiles, client.Certificate, client.Key)
+	}
+	if config.ServerCertificate != "" {
+		daemon.tlsFiles = append(daemon.tlsFiles, config.ServerCertificate)
+	}
+	daemon.tlsFilesState = tlsFilesState(daemon.tlsFiles)
+	if daemon.serverUrl == "" && len(config.Servers) > 0 {
+		daemon.serverUrl = config.Servers[0].ServerURL
+	}
 	if config.Sessions.MaxPerUser > 0 {
 		session.MaxUserSessions = int(config.Sessions.MaxPerUser)
 	}
+	if config.Sessions.ShellIdleTimeout > 0 {
+		session.ShellIdleTimeout = time.Second * time.Duration(config.Sessions.ShellIdleTimeout)
+	}
+	if config.Sessions.ShellIdleGracePeriod > 0 {
+		session.ShellIdleGracePeriod = time.Second * time.Duration(config.Sessions.ShellIdleGracePeriod)
+	}
+	if config.Sessions.ShellIdleWarning > 0 {
+		session.ShellIdleWarning = time.Second * time.Duration(config.Sessions.ShellIdleWarning)
+		session.ShellIdleWarningText = config.Sessions.ShellIdleWarningText
+	}
+	if config.Observe.MaxObservers > 0 {
+		session.MaxObservers = int(config.Observe.MaxObservers)
+	}
+	if config.Sessions.MaxShellSessionsPerUser > 0 {
+		session.MaxUserShells = int(config.Sessions.MaxShellSessionsPerUser)
+	}
+	if config.Sessions.MaxTerminalsPerSession > 0 {
+		session.MaxSessionStreams = int(config.Sessions.MaxTerminalsPerSession)
+	}
+	if config.Terminal.MaxOutputBytesPerSecond > 0 {
+		session.MaxOutputBytesPerSecond = uint64(config.Terminal.MaxOutputBytesPerSecond)
+	}
+	if config.Sessions.MaxConcurrent > 0 {
+		session.MaxSessions = int(config.Sessions.MaxConcurrent)
+		session.MaxSessionsEvictOldestIdle = config.Sessions.MaxConcurrentPolicy ==
+			configuration.SessionsLimitPolicyEvictOldestIdle
+		if session.MaxSessionsEvictOldestIdle {
+			daemon.addEventListener(daemon.shellEvicted)
+		}
+	}
+	shell.LoginShell = config.LoginShell
+	shell.ShellEnv = shellEnv(config.ShellEnvironment)
+	if config.Hardening.NoNewPrivs || config.Hardening.SeccompProfile != "" {
+		executable, err := os.Executable()
+		if err != nil {
+			log.Errorf("failed to find the mender-connect binary, shells hardening not applied: %s",
+				err.Error())
+		} else {
+			shell.ShellHardening = &shell.Hardening{
+				Executable:     executable,
+				NoNewPrivs:     config.Hardening.NoNewPrivs,
+				SeccompProfile: config.Hardening.SeccompProfile,
+			}
+		}
+	}
+	if config.SystemdScope.Enabled {
+		session.SystemdScope = newSystemdScope(config)
+	} else if config.Cgroup.Enabled {
+		cgroups, err := cgroup.NewHierarchy(config.Cgroup.Root, cgroup.Limits{
+			CPUWeight: config.Cgroup.CPUWeight,
+			MemoryMax: config.Cgroup.MemoryMax,
+			PidsMax:   config.Cgroup.PidsMax,
+		})
+		if err != nil {
+			log.Errorf("failed to set up the cgroups of the shells, not applied: %s", err.Error())
+		} else {
+			session.Cgroups = cgroups
+		}
+	}
+	if len(config.CommandPolicy.Allow) > 0 || len(config.CommandPolicy.Deny) > 0 {
+		policy, err := shell.NewCommandPolicy(config.CommandPolicy.Allow, config.CommandPolicy.Deny)
+		if err != nil {
+			log.Errorf("invalid command policy, not applied: %s", err.Error())
+		} else {
+			session.CommandPolicy = policy
+		}
+	}
+	if config.Sessions.AlertAfterPerHour > 0 {
+		session.SessionsPerHourAlertThreshold = int(config.Sessions.AlertAfterPerHour)
+	}
+	session.Hooks = map[string]string{
+		session.HookEventSessionOpen:  config.Hooks.SessionOpen,
+		session.HookEventHandlerStart: config.Hooks.HandlerStart,
+		session.HookEventSessionClose: config.Hooks.SessionClose,
+	}
+	if config.Hooks.TimeoutSeconds > 0 {
+		session.HookTimeout = time.Second * time.Duration(config.Hooks.TimeoutSeconds)
+	}
+	if config.Sessions.TokenExpiryGracePeriod > 0 {
+		daemon.tokenExpiryGracePeriod = time.Second * time.Duration(config.Sessions.TokenExpiryGracePeriod)
+	}
+	if config.Hooks.ConsentTimeoutSeconds > 0 {
+		daemon.consentTimeout = time.Second * time.Duration(config.Hooks.ConsentTimeoutSeconds)
+	}
+	if daemon.consentScript != "" {
+		daemon.addEventListener(daemon.dropSessionConsents)
+	}
+	if config.Sessions.MaxMessagesPerSecond > 0 || len(config.Sessions.ProtocolMaxMessagesPerSecond) > 0 {
+		protoRates := map[ws.ProtoType]uint32{}
+		for name, rate := range config.Sessions.ProtocolMaxMessagesPerSecond {
+			if proto, ok := configuration.ProtocolsByName[name]; ok {
+				protoRates[proto] = rate
+			}
+		}
+		daemon.rateLimiter = newRateLimiter(config.Sessions.MaxMessagesPerSecond, protoRates)
+		daemon.addEventListener(daemon.forgetSessionRate)
+	}
+	dedupWindow := configuration.DefaultDedupWindow
+	if config.Sessions.DedupWindow > 0 {
+		dedupWindow = time.Second * time.Duration(config.Sessions.DedupWindow)
+	}
+	daemon.deduplicator = newDeduplicator(dedupWindow)
+	daemon.addEventListener(daemon.forgetSessionMessages)
+	if config.Sessions.HandlerCloseTimeout > 0 {
+		ProtoHandlerCloseTimeout = time.Second * time.Duration(config.Sessions.HandlerCloseTimeout)
+	}
+	protoHandlerManager.idleTimeout = time.Second * time.Duration(config.Sessions.HandlerIdleTimeout)
+	if config.OfflineQueue.Enabled {
+		outbox, err := newOutbox(config.OfflineQueue.File, config.OfflineQueue.MaxMessages)
+		if err != nil {
+			log.Errorf("failed to load the offline queue %s: %s", config.OfflineQueue.File, err.Error())
+		}
+		daemon.outbox = outbox
+	}
+	notify.SetNotifier(&connectionNotifier{d: &daemon})
+	if config.AuditTrail {
+		daemon.addEventListener(daemon.auditEvent)
+	}
+	if config.CommandAudit.Enabled {
+		auditor, err := newCommandAuditor(config.CommandAudit.File)
+		if err != nil {
+			log.Errorf("failed to open the command audit log %s: %s", config.CommandAudit.File, err.Error())
+		} else {
+			if config.CommandAudit.Upload {
+				auditor.send = daemon.sendAuditMessage
+			}
+			session.AddCommandListener(auditor.commandEntered)
+		}
+	}
+	if config.DebugShell.Enabled {
+		daemon.debugShellSocket = config.DebugShell.Socket
+	}
+	if config.Recording.Enabled {
+		session.RecordingsDir = config.Recording.Directory
+		if config.Recording.Upload {
+			daemon.addEventListener(daemon.uploadRecording)
+		}
+	}
+	if config.Tracing.Enabled {
+		tracing.Enable(tracing.NewOTLPExporter(config.Tracing.Endpoint, config.Tracing.ServiceName))
+		daemon.tracer = newSessionTracer()
+		daemon.addEventListener(daemon.tracer.sessionEvent)
+	}
 	return &daemon
 }
 
+// addEventListener registers a session lifecycle listener, unregistered
+// by removeListeners
+func (d *MenderShellDaemon) addEventListener(listener session.EventListener) {
+	d.removeEventListeners = append(d.removeEventListeners, session.AddEventListener(listener))
+}
+
+// removeListeners unregisters the session lifecycle listeners of the daemon
+func (d *MenderShellDaemon) removeListeners() {
+	for _, remove := range d.removeEventListeners {
+		remove()
+	}
+	d.removeEventListeners = nil
+}
+
 func (d *MenderShellDaemon) StopDaemon() {
 	d.stop = true
 	select {
@@ -135,7 +541,8 @@ func (d *MenderShellDaemon) shouldPrintStatus() bool {
 }
 
 func (d *MenderShellDaemon) timeToSweepSessions() bool {
-	if d.expireSessionsAfter == time.Duration(0) && d.expireSessionsAfterIdle == time.Duration(0) {
+	if d.expireSessionsAfter == time.Duration(0) && d.expireSessionsAfterIdle == time.Duration(0) &&
+		session.ShellIdleTimeout == session.NoExpirationTimeout {
 		return false
 	}
 
@@ -150,6 +557,7 @@ func (d *MenderShellDaemon) timeToSweepSessions() bool {
 }
 
 func (d *MenderShellDaemon) wsReconnect(token string) (err error) {
+	d.setDeviceID(token)
 	err = connectionmanager.Reconnect(ws.ProtoTypeShell, d.serverUrl, d.deviceConnectUrl, token, d.skipVerify, d.serverCertificate, configuration.MaxReconnectAttempts, d.stopChan)
 	if err != nil {
 		return errors.New("failed to reconnect after " + strconv.Itoa(int(configuration.MaxReconnectAttempts)) + " tries: " + err.Error())
@@ -161,6 +569,35 @@ func (d *MenderShellDaemon) wsReconnect(token string) (err error) {
 func (d *MenderShellDaemon) outputStatus() {
 	log.Infof("mender-connect daemon v%s", configuration.VersionString())
 	log.Info(" status: ")
+	if serverUrl := connectionmanager.GetServerURL(ws.ProtoTypeShell); serverUrl != "" {
+		log.Infof("  server: %s", serverUrl)
+	}
+	if status := connectionmanager.GetStatus(ws.ProtoTypeShell); status.Connects > 0 {
+		if status.Connected {
+			log.Infof("  connected for: %s", time.Since(status.Since).Round(time.Second))
+		}
+		log.Infof("  connections: %d reconnects, %d disconnects, handshake latency %s",
+			status.Connects-1, status.Disconnects, status.HandshakeLatency)
+		if !status.LastDisconnectAt.IsZero() {
+			log.Infof("  last disconnect: %s at %s", status.LastDisconnectReason,
+				status.LastDisconnectAt.Format(time.RFC3339))
+		}
+	}
+	if rtt, err := connectionmanager.GetRTTStats(ws.ProtoTypeShell); err == nil {
+		log.Infof("  ping rtt: min:%s avg:%s max:%s last:%s pings:%d",
+			rtt.Min, rtt.Avg, rtt.Max, rtt.Last, rtt.Count)
+	}
+	if traffic, err := connectionmanager.GetTrafficStats(ws.ProtoTypeShell); err == nil {
+		log.Infof("  traffic: received:%d messages/%d bytes (%d on the wire) "+
+			"sent:%d messages/%d bytes (%d on the wire)",
+			traffic.MessagesReceived, traffic.PayloadBytesReceived, traffic.BytesReceived,
+			traffic.MessagesSent, traffic.PayloadBytesSent, traffic.BytesSent)
+	}
+	if d.bandwidth != nil {
+		usage := d.bandwidth.Usage()
+		log.Infof("  bandwidth: hour:%d/%d bytes day:%d/%d bytes",
+			usage.Hour, usage.Hourly, usage.Day, usage.Daily)
+	}
 	log.Infof("  sessions: %d", session.MenderShellSessionGetCount())
 	sessionIds := session.MenderShellSessionGetSessionIds()
 	for _, id := range sessionIds {
@@ -168,38 +605,137 @@ func (d *MenderShellDaemon) outputStatus() {
 		log.Infof("   id:%s status:%d started:%s", id, s.GetStatus(), s.GetStartedAtFmt())
 		log.Infof("   expires:%s active:%s", s.GetExpiresAtFmt(), s.GetActiveAtFmt())
 		log.Infof("   shell:%s", s.GetShellCommandPath())
+		for proto, stats := range s.Stats() {
+			log.Infof("   proto:%d received:%d messages/%d bytes sent:%d messages/%d bytes",
+				proto, stats.MessagesReceived, stats.BytesReceived,
+				stats.MessagesSent, stats.BytesSent)
+		}
 	}
 	d.printStatus = false
 }
 
-func (d *MenderShellDaemon) messageLoop() (err error) {
-	log.Debug("messageLoop: starting")
+// isControlMessage tells if msg controls the connection rather than a
+// session, and should skip the queued data messages; the messages of the
+// sessions, StopShell included, are handled in the order they came in
+func isControlMessage(msg *ws.ProtoMsg) bool {
+	return msg.Header.Proto == protoTypeControl
+}
+
+// readLoop reads the messages from the connection into the control and
+// the data lanes, so that the control messages do not wait behind the
+// data; on read errors it waits for the connection to be re-established.
+// It returns once done is closed, by the message loop returning
+func (d *MenderShellDaemon) readLoop(controlChan, dataChan chan<- *ws.ProtoMsg, done <-chan struct{}) {
 	for {
 		if d.shouldStop() {
-			log.Debug("messageLoop: returning")
-			break
+			log.Debug("readLoop: returning")
+			return
 		}
 
-		log.Debug("messageLoop: calling readMessage")
+		log.Debug("readLoop: calling readMessage")
 		message, err := d.readMessage()
-		log.Debugf("messageLoop: called readMessage: %v,%v", message, err)
-		if err != nil {
-			log.Errorf("messageLoop: error on readMessage: %v; disconnecting, waiting for reconnect.", err)
+		log.Debugf("readLoop: called readMessage: %v,%v", message, err)
+		if err == connection.ErrMessageTooLarge {
+			d.routeMessageResponse(&ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:      ws.ProtoTypeShell,
+					Properties: map[string]interface{}{},
+				},
+			}, err)
+			continue
+		} else if err != nil {
+			log.Errorf("readLoop: error on readMessage: %v; disconnecting, waiting for reconnect.", err)
 			connectionmanager.Close(ws.ProtoTypeShell)
+			d.setBodyCodec(codec.Msgpack)
 			e := MenderShellDaemonEvent{
 				event: EventReconnectRequest,
 			}
-			log.Debugf("messageLoop: posting event: %s; waiting for response", e.event)
-			d.reconnectChan <- e
-			response := <-d.connectionEstChan
-			log.Debugf("messageLoop: got response: %+v", response)
+			log.Debugf("readLoop: posting event: %s; waiting for response", e.event)
+			select {
+			case d.reconnectChan <- e:
+			case <-done:
+				return
+			}
+			select {
+			case response := <-d.connectionEstChan:
+				log.Debugf("readLoop: got response: %+v", response)
+			case <-done:
+				return
+			}
 			continue
 		}
 
-		log.Debugf("got message: type:%s data length:%d", message.Header.MsgType, len(message.Body))
+		lane := dataChan
+		if isControlMessage(message) {
+			lane = controlChan
+		}
+		select {
+		case lane <- message:
+		case <-done:
+			return
+		}
+	}
+}
+
+// nextMessage returns the next message to handle, the pending control
+// messages go first; it returns nil if none arrived within a second
+func nextMessage(controlChan, dataChan <-chan *ws.ProtoMsg) *ws.ProtoMsg {
+	select {
+	case message := <-controlChan:
+		return message
+	default:
+	}
+
+	select {
+	case message := <-controlChan:
+		return message
+	case message := <-dataChan:
+		return message
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+func (d *MenderShellDaemon) messageLoop() (err error) {
+	log.Debug("messageLoop: starting")
+	controlChan := make(chan *ws.ProtoMsg, messageQueueSize)
+	dataChan := make(chan *ws.ProtoMsg, messageQueueSize)
+	done := make(chan struct{})
+	defer close(done)
+	go d.readLoop(controlChan, dataChan, done)
+	for {
+		if d.shouldStop() {
+			log.Debug("messageLoop: returning")
+			break
+		}
+
+		select {
+		case answer := <-d.consentAnswers:
+			if err = d.consentAnswered(answer); err != nil {
+				log.Debugf("error spawning the shell: %s", err.Error())
+			}
+			continue
+		default:
+		}
+
+		message := nextMessage(controlChan, dataChan)
+		if message == nil {
+			continue
+		}
+
+		msgLog := log.WithFields(log.Fields{
+			"connection_id": connectionmanager.GetConnectionID(ws.ProtoTypeShell),
+			"session_id":    message.Header.SessionID,
+		})
+		msgLog.Debugf("got message: type:%s data length:%d", message.Header.MsgType, len(message.Body))
+		if s := getSessionFromMessage(message); s != nil {
+			s.RecordMessageReceived(message)
+		}
+		span := d.tracer.startMessageSpan(message)
 		err = d.routeMessage(message)
+		span.Finish(err)
 		if err != nil {
-			log.Debugf("error routing message: %s", err.Error())
+			msgLog.Debugf("error routing message: %s", err.Error())
 		}
 	}
 
@@ -207,7 +743,7 @@ func (d *MenderShellDaemon) messageLoop() (err error) {
 	return err
 }
 
-func waitForJWTToken(client mender.AuthClient) (jwtToken string, err error) {
+func waitForJWTToken(client mender.AuthProvider) (jwtToken string, err error) {
 	for {
 		p, _ := client.WaitForJwtTokenStateChange()
 		if len(p) > 0 && p[0].ParamType == dbus.GDBusTypeString && len(p[0].ParamData.(string)) > 0 {
@@ -237,12 +773,22 @@ func (d *MenderShellDaemon) gotAuthToken(p []dbus.SignalParams, needsReconnect b
 				d.postEvent(e)
 			}
 		}
+		if previous, _ := d.authToken.Load().(string); d.authorized && previous != jwtToken {
+			e := MenderShellDaemonEvent{
+				event: EventTokenRefreshed,
+				data:  jwtToken,
+				id:    "(gotAuthToken)",
+			}
+			log.Debugf("(gotAuthToken) posting Event: %s", e.event)
+			d.postEvent(e)
+		}
+		d.setAuthToken(jwtToken)
 		d.authorized = true
 	} else {
 		if d.authorized {
 			log.Debugf("dbusEventLoop: StateChanged from authorized to unauthorized." +
 				"terminating all sessions and disconnecting.")
-			shellsCount, sessionsCount, err := session.MenderSessionTerminateAll()
+			shellsCount, sessionsCount, err := session.MenderSessionTerminateAll(session.CloseReasonUnauthorized)
 			if err == nil {
 				log.Infof("dbusEventLoop terminated %d sessions, %d shells",
 					shellsCount, sessionsCount)
@@ -267,7 +813,7 @@ func (d *MenderShellDaemon) needsReconnect() bool {
 	}
 }
 
-func (d *MenderShellDaemon) dbusEventLoop(client mender.AuthClient) {
+func (d *MenderShellDaemon) dbusEventLoop(client mender.AuthProvider) {
 	needsReconnect := false
 	for {
 		if d.shouldStop() {
@@ -331,6 +877,10 @@ func (d *MenderShellDaemon) eventLoop() {
 					event: EventConnectionEstablished,
 				}
 			}
+		case EventTokenRefreshed:
+			d.refreshConnection(event.data)
+		case EventTLSReload:
+			d.reloadTLS()
 		}
 	}
 
@@ -340,60 +890,101 @@ func (d *MenderShellDaemon) eventLoop() {
 //starts all needed elements of the mender-connect daemon
 // * executes given shell (shell.ExecuteShell)
 // * get dbus API and starts the dbus main loop (dbus.GetDBusAPI(), go dbusAPI.MainLoopRun(loop))
-// * creates a new dbus client and connects to dbus (mender.NewAuthClient(dbusAPI), client.Connect(...))
+// * creates a new dbus client and connects to dbus (mender.NewAuthClient(dbusAPI), client.Connect(...)),
+//   or with the file or http auth backend reads the token from them instead (d.newAuthProvider())
 // * gets the JWT token from the mender-client via dbus (client.GetJWTToken())
 // * connects to the backend and returns a new websocket (deviceconnect.Connect(...))
 // * starts the message flow between the shell and websocket (shell.NewMenderShell(...))
 func (d *MenderShellDaemon) Run() error {
+	defer d.removeListeners()
 	if d.debug {
 		log.SetLevel(log.DebugLevel)
 	}
 
 	log.Debug("daemon Run starting")
-	u, err := user.Lookup(d.username)
-	if err == nil && u == nil {
-		return errors.New("unknown error while getting a user id")
-	}
+	runAs, err := lookupRunAsUser(d.username)
 	if err != nil {
 		return err
 	}
-
-	d.homeDir = u.HomeDir
-
-	d.uid, err = strconv.ParseUint(u.Uid, 10, 32)
-	if err != nil {
-		return err
+	d.uid, d.gid, d.homeDir = runAs.uid, runAs.gid, runAs.homeDir
+
+	if d.warmShells > 0 && session.SystemdScope == nil {
+		session.WarmShells = session.NewShellPool(session.MenderShellTerminalSettings{
+			Uid:            uint32(d.uid),
+			Gid:            uint32(d.gid),
+			Shell:          d.shell,
+			HomeDir:        d.homeDir,
+			TerminalString: d.terminalString,
+			Env:            []string{},
+			Height:         d.terminalHeight,
+			Width:          d.terminalWidth,
+		}, d.warmShells)
+		go session.WarmShells.Fill()
+		defer session.WarmShells.Close()
 	}
 
-	d.gid, err = strconv.ParseUint(u.Gid, 10, 32)
-	if err != nil {
-		return err
+	if d.debugShellSocket != "" {
+		debugShell, err := d.serveDebugShell(d.debugShellSocket)
+		if err != nil {
+			log.Errorf("failed to serve the debug shell: %s", err.Error())
+		} else {
+			defer debugShell.close()
+		}
 	}
 
-	log.Debug("mender-connect connecting to dbus")
-	//dbus main loop, required.
-	dbusAPI, err := dbus.GetDBusAPI()
-	if err != nil {
-		return err
+	var client mender.AuthProvider
+	if d.auth.Backend == configuration.AuthBackendFile || d.auth.Backend == configuration.AuthBackendHTTP {
+		client, err = d.newAuthProvider()
+		if err != nil {
+			return err
+		}
 	}
 
-	loop := dbusAPI.MainLoopNew()
-	go dbusAPI.MainLoopRun(loop)
-	defer dbusAPI.MainLoopQuit(loop)
+	if client == nil || d.exportDBusStatus {
+		log.Debug("mender-connect connecting to dbus")
+		//dbus main loop, required.
+		dbusAPI, err := dbus.GetDBusAPI()
+		if err != nil {
+			return err
+		}
 
-	//new dbus client
-	client, err := mender.NewAuthClient(dbusAPI)
-	if err != nil {
-		log.Errorf("mender-shall dbus failed to create client, error: %s", err.Error())
-		return err
+		loop := dbusAPI.MainLoopNew()
+		go dbusAPI.MainLoopRun(loop)
+		defer dbusAPI.MainLoopQuit(loop)
+
+		if client == nil {
+			//new dbus client
+			client, err = mender.NewAuthClient(dbusAPI)
+			if err != nil {
+				log.Errorf("mender-shall dbus failed to create client, error: %s", err.Error())
+				return err
+			}
+
+			//connection to dbus
+			err = client.Connect()
+			if err != nil {
+				log.Errorf("mender-shall dbus failed to connect, error: %s", err.Error())
+				return err
+			}
+		}
+
+		if d.exportDBusStatus {
+			status, err := exportSessionsStatus(dbusAPI, d.getConnectionStatus)
+			if err != nil {
+				log.Errorf("failed to export the sessions status over D-Bus: %s", err.Error())
+			} else {
+				defer status.unexport()
+			}
+		}
 	}
+	d.authClient = client
 
-	//connection to dbus
-	err = client.Connect(mender.DBusObjectName, mender.DBusObjectPath, mender.DBusInterfaceName)
-	if err != nil {
-		log.Errorf("mender-shall dbus failed to connect, error: %s", err.Error())
-		return err
+	// ready to serve once connected; the connection is retried forever,
+	// its state is given by STATUS and the status file
+	if err := sdNotify("READY=1"); err != nil {
+		log.Errorf("failed to notify the service manager: %s", err.Error())
 	}
+	d.reportStatus(time.Now())
 
 	jwtToken, err := client.GetJWTToken()
 	log.Debugf("GetJWTToken().len=%d,%v", len(jwtToken), err)
@@ -405,6 +996,9 @@ func (d *MenderShellDaemon) Run() error {
 		d.authorized = true
 	}
 	log.Debugf("mender-connect got len(JWT)=%d", len(jwtToken))
+	d.setAuthToken(jwtToken)
+	// no loop is running yet, the first sessions get the expiry already
+	d.applyAuthExpiry()
 
 	err = connectionmanager.Connect(ws.ProtoTypeShell,
 		d.serverUrl,
@@ -420,7 +1014,11 @@ func (d *MenderShellDaemon) Run() error {
 		return err
 	}
 
-	go d.messageLoop()
+	d.messageLoopRunning.Add(1)
+	go func() {
+		defer d.messageLoopRunning.Done()
+		_ = d.messageLoop()
+	}()
 	go d.dbusEventLoop(client)
 	go d.eventLoop()
 
@@ -443,22 +1041,184 @@ func (d *MenderShellDaemon) Run() error {
 				log.Infof("main-loop: stopped %d sessions, %d shells, expired sessions left: %d",
 					shellStoppedCount, sessionStoppedCount, totalExpiredLeft)
 			}
+			shellIdleCount, err := session.MenderSessionHangUpIdleShells()
+			if err != nil {
+				log.Errorf("main-loop: failed to hang up some idle shells: %s", err.Error())
+			} else if shellIdleCount != 0 {
+				log.Infof("main-loop: hung up %d idle shells", shellIdleCount)
+			}
+			// warned after the hang up, so that the warning is sent at
+			// least a sweep ahead of it
+			shellWarnedCount, err := session.MenderSessionWarnIdleShells()
+			if err != nil {
+				log.Errorf("main-loop: failed to warn some idle shells: %s", err.Error())
+			} else if shellWarnedCount != 0 {
+				log.Infof("main-loop: warned %d idle shells", shellWarnedCount)
+			}
+			if handlersClosed := protoHandlerManager.closeIdle(); handlersClosed > 0 {
+				log.Infof("main-loop: closed %d idle protocol handlers", handlersClosed)
+			}
 		}
+		d.terminateAuthExpired(time.Now())
+		d.checkTLSFiles(time.Now())
+		d.flushOutbox()
+		d.reportStatus(time.Now())
 
 		time.Sleep(time.Second)
 	}
 
+	_ = sdNotify("STOPPING=1")
+	if d.drainSessions() {
+		d.statusFileWrittenAt = time.Time{}
+		d.reportStatus(time.Now())
+	}
+	tracing.Disable()
 	log.Debug("mainLoop: returning")
 	return nil
 }
 
+// drainSessions closes all the sessions letting the peers know the daemon
+// is shutting down, waiting at most drainSessionsTimeout for the shells
+// to exit; the sessions are closed once the message loop, which handles
+// their messages, returned. It returns false if the sessions were not
+// closed in time, they may then be in use still and the shells left
+// running are hung up when the daemon exits and their terminals close
+func (d *MenderShellDaemon) drainSessions() bool {
+	defer connectionmanager.Close(ws.ProtoTypeShell)
+	timeout := time.After(d.drainSessionsTimeout)
+	stopped := make(chan bool, 1)
+	go func() {
+		d.messageLoopRunning.Wait()
+		stopped <- true
+	}()
+	select {
+	case <-stopped:
+	case <-timeout:
+		log.Warnf("shutting down: the message loop did not return within %s, "+
+			"exiting without closing the sessions", d.drainSessionsTimeout)
+		return false
+	}
+
+	log.Infof("shutting down: closing %d sessions", session.MenderShellSessionGetCount())
+	done := make(chan bool, 1)
+	go func() {
+		shellsCount, sessionsCount, err := session.MenderSessionTerminateAll(session.CloseReasonShutdown)
+		if err == nil {
+			log.Infof("shutting down: terminated %d sessions, %d shells",
+				sessionsCount, shellsCount)
+		} else {
+			log.Errorf("shutting down: error terminating sessions: %s", err.Error())
+		}
+		protoHandlerManager.shutdown()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-timeout:
+		log.Warnf("shutting down: sessions not closed within %s, exiting anyway",
+			d.drainSessionsTimeout)
+		return false
+	}
+}
+
 func (d *MenderShellDaemon) responseMessage(msg *ws.ProtoMsg) (err error) {
 	log.Debugf("responseMessage: webSock.WriteMessage(%+v)", msg)
-	return connectionmanager.Write(ws.ProtoTypeShell, msg)
+	err = connectionmanager.Write(ws.ProtoTypeShell, msg)
+	if err == nil {
+		if s := getSessionFromMessage(msg); s != nil {
+			s.RecordMessageSent(msg)
+		}
+	}
+	return err
 }
 
-func (d *MenderShellDaemon) routeMessage(msg *ws.ProtoMsg) error {
+// handlePanic recovers from a panic raised while handling msg, so that
+// a failure in a single protocol does not take down the daemon and the
+// other sessions; the error is reported back to the peer
+func (d *MenderShellDaemon) handlePanic(msg *ws.ProtoMsg, err *error) {
+	if r := recover(); r != nil {
+		*err = newCodedError(ErrorCodeHandlerPanic, fmt.Sprintf("panic while handling message %d/%s: %v",
+			msg.Header.Proto, msg.Header.MsgType, r))
+		log.Errorf("%s\n%s", (*err).Error(), debug.Stack())
+		response := &ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:      msg.Header.Proto,
+				MsgType:    msg.Header.MsgType,
+				SessionID:  msg.Header.SessionID,
+				Properties: map[string]interface{}{},
+			},
+		}
+		d.routeMessageResponse(response, *err)
+	}
+}
+
+func (d *MenderShellDaemon) routeMessage(msg *ws.ProtoMsg) (err error) {
+	msgID, _ := msg.Header.Properties[propertyMsgID].(string)
+	streamKey := session.StreamKey(msg.Header.SessionID, getStreamIdFromMessage(msg))
+	defer func() {
+		// after handlePanic, which turns the panics into errors
+		if err == nil {
+			d.deduplicator.remember(streamKey, msg.Header.Proto, msgID)
+		}
+	}()
+	defer d.handlePanic(msg, &err)
+	if msg.Header.Proto != protoTypeControl {
+		if !d.isProtocolSupported(msg.Header.Proto) {
+			err = newCodedError(ErrorCodeProtocolNotSupported,
+				fmt.Sprintf("protocol %d is not supported", msg.Header.Proto))
+		} else if !d.isProtocolAllowed(msg.Header.Proto, getUserIdFromSessionOrMessage(msg)) {
+			err = newCodedError(ErrorCodeProtocolNotAllowed,
+				fmt.Sprintf("protocol %d is not allowed", msg.Header.Proto))
+		}
+	}
+	if err == nil && msg.Header.Proto != protoTypeControl &&
+		!d.rateLimiter.allow(streamKey, msg.Header.Proto) {
+		err = newCodedError(ErrorCodeRateLimited,
+			fmt.Sprintf("too many messages of protocol %d, message dropped", msg.Header.Proto))
+		if !d.rateLimiter.report(streamKey, msg.Header.Proto) {
+			return err
+		}
+	}
+	if err != nil {
+		d.routeMessageResponse(&ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:      msg.Header.Proto,
+				MsgType:    msg.Header.MsgType,
+				SessionID:  msg.Header.SessionID,
+				Properties: map[string]interface{}{},
+			},
+		}, err)
+		return err
+	}
+
+	if d.deduplicator.isDuplicate(streamKey, msg.Header.Proto, msgID) {
+		log.WithField("session_id", msg.Header.SessionID).Infof(
+			"dropping duplicate message %s of protocol %d", msgID, msg.Header.Proto)
+		response := &ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     msg.Header.Proto,
+				MsgType:   msg.Header.MsgType,
+				SessionID: msg.Header.SessionID,
+				Properties: map[string]interface{}{
+					"status":          wsshell.NormalMessage,
+					propertyMsgID:     msgID,
+					propertyDuplicate: true,
+				},
+			},
+		}
+		copyStreamId(response, msg)
+		d.routeMessageResponse(response, nil)
+		return nil
+	}
+
 	switch msg.Header.Proto {
+	case protoTypeControl:
+		switch msg.Header.MsgType {
+		case messageTypeOpen:
+			return d.routeMessageOpen(msg)
+		}
 	case ws.ProtoTypeShell:
 		switch msg.Header.MsgType {
 		case wsshell.MessageTypeSpawnShell:
@@ -470,15 +1230,26 @@ func (d *MenderShellDaemon) routeMessage(msg *ws.ProtoMsg) error {
 		case wsshell.MessageTypeResizeShell:
 			return d.routeMessageShellResize(msg)
 		}
+	case configuration.ProtoTypeProcesses:
+		switch msg.Header.MsgType {
+		case messageTypeListProcesses:
+			return d.routeMessageListProcesses(msg)
+		case messageTypeSignalProcesses:
+			return d.routeMessageSignalProcesses(msg)
+		}
+	default:
+		return d.routeMessageProtoHandler(msg)
 	}
-	err := errors.New(fmt.Sprintf("unknown message protocol and type: %d/%s", msg.Header.Proto, msg.Header.MsgType))
+	err = newCodedError(ErrorCodeUnknownMessageType,
+		fmt.Sprintf("unknown message protocol and type: %d/%s", msg.Header.Proto, msg.Header.MsgType))
 	response := &ws.ProtoMsg{
 		Header: ws.ProtoHdr{
 			Proto:     msg.Header.Proto,
 			MsgType:   msg.Header.MsgType,
 			SessionID: msg.Header.SessionID,
 			Properties: map[string]interface{}{
-				"status": wsshell.ErrorMessage,
+				"status":          wsshell.ErrorMessage,
+				propertyErrorCode: ErrorCodeUnknownMessageType,
 			},
 		},
 		Body: []byte(err.Error()),
@@ -491,8 +1262,14 @@ func (d *MenderShellDaemon) routeMessage(msg *ws.ProtoMsg) error {
 
 func (d *MenderShellDaemon) routeMessageResponse(response *ws.ProtoMsg, err error) {
 	if err != nil {
-		log.Errorf(err.Error())
+		connectionID := connectionmanager.GetConnectionID(ws.ProtoTypeShell)
+		log.WithFields(log.Fields{
+			"connection_id": connectionID,
+			"session_id":    response.Header.SessionID,
+		}).Error(err.Error())
 		response.Header.Properties["status"] = wsshell.ErrorMessage
+		response.Header.Properties[propertyConnectionID] = connectionID
+		response.Header.Properties[propertyErrorCode] = errorCode(err)
 		response.Body = []byte(err.Error())
 	} else if response == nil {
 		return
@@ -507,7 +1284,72 @@ func getUserIdFromMessage(message *ws.ProtoMsg) string {
 	return userID
 }
 
+func getStreamIdFromMessage(message *ws.ProtoMsg) string {
+	streamID, _ := message.Header.Properties[session.PropertyStreamID].(string)
+	return streamID
+}
+
+// copyStreamId sets the stream of the response to the one of the message
+func copyStreamId(response *ws.ProtoMsg, message *ws.ProtoMsg) {
+	if streamID := getStreamIdFromMessage(message); streamID != "" {
+		response.Header.Properties[session.PropertyStreamID] = streamID
+	}
+}
+
+// getSessionFromMessage returns the session, or the stream of the session,
+// the message belongs to
+func getSessionFromMessage(message *ws.ProtoMsg) *session.MenderShellSession {
+	return session.MenderShellSessionGetById(
+		session.StreamKey(message.Header.SessionID, getStreamIdFromMessage(message)))
+}
+
+// getObservedSessionFromMessage returns the session whose terminal the
+// session, or the stream of the session, the message belongs to observes
+func getObservedSessionFromMessage(message *ws.ProtoMsg) *session.MenderShellSession {
+	return session.MenderShellSessionGetObserved(
+		session.StreamKey(message.Header.SessionID, getStreamIdFromMessage(message)))
+}
+
+// getUserIdFromSessionOrMessage returns the user id of the session the
+// message belongs to, falling back to the one given in the message
+func getUserIdFromSessionOrMessage(message *ws.ProtoMsg) string {
+	if s := getSessionFromMessage(message); s != nil {
+		return s.GetUserId()
+	}
+	return getUserIdFromMessage(message)
+}
+
+// shellForUser returns the shell of the user, ShellCommand if the user
+// has none of its own
+func (d *MenderShellDaemon) shellForUser(userID string) string {
+	if shell, ok := d.userShells[userID]; ok {
+		return shell
+	}
+	return d.shell
+}
+
+// shellEnv returns the environment variables as "NAME=value", in a
+// stable order
+func shellEnv(variables map[string]string) []string {
+	env := make([]string, 0, len(variables))
+	for name, value := range variables {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// routeMessageSpawnShell spawns the shell, once the consent script
+// approved it if there is one
 func (d *MenderShellDaemon) routeMessageSpawnShell(message *ws.ProtoMsg) error {
+	if d.consentScript != "" {
+		d.requestConsent(message)
+		return nil
+	}
+	return d.spawnShell(message)
+}
+
+func (d *MenderShellDaemon) spawnShell(message *ws.ProtoMsg) error {
 	var err error
 	response := &ws.ProtoMsg{
 		Header: ws.ProtoHdr{
@@ -520,22 +1362,50 @@ func (d *MenderShellDaemon) routeMessageSpawnShell(message *ws.ProtoMsg) error {
 		},
 		Body: []byte{},
 	}
-	if d.shellsSpawned >= configuration.MaxShellsSpawned {
+	copyStreamId(response, message)
+	if d.shouldStop() {
+		err = errDaemonShuttingDown
+		d.routeMessageResponse(response, err)
+		return err
+	}
+	if target, _ := message.Header.Properties[propertyTakeoverSession].(string); target != "" {
+		return d.takeOverShell(message, response, target)
+	}
+	if target, _ := message.Header.Properties[propertyObserveSession].(string); target != "" {
+		return d.observeShell(message, response, target)
+	}
+	s := getSessionFromMessage(message)
+	created := s == nil
+	// a session keeps the slot of its shell until it is closed, even after
+	// the shell exited; the shell respawned in it takes the same slot
+	if created && d.getShellsSpawned() >= configuration.MaxShellsSpawned {
 		err = session.ErrSessionTooManyShellsAlreadyRunning
 		d.routeMessageResponse(response, err)
 		return err
 	}
-	s := session.MenderShellSessionGetById(message.Header.SessionID)
-	if s == nil {
+	if created {
 		userId := getUserIdFromMessage(message)
-		if s, err = session.NewMenderShellSession(message.Header.SessionID, userId, d.expireSessionsAfter, d.expireSessionsAfterIdle); err != nil {
+		if s, err = session.NewMenderShellSessionStream(message.Header.SessionID, getStreamIdFromMessage(message),
+			userId, d.expireSessionsAfter, d.expireSessionsAfterIdle); err != nil {
 			d.routeMessageResponse(response, err)
 			return err
 		}
 		log.Debugf("created a new session: %s", s.GetId())
 	}
 
-	response.Header.SessionID = s.GetId()
+	response.Header.SessionID = s.GetSessionId()
+
+	runAsUserName, _ := message.Header.Properties[propertyRunAsUser].(string)
+	runAs, err := d.runAsUserFor(runAsUserName)
+	if err != nil {
+		if created {
+			_ = session.MenderShellDeleteById(s.GetId())
+		}
+		log.Warnf("refusing to start the shell of session %s as '%s': %s",
+			s.GetSessionId(), runAsUserName, err.Error())
+		d.routeMessageResponse(response, err)
+		return err
+	}
 
 	terminalHeight := d.terminalHeight
 	terminalWidth := d.terminalWidth
@@ -546,23 +1416,64 @@ func (d *MenderShellDaemon) routeMessageSpawnShell(message *ws.ProtoMsg) error {
 		terminalWidth = requestedWidth
 	}
 
+	shellPath := d.shellForUser(s.GetUserId())
+	env := d.localeEnvFor(message.Header.Properties)
+	restricted := d.isRestricted(s.GetUserId(), getUserRolesFromMessage(message))
+	if restricted {
+		s.Logger().Infof("starting the restricted shell %s", d.restrictedShell.Shell)
+		shellPath = d.restrictedShell.Shell
+		if d.restrictedShell.Path != "" {
+			env = append(env, "PATH="+d.restrictedShell.Path)
+		}
+	}
+	var args []string
+	if name, _ := message.Header.Properties[propertyMultiplexerSession].(string); name != "" {
+		if restricted {
+			err = errMultiplexerRestricted
+		} else {
+			args, err = d.multiplexerArgs(name)
+		}
+		if err != nil {
+			if created {
+				_ = session.MenderShellDeleteById(s.GetId())
+			}
+			log.Warnf("refusing to attach the terminal of session %s to '%s': %s",
+				s.GetSessionId(), name, err.Error())
+			d.routeMessageResponse(response, err)
+			return err
+		}
+		s.Logger().Infof("attaching the terminal to the %s session %s", d.multiplexer.Type, name)
+	}
+
 	log.Debugf("starting shell session_id=%s", s.GetId())
-	if err = s.StartShell(s.GetId(), session.MenderShellTerminalSettings{
-		Uid:            uint32(d.uid),
-		Gid:            uint32(d.gid),
-		Shell:          d.shell,
-		HomeDir:        d.homeDir,
-		TerminalString: d.terminalString,
+	if err = s.StartShell(s.GetSessionId(), session.MenderShellTerminalSettings{
+		Uid:            uint32(runAs.uid),
+		Gid:            uint32(runAs.gid),
+		Shell:          shellPath,
+		HomeDir:        runAs.homeDir,
+		TerminalString: d.terminalTypeFor(message.Header.Properties),
+		Env:            env,
+		Args:           args,
 		Height:         terminalHeight,
 		Width:          terminalWidth,
+		Banner:         d.renderBanner(s),
 	}); err != nil {
+		if created {
+			// do not leave behind a session without a shell, it would
+			// count towards the sessions limits
+			_ = session.MenderShellDeleteById(s.GetId())
+		}
 		err = errors.Wrap(err, "failed to start shell")
 		d.routeMessageResponse(response, err)
 		return err
 	}
 
 	log.Debug("Shell started")
-	d.shellsSpawned++
+	if created {
+		d.shellsSpawnedMutex.Lock()
+		d.shellsSpawned++
+		d.shellsSpawnedMutex.Unlock()
+	}
 
 	response.Body = []byte("Shell started")
 	d.routeMessageResponse(response, err)
@@ -577,11 +1488,13 @@ func (d *MenderShellDaemon) routeMessageStopShell(message *ws.ProtoMsg) error {
 			MsgType:   message.Header.MsgType,
 			SessionID: message.Header.SessionID,
 			Properties: map[string]interface{}{
-				"status": wsshell.NormalMessage,
+				"status":                    wsshell.NormalMessage,
+				session.PropertyCloseReason: string(session.CloseReasonOperatorClose),
 			},
 		},
 		Body: []byte{},
 	}
+	copyStreamId(response, message)
 
 	if len(message.Header.SessionID) < 1 {
 		userId := getUserIdFromMessage(message)
@@ -590,26 +1503,40 @@ func (d *MenderShellDaemon) routeMessageStopShell(message *ws.ProtoMsg) error {
 			d.routeMessageResponse(response, err)
 			return err
 		}
+		d.consents.dropUser(userId)
 		shellsStoppedCount, err := session.MenderShellStopByUserId(userId)
 		if err == nil {
+			d.shellsSpawnedMutex.Lock()
 			if shellsStoppedCount > d.shellsSpawned {
 				d.shellsSpawned = 0
 				err = errors.New(fmt.Sprintf("StopByUserId: the shells stopped count (%d) "+
 					"greater than total shells spawned (%d). resetting shells "+
 					"spawned to 0.", shellsStoppedCount, d.shellsSpawned))
-				d.routeMessageResponse(response, err)
-				return err
 			} else {
 				log.Debugf("StopByUserId: stopped %d shells.", shellsStoppedCount)
 				d.shellsSpawned -= shellsStoppedCount
 			}
+			d.shellsSpawnedMutex.Unlock()
 		}
 		d.routeMessageResponse(response, err)
 		return err
 	}
 
-	s := session.MenderShellSessionGetById(message.Header.SessionID)
-	if s == nil {
+	// the shells still waiting for their consent never start
+	stopped := d.consents.drop(message.Header.SessionID, getStreamIdFromMessage(message))
+	if getStreamIdFromMessage(message) == "" {
+		stopped += d.stopSessionStreams(message.Header.SessionID)
+	}
+
+	s := getSessionFromMessage(message)
+	if s == nil && stopped > 0 {
+		d.routeMessageResponse(response, nil)
+		return nil
+	} else if observed := getObservedSessionFromMessage(message); s == nil && observed != nil {
+		err = observed.RemoveObserver(message.Header.SessionID, getStreamIdFromMessage(message))
+		d.routeMessageResponse(response, err)
+		return err
+	} else if s == nil {
 		err = errors.New(fmt.Sprintf("routeMessage: StopShellMessage: session not found for id %s", message.Header.SessionID))
 		d.routeMessageResponse(response, err)
 		return err
@@ -626,23 +1553,71 @@ func (d *MenderShellDaemon) routeMessageStopShell(message *ws.ProtoMsg) error {
 			return err
 		} else {
 			log.Infof("shell exit rc: %s", err.Error())
-			if d.shellsSpawned == 0 {
-				log.Warn("can't decrement shellsSpawned count: it is 0.")
-			} else {
-				d.shellsSpawned--
-			}
+			d.shellStopped()
+		}
+		if err == session.ErrSessionShellNotRunning {
+			// the shell exited or was hung up already, only the
+			// session is left to close
+			err = session.MenderShellDeleteById(s.GetId())
 		}
 		d.routeMessageResponse(response, err)
 		return err
 	}
+	d.shellStopped()
+	err = session.MenderShellDeleteById(s.GetId())
+	d.routeMessageResponse(response, err)
+	return err
+}
+
+// shellStopped frees the slot of a shell in the MaxShellsSpawned limit,
+// once the shell was stopped or its session closed after it exited
+func (d *MenderShellDaemon) shellStopped() {
+	d.shellsSpawnedMutex.Lock()
+	defer d.shellsSpawnedMutex.Unlock()
 	if d.shellsSpawned == 0 {
 		log.Warn("can't decrement shellsSpawned count: it is 0.")
 	} else {
 		d.shellsSpawned--
 	}
-	err = session.MenderShellDeleteById(s.GetId())
-	d.routeMessageResponse(response, err)
-	return err
+}
+
+// getShellsSpawned returns the number of slots taken in the
+// MaxShellsSpawned limit
+func (d *MenderShellDaemon) getShellsSpawned() uint {
+	d.shellsSpawnedMutex.Lock()
+	defer d.shellsSpawnedMutex.Unlock()
+	return d.shellsSpawned
+}
+
+// shellEvicted frees the slot of the shell of a session evicted to make
+// room for a new one; the shell was running if it got a close reason
+func (d *MenderShellDaemon) shellEvicted(event string, s *session.MenderShellSession, proto ws.ProtoType) {
+	if event == session.HookEventSessionClose && s.GetCloseReason() == session.CloseReasonQuota {
+		d.shellStopped()
+	}
+}
+
+// stopSessionStreams stops the streams of the session, leaving the session
+// itself alone, and returns the number of streams stopped
+func (d *MenderShellDaemon) stopSessionStreams(sessionID string) int {
+	count := 0
+	for _, s := range session.MenderShellSessionGetStreams(sessionID) {
+		if s.GetStreamId() == "" {
+			continue
+		}
+		err := s.StopShell()
+		if err != nil && procps.ProcessExists(s.GetShellPid()) {
+			log.Errorf("could not terminate shell (pid %d) for stream %s: %s",
+				s.GetShellPid(), s.GetId(), err.Error())
+			continue
+		}
+		// the shells which exited on their own hold their slot until
+		// their stream is closed, as in routeMessageStopShell
+		d.shellStopped()
+		session.MenderShellDeleteById(s.GetId())
+		count++
+	}
+	return count
 }
 
 func (d *MenderShellDaemon) routeMessageShellCommand(message *ws.ProtoMsg) error {
@@ -658,10 +1633,14 @@ func (d *MenderShellDaemon) routeMessageShellCommand(message *ws.ProtoMsg) error
 		},
 		Body: []byte{},
 	}
+	copyStreamId(response, message)
 
-	s := session.MenderShellSessionGetById(message.Header.SessionID)
+	s := getSessionFromMessage(message)
 	if s == nil {
 		err = session.ErrSessionNotFound
+		if getObservedSessionFromMessage(message) != nil {
+			err = session.ErrSessionReadOnly
+		}
 		d.routeMessageResponse(response, err)
 		return err
 	}
@@ -682,10 +1661,10 @@ func mapPropertiesToTerminalHeightAndWidth(properties map[string]interface{}) (u
 	requestedHeight, requestedHeightOk := properties[propertyTerminalHeight]
 	requestedWidth, requestedWidthOk := properties[propertyTerminalWidth]
 	if requestedHeightOk && requestedWidthOk {
-		if val, _ := utils.Num64(requestedHeight); val > 0 {
+		if val, _ := utils.Num64(requestedHeight); val > 0 && val <= math.MaxUint16 {
 			terminalHeight = uint16(val)
 		}
-		if val, _ := utils.Num64(requestedWidth); val > 0 {
+		if val, _ := utils.Num64(requestedWidth); val > 0 && val <= math.MaxUint16 {
 			terminalWidth = uint16(val)
 		}
 	}
@@ -694,17 +1673,38 @@ func mapPropertiesToTerminalHeightAndWidth(properties map[string]interface{}) (u
 
 func (d *MenderShellDaemon) routeMessageShellResize(message *ws.ProtoMsg) error {
 	var err error
+	response := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     message.Header.Proto,
+			MsgType:   message.Header.MsgType,
+			SessionID: message.Header.SessionID,
+			Properties: map[string]interface{}{
+				"status": wsshell.NormalMessage,
+			},
+		},
+		Body: []byte{},
+	}
+	copyStreamId(response, message)
 
-	s := session.MenderShellSessionGetById(message.Header.SessionID)
+	s := getSessionFromMessage(message)
 	if s == nil {
 		err = session.ErrSessionNotFound
-		d.routeMessageResponse(nil, err)
+		if getObservedSessionFromMessage(message) != nil {
+			err = session.ErrSessionReadOnly
+		}
+		d.routeMessageResponse(response, err)
 		return err
 	}
 
 	terminalHeight, terminalWidth := mapPropertiesToTerminalHeightAndWidth(message.Header.Properties)
-	if terminalHeight > 0 && terminalWidth > 0 {
-		s.ResizeShell(terminalHeight, terminalWidth)
+	if terminalHeight == 0 || terminalWidth == 0 {
+		log.Debugf("session %s: ignoring resize without a valid size", s.GetId())
+		return nil
+	}
+	if err = s.ResizeShell(terminalHeight, terminalWidth); err != nil {
+		err = errors.Wrap(err, "failed to resize the terminal")
+		d.routeMessageResponse(response, err)
+		return err
 	}
 	return nil
 }
@@ -23,8 +23,10 @@ import (
 	"net/url"
 	"os"
 	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -40,9 +42,11 @@ import (
 	authmocks "github.com/mendersoftware/mender-connect/client/mender/mocks"
 
 	"github.com/mendersoftware/mender-connect/client/dbus"
+	"github.com/mendersoftware/mender-connect/client/https"
 	"github.com/mendersoftware/mender-connect/config"
 	"github.com/mendersoftware/mender-connect/connection"
 	"github.com/mendersoftware/mender-connect/connectionmanager"
+	"github.com/mendersoftware/mender-connect/procps"
 	"github.com/mendersoftware/mender-connect/session"
 )
 
@@ -306,6 +310,133 @@ func TestMenderShellStopByUserId(t *testing.T) {
 	assert.Equal(t, sessionsCount-1, d.shellsSpawned)
 }
 
+func TestStopSessionStreamsShellExited(t *testing.T) {
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         currentUser.Username,
+		},
+	})
+	sessionID := "stream-shell-exited"
+	message := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeSpawnShell,
+			SessionID: sessionID,
+			Properties: map[string]interface{}{
+				"user_id":                "user-stream-shell-exited",
+				session.PropertyStreamID: "stream-1",
+			},
+		},
+	}
+	assert.NoError(t, d.spawnShell(message))
+	assert.Equal(t, uint(1), d.shellsSpawned)
+	streams := session.MenderShellSessionGetStreams(sessionID)
+	if !assert.Len(t, streams, 1) {
+		return
+	}
+
+	// the shell exits on its own, its slot is freed once the stream closes
+	assert.NoError(t, syscall.Kill(streams[0].GetShellPid(), syscall.SIGKILL))
+	for i := 0; i < 50 && streams[0].GetStatus() == session.ActiveSession; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.NotEqual(t, session.ActiveSession, streams[0].GetStatus())
+	assert.Equal(t, 1, d.stopSessionStreams(sessionID))
+	assert.Equal(t, uint(0), d.shellsSpawned)
+	assert.Empty(t, session.MenderShellSessionGetStreams(sessionID))
+}
+
+func TestSpawnShellEvictOldestIdle(t *testing.T) {
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	defer func() {
+		session.MaxSessions = 0
+		session.MaxSessionsEvictOldestIdle = false
+	}()
+	_, _, _ = session.MenderSessionTerminateAll(session.CloseReasonShutdown)
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         currentUser.Username,
+			Sessions: config.SessionsConfig{
+				MaxConcurrent:       1,
+				MaxConcurrentPolicy: config.SessionsLimitPolicyEvictOldestIdle,
+			},
+		},
+	})
+	defer d.removeListeners()
+
+	for _, sessionID := range []string{"evicted-session", "evicting-session"} {
+		assert.NoError(t, d.spawnShell(&ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     ws.ProtoTypeShell,
+				MsgType:   wsshell.MessageTypeSpawnShell,
+				SessionID: sessionID,
+				Properties: map[string]interface{}{
+					"user_id": "user-" + sessionID,
+				},
+			},
+		}))
+		// the shell of the evicted session no longer takes a slot
+		assert.Equal(t, uint(1), d.shellsSpawned)
+	}
+	assert.Nil(t, session.MenderShellSessionGetById("evicted-session"))
+	s := session.MenderShellSessionGetById("evicting-session")
+	if assert.NotNil(t, s) {
+		if err := s.StopShell(); err != nil {
+			assert.EqualError(t, err, "error waiting for the process: signal: interrupt")
+		}
+		assert.NoError(t, session.MenderShellDeleteById(s.GetId()))
+	}
+}
+
+func TestSpawnShellRespawnKeepsSlot(t *testing.T) {
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	_, _, _ = session.MenderSessionTerminateAll(session.CloseReasonShutdown)
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         currentUser.Username,
+		},
+	})
+	message := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeSpawnShell,
+			SessionID: "respawn-session",
+			Properties: map[string]interface{}{
+				"user_id": "user-respawn-session",
+			},
+		},
+	}
+	assert.NoError(t, d.spawnShell(message))
+	assert.Equal(t, uint(1), d.shellsSpawned)
+	s := session.MenderShellSessionGetById("respawn-session")
+	if !assert.NotNil(t, s) {
+		return
+	}
+
+	// the shell exits on its own, the one respawned takes its slot
+	assert.NoError(t, syscall.Kill(s.GetShellPid(), syscall.SIGKILL))
+	for i := 0; i < 50 && s.GetStatus() == session.ActiveSession; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, session.EmptySession, s.GetStatus())
+	assert.NoError(t, d.spawnShell(message))
+	assert.Equal(t, uint(1), d.shellsSpawned)
+
+	if err := s.StopShell(); err != nil {
+		assert.EqualError(t, err, "error waiting for the process: signal: interrupt")
+	}
+	d.shellStopped()
+	assert.Equal(t, uint(0), d.shellsSpawned)
+	assert.NoError(t, session.MenderShellDeleteById(s.GetId()))
+}
+
 func newShellUnknownMessage(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(os.Stderr, "newShellUnknownMessage starting\n")
 	var upgrader = websocket.Upgrader{}
@@ -362,6 +493,35 @@ func TestMenderShellUnknownMessage(t *testing.T) {
 	assert.EqualError(t, err, "unknown message protocol and type: 1/does-not-exist")
 }
 
+func TestMenderShellHandlePanic(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+		},
+	})
+	msg := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeResizeShell,
+			SessionID: "some-session-id",
+		},
+	}
+
+	err := func() (err error) {
+		defer d.handlePanic(msg, &err)
+		panic("handler failure")
+	}()
+	assert.EqualError(t, err, "panic while handling message 1/resize: handler failure")
+	assert.Equal(t, ErrorCodeHandlerPanic, errorCode(err))
+
+	err = func() (err error) {
+		defer d.handlePanic(msg, &err)
+		return nil
+	}()
+	assert.NoError(t, err)
+}
+
 func newShellMulti(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("newShellMulti: starting\n\n")
 	var upgrader = websocket.Upgrader{}
@@ -441,6 +601,79 @@ func TestMenderShellSessionLimitPerUser(t *testing.T) {
 	connectionmanager.Close(ws.ProtoTypeShell)
 }
 
+func TestNewDaemonServers(t *testing.T) {
+	defer connectionmanager.SetFailoverServers(nil, false)
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			Servers: []https.MenderServer{
+				{ServerURL: "https://eu.hosted.mender.io"},
+				{ServerURL: "https://hosted.mender.io"},
+			},
+		},
+	})
+	assert.Equal(t, "https://eu.hosted.mender.io", d.serverUrl)
+
+	d = NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			ServerURL:    "https://hosted.mender.io",
+		},
+	})
+	assert.Equal(t, "https://hosted.mender.io", d.serverUrl)
+}
+
+func TestNewAuthProvider(t *testing.T) {
+	defer connectionmanager.SetFailoverServers(nil, false)
+
+	dir, err := ioutil.TempDir("", "auth-file")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	serverURLFile := filepath.Join(dir, "server")
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("some-token\n"), 0600))
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			ServerURL:    "https://hosted.mender.io",
+			Auth: config.AuthConfig{
+				Backend:       config.AuthBackendFile,
+				TokenFile:     tokenFile,
+				ServerURLFile: serverURLFile,
+			},
+		},
+	})
+	client, err := d.newAuthProvider()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://hosted.mender.io", d.serverUrl)
+	token, err := client.GetJWTToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "some-token", token)
+
+	assert.NoError(t, ioutil.WriteFile(serverURLFile, []byte("https://eu.hosted.mender.io/\n"), 0600))
+	_, err = d.newAuthProvider()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://eu.hosted.mender.io", d.serverUrl)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"token":"http-token","server_url":"https://us.hosted.mender.io"}`))
+	}))
+	defer s.Close()
+	d.auth = config.AuthConfig{Backend: config.AuthBackendHTTP, URL: s.URL}
+	client, err = d.newAuthProvider()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://us.hosted.mender.io", d.serverUrl)
+	token, err = client.GetJWTToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "http-token", token)
+
+	d.auth = config.AuthConfig{Backend: config.AuthBackendHTTP, URL: "unix://" + filepath.Join(dir, "none.sock")}
+	_, err = d.newAuthProvider()
+	assert.Error(t, err)
+}
+
 func TestMenderShellStopDaemon(t *testing.T) {
 	currentUser, err := user.Current()
 	if err != nil {
@@ -465,6 +698,94 @@ func TestMenderShellStopDaemon(t *testing.T) {
 	assert.True(t, d.shouldStop())
 }
 
+func TestMenderShellDrainSessions(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+			Sessions: config.SessionsConfig{
+				DrainTimeout: 2,
+			},
+		},
+	})
+	assert.Equal(t, 2*time.Second, d.drainSessionsTimeout)
+
+	session.MenderSessionTerminateAll(session.CloseReasonShutdown)
+	start := time.Now()
+	assert.True(t, d.drainSessions())
+	assert.True(t, time.Since(start) < d.drainSessionsTimeout)
+	assert.Equal(t, 0, session.MenderShellSessionGetCount())
+
+	d = NewDaemon(&config.MenderShellConfig{})
+	assert.Equal(t, config.DefaultDrainSessionsTimeout, d.drainSessionsTimeout)
+}
+
+func TestMenderShellDrainSessionsLiveShell(t *testing.T) {
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	session.MenderSessionTerminateAll(session.CloseReasonShutdown)
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         currentUser.Username,
+			Sessions: config.SessionsConfig{
+				DrainTimeout: 8,
+			},
+		},
+	})
+	assert.NoError(t, d.spawnShell(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeSpawnShell,
+			SessionID: "drained-session",
+			Properties: map[string]interface{}{
+				"user_id": "user-drained-session",
+			},
+		},
+	}))
+	s := session.MenderShellSessionGetById("drained-session")
+	if !assert.NotNil(t, s) {
+		return
+	}
+	pid := s.GetShellPid()
+
+	// the sessions are closed only once the message loop returned
+	d.messageLoopRunning.Add(1)
+	returned := make(chan bool, 1)
+	go func() {
+		time.Sleep(time.Second)
+		assert.NotNil(t, session.MenderShellSessionGetById("drained-session"))
+		returned <- true
+		d.messageLoopRunning.Done()
+	}()
+	assert.True(t, d.drainSessions())
+	assert.Len(t, returned, 1)
+	assert.Equal(t, 0, session.MenderShellSessionGetCount())
+	assert.False(t, procps.ProcessExists(pid))
+}
+
+func TestMenderShellDrainSessionsMessageLoopRunning(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+			Sessions: config.SessionsConfig{
+				DrainTimeout: 1,
+			},
+		},
+	})
+	s, err := session.NewMenderShellSession("undrained-session", "user-undrained-session",
+		session.NoExpirationTimeout, session.NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer session.MenderShellDeleteById(s.GetId())
+
+	// the sessions are left alone while the message loop may use them
+	d.messageLoopRunning.Add(1)
+	defer d.messageLoopRunning.Done()
+	assert.False(t, d.drainSessions())
+	assert.NotNil(t, session.MenderShellSessionGetById(s.GetId()))
+}
+
 func oneMsgMainServerLoop(w http.ResponseWriter, r *http.Request) {
 	var upgrade = websocket.Upgrader{}
 	c, err := upgrade.Upgrade(w, r, nil)
@@ -636,7 +957,7 @@ func TestMenderShellMaxShellsLimit(t *testing.T) {
 	connectionmanager.SetReconnectIntervalSeconds(1)
 	connectionmanager.Reconnect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 526, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 526, 16*time.Second, 16*time.Second, true, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
@@ -774,6 +1095,34 @@ func TestMenderShellGotAuthToken(t *testing.T) {
 	}
 }
 
+func TestMenderShellGotAuthTokenRefreshed(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+		},
+	})
+	d.setAuthToken("first-token")
+	d.authorized = true
+
+	params := []dbus.SignalParams{{ParamType: "s", ParamData: "first-token"}}
+	go d.gotAuthToken(params, false)
+	select {
+	case e := <-d.eventChan:
+		t.Errorf("unexpected event for the same token: %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	params = []dbus.SignalParams{{ParamType: "s", ParamData: "rotated-token"}}
+	go d.gotAuthToken(params, false)
+	select {
+	case e := <-d.eventChan:
+		assert.Equal(t, EventTokenRefreshed, e.event)
+		assert.Equal(t, "rotated-token", e.data)
+	case <-time.After(time.Second):
+		t.Error("no event for the rotated token")
+	}
+}
+
 func TestMenderShellNeedsReconnect(t *testing.T) {
 	currentUser, err := user.Current()
 	if err != nil {
@@ -907,6 +1256,13 @@ func TestTimeToSweepSessions(t *testing.T) {
 	d.expireSessionsAfterIdle = time.Duration(0)
 	assert.False(t, d.timeToSweepSessions())
 
+	//unless the shells idle timeout is set
+	session.ShellIdleTimeout = time.Minute
+	expiredSessionsSweepFrequency = 0
+	assert.True(t, d.timeToSweepSessions())
+	session.ShellIdleTimeout = session.NoExpirationTimeout
+	expiredSessionsSweepFrequency = 32 * time.Second
+
 	//on the other hand when both are set it maybe time to sweep
 	d.expireSessionsAfter = 32 * time.Second
 	d.expireSessionsAfterIdle = 8 * time.Second
@@ -944,7 +1300,7 @@ func TestWaitForJWTToken(t *testing.T) {
 				t.Run(tc.name, func(t *testing.T) {
 					dbusAPI := &dbusmocks.DBusAPI{}
 					defer dbusAPI.AssertExpectations(t)
-					client := &authmocks.AuthClient{}
+					client := &authmocks.AuthProvider{}
 					client.On("WaitForJwtTokenStateChange").Return([]dbus.SignalParams{
 						{
 							ParamType: "s",
@@ -973,7 +1329,7 @@ func TestWaitForJWTToken(t *testing.T) {
 			t.Run(tc.name, func(t *testing.T) {
 				dbusAPI := &dbusmocks.DBusAPI{}
 				defer dbusAPI.AssertExpectations(t)
-				client := &authmocks.AuthClient{}
+				client := &authmocks.AuthProvider{}
 				client.On("WaitForJwtTokenStateChange").Return([]dbus.SignalParams{
 					{
 						ParamType: "s",
@@ -1037,7 +1393,7 @@ func TestDBusEventLoop(t *testing.T) {
 
 					dbusAPI := &dbusmocks.DBusAPI{}
 					defer dbusAPI.AssertExpectations(t)
-					client := &authmocks.AuthClient{}
+					client := &authmocks.AuthProvider{}
 					client.On("WaitForJwtTokenStateChange").Return([]dbus.SignalParams{
 						{
 							ParamType: "s",
@@ -1070,7 +1426,7 @@ func TestDBusEventLoop(t *testing.T) {
 
 				dbusAPI := &dbusmocks.DBusAPI{}
 				defer dbusAPI.AssertExpectations(t)
-				client := &authmocks.AuthClient{}
+				client := &authmocks.AuthProvider{}
 				client.On("WaitForJwtTokenStateChange").Return([]dbus.SignalParams{
 					{
 						ParamType: "s",
@@ -1193,7 +1549,7 @@ func TestMessageMainLoop(t *testing.T) {
 	connectionmanager.SetReconnectIntervalSeconds(1)
 	connectionmanager.Reconnect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
 
-	webSock, err := connection.NewConnection(*urlString, "token", 8*time.Second, 526, 8*time.Second, true, "")
+	webSock, err := connection.NewConnection(*urlString, "token", 8*time.Second, 526, 8*time.Second, 8*time.Second, true, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, webSock)
 
@@ -1256,6 +1612,40 @@ func TestMessageMainLoop(t *testing.T) {
 	}
 }
 
+func TestNextMessage(t *testing.T) {
+	controlChan := make(chan *ws.ProtoMsg, 2)
+	dataChan := make(chan *ws.ProtoMsg, 2)
+	data := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:   ws.ProtoTypeShell,
+			MsgType: wsshell.MessageTypeShellCommand,
+		},
+	}
+	stop := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:   ws.ProtoTypeShell,
+			MsgType: wsshell.MessageTypeStopShell,
+		},
+	}
+	open := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:   protoTypeControl,
+			MsgType: messageTypeOpen,
+		},
+	}
+	assert.False(t, isControlMessage(data))
+	assert.False(t, isControlMessage(stop))
+	assert.True(t, isControlMessage(open))
+
+	dataChan <- data
+	dataChan <- data
+	controlChan <- open
+	assert.Equal(t, open, nextMessage(controlChan, dataChan))
+	assert.Equal(t, data, nextMessage(controlChan, dataChan))
+	assert.Equal(t, data, nextMessage(controlChan, dataChan))
+	assert.Nil(t, nextMessage(controlChan, dataChan))
+}
+
 func TestRun(t *testing.T) {
 	d := &MenderShellDaemon{}
 	d.debug = true
@@ -1274,3 +1664,94 @@ func TestRun(t *testing.T) {
 	case <-done:
 	}
 }
+
+func TestShellForUser(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/bash",
+			User:         "mender",
+			UserShells: map[string]string{
+				"support-user-id": "/bin/rbash",
+			},
+		},
+	})
+	assert.Equal(t, "/bin/rbash", d.shellForUser("support-user-id"))
+	assert.Equal(t, "/bin/bash", d.shellForUser("admin-user-id"))
+}
+
+func TestMapPropertiesToTerminalHeightAndWidth(t *testing.T) {
+	testCases := map[string]struct {
+		properties map[string]interface{}
+		height     uint16
+		width      uint16
+	}{
+		"ok": {
+			properties: map[string]interface{}{
+				propertyTerminalHeight: 40,
+				propertyTerminalWidth:  uint16(80),
+			},
+			height: 40,
+			width:  80,
+		},
+		"width missing": {
+			properties: map[string]interface{}{
+				propertyTerminalHeight: 40,
+			},
+		},
+		"out of range": {
+			properties: map[string]interface{}{
+				propertyTerminalHeight: -1,
+				propertyTerminalWidth:  70000,
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			height, width := mapPropertiesToTerminalHeightAndWidth(tc.properties)
+			assert.Equal(t, tc.height, height)
+			assert.Equal(t, tc.width, width)
+		})
+	}
+}
+
+func TestMenderShellResizeNoSession(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+		},
+	})
+	err := d.routeMessageShellResize(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeResizeShell,
+			SessionID: "resize-session-not-found",
+			Properties: map[string]interface{}{
+				propertyTerminalHeight: 40,
+				propertyTerminalWidth:  80,
+			},
+		},
+	})
+	assert.Equal(t, session.ErrSessionNotFound, err)
+}
+
+func TestShellEnv(t *testing.T) {
+	assert.Equal(t, []string{}, shellEnv(nil))
+	assert.Equal(t, []string{"LANG=C.UTF-8", "MENDER_REMOTE=1"}, shellEnv(map[string]string{
+		"MENDER_REMOTE": "1",
+		"LANG":          "C.UTF-8",
+	}))
+}
+
+func TestKeepAliveFromConfig(t *testing.T) {
+	assert.Nil(t, keepAliveFromConfig(config.TCPKeepAliveConfig{}))
+	assert.Equal(t, &connection.KeepAlive{
+		Idle:     config.DefaultTCPKeepAlive,
+		Interval: 5 * time.Second,
+		Count:    4,
+	}, keepAliveFromConfig(config.TCPKeepAliveConfig{
+		IntervalSeconds: 5,
+		Count:           4,
+	}))
+	assert.True(t, keepAliveFromConfig(config.TCPKeepAliveConfig{Disabled: true}).Disabled)
+}
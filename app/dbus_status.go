@@ -0,0 +1,184 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/client/dbus"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// D-Bus names of the sessions status interface, e.g.:
+// busctl call io.mender.Connect /io/mender/Connect io.mender.Connect1 ListSessions
+const (
+	DBusStatusObjectName    = "io.mender.Connect"
+	DBusStatusObjectPath    = "/io/mender/Connect"
+	DBusStatusInterfaceName = "io.mender.Connect1"
+
+	dbusMethodListSessions        = "ListSessions"
+	dbusMethodGetConnectionStatus = "GetConnectionStatus"
+	dbusSignalSessionOpened       = "SessionOpened"
+	dbusSignalSessionClosed       = "SessionClosed"
+)
+
+const dbusStatusInterfaceXML = `<node>
+  <interface name="io.mender.Connect1">
+    <method name="ListSessions">
+      <arg type="s" name="sessions" direction="out"/>
+    </method>
+    <method name="GetConnectionStatus">
+      <arg type="s" name="status" direction="out"/>
+    </method>
+    <signal name="SessionOpened">
+      <arg type="s" name="session_id"/>
+      <arg type="s" name="user_id"/>
+    </signal>
+    <signal name="SessionClosed">
+      <arg type="s" name="session_id"/>
+      <arg type="s" name="user_id"/>
+      <arg type="s" name="reason"/>
+    </signal>
+  </interface>
+</node>`
+
+// sessionStatus is an element of the JSON list returned by ListSessions
+type sessionStatus struct {
+	SessionID     string         `json:"session_id"`
+	StreamID      string         `json:"stream_id,omitempty"`
+	UserID        string         `json:"user_id"`
+	Protocols     []ws.ProtoType `json:"protocols"`
+	StartedAt     string         `json:"started_at"`
+	IdleSeconds   int64          `json:"idle_seconds"`
+	BytesReceived uint64         `json:"bytes_received"`
+	BytesSent     uint64         `json:"bytes_sent"`
+}
+
+func newSessionStatus(s *session.MenderShellSession, now time.Time) sessionStatus {
+	status := sessionStatus{
+		SessionID:   s.GetSessionId(),
+		StreamID:    s.GetStreamId(),
+		UserID:      s.GetUserId(),
+		Protocols:   []ws.ProtoType{},
+		StartedAt:   s.GetStartedAt().UTC().Format(time.RFC3339),
+		IdleSeconds: int64(now.Sub(s.GetActiveAt()) / time.Second),
+	}
+	for proto, stats := range s.Stats() {
+		status.Protocols = append(status.Protocols, proto)
+		status.BytesReceived += stats.BytesReceived
+		status.BytesSent += stats.BytesSent
+	}
+	sort.Slice(status.Protocols, func(i, j int) bool {
+		return status.Protocols[i] < status.Protocols[j]
+	})
+	return status
+}
+
+// dbusStatus exports the status of the sessions over D-Bus
+type dbusStatus struct {
+	dbusAPI        dbus.DBusAPI
+	conn           dbus.Handle
+	ownerID        uint
+	registrationID uint
+	removeListener func()
+}
+
+// exportSessionsStatus owns DBusStatusObjectName on the system bus and
+// exports the sessions status interface, the status of the connection
+// being given by connectionStatus; the sessions opening and closing are
+// signalled until unexport is called
+func exportSessionsStatus(dbusAPI dbus.DBusAPI, connectionStatus dbus.MethodCallCallback) (*dbusStatus, error) {
+	conn, err := dbusAPI.BusGet(dbus.GBusTypeSystem)
+	if err != nil {
+		return nil, err
+	}
+	registrationID, err := dbusAPI.BusRegisterInterface(conn, DBusStatusObjectPath, dbusStatusInterfaceXML)
+	if err != nil {
+		return nil, err
+	}
+	dbusAPI.RegisterMethodCallCallback(DBusStatusObjectPath, DBusStatusInterfaceName,
+		dbusMethodListSessions, listSessions)
+	dbusAPI.RegisterMethodCallCallback(DBusStatusObjectPath, DBusStatusInterfaceName,
+		dbusMethodGetConnectionStatus, connectionStatus)
+	status := &dbusStatus{
+		dbusAPI:        dbusAPI,
+		conn:           conn,
+		ownerID:        dbusAPI.BusOwnName(conn, DBusStatusObjectName),
+		registrationID: registrationID,
+	}
+	status.removeListener = session.AddEventListener(status.sessionEvent)
+	return status, nil
+}
+
+// unexport releases the name and the interface exported by
+// exportSessionsStatus
+func (d *dbusStatus) unexport() {
+	d.removeListener()
+	d.dbusAPI.UnregisterMethodCallCallback(DBusStatusObjectPath, DBusStatusInterfaceName,
+		dbusMethodListSessions)
+	d.dbusAPI.UnregisterMethodCallCallback(DBusStatusObjectPath, DBusStatusInterfaceName,
+		dbusMethodGetConnectionStatus)
+	d.dbusAPI.BusUnregisterInterface(d.conn, d.registrationID)
+	d.dbusAPI.BusUnownName(d.ownerID)
+	d.conn = nil
+}
+
+// listSessions implements the ListSessions method, returning the JSON
+// list of the active sessions
+func listSessions(objectPath string, interfaceName string, methodName string) (string, error) {
+	now := time.Now()
+	statuses := []sessionStatus{}
+	for _, id := range session.MenderShellSessionGetSessionIds() {
+		if s := session.MenderShellSessionGetById(id); s != nil {
+			statuses = append(statuses, newSessionStatus(s, now))
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].StartedAt < statuses[j].StartedAt
+	})
+	data, err := json.Marshal(statuses)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// sessionEvent signals the sessions opening and closing
+func (d *dbusStatus) sessionEvent(event string, s *session.MenderShellSession, proto ws.ProtoType) {
+	if d.conn == nil {
+		return
+	}
+	var signalName string
+	params := []string{s.GetSessionId(), s.GetUserId()}
+	switch event {
+	case session.HookEventSessionOpen:
+		signalName = dbusSignalSessionOpened
+	case session.HookEventSessionClose:
+		signalName = dbusSignalSessionClosed
+		params = append(params, string(s.GetCloseReason()))
+	default:
+		return
+	}
+	err := d.dbusAPI.EmitSignal(d.conn, "", DBusStatusObjectPath, DBusStatusInterfaceName,
+		signalName, params)
+	if err != nil {
+		log.Errorf("failed to emit the %s D-Bus signal of session %s: %s",
+			signalName, s.GetId(), err.Error())
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/mender-connect/client/dbus"
+	dbusmocks "github.com/mendersoftware/mender-connect/client/dbus/mocks"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+func TestListSessions(t *testing.T) {
+	s, err := session.NewMenderShellSession("dbus-session-id", "dbus-user-id",
+		session.NoExpirationTimeout, session.NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer session.MenderShellDeleteById(s.GetId())
+
+	s.RecordMessageReceived(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto: ws.ProtoTypeShell,
+		},
+		Body: []byte("ls\n"),
+	})
+
+	data, err := listSessions(DBusStatusObjectPath, DBusStatusInterfaceName, dbusMethodListSessions)
+	assert.NoError(t, err)
+
+	var statuses []sessionStatus
+	assert.NoError(t, json.Unmarshal([]byte(data), &statuses))
+	var status *sessionStatus
+	for i := range statuses {
+		if statuses[i].SessionID == "dbus-session-id" {
+			status = &statuses[i]
+		}
+	}
+	if assert.NotNil(t, status) {
+		assert.Equal(t, "dbus-user-id", status.UserID)
+		assert.Equal(t, []ws.ProtoType{ws.ProtoTypeShell}, status.Protocols)
+		assert.Equal(t, uint64(3), status.BytesReceived)
+		assert.Equal(t, uint64(0), status.BytesSent)
+		assert.NotEmpty(t, status.StartedAt)
+	}
+}
+
+func TestDBusStatusSessionEvent(t *testing.T) {
+	s, err := session.NewMenderShellSession("dbus-event-session-id", "dbus-event-user-id",
+		session.NoExpirationTimeout, session.NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer session.MenderShellDeleteById(s.GetId())
+
+	conn := dbus.Handle(&struct{}{})
+	dbusAPI := &dbusmocks.DBusAPI{}
+	defer dbusAPI.AssertExpectations(t)
+	dbusAPI.On("BusGet", uint(dbus.GBusTypeSystem)).Return(conn, nil)
+	dbusAPI.On("BusRegisterInterface", conn, DBusStatusObjectPath, dbusStatusInterfaceXML).Return(uint(1), nil)
+	dbusAPI.On("RegisterMethodCallCallback", DBusStatusObjectPath, DBusStatusInterfaceName,
+		dbusMethodListSessions, mock.Anything).Return()
+	dbusAPI.On("RegisterMethodCallCallback", DBusStatusObjectPath, DBusStatusInterfaceName,
+		dbusMethodGetConnectionStatus, mock.Anything).Return()
+	dbusAPI.On("BusOwnName", conn, DBusStatusObjectName).Return(uint(2))
+	dbusAPI.On("EmitSignal", conn, "", DBusStatusObjectPath, DBusStatusInterfaceName,
+		dbusSignalSessionOpened, []string{"dbus-event-session-id", "dbus-event-user-id"}).Return(nil).Once()
+	dbusAPI.On("UnregisterMethodCallCallback", DBusStatusObjectPath, DBusStatusInterfaceName,
+		dbusMethodListSessions).Return()
+	dbusAPI.On("UnregisterMethodCallCallback", DBusStatusObjectPath, DBusStatusInterfaceName,
+		dbusMethodGetConnectionStatus).Return()
+	dbusAPI.On("BusUnregisterInterface", conn, uint(1)).Return(true)
+	dbusAPI.On("BusUnownName", uint(2)).Return()
+
+	status, err := exportSessionsStatus(dbusAPI, nil)
+	assert.NoError(t, err)
+	status.sessionEvent(session.HookEventSessionOpen, s, ws.ProtoTypeShell)
+	status.sessionEvent(session.HookEventHandlerStart, s, ws.ProtoTypeShell)
+	status.unexport()
+	status.sessionEvent(session.HookEventSessionClose, s, ws.ProtoTypeShell)
+
+	// no longer notified of the sessions once unexported
+	status.conn = conn
+	other, err := session.NewMenderShellSession("dbus-other-session-id", "dbus-other-user-id",
+		session.NoExpirationTimeout, session.NoExpirationTimeout)
+	assert.NoError(t, err)
+	assert.NoError(t, session.MenderShellDeleteById(other.GetId()))
+}
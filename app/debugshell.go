@@ -0,0 +1,344 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vmihailenco/msgpack"
+	"golang.org/x/sys/unix"
+
+	"github.com/mendersoftware/mender-connect/session"
+	"github.com/mendersoftware/mender-connect/utils"
+)
+
+// debugShellUserID is the user id of the debug shell sessions
+const debugShellUserID = "local-debug-shell"
+
+var (
+	// debugShellAllowedUid is the only user allowed to use the debug shell
+	debugShellAllowedUid uint32 = 0
+	// debugShellSessions numbers the debug shell sessions
+	debugShellSessions uint64
+
+	errDebugShellRefused = errors.New("the debug shell closed the connection")
+)
+
+// debugShellServer serves the terminals over a local Unix socket, with the
+// same messages the server sends, msgpack encoded one after another; it
+// lets the terminals be exercised without a connection to the server
+type debugShellServer struct {
+	daemon   *MenderShellDaemon
+	listener *net.UnixListener
+	mutex    sync.Mutex
+	sessions map[*session.MenderShellSession]bool
+}
+
+// serveDebugShell listens on the socket and serves the debug shell in the
+// background until close is called
+func (d *MenderShellDaemon) serveDebugShell(socket string) (*debugShellServer, error) {
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create the debug shell socket directory")
+	}
+	// remove the socket left behind by a previous instance
+	_ = os.Remove(socket)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to listen on the debug shell socket")
+	}
+	if err = os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		return nil, errors.Wrap(err, "failed to set the debug shell socket mode")
+	}
+	server := &debugShellServer{
+		daemon:   d,
+		listener: listener,
+		sessions: map[*session.MenderShellSession]bool{},
+	}
+	go server.serve()
+	log.Infof("serving the debug shell on %s", socket)
+	return server, nil
+}
+
+// close stops listening and stops the running debug shells
+func (srv *debugShellServer) close() {
+	srv.listener.Close()
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	for s := range srv.sessions {
+		_ = s.StopShell()
+	}
+}
+
+func (srv *debugShellServer) serve() {
+	for {
+		conn, err := srv.listener.AcceptUnix()
+		if err != nil {
+			log.Debugf("debug shell: stopped accepting connections: %s", err.Error())
+			return
+		}
+		go srv.handle(conn)
+	}
+}
+
+// peerUid returns the user id of the process at the other end of conn
+func peerUid(conn *net.UnixConn) (uint32, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return cred.Uid, nil
+}
+
+func (srv *debugShellServer) handle(conn *net.UnixConn) {
+	defer conn.Close()
+	uid, err := peerUid(conn)
+	if err != nil {
+		log.Errorf("debug shell: failed to get the peer credentials: %s", err.Error())
+		return
+	}
+	if uid != debugShellAllowedUid {
+		log.Warnf("debug shell: refusing the connection of uid %d", uid)
+		return
+	}
+
+	var writeMutex sync.Mutex
+	encoder := msgpack.NewEncoder(conn)
+	write := func(msg *ws.ProtoMsg) error {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		return encoder.Encode(msg)
+	}
+	sessionID := fmt.Sprintf("debug-shell-%d", atomic.AddUint64(&debugShellSessions, 1))
+	s := session.NewDebugSession(sessionID, debugShellUserID, write)
+	s.Logger().Infof("debug shell: uid %d connected", uid)
+	defer func() {
+		srv.mutex.Lock()
+		defer srv.mutex.Unlock()
+		if srv.sessions[s] {
+			delete(srv.sessions, s)
+			_ = s.StopShell()
+		}
+		s.Logger().Info("debug shell: disconnected")
+	}()
+
+	decoder := msgpack.NewDecoder(conn)
+	for {
+		message := &ws.ProtoMsg{}
+		if err := decoder.Decode(message); err != nil {
+			if err != io.EOF {
+				s.Logger().Errorf("debug shell: failed to read the message: %s", err.Error())
+			}
+			return
+		}
+		switch message.Header.MsgType {
+		case wsshell.MessageTypeSpawnShell:
+			srv.spawnShell(s, message, write)
+		case wsshell.MessageTypeShellCommand:
+			if err := s.ShellCommand(message); err != nil {
+				s.Logger().Debugf("debug shell: %s", err.Error())
+			}
+		case wsshell.MessageTypeResizeShell:
+			height, width := mapPropertiesToTerminalHeightAndWidth(message.Header.Properties)
+			if height > 0 && width > 0 {
+				if err := s.ResizeShell(height, width); err != nil {
+					s.Logger().Debugf("debug shell: %s", err.Error())
+				}
+			}
+		case wsshell.MessageTypeStopShell:
+			return
+		}
+	}
+}
+
+// spawnShell starts the shell of the debug session the way the server
+// requested shells are started, and answers the peer
+func (srv *debugShellServer) spawnShell(s *session.MenderShellSession, message *ws.ProtoMsg,
+	write func(msg *ws.ProtoMsg) error) {
+	d := srv.daemon
+	response := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeSpawnShell,
+			SessionID: s.GetSessionId(),
+			Properties: map[string]interface{}{
+				"status": wsshell.NormalMessage,
+			},
+		},
+		Body: []byte("Shell started"),
+	}
+
+	terminalHeight, terminalWidth := mapPropertiesToTerminalHeightAndWidth(message.Header.Properties)
+	if terminalHeight == 0 || terminalWidth == 0 {
+		terminalHeight, terminalWidth = d.terminalHeight, d.terminalWidth
+	}
+	srv.mutex.Lock()
+	err := s.StartShell(s.GetSessionId(), session.MenderShellTerminalSettings{
+		Uid:            uint32(d.uid),
+		Gid:            uint32(d.gid),
+		Shell:          d.shell,
+		HomeDir:        d.homeDir,
+		TerminalString: d.terminalTypeFor(message.Header.Properties),
+		Env:            d.localeEnvFor(message.Header.Properties),
+		Height:         terminalHeight,
+		Width:          terminalWidth,
+	})
+	if err == nil {
+		srv.sessions[s] = true
+	}
+	srv.mutex.Unlock()
+	if err != nil {
+		s.Logger().Errorf("debug shell: failed to start the shell: %s", err.Error())
+		response.Header.Properties["status"] = wsshell.ErrorMessage
+		response.Header.Properties[propertyErrorCode] = errorCode(err)
+		response.Body = []byte(err.Error())
+	}
+	if err = write(response); err != nil {
+		s.Logger().Errorf("debug shell: failed to answer: %s", err.Error())
+	}
+}
+
+// DebugShell connects to the debug shell served on the socket and runs it
+// in the terminal in, which is put in raw mode, until the shell exits
+func DebugShell(socket string, in *os.File, out io.Writer) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to the debug shell")
+	}
+	defer conn.Close()
+
+	var writeMutex sync.Mutex
+	encoder := msgpack.NewEncoder(conn)
+	send := func(msgType string, properties map[string]interface{}, body []byte) error {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		return encoder.Encode(&ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:      ws.ProtoTypeShell,
+				MsgType:    msgType,
+				Properties: properties,
+			},
+			Body: body,
+		})
+	}
+	sizeProperties := func() map[string]interface{} {
+		size, err := unix.IoctlGetWinsize(int(in.Fd()), unix.TIOCGWINSZ)
+		if err != nil {
+			return map[string]interface{}{}
+		}
+		return map[string]interface{}{
+			propertyTerminalHeight: size.Row,
+			propertyTerminalWidth:  size.Col,
+		}
+	}
+
+	properties := sizeProperties()
+	if term := os.Getenv("TERM"); term != "" {
+		properties[propertyTerminalType] = term
+	}
+	if err = send(wsshell.MessageTypeSpawnShell, properties, nil); err != nil {
+		return errors.Wrap(err, "failed to request the shell")
+	}
+
+	if termios, err := unix.IoctlGetTermios(int(in.Fd()), unix.TCGETS); err == nil {
+		raw := *termios
+		raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP |
+			unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+		raw.Oflag &^= unix.OPOST
+		raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		raw.Cflag &^= unix.CSIZE | unix.PARENB
+		raw.Cflag |= unix.CS8
+		raw.Cc[unix.VMIN] = 1
+		raw.Cc[unix.VTIME] = 0
+		if err = unix.IoctlSetTermios(int(in.Fd()), unix.TCSETS, &raw); err == nil {
+			defer unix.IoctlSetTermios(int(in.Fd()), unix.TCSETS, termios)
+		}
+	}
+
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+	defer signal.Stop(resized)
+	go func() {
+		for range resized {
+			_ = send(wsshell.MessageTypeResizeShell, sizeProperties(), nil)
+		}
+	}()
+
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, err := in.Read(buffer)
+			if n > 0 {
+				if send(wsshell.MessageTypeShellCommand, nil, buffer[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				_ = send(wsshell.MessageTypeStopShell, nil, nil)
+				return
+			}
+		}
+	}()
+
+	started := false
+	decoder := msgpack.NewDecoder(conn)
+	for {
+		message := &ws.ProtoMsg{}
+		if err := decoder.Decode(message); err != nil {
+			if !started {
+				return errDebugShellRefused
+			} else if err == io.EOF {
+				return nil
+			}
+			return errors.Wrap(err, "failed to read from the debug shell")
+		}
+		switch message.Header.MsgType {
+		case wsshell.MessageTypeSpawnShell:
+			status, _ := utils.Num64(message.Header.Properties["status"])
+			if status == int64(wsshell.ErrorMessage) {
+				return errors.New(string(message.Body))
+			}
+			started = true
+		case wsshell.MessageTypeShellCommand:
+			if _, err := out.Write(message.Body); err != nil {
+				return err
+			}
+		case wsshell.MessageTypeStopShell:
+			return nil
+		}
+	}
+}
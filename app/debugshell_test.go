@@ -0,0 +1,99 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+)
+
+func TestDebugShell(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestDebugShell")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	testCases := map[string]struct {
+		allowedUid uint32
+		output     string
+		err        error
+	}{
+		"ok": {
+			allowedUid: uint32(os.Getuid()),
+			output:     "debug shell works",
+		},
+		"refused": {
+			allowedUid: uint32(os.Getuid()) + 1,
+			err:        errDebugShellRefused,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			defaultAllowedUid := debugShellAllowedUid
+			debugShellAllowedUid = tc.allowedUid
+			defer func() {
+				debugShellAllowedUid = defaultAllowedUid
+			}()
+
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					ShellCommand: "/bin/sh",
+					DebugShell: config.DebugShellConfig{
+						Enabled: true,
+						Socket:  path.Join(dir, name, "debug-shell.sock"),
+					},
+				},
+			})
+			current, err := user.Current()
+			assert.NoError(t, err)
+			runAs, err := lookupRunAsUser(current.Username)
+			assert.NoError(t, err)
+			d.uid, d.gid, d.homeDir = runAs.uid, runAs.gid, runAs.homeDir
+
+			server, err := d.serveDebugShell(d.debugShellSocket)
+			assert.NoError(t, err)
+			defer server.close()
+			info, err := os.Stat(d.debugShellSocket)
+			assert.NoError(t, err)
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+			in, input, err := os.Pipe()
+			assert.NoError(t, err)
+			defer in.Close()
+			input.WriteString("echo debug shell works\nexit\n")
+			defer input.Close()
+
+			out := &bytes.Buffer{}
+			done := make(chan error, 1)
+			go func() {
+				done <- DebugShell(d.debugShellSocket, in, out)
+			}()
+			select {
+			case err = <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("the debug shell did not exit")
+			}
+			assert.Equal(t, tc.err, err)
+			assert.Contains(t, out.String(), tc.output)
+		})
+	}
+}
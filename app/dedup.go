@@ -0,0 +1,119 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// Message properties used for the duplicate detection
+const (
+	propertyMsgID     = "msgid"
+	propertyDuplicate = "duplicate"
+)
+
+// deduplicator remembers the ids of the messages handled within a window
+// per session and protocol, to detect the messages delivered twice, e.g.:
+// when the server retries a request after a reconnect
+type deduplicator struct {
+	mutex   sync.Mutex
+	window  time.Duration
+	seen    map[sessionProtoKey]map[string]time.Time
+	sweptAt time.Time
+	now     func() time.Time
+}
+
+func newDeduplicator(window time.Duration) *deduplicator {
+	return &deduplicator{
+		window: window,
+		seen:   map[sessionProtoKey]map[string]time.Time{},
+		now:    time.Now,
+	}
+}
+
+// isDuplicate tells if the message id was handled within the window for
+// the session and protocol; messages without an id are never duplicates
+func (d *deduplicator) isDuplicate(session string, proto ws.ProtoType, msgID string) bool {
+	if d == nil || msgID == "" {
+		return false
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	seenAt, ok := d.seen[sessionProtoKey{session: session, proto: proto}][msgID]
+	return ok && d.now().Sub(seenAt) <= d.window
+}
+
+// remember records the id of a message handled successfully; the failed
+// ones are not, the server retrying them gets them handled again
+func (d *deduplicator) remember(session string, proto ws.ProtoType, msgID string) {
+	if d == nil || msgID == "" {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	now := d.now()
+	d.sweep(now)
+	key := sessionProtoKey{session: session, proto: proto}
+	seen, ok := d.seen[key]
+	if !ok {
+		seen = map[string]time.Time{}
+		d.seen[key] = seen
+	}
+	seen[msgID] = now
+}
+
+// sweep drops the ids older than the window, of all the sessions, at
+// most once per window; the sessions which never opened, or went away
+// unnoticed, are not left behind
+func (d *deduplicator) sweep(now time.Time) {
+	if now.Sub(d.sweptAt) < d.window {
+		return
+	}
+	d.sweptAt = now
+	for key, seen := range d.seen {
+		for id, seenAt := range seen {
+			if now.Sub(seenAt) > d.window {
+				delete(seen, id)
+			}
+		}
+		if len(seen) == 0 {
+			delete(d.seen, key)
+		}
+	}
+}
+
+// forget drops the message ids of the session
+func (d *deduplicator) forget(session string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for key := range d.seen {
+		if key.session == session {
+			delete(d.seen, key)
+		}
+	}
+}
+
+// forgetSessionMessages drops the message ids of a session when it closes
+func (d *MenderShellDaemon) forgetSessionMessages(event string, s *session.MenderShellSession, proto ws.ProtoType) {
+	if event == session.HookEventSessionClose {
+		d.deduplicator.forget(s.GetId())
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack"
+
+	"github.com/mendersoftware/mender-connect/config"
+)
+
+func TestDeduplicator(t *testing.T) {
+	now := time.Now()
+	d := newDeduplicator(time.Minute)
+	d.now = func() time.Time {
+		return now
+	}
+
+	d.remember("session-id", ws.ProtoTypeShell, "")
+	assert.False(t, d.isDuplicate("session-id", ws.ProtoTypeShell, ""))
+	assert.False(t, d.isDuplicate("session-id", ws.ProtoTypeShell, "1"))
+	d.remember("session-id", ws.ProtoTypeShell, "1")
+	assert.True(t, d.isDuplicate("session-id", ws.ProtoTypeShell, "1"))
+	assert.False(t, d.isDuplicate("session-id", ws.ProtoType(3), "1"))
+	assert.False(t, d.isDuplicate("other-session-id", ws.ProtoTypeShell, "1"))
+
+	now = now.Add(2 * time.Minute)
+	assert.False(t, d.isDuplicate("session-id", ws.ProtoTypeShell, "1"))
+	d.remember("session-id", ws.ProtoTypeShell, "1")
+	assert.True(t, d.isDuplicate("session-id", ws.ProtoTypeShell, "1"))
+
+	d.forget("session-id")
+	assert.False(t, d.isDuplicate("session-id", ws.ProtoTypeShell, "1"))
+
+	var nilDeduplicator *deduplicator
+	nilDeduplicator.remember("session-id", ws.ProtoTypeShell, "1")
+	assert.False(t, nilDeduplicator.isDuplicate("session-id", ws.ProtoTypeShell, "1"))
+}
+
+func TestDeduplicatorSweep(t *testing.T) {
+	now := time.Now()
+	d := newDeduplicator(time.Minute)
+	d.now = func() time.Time {
+		return now
+	}
+
+	// the ids of sessions which never open are not kept forever
+	d.remember("never-opened-1", ws.ProtoTypeShell, "1")
+	d.remember("never-opened-2", ws.ProtoTypeShell, "1")
+	assert.Len(t, d.seen, 2)
+	now = now.Add(2 * time.Minute)
+	d.remember("session-id", ws.ProtoTypeShell, "1")
+	assert.Len(t, d.seen, 1)
+	assert.True(t, d.isDuplicate("session-id", ws.ProtoTypeShell, "1"))
+}
+
+func TestRouteMessageDuplicate(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+		},
+	})
+
+	// a failed request is handled again when the server retries it
+	msg := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeShellCommand,
+			SessionID: "duplicate-session-id",
+			Properties: map[string]interface{}{
+				propertyMsgID: "msg-1",
+			},
+		},
+	}
+	err := d.routeMessage(msg)
+	assert.Equal(t, ErrorCodeSessionNotFound, errorCode(err))
+	err = d.routeMessage(msg)
+	assert.Equal(t, ErrorCodeSessionNotFound, errorCode(err))
+
+	// a handled one is not
+	body, _ := msgpack.Marshal(&openMessage{Versions: []int{1}})
+	msg = &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     protoTypeControl,
+			MsgType:   messageTypeOpen,
+			SessionID: "duplicate-session-id",
+			Properties: map[string]interface{}{
+				propertyMsgID: "msg-2",
+			},
+		},
+		Body: body,
+	}
+	assert.NoError(t, d.routeMessage(msg))
+	assert.True(t, d.deduplicator.isDuplicate("duplicate-session-id", protoTypeControl, "msg-2"))
+	assert.NoError(t, d.routeMessage(msg))
+}
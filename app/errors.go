@@ -0,0 +1,113 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mender-connect/connection"
+	"github.com/mendersoftware/mender-connect/session"
+	"github.com/mendersoftware/mender-connect/shell"
+)
+
+// propertyErrorCode is the message property carrying the machine readable
+// code of an error response, the body keeps the human readable message
+const propertyErrorCode = "error_code"
+
+// Codes sent in the error responses
+const (
+	ErrorCodeInternal             = "internal"
+	ErrorCodeLimitExhausted       = "limit_exhausted"
+	ErrorCodeSessionNotFound      = "session_not_found"
+	ErrorCodeShellAlreadyRunning  = "shell_already_running"
+	ErrorCodeShellNotRunning      = "shell_not_running"
+	ErrorCodeMessageTooLarge      = "message_too_large"
+	ErrorCodeShuttingDown         = "shutting_down"
+	ErrorCodeProtocolNotSupported = "protocol_not_supported"
+	ErrorCodeProtocolNotAllowed   = "protocol_not_allowed"
+	ErrorCodeUnknownMessageType   = "unknown_message_type"
+	ErrorCodeHandlerPanic         = "handler_panic"
+	ErrorCodeRateLimited          = "rate_limited"
+	ErrorCodeCommandDenied        = "command_denied"
+	ErrorCodeRunAsUserDenied      = "run_as_user_denied"
+	ErrorCodeConsentRefused       = "consent_refused"
+	ErrorCodeConsentTimeout       = "consent_timeout"
+	ErrorCodeMultiplexerDenied    = "multiplexer_denied"
+	ErrorCodeSignalDenied         = "signal_denied"
+	ErrorCodeTakeoverDenied       = "takeover_denied"
+	ErrorCodeReadOnly             = "read_only"
+	ErrorCodeObserveDenied        = "observe_denied"
+)
+
+var errDaemonShuttingDown = errors.New("the daemon is shutting down")
+
+// errorCodes maps the sentinel errors to their codes
+var errorCodes = map[error]string{
+	session.ErrSessionShellTooManySessionsPerUser: ErrorCodeLimitExhausted,
+	session.ErrSessionTooManySessions:             ErrorCodeLimitExhausted,
+	session.ErrSessionTooManyShellsAlreadyRunning: ErrorCodeLimitExhausted,
+	session.ErrSessionTooManyShellsPerUser:        ErrorCodeLimitExhausted,
+	session.ErrSessionTooManyStreams:              ErrorCodeLimitExhausted,
+	session.ErrSessionNotFound:                    ErrorCodeSessionNotFound,
+	session.ErrSessionShellAlreadyRunning:         ErrorCodeShellAlreadyRunning,
+	session.ErrSessionShellNotRunning:             ErrorCodeShellNotRunning,
+	connection.ErrMessageTooLarge:                 ErrorCodeMessageTooLarge,
+	errDaemonShuttingDown:                         ErrorCodeShuttingDown,
+	shell.ErrCommandDenied:                        ErrorCodeCommandDenied,
+	errRunAsUserDenied:                            ErrorCodeRunAsUserDenied,
+	session.ErrConsentRefused:                     ErrorCodeConsentRefused,
+	session.ErrConsentTimeout:                     ErrorCodeConsentTimeout,
+	errMultiplexerDisabled:                        ErrorCodeMultiplexerDenied,
+	errMultiplexerRestricted:                      ErrorCodeMultiplexerDenied,
+	errMultiplexerSessionName:                     ErrorCodeMultiplexerDenied,
+	errSignalNotAllowed:                           ErrorCodeSignalDenied,
+	errTakeoverDisabled:                           ErrorCodeTakeoverDenied,
+	errTakeoverDenied:                             ErrorCodeTakeoverDenied,
+	errTakeoverRestricted:                         ErrorCodeTakeoverDenied,
+	session.ErrSessionReadOnly:                    ErrorCodeReadOnly,
+	errObserveDisabled:                            ErrorCodeObserveDenied,
+	errObserveDenied:                              ErrorCodeObserveDenied,
+	errObserveRestricted:                          ErrorCodeObserveDenied,
+	session.ErrSessionTooManyObservers:            ErrorCodeLimitExhausted,
+}
+
+// codedError is an error which is not a sentinel, but carries its code
+type codedError struct {
+	code string
+	msg  string
+}
+
+func (e *codedError) Error() string {
+	return e.msg
+}
+
+func newCodedError(code string, msg string) error {
+	return &codedError{
+		code: code,
+		msg:  msg,
+	}
+}
+
+// errorCode returns the code of err, looking through the wrapped errors;
+// errors without a code are reported as internal ones
+func errorCode(err error) string {
+	cause := errors.Cause(err)
+	if e, ok := cause.(*codedError); ok {
+		return e.code
+	}
+	if code, ok := errorCodes[cause]; ok {
+		return code
+	}
+	return ErrorCodeInternal
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/session"
+	"github.com/mendersoftware/mender-connect/shell"
+)
+
+func TestErrorCode(t *testing.T) {
+	testCases := map[string]struct {
+		err  error
+		code string
+	}{
+		"sentinel": {
+			err:  session.ErrSessionTooManySessions,
+			code: ErrorCodeLimitExhausted,
+		},
+		"wrapped sentinel": {
+			err:  errors.Wrap(session.ErrSessionShellAlreadyRunning, "failed to start shell"),
+			code: ErrorCodeShellAlreadyRunning,
+		},
+		"command denied": {
+			err:  errors.Wrap(shell.ErrCommandDenied, "shell command execution error"),
+			code: ErrorCodeCommandDenied,
+		},
+		"coded": {
+			err:  newCodedError(ErrorCodeHandlerPanic, "panic"),
+			code: ErrorCodeHandlerPanic,
+		},
+		"unknown": {
+			err:  errors.New("unknown"),
+			code: ErrorCodeInternal,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.code, errorCode(tc.err))
+		})
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// managedHandler is a running protocol handler
+type managedHandler struct {
+	handler  ProtoHandler
+	activeAt time.Time
+	// expiry of the token which authorized the handler, zero if none
+	authExpiresAt time.Time
+}
+
+// handlerKey identifies a running handler
+type handlerKey struct {
+	proto ws.ProtoType
+	key   string
+}
+
+// handlerManager owns the lifecycle of the protocol handlers: it creates
+// them on the first message of their protocol in a session, closes the
+// ones idle for longer than idleTimeout, and closes them on request, per
+// session, per protocol or all of them when the daemon shuts down
+type handlerManager struct {
+	mutex sync.Mutex
+	// running handlers, keyed by protocol and session/stream key
+	handlers map[ws.ProtoType]map[string]*managedHandler
+	// time after which an idle handler is closed, 0 means never
+	idleTimeout time.Duration
+	// expiry of the token which authorizes the new handlers, zero if none
+	authExpiresAt time.Time
+	now           func() time.Time
+}
+
+func newHandlerManager() *handlerManager {
+	return &handlerManager{
+		handlers: map[ws.ProtoType]map[string]*managedHandler{},
+		now:      time.Now,
+	}
+}
+
+// get returns the handler of the protocol for the session, creating it on
+// the first message; it returns nil if no handler of the protocol is
+// registered
+func (m *handlerManager) get(message *ws.ProtoMsg, key string) ProtoHandler {
+	proto := message.Header.Proto
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if managed, ok := m.handlers[proto][key]; ok {
+		managed.activeAt = m.now()
+		return managed.handler
+	}
+	constructor := getProtoConstructor(proto)
+	if constructor == nil {
+		return nil
+	}
+	if m.handlers[proto] == nil {
+		m.handlers[proto] = map[string]*managedHandler{}
+	}
+	handler := constructor(session.NewLogger(message.Header.SessionID,
+		getStreamIdFromMessage(message), getUserIdFromSessionOrMessage(message), proto))
+	m.handlers[proto][key] = &managedHandler{
+		handler:       handler,
+		activeAt:      m.now(),
+		authExpiresAt: m.authExpiresAt,
+	}
+	return handler
+}
+
+// count returns the number of running handlers
+func (m *handlerManager) count() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	count := 0
+	for _, handlers := range m.handlers {
+		count += len(handlers)
+	}
+	return count
+}
+
+// remove takes the handlers matching out of the manager
+func (m *handlerManager) remove(match func(k handlerKey, managed *managedHandler) bool) map[handlerKey]ProtoHandler {
+	removed := map[handlerKey]ProtoHandler{}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for proto, handlers := range m.handlers {
+		for key, managed := range handlers {
+			k := handlerKey{proto: proto, key: key}
+			if match(k, managed) {
+				removed[k] = managed.handler
+				delete(handlers, key)
+			}
+		}
+		if len(handlers) == 0 {
+			delete(m.handlers, proto)
+		}
+	}
+	return removed
+}
+
+// closeAll closes the handlers concurrently, so that the handlers slow to
+// close delay the others at most by ProtoHandlerCloseTimeout
+func closeAll(handlers map[handlerKey]ProtoHandler) int {
+	wg := sync.WaitGroup{}
+	for k, handler := range handlers {
+		wg.Add(1)
+		go func(k handlerKey, handler ProtoHandler) {
+			defer wg.Done()
+			closeHandler(handler, k.proto, k.key)
+		}(k, handler)
+	}
+	wg.Wait()
+	return len(handlers)
+}
+
+// close closes the handler of the protocol for the session
+func (m *handlerManager) close(proto ws.ProtoType, key string) {
+	closeAll(m.remove(func(k handlerKey, _ *managedHandler) bool {
+		return k.proto == proto && k.key == key
+	}))
+}
+
+// closeSession closes the handlers of all the protocols for the session
+func (m *handlerManager) closeSession(key string) {
+	closeAll(m.remove(func(k handlerKey, _ *managedHandler) bool {
+		return k.key == key
+	}))
+}
+
+// closeProtocol closes the handlers of the protocol for all the sessions
+func (m *handlerManager) closeProtocol(proto ws.ProtoType) {
+	closeAll(m.remove(func(k handlerKey, _ *managedHandler) bool {
+		return k.proto == proto
+	}))
+}
+
+// closeIdle closes the handlers idle for longer than idleTimeout,
+// returning how many were closed
+func (m *handlerManager) closeIdle() int {
+	if m.idleTimeout == 0 {
+		return 0
+	}
+	idleSince := m.now().Add(-m.idleTimeout)
+	return closeAll(m.remove(func(_ handlerKey, managed *managedHandler) bool {
+		return managed.activeAt.Before(idleSince)
+	}))
+}
+
+// setAuthExpiry sets the expiry of the token which authorizes the new
+// handlers
+func (m *handlerManager) setAuthExpiry(expiresAt time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.authExpiresAt = expiresAt
+}
+
+// reauthorize sets the expiry of the token authorizing all the handlers,
+// running or new
+func (m *handlerManager) reauthorize(expiresAt time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.authExpiresAt = expiresAt
+	for _, handlers := range m.handlers {
+		for _, managed := range handlers {
+			managed.authExpiresAt = expiresAt
+		}
+	}
+}
+
+// closeAuthExpired closes the handlers authorized by a token which
+// expired before t, returning how many were closed
+func (m *handlerManager) closeAuthExpired(t time.Time) int {
+	return closeAll(m.remove(func(_ handlerKey, managed *managedHandler) bool {
+		return !managed.authExpiresAt.IsZero() && managed.authExpiresAt.Before(t)
+	}))
+}
+
+// shutdown closes all the handlers
+func (m *handlerManager) shutdown() {
+	closeAll(m.remove(func(handlerKey, *managedHandler) bool {
+		return true
+	}))
+}
+
+// closeHandler calls Close on the handler, giving up after
+// ProtoHandlerCloseTimeout; then the handler is force closed if it
+// implements ForceCloser, and left behind otherwise
+func closeHandler(handler ProtoHandler, proto ws.ProtoType, key string) {
+	done := make(chan error, 1)
+	go func() {
+		done <- handler.Close()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Errorf("failed to close the handler of protocol %d, session %s: %s",
+				proto, key, err.Error())
+		}
+	case <-time.After(ProtoHandlerCloseTimeout):
+		log.Errorf("the handler of protocol %d, session %s did not close within %s",
+			proto, key, ProtoHandlerCloseTimeout)
+		if forceCloser, ok := handler.(ForceCloser); ok {
+			forceCloser.ForceClose()
+		}
+	}
+}
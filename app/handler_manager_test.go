@@ -0,0 +1,100 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerManager(t *testing.T) {
+	const (
+		proto      = ws.ProtoType(0x102)
+		otherProto = ws.ProtoType(0x103)
+	)
+	handlers := map[string]*testProtoHandler{}
+	constructor := func(logger *log.Entry) ProtoHandler {
+		handler := &testProtoHandler{logger: logger}
+		handlers[fmt.Sprintf("%s/%d", logger.Data["session_id"], logger.Data["protocol"])] = handler
+		return handler
+	}
+	assert.NoError(t, RegisterProtoHandler(proto, constructor))
+	assert.NoError(t, RegisterProtoHandler(otherProto, constructor))
+	defer func() {
+		delete(protoConstructors, proto)
+		delete(protoConstructors, otherProto)
+	}()
+
+	now := time.Now()
+	manager := newHandlerManager()
+	manager.idleTimeout = time.Minute
+	manager.now = func() time.Time {
+		return now
+	}
+	message := func(proto ws.ProtoType, sessionID string) *ws.ProtoMsg {
+		return &ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     proto,
+				SessionID: sessionID,
+			},
+		}
+	}
+
+	assert.Nil(t, manager.get(message(0x104, "session-1"), "session-1"))
+	handler := manager.get(message(proto, "session-1"), "session-1")
+	assert.NotNil(t, handler)
+	assert.Equal(t, handler, manager.get(message(proto, "session-1"), "session-1"))
+	manager.get(message(otherProto, "session-1"), "session-1")
+	manager.get(message(proto, "session-2"), "session-2")
+	assert.Equal(t, 3, manager.count())
+
+	// per protocol shutdown
+	manager.closeProtocol(otherProto)
+	assert.True(t, handlers["session-1/259"].closed)
+	assert.False(t, handlers["session-1/258"].closed)
+	assert.Equal(t, 2, manager.count())
+
+	// idle expiry
+	now = now.Add(50 * time.Second)
+	manager.get(message(proto, "session-2"), "session-2")
+	now = now.Add(20 * time.Second)
+	assert.Equal(t, 1, manager.closeIdle())
+	assert.True(t, handlers["session-1/258"].closed)
+	assert.False(t, handlers["session-2/258"].closed)
+
+	// a new handler replaces the closed one
+	assert.NotEqual(t, handler, manager.get(message(proto, "session-1"), "session-1"))
+	assert.Equal(t, 2, manager.count())
+
+	// token expiry
+	manager.setAuthExpiry(now.Add(time.Minute))
+	manager.get(message(otherProto, "session-3"), "session-3")
+	assert.Equal(t, 1, manager.closeAuthExpired(now.Add(2*time.Minute)))
+	assert.True(t, handlers["session-3/259"].closed)
+	assert.False(t, handlers["session-1/258"].closed)
+	manager.reauthorize(now.Add(3 * time.Minute))
+	assert.Equal(t, 0, manager.closeAuthExpired(now.Add(2*time.Minute)))
+	assert.Equal(t, 2, manager.count())
+
+	// final cleanup
+	manager.shutdown()
+	assert.True(t, handlers["session-1/258"].closed)
+	assert.True(t, handlers["session-2/258"].closed)
+	assert.Equal(t, 0, manager.count())
+}
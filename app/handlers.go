@@ -0,0 +1,170 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"sync"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	configuration "github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// Protocol handlers are the extension point for the protocols the daemon
+// does not implement itself. An integrator registers a Constructor for a
+// protocol type, usually from the init function of a package compiled in
+// the daemon; the daemon then advertises the protocol in the accept
+// message and creates one ProtoHandler per session and stream, on the
+// first message of the protocol in that session. The handler lives until
+// it returns ErrProtoHandlerDone, stays idle for
+// Sessions.HandlerIdleTimeout, the session closes, CloseProtoHandlers is
+// called for its protocol or the daemon shuts down. Besides the responses
+// written to the ResponseWriter, a handler may push unsolicited messages
+// with notify.Notify. To make the protocol subject to AllowedProtocols,
+// add its name to config.ProtocolsByName as well.
+
+var (
+	ErrProtoHandlerDone     = errors.New("protocol handler done")
+	ErrProtoHandlerReserved = errors.New("protocol type is reserved")
+)
+
+// ResponseWriter sends the messages of a handler to the server
+type ResponseWriter interface {
+	WriteProtoMsg(msg *ws.ProtoMsg) error
+}
+
+// ProtoHandler handles the messages of a protocol within a session
+type ProtoHandler interface {
+	// ServeProtoMsg handles a message of the session, returning
+	// ErrProtoHandlerDone closes the handler
+	ServeProtoMsg(msg *ws.ProtoMsg, w ResponseWriter) error
+	// Close releases the resources of the handler
+	Close() error
+}
+
+// ForceCloser is implemented by the handlers able to release their
+// resources at once, when Close does not return in time
+type ForceCloser interface {
+	ForceClose()
+}
+
+// Constructor creates a handler for a new session, the logger carries the
+// ids of the session, the stream, the user and the protocol
+type Constructor func(logger *log.Entry) ProtoHandler
+
+// ProtoHandlerCloseTimeout bounds the time the handlers take to close
+var ProtoHandlerCloseTimeout = configuration.DefaultHandlerCloseTimeout
+
+var (
+	protoHandlersMutex = &sync.Mutex{}
+	// registered constructors, keyed by protocol
+	protoConstructors = map[ws.ProtoType]Constructor{}
+	// the running handlers
+	protoHandlerManager = newHandlerManager()
+)
+
+// RegisterProtoHandler registers the constructor of the handlers of proto;
+// the protocols the daemon implements cannot be overridden
+func RegisterProtoHandler(proto ws.ProtoType, constructor Constructor) error {
+	if proto == ws.ProtoTypeShell || proto == protoTypeControl ||
+		proto == configuration.ProtoTypeProcesses {
+		return ErrProtoHandlerReserved
+	}
+
+	protoHandlersMutex.Lock()
+	defer protoHandlersMutex.Unlock()
+	if _, ok := protoConstructors[proto]; ok {
+		return errors.Errorf("handler of protocol %d already registered", proto)
+	}
+	protoConstructors[proto] = constructor
+	return nil
+}
+
+// registeredProtocols returns the protocols with a registered handler
+func registeredProtocols() []ws.ProtoType {
+	protoHandlersMutex.Lock()
+	defer protoHandlersMutex.Unlock()
+	protocols := make([]ws.ProtoType, 0, len(protoConstructors))
+	for proto := range protoConstructors {
+		protocols = append(protocols, proto)
+	}
+	return protocols
+}
+
+func isProtoHandlerRegistered(proto ws.ProtoType) bool {
+	return getProtoConstructor(proto) != nil
+}
+
+func getProtoConstructor(proto ws.ProtoType) Constructor {
+	protoHandlersMutex.Lock()
+	defer protoHandlersMutex.Unlock()
+	return protoConstructors[proto]
+}
+
+// CloseProtoHandlers closes the running handlers of proto in all the
+// sessions, e.g. to recycle them; the next message of the protocol in a
+// session creates a new handler
+func CloseProtoHandlers(proto ws.ProtoType) {
+	protoHandlerManager.closeProtocol(proto)
+}
+
+// protoResponseWriter writes the messages of the handlers on the connection
+type protoResponseWriter struct {
+	d *MenderShellDaemon
+}
+
+func (w *protoResponseWriter) WriteProtoMsg(msg *ws.ProtoMsg) error {
+	return w.d.responseMessage(msg)
+}
+
+// routeMessageProtoHandler passes the message to the handler of its protocol
+func (d *MenderShellDaemon) routeMessageProtoHandler(message *ws.ProtoMsg) error {
+	key := session.StreamKey(message.Header.SessionID, getStreamIdFromMessage(message))
+	handler := protoHandlerManager.get(message, key)
+	if handler == nil {
+		return errors.Errorf("no handler of protocol %d", message.Header.Proto)
+	}
+
+	err := handler.ServeProtoMsg(message, &protoResponseWriter{d: d})
+	if err == ErrProtoHandlerDone {
+		protoHandlerManager.close(message.Header.Proto, key)
+		return nil
+	} else if err != nil {
+		response := &ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:      message.Header.Proto,
+				MsgType:    message.Header.MsgType,
+				SessionID:  message.Header.SessionID,
+				Properties: map[string]interface{}{},
+			},
+		}
+		copyStreamId(response, message)
+		d.routeMessageResponse(response, err)
+	}
+	return err
+}
+
+func init() {
+	session.AddEventListener(closeSessionProtoHandlers)
+}
+
+// closeSessionProtoHandlers closes the handlers of a session when it closes
+func closeSessionProtoHandlers(event string, s *session.MenderShellSession, proto ws.ProtoType) {
+	if event == session.HookEventSessionClose {
+		protoHandlerManager.closeSession(s.GetId())
+	}
+}
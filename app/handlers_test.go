@@ -0,0 +1,136 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+)
+
+type testProtoHandler struct {
+	logger   *log.Entry
+	messages []*ws.ProtoMsg
+	closed   bool
+}
+
+func (h *testProtoHandler) ServeProtoMsg(msg *ws.ProtoMsg, w ResponseWriter) error {
+	h.messages = append(h.messages, msg)
+	if msg.Header.MsgType == "done" {
+		return ErrProtoHandlerDone
+	}
+	return nil
+}
+
+func (h *testProtoHandler) Close() error {
+	h.closed = true
+	return nil
+}
+
+func TestRegisterProtoHandler(t *testing.T) {
+	const proto = ws.ProtoType(0x100)
+	handlers := []*testProtoHandler{}
+	defer func() {
+		protoHandlerManager.shutdown()
+		delete(protoConstructors, proto)
+	}()
+
+	constructor := func(logger *log.Entry) ProtoHandler {
+		handler := &testProtoHandler{logger: logger}
+		handlers = append(handlers, handler)
+		return handler
+	}
+	assert.Equal(t, ErrProtoHandlerReserved, RegisterProtoHandler(ws.ProtoTypeShell, constructor))
+	assert.NoError(t, RegisterProtoHandler(proto, constructor))
+	assert.EqualError(t, RegisterProtoHandler(proto, constructor),
+		"handler of protocol 256 already registered")
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+		},
+	})
+	assert.True(t, d.isProtocolSupported(proto))
+	assert.Contains(t, d.supportedProtocols(), proto)
+
+	for _, msgType := range []string{"data", "data", "done", "data"} {
+		err := d.routeMessage(&ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     proto,
+				MsgType:   msgType,
+				SessionID: "handler-session-id",
+				Properties: map[string]interface{}{
+					"user_id": "handler-user-id",
+				},
+			},
+		})
+		assert.NoError(t, err)
+	}
+
+	assert.Len(t, handlers, 2)
+	assert.Equal(t, log.Fields{
+		"session_id": "handler-session-id",
+		"user_id":    "handler-user-id",
+		"protocol":   proto,
+	}, handlers[0].logger.Data)
+	assert.Len(t, handlers[0].messages, 3)
+	assert.True(t, handlers[0].closed)
+	assert.Len(t, handlers[1].messages, 1)
+	assert.False(t, handlers[1].closed)
+
+	protoHandlerManager.closeSession("handler-session-id")
+	assert.True(t, handlers[1].closed)
+}
+
+type stuckProtoHandler struct {
+	testProtoHandler
+	release     chan bool
+	forceClosed bool
+}
+
+func (h *stuckProtoHandler) Close() error {
+	<-h.release
+	return nil
+}
+
+func (h *stuckProtoHandler) ForceClose() {
+	h.forceClosed = true
+}
+
+func TestCloseProtoHandlerTimeout(t *testing.T) {
+	defer func(timeout time.Duration) {
+		ProtoHandlerCloseTimeout = timeout
+	}(ProtoHandlerCloseTimeout)
+	ProtoHandlerCloseTimeout = 100 * time.Millisecond
+
+	const proto = ws.ProtoType(0x101)
+	handler := &stuckProtoHandler{release: make(chan bool)}
+	defer close(handler.release)
+	manager := newHandlerManager()
+	manager.handlers[proto] = map[string]*managedHandler{
+		"stuck-session-id": {handler: handler},
+	}
+
+	start := time.Now()
+	manager.closeSession("stuck-session-id")
+	assert.True(t, time.Since(start) < time.Second)
+	assert.True(t, handler.forceClosed)
+	assert.Equal(t, 0, manager.count())
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Properties of the spawn shell messages carrying the hints of the remote
+// terminal: its TERM, and its LANG and LC_* variables keyed by name
+const (
+	propertyTerminalType = "terminal_type"
+	propertyLocale       = "locale"
+)
+
+var (
+	// characters a TERM or locale hint may contain, which e.g. keeps the
+	// TERM values from naming terminfo paths
+	terminalHintRe = regexp.MustCompile(`^[A-Za-z0-9_.@+-]{1,64}$`)
+	localeNameRe   = regexp.MustCompile(`^(LANG|LC_[A-Z]+)$`)
+)
+
+// matchesAnyPattern tells if value is well formed and matches one of the
+// glob patterns
+func matchesAnyPattern(value string, patterns []string) bool {
+	if !terminalHintRe.MatchString(value) {
+		return false
+	}
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// terminalTypeFor returns the TERM of the shell: the one the remote
+// terminal asked for, if allowed, or the default one
+func (d *MenderShellDaemon) terminalTypeFor(properties map[string]interface{}) string {
+	terminalType, _ := properties[propertyTerminalType].(string)
+	if terminalType == "" {
+		return d.terminalString
+	}
+	if !matchesAnyPattern(terminalType, d.allowedTerminalTypes) {
+		log.Warnf("ignoring the terminal type '%s' not allowed", terminalType)
+		return d.terminalString
+	}
+	return terminalType
+}
+
+// localeEnvFor returns the LANG and LC_* variables of the shell the remote
+// terminal asked for, as "NAME=value", leaving out the ones not allowed
+func (d *MenderShellDaemon) localeEnvFor(properties map[string]interface{}) []string {
+	locale, _ := properties[propertyLocale].(map[string]interface{})
+	env := []string{}
+	for name, v := range locale {
+		value, _ := v.(string)
+		if !localeNameRe.MatchString(name) || !matchesAnyPattern(value, d.allowedLocales) {
+			log.Warnf("ignoring the locale variable %s='%v' not allowed", name, v)
+			continue
+		}
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
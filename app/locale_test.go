@@ -0,0 +1,123 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+)
+
+func TestTerminalTypeFor(t *testing.T) {
+	testCases := map[string]struct {
+		allowed      []string
+		terminalType interface{}
+		result       string
+	}{
+		"no hint": {
+			result: "xterm-256color",
+		},
+		"default allowed": {
+			terminalType: "screen-256color",
+			result:       "screen-256color",
+		},
+		"not allowed": {
+			terminalType: "xterm-kitty",
+			allowed:      []string{"vt100"},
+			result:       "xterm-256color",
+		},
+		"path": {
+			terminalType: "xterm/../../tmp/x",
+			result:       "xterm-256color",
+		},
+		"not a string": {
+			terminalType: 42,
+			result:       "xterm-256color",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					ShellCommand: "/bin/sh",
+					User:         "mender",
+					Terminal: config.TerminalConfig{
+						AllowedTypes: tc.allowed,
+					},
+				},
+			})
+			assert.Equal(t, tc.result, d.terminalTypeFor(map[string]interface{}{
+				propertyTerminalType: tc.terminalType,
+			}))
+		})
+	}
+}
+
+func TestLocaleEnvFor(t *testing.T) {
+	testCases := map[string]struct {
+		allowed []string
+		locale  interface{}
+		env     []string
+	}{
+		"no hint": {
+			env: []string{},
+		},
+		"default allowed": {
+			locale: map[string]interface{}{
+				"LC_TIME": "en_GB.UTF-8",
+				"LANG":    "C.UTF-8",
+			},
+			env: []string{"LANG=C.UTF-8", "LC_TIME=en_GB.UTF-8"},
+		},
+		"not allowed": {
+			allowed: []string{"en_US.UTF-8"},
+			locale: map[string]interface{}{
+				"LANG":     "en_US.UTF-8",
+				"LC_CTYPE": "de_DE.UTF-8",
+			},
+			env: []string{"LANG=en_US.UTF-8"},
+		},
+		"not a locale variable": {
+			locale: map[string]interface{}{
+				"LD_PRELOAD": "C.UTF-8",
+				"LANGUAGE":   "C.UTF-8",
+			},
+			env: []string{},
+		},
+		"malformed": {
+			locale: map[string]interface{}{
+				"LANG": "x y.UTF-8",
+			},
+			env: []string{},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					ShellCommand: "/bin/sh",
+					User:         "mender",
+					Terminal: config.TerminalConfig{
+						AllowedLocales: tc.allowed,
+					},
+				},
+			})
+			assert.Equal(t, tc.env, d.localeEnvFor(map[string]interface{}{
+				propertyLocale: tc.locale,
+			}))
+		})
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	configuration "github.com/mendersoftware/mender-connect/config"
+)
+
+// propertyMultiplexerSession is the property of the spawn shell messages
+// carrying the name of the multiplexer session the terminal attaches to
+const propertyMultiplexerSession = "multiplexer_session"
+
+var (
+	errMultiplexerDisabled    = errors.New("attaching the terminals to multiplexer sessions is disabled")
+	errMultiplexerRestricted  = errors.New("the restricted shells may not attach to multiplexer sessions")
+	errMultiplexerSessionName = errors.New("invalid multiplexer session name")
+
+	multiplexerSessionRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+)
+
+// shellQuote quotes s for the shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// multiplexerArgs returns the arguments which make the shell attach the
+// terminal to the named session of the multiplexer, creating the session
+// if it does not exist
+func (d *MenderShellDaemon) multiplexerArgs(name string) ([]string, error) {
+	if d.multiplexer.Type == "" {
+		return nil, errMultiplexerDisabled
+	}
+	if !multiplexerSessionRe.MatchString(name) {
+		return nil, errMultiplexerSessionName
+	}
+	path := shellQuote(d.multiplexer.Path)
+	var command string
+	switch d.multiplexer.Type {
+	case configuration.MultiplexerScreen:
+		// attach in multi display mode, so that the terminals share it
+		command = path + " -x " + name + " 2>/dev/null || exec " + path + " -S " + name
+	default:
+		command = "exec " + path + " new-session -A -s " + name
+	}
+	return []string{"-c", command}, nil
+}
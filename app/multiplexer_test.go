@@ -0,0 +1,120 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+func TestMultiplexerArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMultiplexerArgs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the fake multiplexers print their arguments, screen fails to
+	// attach to a session which does not exist
+	multiplexer := path.Join(dir, "fake multiplexer")
+	err = ioutil.WriteFile(multiplexer, []byte("#!/bin/sh\n"+
+		"[ \"$1\" = \"-x\" ] && exit 1\n"+
+		"echo \"$@\"\n"), 0755)
+	assert.NoError(t, err)
+
+	testCases := map[string]struct {
+		multiplexer config.MultiplexerConfig
+		name        string
+		output      string
+		err         error
+	}{
+		"tmux": {
+			multiplexer: config.MultiplexerConfig{Type: config.MultiplexerTmux, Path: multiplexer},
+			name:        "work",
+			output:      "new-session -A -s work",
+		},
+		"screen": {
+			multiplexer: config.MultiplexerConfig{Type: config.MultiplexerScreen, Path: multiplexer},
+			name:        "work",
+			output:      "-S work",
+		},
+		"disabled": {
+			name: "work",
+			err:  errMultiplexerDisabled,
+		},
+		"invalid name": {
+			multiplexer: config.MultiplexerConfig{Type: config.MultiplexerTmux, Path: multiplexer},
+			name:        "work; reboot",
+			err:         errMultiplexerSessionName,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					ShellCommand: "/bin/sh",
+					Multiplexer:  tc.multiplexer,
+				},
+			})
+			args, err := d.multiplexerArgs(tc.name)
+			assert.Equal(t, tc.err, err)
+			if tc.err != nil {
+				return
+			}
+			output, err := exec.Command("/bin/sh", args...).Output()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.output, strings.TrimSpace(string(output)))
+		})
+	}
+}
+
+func TestMenderShellSpawnShellMultiplexerRestricted(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+			Multiplexer: config.MultiplexerConfig{
+				Type: config.MultiplexerTmux,
+				Path: config.DefaultTmuxPath,
+			},
+			RestrictedShell: config.RestrictedShellConfig{
+				Shell: "/bin/rbash",
+				Users: []string{"support-user-id"},
+			},
+		},
+	})
+	sessionID := "multiplexer-restricted-session"
+	err := d.spawnShell(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeSpawnShell,
+			SessionID: sessionID,
+			Properties: map[string]interface{}{
+				"user_id":                  "support-user-id",
+				propertyMultiplexerSession: "work",
+			},
+		},
+	})
+	assert.Equal(t, errMultiplexerRestricted, err)
+	assert.Nil(t, session.MenderShellSessionGetById(sessionID))
+}
@@ -0,0 +1,46 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"github.com/mendersoftware/go-lib-micro/ws"
+
+	"github.com/mendersoftware/mender-connect/notify"
+)
+
+// messageTypeNotification is the control message type carrying the
+// notifications, the body is encoded with the negotiated codec
+const messageTypeNotification = "notification"
+
+// connectionNotifier writes the notifications on the connection
+type connectionNotifier struct {
+	d *MenderShellDaemon
+}
+
+func (n *connectionNotifier) Notify(sessionID string, notification *notify.Notification) error {
+	body, err := n.d.bodyCodec().Marshal(notification)
+	if err != nil {
+		return err
+	}
+	msg := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:      protoTypeControl,
+			MsgType:    messageTypeNotification,
+			SessionID:  sessionID,
+			Properties: map[string]interface{}{},
+		},
+		Body: body,
+	}
+	return n.d.sendQueued(msg)
+}
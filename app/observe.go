@@ -0,0 +1,94 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// Properties of the spawn shell messages asking to observe the terminal
+// of another session, or of a stream of it, instead of starting a shell
+const (
+	propertyObserveSession = "observe_session"
+	propertyObserveStream  = "observe_stream"
+)
+
+var (
+	errObserveDisabled = errors.New("observing the terminals is disabled")
+	errObserveDenied   = errors.New("the user may not observe the terminals")
+	// read-only, but the terminals of the others may show what the
+	// restricted shell is meant to keep from its users
+	errObserveRestricted = errors.New("the users of the restricted shell may not observe the terminals")
+)
+
+// mayObserve tells if the user may observe the terminals of the others
+func (d *MenderShellDaemon) mayObserve(userID string) error {
+	if !d.observe.Enabled {
+		return errObserveDisabled
+	}
+	if len(d.observe.Users) == 0 {
+		return nil
+	}
+	for _, user := range d.observe.Users {
+		if user == userID {
+			return nil
+		}
+	}
+	return errObserveDenied
+}
+
+// observeShell attaches the session of the message to the terminal of the
+// session given in the message properties, receiving its output only
+func (d *MenderShellDaemon) observeShell(message *ws.ProtoMsg, response *ws.ProtoMsg, target string) error {
+	userID := getUserIdFromMessage(message)
+	if err := d.mayObserve(userID); err != nil {
+		log.Warnf("refusing to let user %s of session %s observe session %s: %s",
+			userID, message.Header.SessionID, target, err.Error())
+		d.routeMessageResponse(response, err)
+		return err
+	}
+
+	if d.isRestricted(userID, getUserRolesFromMessage(message)) {
+		log.Warnf("refusing to let user %s of session %s observe session %s: %s",
+			userID, message.Header.SessionID, target, errObserveRestricted.Error())
+		d.routeMessageResponse(response, errObserveRestricted)
+		return errObserveRestricted
+	}
+
+	targetStream, _ := message.Header.Properties[propertyObserveStream].(string)
+	s := session.MenderShellSessionGetById(session.StreamKey(target, targetStream))
+	if s == nil {
+		d.routeMessageResponse(response, session.ErrSessionNotFound)
+		return session.ErrSessionNotFound
+	}
+	if err := d.runsAsRequested(message, s); err != nil {
+		log.Warnf("refusing to let user %s of session %s observe session %s: %s",
+			userID, message.Header.SessionID, target, err.Error())
+		d.routeMessageResponse(response, err)
+		return err
+	}
+	err := s.AddObserver(message.Header.SessionID, getStreamIdFromMessage(message), userID)
+	if err != nil {
+		err = errors.Wrap(err, "failed to observe the terminal")
+		d.routeMessageResponse(response, err)
+		return err
+	}
+	response.Body = []byte("Shell observed")
+	d.routeMessageResponse(response, nil)
+	return nil
+}
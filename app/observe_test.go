@@ -0,0 +1,104 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+func TestMayObserve(t *testing.T) {
+	testCases := map[string]struct {
+		observe config.ObserveConfig
+		userID  string
+		err     error
+	}{
+		"disabled": {
+			userID: "senior",
+			err:    errObserveDisabled,
+		},
+		"any user": {
+			observe: config.ObserveConfig{Enabled: true},
+			userID:  "senior",
+		},
+		"user allowed": {
+			observe: config.ObserveConfig{
+				Enabled: true,
+				Users:   []string{"lead", "senior"},
+			},
+			userID: "senior",
+		},
+		"user denied": {
+			observe: config.ObserveConfig{
+				Enabled: true,
+				Users:   []string{"lead"},
+			},
+			userID: "junior",
+			err:    errObserveDenied,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					ShellCommand: "/bin/sh",
+					Observe:      tc.observe,
+				},
+			})
+			assert.Equal(t, tc.err, d.mayObserve(tc.userID))
+		})
+	}
+}
+
+func TestMenderShellSpawnShellObserve(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+			Observe: config.ObserveConfig{
+				Enabled: true,
+				Users:   []string{"senior"},
+			},
+		},
+	})
+	sessionID := "observer-session"
+	message := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeSpawnShell,
+			SessionID: sessionID,
+			Properties: map[string]interface{}{
+				"user_id":              "junior",
+				propertyObserveSession: "observed-session",
+			},
+		},
+	}
+	assert.Equal(t, errObserveDenied, d.spawnShell(message))
+
+	// read-only, but still not for the restricted shell users
+	d.restrictedShell.Users = []string{"senior"}
+	message.Header.Properties["user_id"] = "senior"
+	assert.Equal(t, errObserveRestricted, d.spawnShell(message))
+	d.restrictedShell.Users = nil
+
+	assert.Equal(t, session.ErrSessionNotFound, d.spawnShell(message))
+	assert.Nil(t, session.MenderShellSessionGetById(sessionID))
+	assert.Nil(t, session.MenderShellSessionGetObserved(sessionID))
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	log "github.com/sirupsen/logrus"
+	"github.com/vmihailenco/msgpack"
+
+	"github.com/mendersoftware/mender-connect/connectionmanager"
+)
+
+// outbox holds the messages the device originates, e.g. the audit events
+// and the notifications, while the server is unreachable; they are sent,
+// in order, once the connection is back
+type outbox struct {
+	mutex    sync.Mutex
+	file     string
+	max      int
+	messages []*ws.ProtoMsg
+}
+
+// newOutbox returns an outbox holding up to max messages, kept in file
+// across restarts if given; the messages left in the file are loaded
+func newOutbox(file string, max int) (*outbox, error) {
+	o := &outbox{
+		file: file,
+		max:  max,
+	}
+	if file == "" {
+		return o, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return o, nil
+	} else if err != nil {
+		return o, err
+	}
+	if err = msgpack.Unmarshal(data, &o.messages); err != nil {
+		o.messages = nil
+		return o, err
+	}
+	o.trim()
+	return o, nil
+}
+
+// len returns the number of messages waiting
+func (o *outbox) len() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return len(o.messages)
+}
+
+// send writes msg with write unless older messages are waiting, or the
+// write fails; msg is queued then
+func (o *outbox) send(msg *ws.ProtoMsg, write func(*ws.ProtoMsg) error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if len(o.messages) == 0 {
+		err := write(msg)
+		if err == nil {
+			return
+		}
+		log.Debugf("outbox: queueing the %s message: %s", msg.Header.MsgType, err.Error())
+	}
+	o.messages = append(o.messages, msg)
+	o.trim()
+	o.save()
+}
+
+// flush writes the waiting messages with write, stopping at the first
+// failure; it returns the number of messages sent
+func (o *outbox) flush(write func(*ws.ProtoMsg) error) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	sent := 0
+	var err error
+	for _, msg := range o.messages {
+		if err = write(msg); err != nil {
+			break
+		}
+		sent++
+	}
+	if sent > 0 {
+		o.messages = o.messages[sent:]
+		o.save()
+	}
+	return sent, err
+}
+
+// trim drops the oldest messages beyond the capacity
+func (o *outbox) trim() {
+	if o.max > 0 && len(o.messages) > o.max {
+		dropped := len(o.messages) - o.max
+		o.messages = o.messages[dropped:]
+		log.Warnf("outbox: full, dropped the %d oldest messages", dropped)
+	}
+}
+
+// save replaces the file with the waiting messages
+func (o *outbox) save() {
+	if o.file == "" {
+		return
+	}
+	var err error
+	if len(o.messages) == 0 {
+		err = os.Remove(o.file)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		var data []byte
+		if data, err = msgpack.Marshal(o.messages); err == nil {
+			err = replaceFile(o.file, data, 0600)
+		}
+	}
+	if err != nil {
+		log.Errorf("outbox: failed to save the queue to %s: %s", o.file, err.Error())
+	}
+}
+
+// sendQueued sends the message the device originates to the server,
+// queueing it while the server is unreachable
+func (d *MenderShellDaemon) sendQueued(msg *ws.ProtoMsg) error {
+	if d.outbox == nil {
+		return connectionmanager.Write(ws.ProtoTypeShell, msg)
+	}
+	d.outbox.send(msg, func(msg *ws.ProtoMsg) error {
+		return connectionmanager.Write(ws.ProtoTypeShell, msg)
+	})
+	return nil
+}
+
+// flushOutbox sends the queued messages once connected
+func (d *MenderShellDaemon) flushOutbox() {
+	if d.outbox == nil || d.outbox.len() == 0 ||
+		!connectionmanager.GetStatus(ws.ProtoTypeShell).Connected {
+		return
+	}
+	sent, err := d.outbox.flush(func(msg *ws.ProtoMsg) error {
+		return connectionmanager.Write(ws.ProtoTypeShell, msg)
+	})
+	if sent > 0 {
+		log.Infof("outbox: sent %d queued messages", sent)
+	}
+	if err != nil {
+		log.Debugf("outbox: %d messages left: %s", d.outbox.len(), err.Error())
+	}
+}
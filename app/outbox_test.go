@@ -0,0 +1,86 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "queue")
+
+	var sent []string
+	offline := errors.New("offline")
+	online := false
+	write := func(msg *ws.ProtoMsg) error {
+		if !online {
+			return offline
+		}
+		sent = append(sent, msg.Header.SessionID)
+		return nil
+	}
+	message := func(sessionID string) *ws.ProtoMsg {
+		return &ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     protoTypeControl,
+				MsgType:   messageTypeAudit,
+				SessionID: sessionID,
+			},
+			Body: []byte(sessionID),
+		}
+	}
+
+	o, err := newOutbox(file, 2)
+	assert.NoError(t, err)
+	o.send(message("1"), write)
+	o.send(message("2"), write)
+	o.send(message("3"), write)
+	assert.Equal(t, 2, o.len())
+	assert.Empty(t, sent)
+
+	// the queue survives a restart
+	o, err = newOutbox(file, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, o.len())
+
+	// sent after the older messages
+	online = true
+	o.send(message("4"), write)
+	assert.Empty(t, sent)
+	n, err := o.flush(write)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"3", "4"}, sent)
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+
+	o.send(message("5"), write)
+	assert.Equal(t, []string{"3", "4", "5"}, sent)
+	assert.Equal(t, 0, o.len())
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte("garbage"), 0600))
+	o, err = newOutbox(file, 2)
+	assert.Error(t, err)
+	assert.Equal(t, 0, o.len())
+}
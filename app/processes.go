@@ -0,0 +1,187 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	configuration "github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/procps"
+)
+
+// Message types of the process management protocol; the responses carry
+// the type of the request
+const (
+	// lists the processes, the response body is a list of procps.Process
+	messageTypeListProcesses = "list"
+	// sends a signal to processes, the body is a signalRequest and the
+	// response body a list of signalResult
+	messageTypeSignalProcesses = "signal"
+)
+
+var (
+	errSignalNotAllowed   = errors.New("the signal may not be sent")
+	errProcessNotAllowed  = errors.New("the processes of the user may not be signaled")
+	errProcessNotSignaled = errors.New("the daemon may not signal itself")
+)
+
+// signalRequest is the body of the messageTypeSignalProcesses messages
+type signalRequest struct {
+	Pids []int `json:"pids" msgpack:"pids"`
+	// Name of the signal, with or without the SIG prefix
+	Signal string `json:"signal" msgpack:"signal"`
+}
+
+// signalResult tells if a process was signaled
+type signalResult struct {
+	Pid   int    `json:"pid" msgpack:"pid"`
+	Error string `json:"error,omitempty" msgpack:"error,omitempty"`
+}
+
+// isSignalAllowed tells if the configuration allows sending the signal
+func (d *MenderShellDaemon) isSignalAllowed(signal syscall.Signal) bool {
+	for _, name := range d.processes.AllowedSignals {
+		if configuration.SignalByName(name) == signal {
+			return true
+		}
+	}
+	return false
+}
+
+// isProcessUserAllowed tells if the processes of the user may be signaled;
+// only the users listed in the configuration are, none if it is empty
+func (d *MenderShellDaemon) isProcessUserAllowed(uid uint32) bool {
+	for _, name := range d.processes.AllowedUsers {
+		if u, err := user.Lookup(name); err == nil && u.Uid == strconv.FormatUint(uint64(uid), 10) {
+			return true
+		}
+	}
+	return false
+}
+
+// signalProcesses sends the signal to each of the processes the
+// configuration allows signaling, returning how it went for each of them
+func (d *MenderShellDaemon) signalProcesses(pids []int, signal syscall.Signal) []signalResult {
+	results := make([]signalResult, 0, len(pids))
+	for _, pid := range pids {
+		result := signalResult{Pid: pid}
+		if err := d.signalProcess(pid, signal); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (d *MenderShellDaemon) signalProcess(pid int, signal syscall.Signal) error {
+	if pid <= 0 {
+		return errors.Errorf("invalid pid %d", pid)
+	}
+	if pid == os.Getpid() {
+		return errProcessNotSignaled
+	}
+	// the init process may only be signaled when root is listed, whoever
+	// owns it (e.g. in a user namespace)
+	if pid == 1 && !d.isProcessUserAllowed(0) {
+		return errProcessNotAllowed
+	}
+	uid, err := procps.ProcessUid(pid)
+	if err != nil {
+		return errors.Errorf("no process %d", pid)
+	}
+	if !d.isProcessUserAllowed(uid) {
+		return errProcessNotAllowed
+	}
+	return syscall.Kill(pid, signal)
+}
+
+// routeMessageListProcesses answers with the processes of the device
+func (d *MenderShellDaemon) routeMessageListProcesses(message *ws.ProtoMsg) error {
+	response := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     message.Header.Proto,
+			MsgType:   message.Header.MsgType,
+			SessionID: message.Header.SessionID,
+			Properties: map[string]interface{}{
+				"status": wsshell.NormalMessage,
+			},
+		},
+	}
+	copyStreamId(response, message)
+
+	processes, err := procps.ListProcesses()
+	if err == nil {
+		response.Body, err = d.bodyCodec().Marshal(processes)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "failed to list the processes")
+		d.routeMessageResponse(response, err)
+		return err
+	}
+	d.routeMessageResponse(response, nil)
+	return nil
+}
+
+// routeMessageSignalProcesses sends a signal to the processes, if the
+// configuration allows the signal, and answers how it went for each one
+func (d *MenderShellDaemon) routeMessageSignalProcesses(message *ws.ProtoMsg) error {
+	response := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     message.Header.Proto,
+			MsgType:   message.Header.MsgType,
+			SessionID: message.Header.SessionID,
+			Properties: map[string]interface{}{
+				"status": wsshell.NormalMessage,
+			},
+		},
+	}
+	copyStreamId(response, message)
+
+	request := &signalRequest{}
+	if err := d.bodyCodec().Unmarshal(message.Body, request); err != nil {
+		err = errors.Wrap(err, "malformed signal message")
+		d.routeMessageResponse(response, err)
+		return err
+	}
+	signal := configuration.SignalByName(request.Signal)
+	if signal == 0 || !d.isSignalAllowed(signal) {
+		d.routeMessageResponse(response, errSignalNotAllowed)
+		return errSignalNotAllowed
+	}
+
+	results := d.signalProcesses(request.Pids, signal)
+	log.WithFields(log.Fields{
+		"session_id": message.Header.SessionID,
+		"user_id":    getUserIdFromMessage(message),
+	}).Infof("sent SIG%s to the processes %v",
+		strings.TrimPrefix(strings.ToUpper(request.Signal), "SIG"), request.Pids)
+
+	body, err := d.bodyCodec().Marshal(results)
+	if err != nil {
+		d.routeMessageResponse(response, err)
+		return err
+	}
+	response.Body = body
+	d.routeMessageResponse(response, nil)
+	return nil
+}
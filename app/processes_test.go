@@ -0,0 +1,180 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"syscall"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack"
+
+	"github.com/mendersoftware/mender-connect/config"
+)
+
+func TestProcessesProtocolSupported(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+		},
+	})
+	assert.False(t, d.isProtocolSupported(config.ProtoTypeProcesses))
+	assert.NotContains(t, d.supportedProtocols(), config.ProtoTypeProcesses)
+
+	d = NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+			Processes: config.ProcessesConfig{
+				Enabled: true,
+			},
+		},
+	})
+	assert.True(t, d.isProtocolSupported(config.ProtoTypeProcesses))
+	assert.Contains(t, d.supportedProtocols(), config.ProtoTypeProcesses)
+	assert.Equal(t, ErrProtoHandlerReserved, RegisterProtoHandler(config.ProtoTypeProcesses, nil))
+
+	err := d.routeMessage(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:   config.ProtoTypeProcesses,
+			MsgType: messageTypeListProcesses,
+		},
+	})
+	assert.NoError(t, err)
+}
+
+func TestSignalProcesses(t *testing.T) {
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+
+	testCases := map[string]struct {
+		processes config.ProcessesConfig
+		signal    string
+		err       error
+		killed    bool
+	}{
+		"allowed": {
+			processes: config.ProcessesConfig{
+				Enabled:        true,
+				AllowedSignals: []string{"TERM"},
+				AllowedUsers:   []string{currentUser.Username},
+			},
+			signal: "SIGTERM",
+			killed: true,
+		},
+		"no user allowed": {
+			processes: config.ProcessesConfig{
+				Enabled:        true,
+				AllowedSignals: []string{"TERM"},
+			},
+			signal: "TERM",
+		},
+		"signal not allowed": {
+			processes: config.ProcessesConfig{
+				Enabled:        true,
+				AllowedSignals: []string{"HUP"},
+			},
+			signal: "KILL",
+			err:    errSignalNotAllowed,
+		},
+		"unknown signal": {
+			processes: config.ProcessesConfig{
+				Enabled:        true,
+				AllowedSignals: []string{"TERM"},
+			},
+			signal: "BOGUS",
+			err:    errSignalNotAllowed,
+		},
+		"user allowed": {
+			processes: config.ProcessesConfig{
+				Enabled:        true,
+				AllowedSignals: []string{"term"},
+				AllowedUsers:   []string{currentUser.Username},
+			},
+			signal: "TERM",
+			killed: true,
+		},
+		"user not allowed": {
+			processes: config.ProcessesConfig{
+				Enabled:        true,
+				AllowedSignals: []string{"TERM"},
+				AllowedUsers:   []string{"nobody"},
+			},
+			signal: "TERM",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			cmd := exec.Command("sleep", "16")
+			assert.NoError(t, cmd.Start())
+			defer func() {
+				_ = cmd.Process.Kill()
+			}()
+
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					ShellCommand: "/bin/sh",
+					User:         "mender",
+					Processes:    tc.processes,
+				},
+			})
+			body, _ := msgpack.Marshal(&signalRequest{
+				Pids:   []int{cmd.Process.Pid},
+				Signal: tc.signal,
+			})
+			err := d.routeMessage(&ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:   config.ProtoTypeProcesses,
+					MsgType: messageTypeSignalProcesses,
+				},
+				Body: body,
+			})
+			assert.Equal(t, tc.err, err)
+
+			_ = cmd.Process.Kill()
+			err = cmd.Wait()
+			if tc.killed {
+				assert.EqualError(t, err, "signal: terminated")
+			} else {
+				assert.EqualError(t, err, "signal: killed")
+			}
+		})
+	}
+}
+
+func TestSignalProcessesResults(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+			Processes: config.ProcessesConfig{
+				Enabled:        true,
+				AllowedSignals: []string{"TERM"},
+				AllowedUsers:   []string{"nobody"},
+			},
+		},
+	})
+	results := d.signalProcesses([]int{os.Getpid(), -1, 1, 1 << 30}, syscall.SIGTERM)
+	assert.Equal(t, []signalResult{
+		{Pid: os.Getpid(), Error: errProcessNotSignaled.Error()},
+		{Pid: -1, Error: "invalid pid -1"},
+		{Pid: 1, Error: errProcessNotAllowed.Error()},
+		{Pid: 1 << 30, Error: "no process 1073741824"},
+	}, results)
+}
@@ -0,0 +1,152 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// idle time after which the bucket of a session is forgotten, once
+// there are more than maxRateLimitBuckets of them
+const (
+	rateLimitBucketIdle = time.Minute
+	maxRateLimitBuckets = 1024
+)
+
+// rateLimitBucket is a token bucket refilled at the allowed rate,
+// holding at most one second worth of messages
+type rateLimitBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	// a dropped message was reported since the last allowed one
+	reported bool
+}
+
+// sessionProtoKey identifies a protocol within a session
+type sessionProtoKey struct {
+	session string
+	proto   ws.ProtoType
+}
+
+// rateLimiter caps the number of messages per second each session may
+// send for a protocol
+type rateLimiter struct {
+	mutex sync.Mutex
+	// messages per second, 0 means no limit
+	rate uint32
+	// per protocol overrides of rate
+	protoRates map[ws.ProtoType]uint32
+	buckets    map[sessionProtoKey]*rateLimitBucket
+	now        func() time.Time
+}
+
+func newRateLimiter(rate uint32, protoRates map[ws.ProtoType]uint32) *rateLimiter {
+	return &rateLimiter{
+		rate:       rate,
+		protoRates: protoRates,
+		buckets:    map[sessionProtoKey]*rateLimitBucket{},
+		now:        time.Now,
+	}
+}
+
+func (l *rateLimiter) protoRate(proto ws.ProtoType) uint32 {
+	if rate, ok := l.protoRates[proto]; ok {
+		return rate
+	}
+	return l.rate
+}
+
+// allow tells if the session may send one more message of the protocol
+func (l *rateLimiter) allow(session string, proto ws.ProtoType) bool {
+	if l == nil {
+		return true
+	}
+	rate := l.protoRate(proto)
+	if rate == 0 {
+		return true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	key := sessionProtoKey{session: session, proto: proto}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.prune(now)
+		}
+		bucket = &rateLimitBucket{
+			tokens:    float64(rate),
+			updatedAt: now,
+		}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.updatedAt).Seconds() * float64(rate)
+	if bucket.tokens > float64(rate) {
+		bucket.tokens = float64(rate)
+	}
+	bucket.updatedAt = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	bucket.reported = false
+	return true
+}
+
+// report tells if a message the session was not allowed to send should
+// be answered with an error; only the first one dropped since the last
+// allowed message is, the others are dropped silently
+func (l *rateLimiter) report(session string, proto ws.ProtoType) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	bucket, ok := l.buckets[sessionProtoKey{session: session, proto: proto}]
+	if !ok || bucket.reported {
+		return false
+	}
+	bucket.reported = true
+	return true
+}
+
+// forget drops the buckets of the session
+func (l *rateLimiter) forget(session string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for key := range l.buckets {
+		if key.session == session {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// forgetSessionRate drops the rate limits of a session when it closes
+func (d *MenderShellDaemon) forgetSessionRate(event string, s *session.MenderShellSession, proto ws.ProtoType) {
+	if event == session.HookEventSessionClose {
+		d.rateLimiter.forget(s.GetId())
+	}
+}
+
+func (l *rateLimiter) prune(now time.Time) {
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.updatedAt) > rateLimitBucketIdle {
+			delete(l.buckets, key)
+		}
+	}
+}
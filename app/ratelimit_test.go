@@ -0,0 +1,109 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(2, map[ws.ProtoType]uint32{ws.ProtoType(3): 0})
+	l.now = func() time.Time {
+		return now
+	}
+
+	assert.True(t, l.allow("session-id", ws.ProtoTypeShell))
+	assert.True(t, l.allow("session-id", ws.ProtoTypeShell))
+	assert.False(t, l.allow("session-id", ws.ProtoTypeShell))
+	assert.True(t, l.report("session-id", ws.ProtoTypeShell))
+	assert.False(t, l.allow("session-id", ws.ProtoTypeShell))
+	assert.False(t, l.report("session-id", ws.ProtoTypeShell))
+	assert.True(t, l.allow("other-session-id", ws.ProtoTypeShell))
+	for i := 0; i < 10; i++ {
+		assert.True(t, l.allow("session-id", ws.ProtoType(3)))
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, l.allow("session-id", ws.ProtoTypeShell))
+	assert.False(t, l.allow("session-id", ws.ProtoTypeShell))
+	assert.True(t, l.report("session-id", ws.ProtoTypeShell))
+
+	l.forget("session-id")
+	assert.True(t, l.allow("session-id", ws.ProtoTypeShell))
+
+	var nilLimiter *rateLimiter
+	assert.True(t, nilLimiter.allow("session-id", ws.ProtoTypeShell))
+}
+
+func TestRouteMessageRateLimited(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+			Sessions: config.SessionsConfig{
+				MaxMessagesPerSecond: 1,
+			},
+		},
+	})
+	msg := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeShellCommand,
+			SessionID: "rate-limited-session-id",
+		},
+	}
+	err := d.routeMessage(msg)
+	assert.Equal(t, ErrorCodeSessionNotFound, errorCode(err))
+	err = d.routeMessage(msg)
+	assert.EqualError(t, err, "too many messages of protocol 1, message dropped")
+	assert.Equal(t, ErrorCodeRateLimited, errorCode(err))
+}
+
+func TestRateLimiterSessionClosed(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+			Sessions: config.SessionsConfig{
+				MaxMessagesPerSecond: 1,
+			},
+		},
+	})
+	defer d.removeListeners()
+
+	s, err := session.NewMenderShellSession("rate-session-id", "rate-user-id",
+		session.NoExpirationTimeout, session.NoExpirationTimeout)
+	assert.NoError(t, err)
+	assert.True(t, d.rateLimiter.allow(s.GetId(), ws.ProtoTypeShell))
+	assert.False(t, d.rateLimiter.allow(s.GetId(), ws.ProtoTypeShell))
+	assert.NoError(t, session.MenderShellDeleteById(s.GetId()))
+	assert.True(t, d.rateLimiter.allow(s.GetId(), ws.ProtoTypeShell))
+
+	// no longer notified once the listeners are removed
+	d.removeListeners()
+	s, err = session.NewMenderShellSession("rate-session-id", "rate-user-id",
+		session.NoExpirationTimeout, session.NoExpirationTimeout)
+	assert.NoError(t, err)
+	assert.NoError(t, session.MenderShellDeleteById(s.GetId()))
+	assert.False(t, d.rateLimiter.allow(s.GetId(), ws.ProtoTypeShell))
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io"
+	"os"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/connectionmanager"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// messageTypeRecording is the control message type carrying the chunks of
+// the terminal recordings, uploaded when the sessions close
+const messageTypeRecording = "recording"
+
+// Properties of the messageTypeRecording messages
+const (
+	propertyRecordingFormat = "format"
+	propertyRecordingOffset = "offset"
+	propertyRecordingEOF    = "eof"
+)
+
+// size of the chunks the recordings are uploaded in
+var recordingChunkSize = 16 * 1024
+
+// sendRecording sends the recording at path in chunks, the last one
+// flagged with propertyRecordingEOF
+func sendRecording(path string, sessionID string, streamID string, write func(msg *ws.ProtoMsg) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buffer := make([]byte, recordingChunkSize)
+	offset := int64(0)
+	for {
+		n, err := io.ReadFull(file, buffer)
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			return err
+		}
+		msg := &ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     protoTypeControl,
+				MsgType:   messageTypeRecording,
+				SessionID: sessionID,
+				Properties: map[string]interface{}{
+					propertyRecordingFormat: session.RecordingFormat,
+					propertyRecordingOffset: offset,
+					propertyRecordingEOF:    eof,
+				},
+			},
+			Body: append([]byte{}, buffer[:n]...),
+		}
+		if streamID != "" {
+			msg.Header.Properties[session.PropertyStreamID] = streamID
+		}
+		if err := write(msg); err != nil {
+			return err
+		}
+		if eof {
+			return nil
+		}
+		offset += int64(n)
+	}
+}
+
+// uploadRecording uploads the recording of a closed session to the server,
+// removing it from the device once sent
+func (d *MenderShellDaemon) uploadRecording(event string, s *session.MenderShellSession, proto ws.ProtoType) {
+	path := s.GetRecordingPath()
+	if event != session.HookEventSessionClose || path == "" {
+		return
+	}
+	sessionID, streamID := s.GetSessionId(), s.GetStreamId()
+	go func() {
+		err := sendRecording(path, sessionID, streamID, func(msg *ws.ProtoMsg) error {
+			return connectionmanager.Write(ws.ProtoTypeShell, msg)
+		})
+		if err != nil {
+			log.Errorf("failed to upload the recording %s of session %s: %s", path, sessionID, err.Error())
+			return
+		}
+		log.Infof("uploaded the recording %s of session %s", path, sessionID)
+		if err = os.Remove(path); err != nil {
+			log.Errorf("failed to remove the uploaded recording %s: %s", path, err.Error())
+		}
+	}()
+}
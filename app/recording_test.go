@@ -0,0 +1,69 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+func TestSendRecording(t *testing.T) {
+	defer func(size int) {
+		recordingChunkSize = size
+	}(recordingChunkSize)
+	recordingChunkSize = 4
+
+	file, err := ioutil.TempFile("", "TestSendRecording")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString("0123456789")
+	file.Close()
+
+	messages := []*ws.ProtoMsg{}
+	err = sendRecording(file.Name(), "recording-session-id", "stream-id", func(msg *ws.ProtoMsg) error {
+		messages = append(messages, msg)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	if assert.Len(t, messages, 3) {
+		body := []byte{}
+		for i, msg := range messages {
+			assert.Equal(t, protoTypeControl, msg.Header.Proto)
+			assert.Equal(t, messageTypeRecording, msg.Header.MsgType)
+			assert.Equal(t, "recording-session-id", msg.Header.SessionID)
+			assert.Equal(t, "stream-id", msg.Header.Properties[session.PropertyStreamID])
+			assert.Equal(t, session.RecordingFormat, msg.Header.Properties[propertyRecordingFormat])
+			assert.Equal(t, int64(i*4), msg.Header.Properties[propertyRecordingOffset])
+			assert.Equal(t, i == 2, msg.Header.Properties[propertyRecordingEOF])
+			body = append(body, msg.Body...)
+		}
+		assert.Equal(t, "0123456789", string(body))
+	}
+
+	err = sendRecording(file.Name(), "recording-session-id", "", func(msg *ws.ProtoMsg) error {
+		return errors.New("connection closed")
+	})
+	assert.EqualError(t, err, "connection closed")
+
+	err = sendRecording("/does/not/exist", "recording-session-id", "", nil)
+	assert.Error(t, err)
+}
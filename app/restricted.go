@@ -0,0 +1,55 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"github.com/mendersoftware/go-lib-micro/ws"
+)
+
+// propertyUserRoles is the property of the spawn shell messages carrying
+// the roles of the user, which may select the restricted shell
+const propertyUserRoles = "user_roles"
+
+func getUserRolesFromMessage(message *ws.ProtoMsg) []string {
+	roles := []string{}
+	switch values := message.Header.Properties[propertyUserRoles].(type) {
+	case []string:
+		roles = append(roles, values...)
+	case []interface{}:
+		for _, value := range values {
+			if role, ok := value.(string); ok {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+// isRestricted tells if the user, having the roles, gets the restricted
+// shell instead of a full one
+func (d *MenderShellDaemon) isRestricted(userID string, roles []string) bool {
+	for _, restrictedUserID := range d.restrictedShell.Users {
+		if userID == restrictedUserID {
+			return true
+		}
+	}
+	for _, restrictedRole := range d.restrictedShell.Roles {
+		for _, role := range roles {
+			if role == restrictedRole {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+)
+
+func TestGetUserRolesFromMessage(t *testing.T) {
+	testCases := map[string]struct {
+		roles    interface{}
+		expected []string
+	}{
+		"decoded": {
+			roles:    []interface{}{"support", 1, "viewer"},
+			expected: []string{"support", "viewer"},
+		},
+		"strings": {
+			roles:    []string{"admin"},
+			expected: []string{"admin"},
+		},
+		"none": {
+			expected: []string{},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, getUserRolesFromMessage(&ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Properties: map[string]interface{}{
+						propertyUserRoles: tc.roles,
+					},
+				},
+			}))
+		})
+	}
+}
+
+func TestIsRestricted(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+			RestrictedShell: config.RestrictedShellConfig{
+				Shell: "/bin/rbash",
+				Users: []string{"support-user-id"},
+				Roles: []string{"support"},
+			},
+		},
+	})
+	testCases := map[string]struct {
+		userID     string
+		roles      []string
+		restricted bool
+	}{
+		"restricted user": {
+			userID:     "support-user-id",
+			restricted: true,
+		},
+		"restricted role": {
+			userID:     "other-user-id",
+			roles:      []string{"viewer", "support"},
+			restricted: true,
+		},
+		"not restricted": {
+			userID: "admin-user-id",
+			roles:  []string{"admin"},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.restricted, d.isRestricted(tc.userID, tc.roles))
+		})
+	}
+}
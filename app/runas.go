@@ -0,0 +1,98 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"os/user"
+	"strconv"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// propertyRunAsUser is the property of the spawn shell messages carrying
+// the local user the shell should run as, instead of User
+const propertyRunAsUser = "run_as_user"
+
+var errRunAsUserDenied = errors.New("the shell may not run as the requested user")
+
+// runAsUser holds the credentials and home of the local user a shell runs as
+type runAsUser struct {
+	uid     uint64
+	gid     uint64
+	homeDir string
+}
+
+func lookupRunAsUser(name string) (*runAsUser, error) {
+	u, err := user.Lookup(name)
+	if err == nil && u == nil {
+		return nil, errors.New("unknown error while getting a user id")
+	}
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &runAsUser{
+		uid:     uid,
+		gid:     gid,
+		homeDir: u.HomeDir,
+	}, nil
+}
+
+// runAsUserFor returns the local user the shell should run as: User if
+// name is empty or is User, otherwise name if it is listed in
+// AllowedRunAsUsers; any other user is denied
+func (d *MenderShellDaemon) runAsUserFor(name string) (*runAsUser, error) {
+	if name == "" || name == d.username {
+		return &runAsUser{
+			uid:     d.uid,
+			gid:     d.gid,
+			homeDir: d.homeDir,
+		}, nil
+	}
+	for _, allowed := range d.allowedRunAsUsers {
+		if name == allowed {
+			runAs, err := lookupRunAsUser(name)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to look up the user %s", name)
+			}
+			return runAs, nil
+		}
+	}
+	return nil, errRunAsUserDenied
+}
+
+// runsAsRequested tells if the shell of s, to be taken over or observed
+// by the session of the message, runs as the user a shell spawned by the
+// message would run as; the terminals of the other users are denied
+func (d *MenderShellDaemon) runsAsRequested(message *ws.ProtoMsg, s *session.MenderShellSession) error {
+	runAsUserName, _ := message.Header.Properties[propertyRunAsUser].(string)
+	runAs, err := d.runAsUserFor(runAsUserName)
+	if err != nil {
+		return err
+	}
+	if uint64(s.GetShellUid()) != runAs.uid {
+		return errRunAsUserDenied
+	}
+	return nil
+}
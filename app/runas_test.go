@@ -0,0 +1,121 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"os/user"
+	"strconv"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+func TestRunAsUserFor(t *testing.T) {
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Fatalf("cant get current user: %s", err.Error())
+	}
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+
+	testCases := map[string]struct {
+		allowed []string
+		name    string
+		runAs   *runAsUser
+		err     error
+	}{
+		"default": {
+			runAs: &runAsUser{uid: 4321, gid: 4321, homeDir: "/home/mender"},
+		},
+		"default by name": {
+			name:  "mender",
+			runAs: &runAsUser{uid: 4321, gid: 4321, homeDir: "/home/mender"},
+		},
+		"allowed": {
+			allowed: []string{"nobody", currentUser.Username},
+			name:    currentUser.Username,
+			runAs:   &runAsUser{uid: uid, homeDir: currentUser.HomeDir},
+		},
+		"denied by default": {
+			name: currentUser.Username,
+			err:  errRunAsUserDenied,
+		},
+		"not listed": {
+			allowed: []string{"nobody"},
+			name:    currentUser.Username,
+			err:     errRunAsUserDenied,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					ShellCommand:      "/bin/sh",
+					User:              "mender",
+					AllowedRunAsUsers: tc.allowed,
+				},
+			})
+			d.uid, d.gid, d.homeDir = 4321, 4321, "/home/mender"
+			runAs, err := d.runAsUserFor(tc.name)
+			assert.Equal(t, tc.err, err)
+			if tc.runAs != nil && assert.NotNil(t, runAs) {
+				assert.Equal(t, tc.runAs.uid, runAs.uid)
+				assert.Equal(t, tc.runAs.homeDir, runAs.homeDir)
+				if tc.runAs.gid != 0 {
+					assert.Equal(t, tc.runAs.gid, runAs.gid)
+				}
+			}
+		})
+	}
+}
+
+func TestRunAsUserForUnknownUser(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand:      "/bin/sh",
+			User:              "mender",
+			AllowedRunAsUsers: []string{"mender-connect-no-such-user"},
+		},
+	})
+	_, err := d.runAsUserFor("mender-connect-no-such-user")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to look up the user mender-connect-no-such-user")
+}
+
+func TestMenderShellSpawnShellRunAsUserDenied(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+		},
+	})
+	err := d.routeMessageSpawnShell(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeSpawnShell,
+			SessionID: "run-as-session-id",
+			Properties: map[string]interface{}{
+				"user_id":         "run-as-user-id",
+				propertyRunAsUser: "root",
+			},
+		},
+	})
+	assert.Equal(t, errRunAsUserDenied, err)
+	assert.Equal(t, ErrorCodeRunAsUserDenied, errorCode(err))
+	assert.Nil(t, session.MenderShellSessionGetById("run-as-session-id"))
+}
@@ -0,0 +1,144 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package sessiontest helps unit testing the protocol handlers without a
+// connection to the server: Recorder is a ResponseWriter recording the
+// messages of the handler, NewMessage builds the messages sent to it and
+// Session runs a scripted exchange with a handler.
+package sessiontest
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/app"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// Ids of the session the messages built by NewMessage belong to
+const (
+	SessionID = "sessiontest-session-id"
+	UserID    = "sessiontest-user-id"
+)
+
+// Recorder is a ResponseWriter recording the messages written to it
+type Recorder struct {
+	mutex    sync.Mutex
+	messages []*ws.ProtoMsg
+	// Err, if set, is returned by WriteProtoMsg, e.g. to simulate a
+	// broken connection
+	Err error
+}
+
+// NewRecorder returns an empty Recorder
+func NewRecorder() *Recorder {
+	return &Recorder{
+		messages: []*ws.ProtoMsg{},
+	}
+}
+
+// WriteProtoMsg records msg
+func (r *Recorder) WriteProtoMsg(msg *ws.ProtoMsg) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	r.messages = append(r.messages, msg)
+	return nil
+}
+
+// Messages returns the messages recorded so far
+func (r *Recorder) Messages() []*ws.ProtoMsg {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]*ws.ProtoMsg{}, r.messages...)
+}
+
+// Reset forgets the recorded messages, returning them
+func (r *Recorder) Reset() []*ws.ProtoMsg {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	messages := r.messages
+	r.messages = []*ws.ProtoMsg{}
+	return messages
+}
+
+// NewMessage builds a message of the SessionID session, sent by UserID
+func NewMessage(proto ws.ProtoType, msgType string, body []byte) *ws.ProtoMsg {
+	return &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     proto,
+			MsgType:   msgType,
+			SessionID: SessionID,
+			Properties: map[string]interface{}{
+				"user_id": UserID,
+			},
+		},
+		Body: body,
+	}
+}
+
+// Step is a message sent to the handler and the expected outcome
+type Step struct {
+	// Message served to the handler
+	Message *ws.ProtoMsg
+	// Err is the error ServeProtoMsg is expected to return
+	Err error
+	// Check, if set, verifies the messages the handler wrote while
+	// serving Message
+	Check func(t *testing.T, written []*ws.ProtoMsg)
+}
+
+// Session is a scripted exchange with a handler
+type Session struct {
+	// Constructor of the handler under test
+	Constructor app.Constructor
+	// Steps served to the handler, in order
+	Steps []Step
+}
+
+// Run creates the handler and serves it the steps, stopping after the one
+// returning ErrProtoHandlerDone; the handler is closed at the end
+func (s *Session) Run(t *testing.T) {
+	if len(s.Steps) == 0 {
+		t.Fatal("sessiontest: no steps to run")
+	}
+	proto := s.Steps[0].Message.Header.Proto
+	handler := s.Constructor(session.NewLogger(SessionID, "", UserID, proto))
+	defer func() {
+		assert.NoError(t, handler.Close(), "closing the handler")
+	}()
+
+	w := NewRecorder()
+	for i, step := range s.Steps {
+		err := handler.ServeProtoMsg(step.Message, w)
+		if step.Err != nil {
+			assert.EqualError(t, err, step.Err.Error(), "step %d", i)
+		} else {
+			assert.NoError(t, err, "step %d", i)
+		}
+		written := w.Reset()
+		if step.Check != nil {
+			step.Check(t, written)
+		}
+		if err == app.ErrProtoHandlerDone {
+			assert.Equal(t, len(s.Steps)-1, i, "the handler is done before the last step")
+			return
+		}
+	}
+}
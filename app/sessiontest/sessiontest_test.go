@@ -0,0 +1,108 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package sessiontest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/app"
+)
+
+const protoEcho = ws.ProtoType(0x200)
+
+// echoHandler writes back the body of the "echo" messages
+type echoHandler struct {
+	logger *log.Entry
+	closed bool
+}
+
+func (h *echoHandler) ServeProtoMsg(msg *ws.ProtoMsg, w app.ResponseWriter) error {
+	switch msg.Header.MsgType {
+	case "echo":
+		return w.WriteProtoMsg(&ws.ProtoMsg{
+			Header: msg.Header,
+			Body:   msg.Body,
+		})
+	case "bye":
+		return app.ErrProtoHandlerDone
+	}
+	return errors.New("unknown message type " + msg.Header.MsgType)
+}
+
+func (h *echoHandler) Close() error {
+	h.closed = true
+	return nil
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder()
+	msg := NewMessage(protoEcho, "echo", []byte("hello"))
+	assert.NoError(t, r.WriteProtoMsg(msg))
+	assert.Equal(t, []*ws.ProtoMsg{msg}, r.Messages())
+	assert.Equal(t, []*ws.ProtoMsg{msg}, r.Reset())
+	assert.Empty(t, r.Messages())
+
+	r.Err = errors.New("broken pipe")
+	assert.EqualError(t, r.WriteProtoMsg(msg), "broken pipe")
+	assert.Empty(t, r.Messages())
+}
+
+func TestNewMessage(t *testing.T) {
+	msg := NewMessage(protoEcho, "echo", []byte("hello"))
+	assert.Equal(t, protoEcho, msg.Header.Proto)
+	assert.Equal(t, "echo", msg.Header.MsgType)
+	assert.Equal(t, SessionID, msg.Header.SessionID)
+	assert.Equal(t, UserID, msg.Header.Properties["user_id"])
+	assert.Equal(t, []byte("hello"), msg.Body)
+}
+
+func TestSessionRun(t *testing.T) {
+	handler := &echoHandler{}
+	session := &Session{
+		Constructor: func(logger *log.Entry) app.ProtoHandler {
+			handler.logger = logger
+			return handler
+		},
+		Steps: []Step{
+			{
+				Message: NewMessage(protoEcho, "echo", []byte("hello")),
+				Check: func(t *testing.T, written []*ws.ProtoMsg) {
+					if assert.Len(t, written, 1) {
+						assert.Equal(t, []byte("hello"), written[0].Body)
+					}
+				},
+			},
+			{
+				Message: NewMessage(protoEcho, "unknown", nil),
+				Err:     errors.New("unknown message type unknown"),
+				Check: func(t *testing.T, written []*ws.ProtoMsg) {
+					assert.Empty(t, written)
+				},
+			},
+			{
+				Message: NewMessage(protoEcho, "bye", nil),
+				Err:     app.ErrProtoHandlerDone,
+			},
+		},
+	}
+	session.Run(t)
+	assert.True(t, handler.closed)
+	assert.Equal(t, SessionID, handler.logger.Data["session_id"])
+	assert.Equal(t, UserID, handler.logger.Data["user_id"])
+}
@@ -0,0 +1,203 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/connectionmanager"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// States of the connection reported in the status file
+const (
+	statusConnected    = "connected"
+	statusDisconnected = "disconnected"
+	statusStopped      = "stopped"
+)
+
+// Default interval between the writes of the status file
+const defaultStatusFileInterval = 10 * time.Second
+
+// connectionStatus is the content of the status file, for the monitoring
+// agents to check the connectivity without parsing the logs
+type connectionStatus struct {
+	State           string `json:"state"`
+	ServerURL       string `json:"server_url,omitempty"`
+	Since           string `json:"since,omitempty"`
+	LastError       string `json:"last_error,omitempty"`
+	LastErrorAt     string `json:"last_error_at,omitempty"`
+	LastErrorReason string `json:"last_error_reason,omitempty"`
+	UptimeSeconds   int64  `json:"uptime_seconds"`
+	Sessions        int    `json:"sessions"`
+	UpdatedAt       string `json:"updated_at"`
+	// the bandwidth budget of the hour or of the day is used up
+	BandwidthExhausted bool `json:"bandwidth_exhausted,omitempty"`
+	// end of the quiet period of the reconnects, after many failures
+	QuietUntil string `json:"quiet_until,omitempty"`
+	// time connected since the connection was established
+	ConnectedSeconds int64 `json:"connected_seconds"`
+	// connections established after the first one, and lost, since the
+	// daemon started; many of them tell a flapping connection
+	Reconnects           uint64 `json:"reconnects"`
+	Disconnects          uint64 `json:"disconnects"`
+	LastDisconnectAt     string `json:"last_disconnect_at,omitempty"`
+	LastDisconnectReason string `json:"last_disconnect_reason,omitempty"`
+	// time the dial of the last connection took, the handshakes included
+	HandshakeLatencyMs int64 `json:"handshake_latency_ms,omitempty"`
+}
+
+func (d *MenderShellDaemon) currentStatus(now time.Time) connectionStatus {
+	connStatus := connectionmanager.GetStatus(ws.ProtoTypeShell)
+	status := connectionStatus{
+		State:           statusDisconnected,
+		ServerURL:       connStatus.ServerURL,
+		LastError:       connStatus.LastError,
+		LastErrorReason: connStatus.LastErrorReason,
+		UptimeSeconds:   int64(now.Sub(d.startedAt) / time.Second),
+		Sessions:        session.MenderShellSessionGetCount(),
+		UpdatedAt:       now.UTC().Format(time.RFC3339),
+	}
+	if connStatus.Connected {
+		status.State = statusConnected
+		status.ConnectedSeconds = int64(now.Sub(connStatus.Since) / time.Second)
+	}
+	if connStatus.Connects > 1 {
+		status.Reconnects = connStatus.Connects - 1
+	}
+	status.Disconnects = connStatus.Disconnects
+	status.LastDisconnectReason = connStatus.LastDisconnectReason
+	if !connStatus.LastDisconnectAt.IsZero() {
+		status.LastDisconnectAt = connStatus.LastDisconnectAt.UTC().Format(time.RFC3339)
+	}
+	status.HandshakeLatencyMs = int64(connStatus.HandshakeLatency / time.Millisecond)
+	if !connStatus.Since.IsZero() {
+		status.Since = connStatus.Since.UTC().Format(time.RFC3339)
+	}
+	if !connStatus.LastErrorAt.IsZero() {
+		status.LastErrorAt = connStatus.LastErrorAt.UTC().Format(time.RFC3339)
+	}
+	if !connStatus.QuietUntil.IsZero() {
+		status.QuietUntil = connStatus.QuietUntil.UTC().Format(time.RFC3339)
+	}
+	if d.bandwidth != nil {
+		status.BandwidthExhausted = d.bandwidth.Exceeded()
+	}
+	if d.shouldStop() {
+		status.State = statusStopped
+	}
+	return status
+}
+
+// getConnectionStatus implements the GetConnectionStatus D-Bus method,
+// returning the content of the status file
+func (d *MenderShellDaemon) getConnectionStatus(objectPath string, interfaceName string, methodName string) (string, error) {
+	data, err := json.Marshal(d.currentStatus(time.Now()))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// writeStatusFile replaces the status file, so that the readers never see
+// it half written
+func writeStatusFile(path string, status connectionStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, append(data, '\n'), 0644)
+}
+
+// replaceFile writes data to a temporary file next to path and renames it
+// over path
+func replaceFile(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// sdNotify sends the state, e.g. "READY=1", to the service manager if it
+// runs the daemon as a Type=notify unit; it does nothing otherwise
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// statusText is the STATUS= line of the status
+func (s connectionStatus) statusText() string {
+	switch {
+	case s.State == statusConnected:
+		return "connected to " + s.ServerURL
+	case s.State == statusDisconnected && s.QuietUntil != "":
+		return "disconnected (" + s.LastErrorReason + "), quiet until " + s.QuietUntil +
+			": " + s.LastError
+	case s.State == statusDisconnected && s.LastError != "":
+		return "disconnected (" + s.LastErrorReason + "): " + s.LastError
+	default:
+		return s.State
+	}
+}
+
+// reportStatus writes the status file when it is due, and tells the
+// service manager the state of the connection when it changes
+func (d *MenderShellDaemon) reportStatus(now time.Time) {
+	status := d.currentStatus(now)
+	if d.statusFile != "" && !now.Before(d.statusFileWrittenAt.Add(d.statusFileInterval)) {
+		if err := writeStatusFile(d.statusFile, status); err != nil {
+			log.Errorf("failed to write the status file %s: %s", d.statusFile, err.Error())
+		}
+		d.statusFileWrittenAt = now
+	}
+	if text := status.statusText(); text != d.notifiedStatus {
+		if err := sdNotify("STATUS=" + text); err != nil {
+			log.Debugf("failed to notify the service manager: %s", err.Error())
+		}
+		d.notifiedStatus = text
+	}
+}
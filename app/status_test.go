@@ -0,0 +1,96 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+)
+
+func TestReportStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "status")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "notify.sock")
+	notifications, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	assert.NoError(t, err)
+	defer notifications.Close()
+	notifications.SetReadDeadline(time.Now().Add(10 * time.Second))
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	statusFile := filepath.Join(dir, "status.json")
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			StatusFile: config.StatusFileConfig{
+				Path: statusFile,
+			},
+		},
+	})
+	assert.Equal(t, defaultStatusFileInterval, d.statusFileInterval)
+	now := d.startedAt.Add(5 * time.Second)
+	d.reportStatus(now)
+
+	var status connectionStatus
+	data, err := ioutil.ReadFile(statusFile)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &status))
+	assert.Equal(t, statusDisconnected, status.State)
+	assert.Equal(t, int64(5), status.UptimeSeconds)
+	assert.Equal(t, now.UTC().Format(time.RFC3339), status.UpdatedAt)
+
+	buf := make([]byte, 256)
+	n, err := notifications.Read(buf)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "STATUS=disconnected"))
+
+	// not due yet, nor changed
+	assert.NoError(t, os.Remove(statusFile))
+	d.reportStatus(now.Add(time.Second))
+	_, err = os.Stat(statusFile)
+	assert.True(t, os.IsNotExist(err))
+	d.reportStatus(now.Add(defaultStatusFileInterval))
+	_, err = os.Stat(statusFile)
+	assert.NoError(t, err)
+
+	reply, err := d.getConnectionStatus(DBusStatusObjectPath, DBusStatusInterfaceName,
+		dbusMethodGetConnectionStatus)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal([]byte(reply), &status))
+	assert.Equal(t, statusDisconnected, status.State)
+
+	d.stop = true
+	d.reportStatus(now.Add(2 * defaultStatusFileInterval))
+	data, err = ioutil.ReadFile(statusFile)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &status))
+	assert.Equal(t, statusStopped, status.State)
+	n, err = notifications.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "STATUS=stopped", string(buf[:n]))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 2)
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"os/exec"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	configuration "github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/shell"
+)
+
+// newSystemdScope returns the settings of the scope units of the shells;
+// the cgroup limits, if any, become properties of the scopes, systemd
+// owning the cgroups of its units
+func newSystemdScope(config *configuration.MenderShellConfig) *shell.SystemdScope {
+	scope := &shell.SystemdScope{
+		Command: shell.DefaultSystemdRunCommand,
+		Slice:   config.SystemdScope.Slice,
+	}
+	if path, err := exec.LookPath("systemd-run"); err == nil {
+		scope.Command = path
+	} else {
+		log.Warnf("systemd-run not found in PATH, using %s", scope.Command)
+	}
+	if config.Cgroup.Enabled {
+		if config.Cgroup.CPUWeight > 0 {
+			scope.Properties = append(scope.Properties,
+				"CPUWeight="+strconv.FormatUint(uint64(config.Cgroup.CPUWeight), 10))
+		}
+		if config.Cgroup.MemoryMax > 0 {
+			scope.Properties = append(scope.Properties,
+				"MemoryMax="+strconv.FormatUint(config.Cgroup.MemoryMax, 10))
+		}
+		if config.Cgroup.PidsMax > 0 {
+			scope.Properties = append(scope.Properties,
+				"TasksMax="+strconv.FormatUint(uint64(config.Cgroup.PidsMax), 10))
+		}
+	}
+	return scope
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+)
+
+func TestNewSystemdScope(t *testing.T) {
+	testCases := map[string]struct {
+		config     config.MenderShellConfigFromFile
+		slice      string
+		properties []string
+	}{
+		"no limits": {
+			config: config.MenderShellConfigFromFile{
+				SystemdScope: config.SystemdScopeConfig{
+					Enabled: true,
+					Slice:   "mender-connect.slice",
+				},
+			},
+			slice: "mender-connect.slice",
+		},
+		"limits": {
+			config: config.MenderShellConfigFromFile{
+				SystemdScope: config.SystemdScopeConfig{
+					Enabled: true,
+				},
+				Cgroup: config.CgroupConfig{
+					Enabled:   true,
+					CPUWeight: 50,
+					MemoryMax: 64 * 1024 * 1024,
+					PidsMax:   128,
+				},
+			},
+			properties: []string{"CPUWeight=50", "MemoryMax=67108864", "TasksMax=128"},
+		},
+		"limits disabled": {
+			config: config.MenderShellConfigFromFile{
+				SystemdScope: config.SystemdScopeConfig{
+					Enabled: true,
+				},
+				Cgroup: config.CgroupConfig{
+					PidsMax: 128,
+				},
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			scope := newSystemdScope(&config.MenderShellConfig{
+				MenderShellConfigFromFile: tc.config,
+			})
+			assert.NotEmpty(t, scope.Command)
+			assert.Equal(t, tc.slice, scope.Slice)
+			assert.Equal(t, tc.properties, scope.Properties)
+		})
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	configuration "github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// Properties of the spawn shell messages asking to take over the terminal
+// of another session, or of a stream of it, instead of starting a shell
+const (
+	propertyTakeoverSession = "takeover_session"
+	propertyTakeoverStream  = "takeover_stream"
+)
+
+var (
+	errTakeoverDisabled = errors.New("taking over the terminals is disabled")
+	errTakeoverDenied   = errors.New("the user may not take over the terminals")
+	// the users given the restricted shell may not escape it by taking
+	// over an unrestricted terminal
+	errTakeoverRestricted = errors.New("the users of the restricted shell may not take over the terminals")
+)
+
+// mayTakeOver tells if the user may take over the terminals of the others
+func (d *MenderShellDaemon) mayTakeOver(userID string) error {
+	if d.takeover.Policy == "" {
+		return errTakeoverDisabled
+	}
+	if len(d.takeover.Users) == 0 {
+		return nil
+	}
+	for _, user := range d.takeover.Users {
+		if user == userID {
+			return nil
+		}
+	}
+	return errTakeoverDenied
+}
+
+// takeOverShell moves the terminal of the session given in the message
+// properties to the session of the message, applying the takeover policy
+// to its former operator
+func (d *MenderShellDaemon) takeOverShell(message *ws.ProtoMsg, response *ws.ProtoMsg, target string) error {
+	userID := getUserIdFromMessage(message)
+	if err := d.mayTakeOver(userID); err != nil {
+		log.Warnf("refusing to let user %s of session %s take over session %s: %s",
+			userID, message.Header.SessionID, target, err.Error())
+		d.routeMessageResponse(response, err)
+		return err
+	}
+	if d.isRestricted(userID, getUserRolesFromMessage(message)) {
+		log.Warnf("refusing to let user %s of session %s take over session %s: %s",
+			userID, message.Header.SessionID, target, errTakeoverRestricted.Error())
+		d.routeMessageResponse(response, errTakeoverRestricted)
+		return errTakeoverRestricted
+	}
+	if getSessionFromMessage(message) != nil {
+		d.routeMessageResponse(response, session.ErrSessionShellAlreadyRunning)
+		return session.ErrSessionShellAlreadyRunning
+	}
+
+	targetStream, _ := message.Header.Properties[propertyTakeoverStream].(string)
+	if taken := session.MenderShellSessionGetById(session.StreamKey(target, targetStream)); taken != nil {
+		if err := d.runsAsRequested(message, taken); err != nil {
+			log.Warnf("refusing to let user %s of session %s take over session %s: %s",
+				userID, message.Header.SessionID, target, err.Error())
+			d.routeMessageResponse(response, err)
+			return err
+		}
+	}
+	s, err := session.TakeOver(session.StreamKey(target, targetStream), message.Header.SessionID,
+		getStreamIdFromMessage(message), userID, d.takeover.Policy == configuration.TakeoverPolicyObserve)
+	if err != nil {
+		err = errors.Wrap(err, "failed to take over the terminal")
+		d.routeMessageResponse(response, err)
+		return err
+	}
+
+	// a resize makes the full screen programs redraw for the new operator
+	if height, width := mapPropertiesToTerminalHeightAndWidth(message.Header.Properties); height > 0 && width > 0 {
+		if err = s.ResizeShell(height, width); err != nil {
+			s.Logger().Errorf("failed to resize the terminal taken over: %s", err.Error())
+		}
+	}
+	response.Body = []byte("Shell taken over")
+	d.routeMessageResponse(response, nil)
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"os/user"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+func TestMayTakeOver(t *testing.T) {
+	testCases := map[string]struct {
+		takeover config.TakeoverConfig
+		userID   string
+		err      error
+	}{
+		"disabled": {
+			userID: "senior",
+			err:    errTakeoverDisabled,
+		},
+		"any user": {
+			takeover: config.TakeoverConfig{Policy: config.TakeoverPolicyDisconnect},
+			userID:   "senior",
+		},
+		"user allowed": {
+			takeover: config.TakeoverConfig{
+				Policy: config.TakeoverPolicyObserve,
+				Users:  []string{"lead", "senior"},
+			},
+			userID: "senior",
+		},
+		"user denied": {
+			takeover: config.TakeoverConfig{
+				Policy: config.TakeoverPolicyObserve,
+				Users:  []string{"lead"},
+			},
+			userID: "junior",
+			err:    errTakeoverDenied,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					ShellCommand: "/bin/sh",
+					Takeover:     tc.takeover,
+				},
+			})
+			assert.Equal(t, tc.err, d.mayTakeOver(tc.userID))
+		})
+	}
+}
+
+func TestMenderShellSpawnShellTakeover(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "mender",
+			Takeover: config.TakeoverConfig{
+				Policy: config.TakeoverPolicyDisconnect,
+				Users:  []string{"senior"},
+			},
+		},
+	})
+	sessionID := "takeover-session"
+	message := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeSpawnShell,
+			SessionID: sessionID,
+			Properties: map[string]interface{}{
+				"user_id":               "junior",
+				propertyTakeoverSession: "takeover-former-session",
+			},
+		},
+	}
+	assert.Equal(t, errTakeoverDenied, d.spawnShell(message))
+
+	// the restricted shell users may not escape it this way
+	d.restrictedShell.Users = []string{"senior"}
+	message.Header.Properties["user_id"] = "senior"
+	assert.Equal(t, errTakeoverRestricted, d.spawnShell(message))
+	d.restrictedShell.Users = nil
+
+	err := d.spawnShell(message)
+	assert.Error(t, err)
+	assert.Equal(t, session.ErrSessionNotFound, errors.Cause(err))
+	assert.Nil(t, session.MenderShellSessionGetById(sessionID))
+}
+
+func TestMenderShellSpawnShellAttachRunAs(t *testing.T) {
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand:      "/bin/sh",
+			User:              currentUser.Username,
+			AllowedRunAsUsers: []string{"nobody"},
+			Takeover: config.TakeoverConfig{
+				Policy: config.TakeoverPolicyDisconnect,
+			},
+			Observe: config.ObserveConfig{
+				Enabled: true,
+			},
+		},
+	})
+	target := "attach-run-as-target"
+	assert.NoError(t, d.spawnShell(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:      ws.ProtoTypeShell,
+			MsgType:    wsshell.MessageTypeSpawnShell,
+			SessionID:  target,
+			Properties: map[string]interface{}{"user_id": "junior"},
+		},
+	}))
+	defer func() {
+		if s := session.MenderShellSessionGetById(target); s != nil {
+			_ = s.StopShell()
+			_ = session.MenderShellDeleteById(s.GetId())
+		}
+	}()
+
+	attach := func(sessionID, property string, runAs string) *ws.ProtoMsg {
+		return &ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     ws.ProtoTypeShell,
+				MsgType:   wsshell.MessageTypeSpawnShell,
+				SessionID: sessionID,
+				Properties: map[string]interface{}{
+					"user_id":         "senior",
+					property:          target,
+					propertyRunAsUser: runAs,
+				},
+			},
+		}
+	}
+
+	// the terminal runs as User, not as the user the shell would run as
+	assert.Equal(t, errRunAsUserDenied, d.spawnShell(attach("observer", propertyObserveSession, "nobody")))
+	assert.Nil(t, session.MenderShellSessionGetObserved("observer"))
+	assert.Equal(t, errRunAsUserDenied, d.spawnShell(attach("taker", propertyTakeoverSession, "nobody")))
+	assert.NotNil(t, session.MenderShellSessionGetById(target))
+
+	assert.NoError(t, d.spawnShell(attach("taker", propertyTakeoverSession, "")))
+	assert.Nil(t, session.MenderShellSessionGetById(target))
+	target = "taker"
+}
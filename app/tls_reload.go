@@ -0,0 +1,98 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/codec"
+	"github.com/mendersoftware/mender-connect/connectionmanager"
+)
+
+// defaultTLSReloadInterval is the interval between the checks of the
+// client certificate and key and of the server certificate files
+const defaultTLSReloadInterval = 30 * time.Second
+
+// tlsFilesState returns the modification times and sizes of the files,
+// which tell when any of them changed
+func tlsFilesState(files []string) string {
+	var state strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			fmt.Fprintf(&state, "%s:-;", file)
+			continue
+		}
+		fmt.Fprintf(&state, "%s:%d:%d;", file, info.ModTime().UnixNano(), info.Size())
+	}
+	return state.String()
+}
+
+// ReloadTLS requests the client certificate and key and the server
+// certificate to be reloaded, e.g. on SIGHUP
+func (d *MenderShellDaemon) ReloadTLS() {
+	atomic.StoreInt32(&d.tlsReloadRequested, 1)
+}
+
+// checkTLSFiles posts the TLS reload event when requested or, with the
+// files watched, when they changed since the previous check
+func (d *MenderShellDaemon) checkTLSFiles(now time.Time) {
+	if atomic.SwapInt32(&d.tlsReloadRequested, 0) == 1 {
+		log.Info("reloading the TLS certificates and key")
+		d.tlsFilesState = tlsFilesState(d.tlsFiles)
+	} else {
+		if !d.tlsReloadWatch || now.Sub(d.tlsFilesCheckedAt) < d.tlsReloadInterval {
+			return
+		}
+		d.tlsFilesCheckedAt = now
+		state := tlsFilesState(d.tlsFiles)
+		if state == d.tlsFilesState {
+			return
+		}
+		d.tlsFilesState = state
+		log.Info("the TLS certificates or key changed, reloading them")
+	}
+	// the event loop may be busy reconnecting, do not hold the main loop
+	go d.postEvent(MenderShellDaemonEvent{
+		event: EventTLSReload,
+		id:    "(checkTLSFiles)",
+	})
+}
+
+// reloadTLS swaps the connection for one made with the reloaded client
+// certificate and key and server certificate, without interrupting the
+// sessions; if the new connection fails the current one is kept. While
+// disconnected there is nothing to do, the next connection loads them
+func (d *MenderShellDaemon) reloadTLS() {
+	token, _ := d.authToken.Load().(string)
+	if token == "" || !connectionmanager.GetStatus(ws.ProtoTypeShell).Connected {
+		return
+	}
+	err := connectionmanager.Refresh(ws.ProtoTypeShell, d.serverUrl, d.deviceConnectUrl, token,
+		d.skipVerify, d.serverCertificate, 1, d.stopChan)
+	if err != nil {
+		log.Errorf("failed to reconnect with the reloaded TLS certificates and key, "+
+			"keeping the current connection: %s", err.Error())
+		return
+	}
+	d.setBodyCodec(codec.Msgpack)
+	log.Info("reconnected with the reloaded TLS certificates and key")
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+)
+
+func TestCheckTLSFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	serverCert := filepath.Join(dir, "server.crt")
+	assert.NoError(t, ioutil.WriteFile(serverCert, []byte("server"), 0600))
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand:      "/bin/sh",
+			ServerCertificate: serverCert,
+			TLSReload: config.TLSReloadConfig{
+				Watch: true,
+			},
+		},
+	})
+	assert.Equal(t, defaultTLSReloadInterval, d.tlsReloadInterval)
+	assert.Equal(t, []string{serverCert}, d.tlsFiles)
+
+	expectEvent := func(expected bool) {
+		select {
+		case e := <-d.eventChan:
+			assert.True(t, expected, "unexpected event: %+v", e)
+			assert.Equal(t, EventTLSReload, e.event)
+		case <-time.After(100 * time.Millisecond):
+			assert.False(t, expected, "no TLS reload event")
+		}
+	}
+
+	now := time.Now()
+	d.checkTLSFiles(now)
+	expectEvent(false)
+
+	// checked only once the interval elapses
+	assert.NoError(t, ioutil.WriteFile(serverCert, []byte("rotated"), 0600))
+	d.checkTLSFiles(now.Add(time.Second))
+	expectEvent(false)
+	d.checkTLSFiles(now.Add(defaultTLSReloadInterval))
+	expectEvent(true)
+	d.checkTLSFiles(now.Add(2 * defaultTLSReloadInterval))
+	expectEvent(false)
+
+	// reloaded on request regardless
+	d.ReloadTLS()
+	d.checkTLSFiles(now.Add(2*defaultTLSReloadInterval + time.Second))
+	expectEvent(true)
+
+	d.tlsReloadWatch = false
+	assert.NoError(t, os.Remove(serverCert))
+	d.checkTLSFiles(now.Add(4 * defaultTLSReloadInterval))
+	expectEvent(false)
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/codec"
+	configuration "github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/connectionmanager"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// tokenExpiry returns the expiry of the JWT token, the zero time if the
+// token does not expire
+func tokenExpiry(token string) time.Time {
+	claims := parseTokenClaims(token)
+	if claims.ExpiresAt <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.ExpiresAt, 0)
+}
+
+// setAuthToken takes the JWT token the daemon is authorized with; its
+// expiry is applied to the sessions and handlers by the main loop, see
+// applyAuthExpiry
+func (d *MenderShellDaemon) setAuthToken(token string) {
+	d.setDeviceID(token)
+	d.authToken.Store(token)
+	if d.tokenExpiryAction == "" {
+		return
+	}
+	d.tokenExpiresAt.Store(tokenExpiry(token))
+	atomic.StoreInt32(&d.tokenRefreshRequested, 0)
+	atomic.StoreInt32(&d.authExpiryChanged, 1)
+}
+
+// applyAuthExpiry applies the expiry of the token set last, if it changed:
+// with the reauthorize action it authorizes the running sessions and
+// handlers too, otherwise only the new ones
+func (d *MenderShellDaemon) applyAuthExpiry() {
+	if atomic.SwapInt32(&d.authExpiryChanged, 0) == 0 {
+		return
+	}
+	expiresAt, _ := d.tokenExpiresAt.Load().(time.Time)
+	if d.tokenExpiryAction == configuration.TokenExpiryActionReauthorize {
+		session.MenderSessionReauthorize(expiresAt)
+		protoHandlerManager.reauthorize(expiresAt)
+	} else {
+		session.SetAuthExpiry(expiresAt)
+		protoHandlerManager.setAuthExpiry(expiresAt)
+	}
+}
+
+// refreshConnection re-authenticates the connection with the rotated
+// token by swapping it for a new one, without interrupting the sessions;
+// if the new connection fails the current one is kept, the server
+// dropping it in the end leads to a reconnect with the new token
+func (d *MenderShellDaemon) refreshConnection(token string) {
+	err := connectionmanager.Refresh(ws.ProtoTypeShell, d.serverUrl, d.deviceConnectUrl, token,
+		d.skipVerify, d.serverCertificate, 1, d.stopChan)
+	if err != nil {
+		log.Errorf("failed to re-authenticate the connection with the refreshed token: %s", err.Error())
+		return
+	}
+	d.setBodyCodec(codec.Msgpack)
+	log.Info("re-authenticated the connection with the refreshed token")
+}
+
+// terminateAuthExpired terminates the sessions and closes the handlers
+// which outlived their token; with the reauthorize action a refreshed
+// token is requested once the token expires, and they are given
+// tokenExpiryGracePeriod for it to come
+func (d *MenderShellDaemon) terminateAuthExpired(now time.Time) {
+	if d.tokenExpiryAction == "" {
+		return
+	}
+	d.applyAuthExpiry()
+	deadline := now
+	if d.tokenExpiryAction == configuration.TokenExpiryActionReauthorize {
+		expiresAt, _ := d.tokenExpiresAt.Load().(time.Time)
+		if !expiresAt.IsZero() && expiresAt.Before(now) &&
+			atomic.CompareAndSwapInt32(&d.tokenRefreshRequested, 0, 1) {
+			log.Info("the JWT token expired, requesting a refreshed one")
+			if d.authClient != nil {
+				if _, err := d.authClient.FetchJWTToken(); err != nil {
+					log.Errorf("failed to request a refreshed JWT token: %s", err.Error())
+				}
+			}
+		}
+		deadline = now.Add(-d.tokenExpiryGracePeriod)
+	}
+
+	shellsCount, sessionsCount, err := session.MenderSessionTerminateAuthExpired(deadline)
+	for i := 0; i < shellsCount; i++ {
+		d.shellStopped()
+	}
+	if err != nil {
+		log.Errorf("main-loop: failed to terminate some sessions of an expired token: %s", err.Error())
+	} else if sessionsCount > 0 {
+		log.Infof("main-loop: the token expired, terminated %d sessions, %d shells",
+			sessionsCount, shellsCount)
+	}
+	if handlersClosed := protoHandlerManager.closeAuthExpired(deadline); handlersClosed > 0 {
+		log.Infof("main-loop: the token expired, closed %d protocol handlers", handlersClosed)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"os/user"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/stretchr/testify/assert"
+
+	authmocks "github.com/mendersoftware/mender-connect/client/mender/mocks"
+	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+func TestTokenExpiry(t *testing.T) {
+	testCases := map[string]struct {
+		token     string
+		expiresAt time.Time
+	}{
+		"ok": {
+			token:     newToken(`{"sub":"device-id","exp":1600000000}`),
+			expiresAt: time.Unix(1600000000, 0),
+		},
+		"no expiry": {
+			token: newToken(`{"sub":"device-id"}`),
+		},
+		"not a token": {
+			token: "token",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expiresAt, tokenExpiry(tc.token))
+		})
+	}
+}
+
+func TestTerminateAuthExpired(t *testing.T) {
+	defer func() {
+		session.SetAuthExpiry(time.Time{})
+		protoHandlerManager.setAuthExpiry(time.Time{})
+	}()
+
+	now := time.Now()
+	token := func(expiresAt time.Time) string {
+		return newToken(fmt.Sprintf(`{"sub":"device-id","exp":%d}`, expiresAt.Unix()))
+	}
+	testCases := map[string]struct {
+		action      string
+		refreshed   bool
+		terminated  bool
+		fetchCalled bool
+	}{
+		"no action": {},
+		"terminate": {
+			action:     config.TokenExpiryActionTerminate,
+			terminated: true,
+		},
+		"terminate, refreshed token": {
+			action:     config.TokenExpiryActionTerminate,
+			refreshed:  true,
+			terminated: true,
+		},
+		"reauthorize, refreshed token": {
+			action:    config.TokenExpiryActionReauthorize,
+			refreshed: true,
+		},
+		"reauthorize, no refreshed token": {
+			action:      config.TokenExpiryActionReauthorize,
+			terminated:  true,
+			fetchCalled: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			client := &authmocks.AuthProvider{}
+			client.On("FetchJWTToken").Return(true, nil)
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					Sessions: config.SessionsConfig{
+						TokenExpiryAction:      tc.action,
+						TokenExpiryGracePeriod: 30,
+					},
+				},
+			})
+			d.authClient = client
+
+			d.setAuthToken(token(now.Add(time.Minute)))
+			d.applyAuthExpiry()
+			s, err := session.NewMenderShellSession("token-expiry-"+name, "user-id",
+				session.NoExpirationTimeout, session.NoExpirationTimeout)
+			assert.NoError(t, err)
+			defer session.MenderShellDeleteById(s.GetId())
+			if tc.refreshed {
+				d.setAuthToken(token(now.Add(time.Hour)))
+			}
+
+			// within the grace period of the reauthorize action
+			d.terminateAuthExpired(now.Add(80 * time.Second))
+			if tc.action == config.TokenExpiryActionTerminate {
+				assert.Nil(t, session.MenderShellSessionGetById(s.GetId()))
+			} else {
+				assert.NotNil(t, session.MenderShellSessionGetById(s.GetId()))
+			}
+
+			d.terminateAuthExpired(now.Add(2 * time.Minute))
+			if tc.terminated {
+				assert.Nil(t, session.MenderShellSessionGetById(s.GetId()))
+			} else {
+				assert.NotNil(t, session.MenderShellSessionGetById(s.GetId()))
+			}
+			if tc.fetchCalled {
+				client.AssertNumberOfCalls(t, "FetchJWTToken", 1)
+			} else {
+				client.AssertNotCalled(t, "FetchJWTToken")
+			}
+		})
+	}
+}
+
+func TestTerminateAuthExpiredShellSlot(t *testing.T) {
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	defer func() {
+		session.SetAuthExpiry(time.Time{})
+		protoHandlerManager.setAuthExpiry(time.Time{})
+	}()
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         currentUser.Username,
+			Sessions: config.SessionsConfig{
+				TokenExpiryAction: config.TokenExpiryActionTerminate,
+			},
+		},
+	})
+	now := time.Now()
+	d.setAuthToken(newToken(fmt.Sprintf(`{"sub":"device-id","exp":%d}`, now.Add(time.Minute).Unix())))
+	d.applyAuthExpiry()
+	assert.NoError(t, d.spawnShell(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeSpawnShell,
+			SessionID: "auth-expired-session",
+			Properties: map[string]interface{}{
+				"user_id": "user-auth-expired-session",
+			},
+		},
+	}))
+	assert.Equal(t, uint(1), d.shellsSpawned)
+
+	// the shell stopped with its session frees its slot
+	d.terminateAuthExpired(now.Add(2 * time.Minute))
+	assert.Nil(t, session.MenderShellSessionGetById("auth-expired-session"))
+	assert.Equal(t, uint(0), d.shellsSpawned)
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+
+	"github.com/mendersoftware/mender-connect/session"
+	"github.com/mendersoftware/mender-connect/tracing"
+)
+
+// Span names and attributes
+const (
+	spanNameSession  = "session"
+	spanNameDispatch = "dispatch"
+
+	spanAttributeProto       = "mender.proto"
+	spanAttributeMsgType     = "mender.msg_type"
+	spanAttributeSessionID   = "mender.session_id"
+	spanAttributeStreamID    = "mender.stream_id"
+	spanAttributeUserID      = "mender.user_id"
+	spanAttributeCloseReason = "mender.close_reason"
+)
+
+// sessionTracer keeps a span open for the lifetime of each session, the
+// spans of the messages of a session are its children so that a session
+// makes a single trace
+type sessionTracer struct {
+	mutex sync.Mutex
+	spans map[string]*tracing.Span
+}
+
+func newSessionTracer() *sessionTracer {
+	return &sessionTracer{
+		spans: map[string]*tracing.Span{},
+	}
+}
+
+// sessionEvent starts and finishes the spans of the sessions
+func (t *sessionTracer) sessionEvent(event string, s *session.MenderShellSession, proto ws.ProtoType) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	switch event {
+	case session.HookEventSessionOpen:
+		t.spans[s.GetId()] = tracing.StartSpan(spanNameSession,
+			tracing.Attribute{Key: spanAttributeSessionID, Value: s.GetSessionId()},
+			tracing.Attribute{Key: spanAttributeStreamID, Value: s.GetStreamId()},
+			tracing.Attribute{Key: spanAttributeUserID, Value: s.GetUserId()},
+		)
+	case session.HookEventSessionClose:
+		span := t.spans[s.GetId()]
+		delete(t.spans, s.GetId())
+		span.SetAttributes(tracing.Attribute{
+			Key:   spanAttributeCloseReason,
+			Value: string(s.GetCloseReason()),
+		})
+		span.Finish(nil)
+	}
+}
+
+// startMessageSpan starts the span of the dispatch of msg, child of the
+// span of its session if any
+func (t *sessionTracer) startMessageSpan(msg *ws.ProtoMsg) *tracing.Span {
+	if t == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	parent := t.spans[session.StreamKey(msg.Header.SessionID, getStreamIdFromMessage(msg))]
+	t.mutex.Unlock()
+	return parent.StartChild(spanNameDispatch,
+		tracing.Attribute{Key: spanAttributeProto, Value: strconv.Itoa(int(msg.Header.Proto))},
+		tracing.Attribute{Key: spanAttributeMsgType, Value: msg.Header.MsgType},
+		tracing.Attribute{Key: spanAttributeSessionID, Value: msg.Header.SessionID},
+	)
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/session"
+	"github.com/mendersoftware/mender-connect/tracing"
+)
+
+type recordingExporter struct {
+	spans []*tracing.Span
+}
+
+func (e *recordingExporter) Export(spans []*tracing.Span) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestSessionTracerDisabled(t *testing.T) {
+	var tracer *sessionTracer
+	span := tracer.startMessageSpan(&ws.ProtoMsg{})
+	assert.Nil(t, span)
+	span.Finish(nil)
+}
+
+func TestSessionTracer(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracing.Enable(exporter)
+
+	s, err := session.NewMenderShellSession("trace-session-id", "trace-user-id",
+		session.NoExpirationTimeout, session.NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer session.MenderShellDeleteById(s.GetId())
+
+	tracer := newSessionTracer()
+	tracer.sessionEvent(session.HookEventSessionOpen, s, ws.ProtoTypeShell)
+	span := tracer.startMessageSpan(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeShellCommand,
+			SessionID: "trace-session-id",
+		},
+	})
+	span.Finish(errors.New("failed"))
+	tracer.sessionEvent(session.HookEventSessionClose, s, ws.ProtoTypeShell)
+	tracing.Disable()
+
+	if assert.Len(t, exporter.spans, 2) {
+		dispatch, sessionSpan := exporter.spans[0], exporter.spans[1]
+		assert.Equal(t, spanNameDispatch, dispatch.Name)
+		assert.Equal(t, spanNameSession, sessionSpan.Name)
+		assert.Equal(t, sessionSpan.TraceID, dispatch.TraceID)
+		assert.Equal(t, sessionSpan.SpanID, dispatch.ParentID)
+		assert.Contains(t, dispatch.Attributes, tracing.Attribute{
+			Key:   spanAttributeMsgType,
+			Value: wsshell.MessageTypeShellCommand,
+		})
+		assert.Contains(t, dispatch.Attributes, tracing.Attribute{
+			Key:   spanAttributeProto,
+			Value: "1",
+		})
+		assert.EqualError(t, dispatch.Err, "failed")
+		assert.Contains(t, sessionSpan.Attributes, tracing.Attribute{
+			Key:   spanAttributeUserID,
+			Value: "trace-user-id",
+		})
+	}
+	assert.Empty(t, tracer.spans)
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package cgroup
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cgroup v2 interface files
+const (
+	fileSubtreeControl = "cgroup.subtree_control"
+	fileProcs          = "cgroup.procs"
+	fileEvents         = "cgroup.events"
+	fileKill           = "cgroup.kill"
+	fileCPUWeight      = "cpu.weight"
+	fileMemoryMax      = "memory.max"
+	filePidsMax        = "pids.max"
+)
+
+// controllers enabled for the cgroups of the shells
+var controllers = []string{"cpu", "memory", "pids"}
+
+var ErrRemoveTimeout = errors.New("timeout waiting for the processes of the cgroup to exit")
+
+// Limits are the resources limits of a cgroup, the zero values leave the
+// kernel defaults in place
+type Limits struct {
+	// Relative share of CPU time, 1-10000, the default is 100
+	CPUWeight uint32
+	// Maximum memory usage in bytes
+	MemoryMax uint64
+	// Maximum number of processes
+	PidsMax uint32
+}
+
+// Hierarchy is the cgroup v2 directory the cgroups of the shells are
+// created in
+type Hierarchy struct {
+	root   string
+	limits Limits
+}
+
+// Cgroup is the cgroup of a single shell and its descendants
+type Cgroup struct {
+	path string
+}
+
+// NewHierarchy creates the root directory, if needed, and enables the
+// controllers the limits need for its children
+func NewHierarchy(root string, limits Limits) (*Hierarchy, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	enable := make([]string, len(controllers))
+	for i, controller := range controllers {
+		enable[i] = "+" + controller
+	}
+	err := writeFile(filepath.Join(root, fileSubtreeControl), strings.Join(enable, " "))
+	if err != nil {
+		return nil, err
+	}
+	return &Hierarchy{
+		root:   root,
+		limits: limits,
+	}, nil
+}
+
+// Add creates the cgroup name, applies the limits to it and moves the
+// process pid in; the children the process forks afterwards stay in it,
+// the ones forked before it was moved do not. The directory of the cgroup
+// is named after a hash of name, which may then hold any character
+func (h *Hierarchy) Add(name string, pid int) (*Cgroup, error) {
+	c := &Cgroup{
+		path: filepath.Join(h.root, dirName(name)),
+	}
+	if err := os.Mkdir(c.path, 0755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	err := c.setLimits(h.limits)
+	if err == nil {
+		err = writeFile(filepath.Join(c.path, fileProcs), strconv.Itoa(pid))
+	}
+	if err != nil {
+		_ = os.Remove(c.path)
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Cgroup) setLimits(limits Limits) error {
+	if limits.CPUWeight > 0 {
+		err := writeFile(filepath.Join(c.path, fileCPUWeight),
+			strconv.FormatUint(uint64(limits.CPUWeight), 10))
+		if err != nil {
+			return err
+		}
+	}
+	if limits.MemoryMax > 0 {
+		err := writeFile(filepath.Join(c.path, fileMemoryMax),
+			strconv.FormatUint(limits.MemoryMax, 10))
+		if err != nil {
+			return err
+		}
+	}
+	if limits.PidsMax > 0 {
+		err := writeFile(filepath.Join(c.path, filePidsMax),
+			strconv.FormatUint(uint64(limits.PidsMax), 10))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Path returns the directory of the cgroup
+func (c *Cgroup) Path() string {
+	return c.path
+}
+
+// Remove kills the processes left in the cgroup, waits at most timeout
+// for them to exit and removes the cgroup
+func (c *Cgroup) Remove(timeout time.Duration) error {
+	if err := c.kill(); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for c.populated() {
+		if time.Now().After(deadline) {
+			return ErrRemoveTimeout
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return syscall.Rmdir(c.path)
+}
+
+// kill sends SIGKILL to the processes of the cgroup, at once with
+// cgroup.kill if the kernel has it (5.14+)
+func (c *Cgroup) kill() error {
+	if err := writeFile(filepath.Join(c.path, fileKill), "1"); err == nil {
+		return nil
+	}
+	pids, err := c.pids()
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cgroup) pids() ([]int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.path, fileProcs))
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, field := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// populated tells if there are processes left in the cgroup
+func (c *Cgroup) populated() bool {
+	file, err := os.Open(filepath.Join(c.path, fileEvents))
+	if err != nil {
+		pids, err := c.pids()
+		return err == nil && len(pids) > 0
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if scanner.Text() == "populated 1" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFile writes the value to the interface file at path, which the
+// kernel creates together with the cgroup
+// dirName is the name of the directory of the cgroup name, which may
+// neither escape the hierarchy nor collide with the interface files
+func dirName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return "shell-" + hex.EncodeToString(sum[:16])
+}
+
+func writeFile(path string, value string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(value)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/procps"
+)
+
+// fakeCgroup creates the directory of a cgroup with the interface files
+// the kernel would create
+func fakeCgroup(t *testing.T, path string, files ...string) {
+	assert.NoError(t, os.MkdirAll(path, 0755))
+	for _, file := range files {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(path, file), []byte{}, 0644))
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestHierarchy(t *testing.T) {
+	root, err := ioutil.TempDir("", "TestHierarchy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	_, err = NewHierarchy(root, Limits{})
+	assert.Error(t, err)
+
+	fakeCgroup(t, root, fileSubtreeControl)
+	h, err := NewHierarchy(root, Limits{
+		CPUWeight: 50,
+		MemoryMax: 64 * 1024 * 1024,
+		PidsMax:   128,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "+cpu +memory +pids", readFile(t, filepath.Join(root, fileSubtreeControl)))
+
+	_, err = h.Add("no-interface-files", 1234)
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(root, "no-interface-files"))
+	assert.True(t, os.IsNotExist(err))
+
+	fakeCgroup(t, filepath.Join(root, dirName("shell")), fileProcs, fileCPUWeight, fileMemoryMax, filePidsMax)
+	c, err := h.Add("shell", 1234)
+	assert.NoError(t, err)
+	assert.Equal(t, root, filepath.Dir(c.Path()))
+	assert.Equal(t, "1234", readFile(t, filepath.Join(c.Path(), fileProcs)))
+	assert.Equal(t, "50", readFile(t, filepath.Join(c.Path(), fileCPUWeight)))
+	assert.Equal(t, "67108864", readFile(t, filepath.Join(c.Path(), fileMemoryMax)))
+	assert.Equal(t, "128", readFile(t, filepath.Join(c.Path(), filePidsMax)))
+
+	for _, name := range []string{"..", "../../escaped", "cgroup.procs", ""} {
+		path := filepath.Join(root, dirName(name))
+		assert.Equal(t, root, filepath.Dir(path))
+		assert.NotEqual(t, path, filepath.Join(root, fileProcs))
+	}
+	assert.NotEqual(t, dirName("session_id"), dirName("session/id"))
+}
+
+func TestCgroupKill(t *testing.T) {
+	root, err := ioutil.TempDir("", "TestCgroupKill")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	cmd := exec.Command("sleep", "16")
+	assert.NoError(t, cmd.Start())
+	fakeCgroup(t, root, fileProcs, fileEvents)
+	c := &Cgroup{path: root}
+	assert.NoError(t, writeFile(filepath.Join(root, fileProcs), strconv.Itoa(cmd.Process.Pid)+"\n"))
+
+	assert.NoError(t, writeFile(filepath.Join(root, fileEvents), "populated 1\nfrozen 0\n"))
+	assert.True(t, c.populated())
+
+	assert.NoError(t, c.kill())
+	assert.Error(t, cmd.Wait())
+	assert.False(t, procps.ProcessExists(cmd.Process.Pid))
+
+	assert.NoError(t, writeFile(filepath.Join(root, fileEvents), "populated 0\nfrozen 0\n"))
+	assert.False(t, c.populated())
+}
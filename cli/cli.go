@@ -17,6 +17,7 @@ import (
 	"github.com/urfave/cli/v2"
 
 	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/shell"
 )
 
 func SetupCLI(args []string) error {
@@ -32,6 +33,38 @@ func SetupCLI(args []string) error {
 				Usage:  "Start the client as a background service.",
 				Action: runOptions.handleCLIOptions,
 			},
+			{
+				Name:   shell.ExecShellCommand,
+				Usage:  "Harden the process and execute the shell, used internally to spawn the shells",
+				Hidden: true,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "no-new-privs",
+						Usage: "Set no_new_privs before executing the shell",
+					},
+					&cli.StringFlag{
+						Name:  "seccomp-profile",
+						Usage: "Compiled seccomp `FILE` to load before executing the shell",
+					},
+					&cli.BoolFlag{
+						Name:  "login",
+						Usage: "Execute the shell as a login shell",
+					},
+				},
+				Action: execShell,
+			},
+			{
+				Name:  "debug-shell",
+				Usage: "Open a shell served by the running daemon over its local debug shell socket",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "socket",
+						Usage: "Debug shell socket `FILE` path",
+						Value: config.DefaultDebugShellSocket,
+					},
+				},
+				Action: debugShell,
+			},
 			{
 				Name:   "version",
 				Usage:  "Show the version and runtime information of the binary build",
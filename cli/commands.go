@@ -18,8 +18,11 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/urfave/cli/v2"
+
 	"github.com/mendersoftware/mender-connect/app"
 	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/shell"
 )
 
 type runOptionsType struct {
@@ -28,6 +31,22 @@ type runOptionsType struct {
 	debug          bool
 }
 
+// execShell hardens the process and replaces it with the shell given
+// after the flags
+func execShell(ctx *cli.Context) error {
+	hardening := &shell.Hardening{
+		NoNewPrivs:     ctx.Bool("no-new-privs"),
+		SeccompProfile: ctx.String("seccomp-profile"),
+		Login:          ctx.Bool("login"),
+	}
+	return hardening.ExecHardened(ctx.Args().Slice())
+}
+
+// debugShell runs the debug shell served by the daemon in the terminal
+func debugShell(ctx *cli.Context) error {
+	return app.DebugShell(ctx.String("socket"), os.Stdin, os.Stdout)
+}
+
 func initDaemon(config *config.MenderShellConfig) (*app.MenderShellDaemon, error) {
 	daemon := app.NewDaemon(config)
 	return daemon, nil
@@ -39,6 +58,7 @@ func runDaemon(d *app.MenderShellDaemon) error {
 		c := make(chan os.Signal, 2)
 		signal.Notify(c, syscall.SIGTERM)
 		signal.Notify(c, syscall.SIGUSR1)
+		signal.Notify(c, syscall.SIGHUP)
 		defer signal.Stop(c)
 
 		for {
@@ -48,6 +68,8 @@ func runDaemon(d *app.MenderShellDaemon) error {
 				d.StopDaemon()
 			case syscall.SIGUSR1:
 				d.PrintStatus()
+			case syscall.SIGHUP:
+				d.ReloadTLS()
 			}
 		}
 	}()
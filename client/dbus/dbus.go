@@ -34,6 +34,10 @@ type DBusCallResponse interface {
 	GetBoolean() bool
 }
 
+// MethodCallCallback handles a call to a method of an exported interface,
+// returning the string reply of the method
+type MethodCallCallback func(objectPath string, interfaceName string, methodName string) (string, error)
+
 type SignalParams struct {
 	ParamType string
 	ParamData interface{}
@@ -57,6 +61,23 @@ type DBusAPI interface {
 	HandleSignal(signalName string, params []SignalParams)
 	// WaitForSignal waits for a DBus signal
 	WaitForSignal(signalName string, timeout time.Duration) ([]SignalParams, error)
+	// BusOwnName requests a well-known name on the connection
+	BusOwnName(conn Handle, name string) uint
+	// BusUnownName releases a name requested with BusOwnName
+	BusUnownName(ownerID uint)
+	// BusRegisterInterface exports at the object path the interface
+	// described by the introspection XML
+	BusRegisterInterface(conn Handle, objectPath string, interfaceXML string) (uint, error)
+	// BusUnregisterInterface unexports an interface
+	BusUnregisterInterface(conn Handle, registrationID uint) bool
+	// RegisterMethodCallCallback registers the callback handling the calls
+	// to a method of an exported interface
+	RegisterMethodCallCallback(objectPath string, interfaceName string, methodName string, callback MethodCallCallback)
+	// UnregisterMethodCallCallback unregisters a method call callback
+	UnregisterMethodCallCallback(objectPath string, interfaceName string, methodName string)
+	// EmitSignal emits a signal with string parameters; an empty
+	// destination broadcasts the signal
+	EmitSignal(conn Handle, destination string, objectPath string, interfaceName string, signalName string, params []string) error
 }
 
 // GetDBusAPI returns the global DBusAPI object
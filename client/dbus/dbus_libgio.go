@@ -22,6 +22,7 @@ package dbus
 import "C"
 import (
 	"runtime"
+	"sync"
 	"time"
 	"unsafe"
 
@@ -29,7 +30,9 @@ import (
 )
 
 type dbusAPILibGio struct {
-	signals map[string]chan []SignalParams
+	signals      map[string]chan []SignalParams
+	methods      map[string]MethodCallCallback
+	methodsMutex sync.Mutex
 }
 
 // constants for GDBusProxyFlags
@@ -164,6 +167,132 @@ func (d *dbusAPILibGio) WaitForSignal(signalName string, timeout time.Duration)
 	}
 }
 
+// BusOwnName requests a well-known name on the connection
+// https://developer.gnome.org/gio/stable/gio-Owning-Bus-Names.html#g-bus-own-name-on-connection
+func (d *dbusAPILibGio) BusOwnName(conn Handle, name string) uint {
+	gconn := C.to_gdbusconnection(unsafe.Pointer(conn))
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	flags := C.GBusNameOwnerFlags(C.G_BUS_NAME_OWNER_FLAGS_NONE)
+	ownerID := C.g_bus_own_name_on_connection(gconn, cname, flags, nil, nil, nil, nil)
+	return uint(ownerID)
+}
+
+// BusUnownName releases a name requested with BusOwnName
+// https://developer.gnome.org/gio/stable/gio-Owning-Bus-Names.html#g-bus-unown-name
+func (d *dbusAPILibGio) BusUnownName(ownerID uint) {
+	C.g_bus_unown_name(C.guint(ownerID))
+}
+
+// BusRegisterInterface exports at the object path the interface described
+// by the introspection XML
+// https://developer.gnome.org/gio/stable/GDBusConnection.html#g-dbus-connection-register-object
+func (d *dbusAPILibGio) BusRegisterInterface(conn Handle, objectPath string, interfaceXML string) (uint, error) {
+	var gerror *C.GError
+	gconn := C.to_gdbusconnection(unsafe.Pointer(conn))
+	cobjectPath := C.CString(objectPath)
+	defer C.free(unsafe.Pointer(cobjectPath))
+	cinterfaceXML := C.CString(interfaceXML)
+	defer C.free(unsafe.Pointer(cinterfaceXML))
+	id := C.register_interface(gconn, cobjectPath, cinterfaceXML, &gerror)
+	if Handle(gerror) != nil {
+		return 0, ErrorFromNative(Handle(gerror))
+	}
+	return uint(id), nil
+}
+
+// BusUnregisterInterface unexports an interface
+// https://developer.gnome.org/gio/stable/GDBusConnection.html#g-dbus-connection-unregister-object
+func (d *dbusAPILibGio) BusUnregisterInterface(conn Handle, registrationID uint) bool {
+	gconn := C.to_gdbusconnection(unsafe.Pointer(conn))
+	return C.g_dbus_connection_unregister_object(gconn, C.guint(registrationID)) != 0
+}
+
+func methodKey(objectPath string, interfaceName string, methodName string) string {
+	return objectPath + "/" + interfaceName + "." + methodName
+}
+
+// RegisterMethodCallCallback registers the callback handling the calls to a
+// method of an exported interface
+func (d *dbusAPILibGio) RegisterMethodCallCallback(objectPath string, interfaceName string, methodName string, callback MethodCallCallback) {
+	d.methodsMutex.Lock()
+	defer d.methodsMutex.Unlock()
+	d.methods[methodKey(objectPath, interfaceName, methodName)] = callback
+}
+
+// UnregisterMethodCallCallback unregisters a method call callback
+func (d *dbusAPILibGio) UnregisterMethodCallCallback(objectPath string, interfaceName string, methodName string) {
+	d.methodsMutex.Lock()
+	defer d.methodsMutex.Unlock()
+	delete(d.methods, methodKey(objectPath, interfaceName, methodName))
+}
+
+func (d *dbusAPILibGio) getMethodCallCallback(objectPath string, interfaceName string, methodName string) MethodCallCallback {
+	d.methodsMutex.Lock()
+	defer d.methodsMutex.Unlock()
+	return d.methods[methodKey(objectPath, interfaceName, methodName)]
+}
+
+// EmitSignal emits a signal with string parameters; an empty destination
+// broadcasts the signal
+// https://developer.gnome.org/gio/stable/GDBusConnection.html#g-dbus-connection-emit-signal
+func (d *dbusAPILibGio) EmitSignal(conn Handle, destination string, objectPath string, interfaceName string, signalName string, params []string) error {
+	var gerror *C.GError
+	gconn := C.to_gdbusconnection(unsafe.Pointer(conn))
+	var cdestination *C.char
+	if destination != "" {
+		cdestination = C.CString(destination)
+		defer C.free(unsafe.Pointer(cdestination))
+	}
+	cobjectPath := C.CString(objectPath)
+	defer C.free(unsafe.Pointer(cobjectPath))
+	cinterfaceName := C.CString(interfaceName)
+	defer C.free(unsafe.Pointer(cinterfaceName))
+	csignalName := C.CString(signalName)
+	defer C.free(unsafe.Pointer(csignalName))
+
+	cparams := make([]*C.gchar, len(params)+1)
+	for i, param := range params {
+		cparams[i] = (*C.gchar)(C.CString(param))
+		defer C.free(unsafe.Pointer(cparams[i]))
+	}
+	cvalues := (**C.gchar)(C.malloc(C.size_t(len(cparams)) * C.size_t(unsafe.Sizeof(cparams[0]))))
+	defer C.free(unsafe.Pointer(cvalues))
+	copy((*[1 << 20]*C.gchar)(unsafe.Pointer(cvalues))[:len(cparams):len(cparams)], cparams)
+	tuple := C.new_strings_tuple(cvalues, C.gsize(len(params)))
+
+	C.g_dbus_connection_emit_signal(gconn, cdestination, cobjectPath, cinterfaceName, csignalName, tuple, &gerror)
+	if Handle(gerror) != nil {
+		return ErrorFromNative(Handle(gerror))
+	}
+	return nil
+}
+
+//export handle_method_call_callback
+func handle_method_call_callback(objectPath *C.gchar, interfaceName *C.gchar, methodName *C.gchar, invocation *C.GDBusMethodInvocation) {
+	goObjectPath := C.GoString(objectPath)
+	goInterfaceName := C.GoString(interfaceName)
+	goMethodName := C.GoString(methodName)
+	var callback MethodCallCallback
+	if api, ok := dbusAPI.(*dbusAPILibGio); ok {
+		callback = api.getMethodCallCallback(goObjectPath, goInterfaceName, goMethodName)
+	}
+	var result string
+	err := errors.New("unknown method " + goInterfaceName + "." + goMethodName)
+	if callback != nil {
+		result, err = callback(goObjectPath, goInterfaceName, goMethodName)
+	}
+	if err != nil {
+		cmessage := C.CString(err.Error())
+		defer C.free(unsafe.Pointer(cmessage))
+		C.return_error(invocation, cmessage)
+		return
+	}
+	cresult := C.CString(result)
+	defer C.free(unsafe.Pointer(cresult))
+	C.return_string(invocation, cresult)
+}
+
 //export handle_on_signal_callback
 func handle_on_signal_callback(proxy *C.GDBusProxy, senderName *C.gchar, signalName *C.gchar, params *C.GVariant, userData C.gpointer) {
 	goSignalName := C.GoString(signalName)
@@ -193,6 +322,7 @@ func handle_on_signal_callback(proxy *C.GDBusProxy, senderName *C.gchar, signalN
 func newDBusAPILibGio() *dbusAPILibGio {
 	return &dbusAPILibGio{
 		signals: make(map[string]chan []SignalParams),
+		methods: make(map[string]MethodCallCallback),
 	}
 }
 
@@ -63,3 +63,82 @@ static void g_signal_connect_on_proxy(GDBusProxy *proxy)
 {
     g_signal_connect(proxy, "g-signal", G_CALLBACK(on_signal), NULL);
 }
+
+// exported by golang, see dbus_libgio.go
+void handle_method_call_callback(
+    gchar *object_path,
+    gchar *interface_name,
+    gchar *method_name,
+    GDBusMethodInvocation *invocation);
+
+// method call handler of the exported interfaces
+static void on_method_call(
+    GDBusConnection *connection,
+    const gchar *sender,
+    const gchar *object_path,
+    const gchar *interface_name,
+    const gchar *method_name,
+    GVariant *parameters,
+    GDBusMethodInvocation *invocation,
+    gpointer user_data)
+{
+    handle_method_call_callback(
+        (gchar *)object_path, (gchar *)interface_name, (gchar *)method_name, invocation);
+}
+
+static const GDBusInterfaceVTable interface_vtable = {
+    on_method_call,
+    NULL,
+    NULL,
+};
+
+// registers the first interface of the introspection XML at the object path
+static guint register_interface(
+    GDBusConnection *connection,
+    const gchar *object_path,
+    const gchar *interface_xml,
+    GError **error)
+{
+    GDBusNodeInfo *node = g_dbus_node_info_new_for_xml(interface_xml, error);
+    if (node == NULL)
+    {
+        return 0;
+    }
+    if (node->interfaces == NULL || node->interfaces[0] == NULL)
+    {
+        g_dbus_node_info_unref(node);
+        g_set_error_literal(
+            error, G_IO_ERROR, G_IO_ERROR_INVALID_ARGUMENT, "no interface in the introspection XML");
+        return 0;
+    }
+    guint id = g_dbus_connection_register_object(
+        connection, object_path, node->interfaces[0], &interface_vtable, NULL, NULL, error);
+    g_dbus_node_info_unref(node);
+    return id;
+}
+
+// replies to a method call with a string
+static void return_string(GDBusMethodInvocation *invocation, const gchar *value)
+{
+    g_dbus_method_invocation_return_value(invocation, g_variant_new("(s)", value));
+}
+
+// replies to a method call with an error
+static void return_error(GDBusMethodInvocation *invocation, const gchar *message)
+{
+    g_dbus_method_invocation_return_error_literal(
+        invocation, G_DBUS_ERROR, G_DBUS_ERROR_FAILED, message);
+}
+
+// creates a new tuple of strings
+static GVariant *new_strings_tuple(gchar **values, gsize count)
+{
+    GVariant **children = g_new(GVariant *, count);
+    for (gsize i = 0; i < count; i++)
+    {
+        children[i] = g_variant_new_string(values[i]);
+    }
+    GVariant *tuple = g_variant_new_tuple(children, count);
+    g_free(children);
+    return tuple;
+}
@@ -49,6 +49,20 @@ func (_m *DBusAPI) BusGet(_a0 uint) (dbus.Handle, error) {
 	return r0, r1
 }
 
+// BusOwnName provides a mock function with given fields: conn, name
+func (_m *DBusAPI) BusOwnName(conn dbus.Handle, name string) uint {
+	ret := _m.Called(conn, name)
+
+	var r0 uint
+	if rf, ok := ret.Get(0).(func(dbus.Handle, string) uint); ok {
+		r0 = rf(conn, name)
+	} else {
+		r0 = ret.Get(0).(uint)
+	}
+
+	return r0
+}
+
 // BusProxyCall provides a mock function with given fields: _a0, _a1, _a2, _a3
 func (_m *DBusAPI) BusProxyCall(_a0 dbus.Handle, _a1 string, _a2 interface{}, _a3 int) (dbus.DBusCallResponse, error) {
 	ret := _m.Called(_a0, _a1, _a2, _a3)
@@ -93,6 +107,60 @@ func (_m *DBusAPI) BusProxyNew(_a0 dbus.Handle, _a1 string, _a2 string, _a3 stri
 	return r0, r1
 }
 
+// BusRegisterInterface provides a mock function with given fields: conn, objectPath, interfaceXML
+func (_m *DBusAPI) BusRegisterInterface(conn dbus.Handle, objectPath string, interfaceXML string) (uint, error) {
+	ret := _m.Called(conn, objectPath, interfaceXML)
+
+	var r0 uint
+	if rf, ok := ret.Get(0).(func(dbus.Handle, string, string) uint); ok {
+		r0 = rf(conn, objectPath, interfaceXML)
+	} else {
+		r0 = ret.Get(0).(uint)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(dbus.Handle, string, string) error); ok {
+		r1 = rf(conn, objectPath, interfaceXML)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// BusUnownName provides a mock function with given fields: ownerID
+func (_m *DBusAPI) BusUnownName(ownerID uint) {
+	_m.Called(ownerID)
+}
+
+// BusUnregisterInterface provides a mock function with given fields: conn, registrationID
+func (_m *DBusAPI) BusUnregisterInterface(conn dbus.Handle, registrationID uint) bool {
+	ret := _m.Called(conn, registrationID)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(dbus.Handle, uint) bool); ok {
+		r0 = rf(conn, registrationID)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	return r0
+}
+
+// EmitSignal provides a mock function with given fields: conn, destination, objectPath, interfaceName, signalName, params
+func (_m *DBusAPI) EmitSignal(conn dbus.Handle, destination string, objectPath string, interfaceName string, signalName string, params []string) error {
+	ret := _m.Called(conn, destination, objectPath, interfaceName, signalName, params)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(dbus.Handle, string, string, string, string, []string) error); ok {
+		r0 = rf(conn, destination, objectPath, interfaceName, signalName, params)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // HandleSignal provides a mock function with given fields: signalName
 func (_m *DBusAPI) HandleSignal(signalName string, params []dbus.SignalParams) {
 	_m.Called(signalName)
@@ -122,6 +190,16 @@ func (_m *DBusAPI) MainLoopRun(_a0 dbus.MainLoop) {
 	_m.Called(_a0)
 }
 
+// RegisterMethodCallCallback provides a mock function with given fields: objectPath, interfaceName, methodName, callback
+func (_m *DBusAPI) RegisterMethodCallCallback(objectPath string, interfaceName string, methodName string, callback dbus.MethodCallCallback) {
+	_m.Called(objectPath, interfaceName, methodName, callback)
+}
+
+// UnregisterMethodCallCallback provides a mock function with given fields: objectPath, interfaceName, methodName
+func (_m *DBusAPI) UnregisterMethodCallCallback(objectPath string, interfaceName string, methodName string) {
+	_m.Called(objectPath, interfaceName, methodName)
+}
+
 // WaitForSignal provides a mock function with given fields: signalName, timeout
 func (_m *DBusAPI) WaitForSignal(signalName string, timeout time.Duration) ([]dbus.SignalParams, error) {
 	ret := _m.Called(signalName, timeout)
@@ -33,15 +33,18 @@ const (
 
 var timeout = 10 * time.Second
 
-// AuthClient is the interface for the Mender Authentication Manager clilents
-type AuthClient interface {
-	// Connect to the Mender client interface
-	Connect(objectName, objectPath, interfaceName string) error
+// AuthProvider is the interface of the sources of the device JWT token: the
+// Mender Authentication Manager over D-Bus, a token file, or the local API
+// of mender-auth over HTTP
+type AuthProvider interface {
+	// Connect to the provider
+	Connect() error
 	// GetJWTToken returns a device JWT token
 	GetJWTToken() (string, error)
 	// FetchJWTToken schedules the fetching of a new device JWT token
 	FetchJWTToken() (bool, error)
-	// WaitForJwtTokenStateChange synchronously waits for the JwtTokenStateChange signal
+	// WaitForJwtTokenStateChange synchronously waits for the token to
+	// change, returning the new one as the JwtTokenStateChange signal does
 	WaitForJwtTokenStateChange() ([]dbus.SignalParams, error)
 }
 
@@ -53,8 +56,9 @@ type AuthClientDBUS struct {
 	authManagerProxy dbus.Handle
 }
 
-// NewAuthClient returns a new AuthClient
-func NewAuthClient(dbusAPI dbus.DBusAPI) (AuthClient, error) {
+// NewAuthClient returns a new AuthProvider talking to the Mender
+// Authentication Manager over D-Bus
+func NewAuthClient(dbusAPI dbus.DBusAPI) (AuthProvider, error) {
 	if dbusAPI == nil {
 		var err error
 		dbusAPI, err = dbus.GetDBusAPI()
@@ -68,12 +72,13 @@ func NewAuthClient(dbusAPI dbus.DBusAPI) (AuthClient, error) {
 }
 
 // Connect to the Mender client interface
-func (a *AuthClientDBUS) Connect(objectName, objectPath, interfaceName string) error {
+func (a *AuthClientDBUS) Connect() error {
 	dbusConnection, err := a.dbusAPI.BusGet(dbus.GBusTypeSystem)
 	if err != nil {
 		return err
 	}
-	authManagerProxy, err := a.dbusAPI.BusProxyNew(dbusConnection, objectName, objectPath, interfaceName)
+	authManagerProxy, err := a.dbusAPI.BusProxyNew(dbusConnection, DBusObjectName, DBusObjectPath,
+		DBusInterfaceName)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,93 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mender
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mendersoftware/mender-connect/client/dbus"
+)
+
+// AuthClientFile is the implementation of the client which reads the
+// device JWT from a file kept up to date by another agent, for the
+// systems without the mender-client
+type AuthClientFile struct {
+	tokenFile     string
+	serverURLFile string
+	poller        *tokenPoller
+}
+
+// NewAuthClientFile returns a new AuthProvider reading the JWT from the
+// token file, and the server URL from the server URL file if not empty
+func NewAuthClientFile(tokenFile, serverURLFile string) *AuthClientFile {
+	return &AuthClientFile{
+		tokenFile:     tokenFile,
+		serverURLFile: serverURLFile,
+		poller: newTokenPoller(func() (string, error) {
+			return readFile(tokenFile)
+		}),
+	}
+}
+
+// readFile returns the trimmed content of the file, empty if it does not exist
+func readFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Connect checks the token file may be read
+func (a *AuthClientFile) Connect() error {
+	_, err := readFile(a.tokenFile)
+	return err
+}
+
+// GetJWTToken returns the device JWT token of the file, empty if there is
+// no file yet
+func (a *AuthClientFile) GetJWTToken() (string, error) {
+	return a.poller.get()
+}
+
+// FetchJWTToken cannot ask the agent for a new token; it only has the file
+// read again right away
+func (a *AuthClientFile) FetchJWTToken() (bool, error) {
+	a.poller.refresh()
+	return true, nil
+}
+
+// WaitForJwtTokenStateChange waits for the content of the token file to
+// change, returning the new token like the JwtTokenStateChange signal does
+func (a *AuthClientFile) WaitForJwtTokenStateChange() ([]dbus.SignalParams, error) {
+	return a.poller.wait()
+}
+
+// ServerURL returns the server URL of the server URL file, empty if there
+// is none
+func (a *AuthClientFile) ServerURL() (string, error) {
+	if a.serverURLFile == "" {
+		return "", nil
+	}
+	serverURL, err := readFile(a.serverURLFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(serverURL, "/"), nil
+}
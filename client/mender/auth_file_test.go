@@ -0,0 +1,78 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mender
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/client/dbus"
+)
+
+func TestAuthClientFile(t *testing.T) {
+	defer func(t, interval time.Duration) {
+		timeout = t
+		pollInterval = interval
+	}(timeout, pollInterval)
+	timeout = 200 * time.Millisecond
+	pollInterval = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "auth-file")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	serverURLFile := filepath.Join(dir, "server")
+
+	var client AuthProvider = NewAuthClientFile(tokenFile, serverURLFile)
+	assert.NoError(t, client.Connect())
+
+	// no token yet
+	token, err := client.GetJWTToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "", token)
+	p, err := client.WaitForJwtTokenStateChange()
+	assert.Error(t, err)
+	assert.Empty(t, p)
+
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("first-token\n"), 0600))
+	p, err = client.WaitForJwtTokenStateChange()
+	assert.NoError(t, err)
+	assert.Equal(t, []dbus.SignalParams{{ParamType: dbus.GDBusTypeString, ParamData: "first-token"}}, p)
+	token, err = client.GetJWTToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "first-token", token)
+
+	// the token is removed
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte{}, 0600))
+	fetched, err := client.FetchJWTToken()
+	assert.NoError(t, err)
+	assert.True(t, fetched)
+	p, err = client.WaitForJwtTokenStateChange()
+	assert.NoError(t, err)
+	assert.Equal(t, []dbus.SignalParams{{ParamType: dbus.GDBusTypeString, ParamData: ""}}, p)
+
+	serverURL, err := client.(*AuthClientFile).ServerURL()
+	assert.NoError(t, err)
+	assert.Equal(t, "", serverURL)
+	assert.NoError(t, ioutil.WriteFile(serverURLFile, []byte("https://hosted.mender.io/\n"), 0600))
+	serverURL, err = client.(*AuthClientFile).ServerURL()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://hosted.mender.io", serverURL)
+}
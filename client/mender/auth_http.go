@@ -0,0 +1,142 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mender
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/mender-connect/client/dbus"
+)
+
+// Paths of the local API of mender-auth
+const (
+	HTTPPathToken      = "/token"
+	HTTPPathFetchToken = "/token/fetch"
+)
+
+// HTTPToken is the body of the token responses of the local API: the token
+// is empty while the device is not authorized
+type HTTPToken struct {
+	Token     string `json:"token"`
+	ServerURL string `json:"server_url"`
+}
+
+// AuthClientHTTP is the implementation of the client for the local API of
+// mender-auth, reached over HTTP, for the containers without D-Bus
+type AuthClientHTTP struct {
+	baseURL   string
+	client    *http.Client
+	poller    *tokenPoller
+	mutex     sync.Mutex
+	serverURL string
+}
+
+// NewAuthClientHTTP returns a new AuthProvider talking to the local API at
+// the http:// or https:// URL, or over the unix:// socket
+func NewAuthClientHTTP(apiURL string) (*AuthClientHTTP, error) {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{}
+	switch u.Scheme {
+	case "http", "https":
+	case "unix":
+		socket := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		u = &url.URL{Scheme: "http", Host: "localhost"}
+	default:
+		return nil, errors.New("unsupported scheme of the mender-auth URL: " + apiURL)
+	}
+	a := &AuthClientHTTP{
+		baseURL: strings.TrimSuffix(u.String(), "/"),
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   DBusMethodTimeoutInMilliSeconds * time.Millisecond,
+		},
+	}
+	a.poller = newTokenPoller(a.readToken)
+	return a, nil
+}
+
+// readToken asks the local API for the token
+func (a *AuthClientHTTP) readToken() (string, error) {
+	response, err := a.client.Get(a.baseURL + HTTPPathToken)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", errors.New("failed to get the token from mender-auth: " + response.Status)
+	}
+	var token HTTPToken
+	if err = json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	a.mutex.Lock()
+	a.serverURL = strings.TrimSuffix(token.ServerURL, "/")
+	a.mutex.Unlock()
+	return token.Token, nil
+}
+
+// Connect checks the local API answers
+func (a *AuthClientHTTP) Connect() error {
+	_, err := a.readToken()
+	return err
+}
+
+// GetJWTToken returns a device JWT token
+func (a *AuthClientHTTP) GetJWTToken() (string, error) {
+	return a.poller.get()
+}
+
+// FetchJWTToken schedules the fetching of a new device JWT token
+func (a *AuthClientHTTP) FetchJWTToken() (bool, error) {
+	response, err := a.client.Post(a.baseURL+HTTPPathFetchToken, "application/json", nil)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return false, nil
+	}
+	a.poller.refresh()
+	return true, nil
+}
+
+// WaitForJwtTokenStateChange polls the local API until the token changes,
+// returning the new token like the JwtTokenStateChange signal does
+func (a *AuthClientHTTP) WaitForJwtTokenStateChange() ([]dbus.SignalParams, error) {
+	return a.poller.wait()
+}
+
+// ServerURL returns the server URL the token was issued by, empty if the
+// local API did not tell
+func (a *AuthClientHTTP) ServerURL() (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.serverURL, nil
+}
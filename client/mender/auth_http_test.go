@@ -0,0 +1,120 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mender
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/client/dbus"
+)
+
+// fakeAuthAPI serves the token of the local API of mender-auth, issuing
+// the next one when asked to fetch
+type fakeAuthAPI struct {
+	mutex   sync.Mutex
+	tokens  []string
+	fetches int
+}
+
+func (f *fakeAuthAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == HTTPPathToken:
+		_ = json.NewEncoder(w).Encode(HTTPToken{
+			Token:     f.tokens[0],
+			ServerURL: "https://hosted.mender.io/",
+		})
+	case r.Method == http.MethodPost && r.URL.Path == HTTPPathFetchToken:
+		f.fetches++
+		if len(f.tokens) > 1 {
+			f.tokens = f.tokens[1:]
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestAuthClientHTTP(t *testing.T) {
+	defer func(t, interval time.Duration) {
+		timeout = t
+		pollInterval = interval
+	}(timeout, pollInterval)
+	timeout = 200 * time.Millisecond
+	pollInterval = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "auth-http")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fake := &fakeAuthAPI{}
+	s := httptest.NewServer(fake)
+	defer s.Close()
+	socket := filepath.Join(dir, "auth.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	unixServer := httptest.NewUnstartedServer(fake)
+	unixServer.Listener = listener
+	unixServer.Start()
+	defer unixServer.Close()
+
+	for name, apiURL := range map[string]string{
+		"http": s.URL + "/",
+		"unix": "unix://" + socket,
+	} {
+		t.Run(name, func(t *testing.T) {
+			fake.tokens = []string{"", "first-token"}
+			client, err := NewAuthClientHTTP(apiURL)
+			assert.NoError(t, err)
+			var provider AuthProvider = client
+			assert.NoError(t, provider.Connect())
+
+			// not authorized yet
+			token, err := provider.GetJWTToken()
+			assert.NoError(t, err)
+			assert.Equal(t, "", token)
+			_, err = provider.WaitForJwtTokenStateChange()
+			assert.Error(t, err)
+
+			fetched, err := provider.FetchJWTToken()
+			assert.NoError(t, err)
+			assert.True(t, fetched)
+			p, err := provider.WaitForJwtTokenStateChange()
+			assert.NoError(t, err)
+			assert.Equal(t, []dbus.SignalParams{{ParamType: dbus.GDBusTypeString, ParamData: "first-token"}}, p)
+
+			serverURL, err := client.ServerURL()
+			assert.NoError(t, err)
+			assert.Equal(t, "https://hosted.mender.io", serverURL)
+		})
+	}
+
+	_, err = NewAuthClientHTTP("ftp://localhost")
+	assert.Error(t, err)
+	client, err := NewAuthClientHTTP("unix://" + filepath.Join(dir, "none.sock"))
+	assert.NoError(t, err)
+	assert.Error(t, client.Connect())
+}
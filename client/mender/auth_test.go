@@ -84,7 +84,7 @@ func TestAuthClientConnect(t *testing.T) {
 			assert.NoError(t, err)
 			assert.NotNil(t, client)
 
-			err = client.Connect(DBusObjectName, DBusObjectPath, DBusInterfaceName)
+			err = client.Connect()
 			if tc.busGetError != nil {
 				assert.Error(t, err, tc.busGetError)
 			} else if tc.busProxyNewError != nil {
@@ -21,18 +21,18 @@ import (
 	mock "github.com/stretchr/testify/mock"
 )
 
-// AuthClient is an autogenerated mock type for the AuthClient type
-type AuthClient struct {
+// AuthProvider is an autogenerated mock type for the AuthProvider type
+type AuthProvider struct {
 	mock.Mock
 }
 
-// Connect provides a mock function with given fields: objectName, objectPath, interfaceName
-func (_m *AuthClient) Connect(objectName string, objectPath string, interfaceName string) error {
-	ret := _m.Called(objectName, objectPath, interfaceName)
+// Connect provides a mock function with given fields:
+func (_m *AuthProvider) Connect() error {
+	ret := _m.Called()
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, string, string) error); ok {
-		r0 = rf(objectName, objectPath, interfaceName)
+	if rf, ok := ret.Get(0).(func() error); ok {
+		r0 = rf()
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -41,7 +41,7 @@ func (_m *AuthClient) Connect(objectName string, objectPath string, interfaceNam
 }
 
 // FetchJWTToken provides a mock function with given fields:
-func (_m *AuthClient) FetchJWTToken() (bool, error) {
+func (_m *AuthProvider) FetchJWTToken() (bool, error) {
 	ret := _m.Called()
 
 	var r0 bool
@@ -62,7 +62,7 @@ func (_m *AuthClient) FetchJWTToken() (bool, error) {
 }
 
 // GetJWTToken provides a mock function with given fields:
-func (_m *AuthClient) GetJWTToken() (string, error) {
+func (_m *AuthProvider) GetJWTToken() (string, error) {
 	ret := _m.Called()
 
 	var r0 string
@@ -83,7 +83,7 @@ func (_m *AuthClient) GetJWTToken() (string, error) {
 }
 
 // WaitForJwtTokenStateChange provides a mock function with given fields:
-func (_m *AuthClient) WaitForJwtTokenStateChange() ([]dbus.SignalParams, error) {
+func (_m *AuthProvider) WaitForJwtTokenStateChange() ([]dbus.SignalParams, error) {
 	ret := _m.Called()
 
 	var r0 []dbus.SignalParams
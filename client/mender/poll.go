@@ -0,0 +1,92 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mender
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/mender-connect/client/dbus"
+)
+
+// Interval between the reads of the token while waiting for it to change
+var pollInterval = time.Second
+
+// tokenPoller detects the changes of a token read periodically, for the
+// providers which do not signal them
+type tokenPoller struct {
+	read func() (string, error)
+	// the token last returned
+	token string
+	mutex sync.Mutex
+	fetch chan struct{}
+}
+
+func newTokenPoller(read func() (string, error)) *tokenPoller {
+	return &tokenPoller{
+		read:  read,
+		fetch: make(chan struct{}, 1),
+	}
+}
+
+// get reads the token
+func (p *tokenPoller) get() (string, error) {
+	token, err := p.read()
+	if err != nil {
+		return "", err
+	}
+	p.mutex.Lock()
+	p.token = token
+	p.mutex.Unlock()
+	return token, nil
+}
+
+// refresh has the token read again right away
+func (p *tokenPoller) refresh() {
+	select {
+	case p.fetch <- struct{}{}:
+	default:
+	}
+}
+
+// wait reads the token until it changes, returning the new one as the
+// JwtTokenStateChange signal does
+func (p *tokenPoller) wait() ([]dbus.SignalParams, error) {
+	deadline := time.After(timeout)
+	for {
+		token, err := p.read()
+		if err == nil {
+			p.mutex.Lock()
+			changed := token != p.token
+			p.token = token
+			p.mutex.Unlock()
+			if changed {
+				return []dbus.SignalParams{
+					{
+						ParamType: dbus.GDBusTypeString,
+						ParamData: token,
+					},
+				}, nil
+			}
+		}
+		select {
+		case <-p.fetch:
+		case <-time.After(pollInterval):
+		case <-deadline:
+			return []dbus.SignalParams{}, errors.New("timeout waiting for the token to change")
+		}
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package codec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// CBOR major types
+const (
+	cborUint   = 0
+	cborNegint = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+// CBOR simple values and additional information
+const (
+	cborFalse      = 20
+	cborTrue       = 21
+	cborNull       = 22
+	cborUndefined  = 23
+	cborFloat16    = 25
+	cborFloat32    = 26
+	cborFloat64    = 27
+	cborIndefinite = 31
+	cborBreak      = 0xff
+)
+
+// maximum nesting of the decoded arrays and maps
+const cborMaxDepth = 64
+
+var (
+	ErrCBORTruncated = errors.New("cbor: unexpected end of data")
+	ErrCBORMalformed = errors.New("cbor: malformed data")
+)
+
+// cborCodec encodes the JSON data model of the values (RFC 8949, section
+// 6.2), so the values map to CBOR the way they map to JSON, through their
+// json struct tags; byte strings are decoded as the base64 text JSON
+// expects them to be
+type cborCodec struct{}
+
+func (cborCodec) Name() string {
+	return NameCBOR
+}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := cborEncode(buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	d := &cborDecoder{data: data}
+	value, err := d.decode(0)
+	if err != nil {
+		return err
+	}
+	if d.offset != len(data) {
+		return ErrCBORMalformed
+	}
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonData, v)
+}
+
+func cborHead(buf *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		_ = binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		_ = binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major | 27)
+		_ = binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// cborEncode encodes a value decoded from JSON with UseNumber
+func cborEncode(buf *bytes.Buffer, value interface{}) error {
+	switch value := value.(type) {
+	case nil:
+		buf.WriteByte(cborSimple<<5 | cborNull)
+	case bool:
+		if value {
+			buf.WriteByte(cborSimple<<5 | cborTrue)
+		} else {
+			buf.WriteByte(cborSimple<<5 | cborFalse)
+		}
+	case json.Number:
+		if n, err := strconv.ParseUint(string(value), 10, 64); err == nil {
+			cborHead(buf, cborUint, n)
+		} else if n, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+			cborHead(buf, cborNegint, uint64(-(n + 1)))
+		} else if f, err := value.Float64(); err == nil {
+			buf.WriteByte(cborSimple<<5 | cborFloat64)
+			_ = binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		} else {
+			return err
+		}
+	case string:
+		cborHead(buf, cborText, uint64(len(value)))
+		buf.WriteString(value)
+	case []interface{}:
+		cborHead(buf, cborArray, uint64(len(value)))
+		for _, item := range value {
+			if err := cborEncode(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		// sorted, for the encoding to be deterministic
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		cborHead(buf, cborMap, uint64(len(keys)))
+		for _, key := range keys {
+			cborHead(buf, cborText, uint64(len(key)))
+			buf.WriteString(key)
+			if err := cborEncode(buf, value[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return ErrCBORMalformed
+	}
+	return nil
+}
+
+type cborDecoder struct {
+	data   []byte
+	offset int
+}
+
+func (d *cborDecoder) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.offset) {
+		return nil, ErrCBORTruncated
+	}
+	b := d.data[d.offset : d.offset+int(n)]
+	d.offset += int(n)
+	return b, nil
+}
+
+// head reads the major type and the argument of the next item; indefinite
+// tells that the length of the item is not given
+func (d *cborDecoder) head() (major byte, info byte, n uint64, err error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info = b[0]>>5, b[0]&0x1f
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		b, err = d.next(1 << (info - 24))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+	case info == cborIndefinite && major != cborUint && major != cborNegint && major != cborTag:
+	default:
+		return 0, 0, 0, ErrCBORMalformed
+	}
+	return major, info, n, nil
+}
+
+func (d *cborDecoder) atBreak() bool {
+	if d.offset < len(d.data) && d.data[d.offset] == cborBreak {
+		d.offset++
+		return true
+	}
+	return false
+}
+
+// decode returns the next item, in the form encoding/json decodes into
+// an empty interface
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > cborMaxDepth {
+		return nil, ErrCBORMalformed
+	}
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	indefinite := info == cborIndefinite
+	switch major {
+	case cborUint:
+		return n, nil
+	case cborNegint:
+		if n > math.MaxInt64 {
+			return -1 - float64(n), nil
+		}
+		return -1 - int64(n), nil
+	case cborBytes, cborText:
+		s, err := d.decodeString(major, n, indefinite)
+		if err != nil {
+			return nil, err
+		}
+		if major == cborBytes {
+			return base64.StdEncoding.EncodeToString(s), nil
+		}
+		return string(s), nil
+	case cborArray:
+		array := []interface{}{}
+		for i := uint64(0); indefinite || i < n; i++ {
+			if indefinite && d.atBreak() {
+				break
+			}
+			item, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, item)
+		}
+		return array, nil
+	case cborMap:
+		object := map[string]interface{}{}
+		for i := uint64(0); indefinite || i < n; i++ {
+			if indefinite && d.atBreak() {
+				break
+			}
+			key, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, ErrCBORMalformed
+			}
+			if object[name], err = d.decode(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return object, nil
+	case cborTag:
+		// the tags only add semantics to the item they enclose
+		return d.decode(depth + 1)
+	default:
+		return d.decodeSimple(info, n)
+	}
+}
+
+func (d *cborDecoder) decodeString(major byte, n uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		return d.next(n)
+	}
+	// indefinite length strings are sequences of definite length chunks
+	s := []byte{}
+	for !d.atBreak() {
+		chunkMajor, info, n, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor != major || info == cborIndefinite {
+			return nil, ErrCBORMalformed
+		}
+		chunk, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, chunk...)
+	}
+	return s, nil
+}
+
+func (d *cborDecoder) decodeSimple(info byte, n uint64) (interface{}, error) {
+	switch info {
+	case cborFalse:
+		return false, nil
+	case cborTrue:
+		return true, nil
+	case cborNull, cborUndefined:
+		return nil, nil
+	case cborFloat16:
+		return float16(uint16(n)), nil
+	case cborFloat32:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case cborFloat64:
+		return math.Float64frombits(n), nil
+	}
+	return nil, ErrCBORMalformed
+}
+
+// float16 converts an IEEE 754 half precision float
+func float16(h uint16) float64 {
+	exponent := int(h>>10) & 0x1f
+	mantissa := float64(h & 0x3ff)
+	var f float64
+	switch exponent {
+	case 0:
+		f = math.Ldexp(mantissa, -24)
+	case 0x1f:
+		if mantissa == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mantissa+1024, exponent-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package codec
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCBORMarshal(t *testing.T) {
+	// examples of RFC 8949, appendix A
+	testCases := map[string]struct {
+		value interface{}
+		data  string
+	}{
+		"zero":     {value: 0, data: "00"},
+		"small":    {value: 23, data: "17"},
+		"uint8":    {value: 100, data: "1864"},
+		"uint16":   {value: 1000, data: "1903e8"},
+		"uint64":   {value: uint64(18446744073709551615), data: "1bffffffffffffffff"},
+		"negative": {value: -1000, data: "3903e7"},
+		"float":    {value: 1.1, data: "fb3ff199999999999a"},
+		"false":    {value: false, data: "f4"},
+		"null":     {value: nil, data: "f6"},
+		"text":     {value: "ü", data: "62c3bc"},
+		"array":    {value: []interface{}{1, []int{2, 3}}, data: "8201820203"},
+		"map": {
+			value: map[string]interface{}{"b": []int{2, 3}, "a": 1},
+			data:  "a26161016162820203",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			data, err := CBOR.Marshal(tc.value)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.data, hex.EncodeToString(data))
+		})
+	}
+}
+
+func TestCBORUnmarshal(t *testing.T) {
+	testCases := map[string]struct {
+		data  string
+		value interface{}
+		err   error
+	}{
+		"uint": {data: "1903e8", value: float64(1000)},
+		"negative": {
+			data:  "3903e7",
+			value: float64(-1000),
+		},
+		"float16":   {data: "f93e00", value: 1.5},
+		"float32":   {data: "fa47c35000", value: float64(100000)},
+		"tagged":    {data: "c11a514b67b0", value: float64(1363896240)},
+		"undefined": {data: "f7", value: nil},
+		"bytes":     {data: "4401020304", value: "AQIDBA=="},
+		"indefinite text": {
+			data:  "7f657374726561646d696e67ff",
+			value: "streaming",
+		},
+		"indefinite array": {
+			data:  "9f018202039f0405ffff",
+			value: []interface{}{float64(1), []interface{}{float64(2), float64(3)}, []interface{}{float64(4), float64(5)}},
+		},
+		"indefinite map": {
+			data:  "bf6346756ef563416d7421ff",
+			value: map[string]interface{}{"Fun": true, "Amt": float64(-2)},
+		},
+		"truncated":        {data: "1903", err: ErrCBORTruncated},
+		"trailing data":    {data: "0000", err: ErrCBORMalformed},
+		"unexpected break": {data: "ff", err: ErrCBORMalformed},
+		"non text key":     {data: "a10102", err: ErrCBORMalformed},
+		"huge length":      {data: "5bffffffffffffffff", err: ErrCBORTruncated},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			data, err := hex.DecodeString(tc.data)
+			assert.NoError(t, err)
+			var value interface{}
+			err = CBOR.Unmarshal(data, &value)
+			if tc.err != nil {
+				assert.Equal(t, tc.err, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.value, value)
+		})
+	}
+}
+
+func TestCBORBytes(t *testing.T) {
+	type body struct {
+		Data []byte `json:"data"`
+	}
+	data, err := CBOR.Marshal(&body{Data: []byte{1, 2, 3, 4}})
+	assert.NoError(t, err)
+	decoded := &body{}
+	assert.NoError(t, CBOR.Unmarshal(data, decoded))
+	assert.Equal(t, []byte{1, 2, 3, 4}, decoded.Data)
+
+	// byte strings decode the way JSON expects them
+	data, err = hex.DecodeString("a164646174614401020304")
+	assert.NoError(t, err)
+	decoded = &body{}
+	assert.NoError(t, CBOR.Unmarshal(data, decoded))
+	assert.Equal(t, []byte{1, 2, 3, 4}, decoded.Data)
+}
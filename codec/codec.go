@@ -0,0 +1,92 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// Names of the available body encodings
+const (
+	NameMsgpack = "msgpack"
+	NameJSON    = "json"
+	NameCBOR    = "cbor"
+)
+
+var ErrUnknownCodec = errors.New("unknown body encoding")
+
+// Codec encodes and decodes the bodies of the messages; the envelope
+// (ws.ProtoMsg) is always msgpack encoded, as the server expects it
+type Codec interface {
+	// Name returns the name the encoding is negotiated with
+	Name() string
+	// Marshal encodes v
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes data into v
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return NameMsgpack
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return NameJSON
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+var (
+	// Msgpack is the default codec, used unless another one is negotiated
+	Msgpack Codec = msgpackCodec{}
+	// JSON eases debugging and the interoperability with other tools
+	JSON Codec = jsonCodec{}
+	// CBOR is a compact binary encoding of the JSON data model
+	CBOR Codec = cborCodec{}
+)
+
+var codecs = map[string]Codec{
+	NameMsgpack: Msgpack,
+	NameJSON:    JSON,
+	NameCBOR:    CBOR,
+}
+
+// Get returns the codec with the given name
+func Get(name string) (Codec, error) {
+	if c, ok := codecs[name]; ok {
+		return c, nil
+	}
+	return nil, ErrUnknownCodec
+}
@@ -0,0 +1,46 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package codec
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testBody struct {
+	Name     string `msgpack:"name" json:"name"`
+	Versions []int  `msgpack:"versions" json:"versions"`
+}
+
+func TestCodecs(t *testing.T) {
+	for _, name := range []string{NameMsgpack, NameJSON, NameCBOR} {
+		t.Run(name, func(t *testing.T) {
+			c, err := Get(name)
+			assert.NoError(t, err)
+			assert.Equal(t, name, c.Name())
+
+			data, err := c.Marshal(&testBody{Name: "open", Versions: []int{1, 2}})
+			assert.NoError(t, err)
+			body := &testBody{}
+			err = c.Unmarshal(data, body)
+			assert.NoError(t, err)
+			assert.Equal(t, &testBody{Name: "open", Versions: []int{1, 2}}, body)
+		})
+	}
+
+	c, err := Get("xml")
+	assert.Equal(t, ErrUnknownCodec, err)
+	assert.Nil(t, c)
+}
@@ -18,23 +18,88 @@ import (
 	"bufio"
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
 
+	"github.com/mendersoftware/go-lib-micro/ws"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 
 	"github.com/mendersoftware/mender-connect/client/https"
+	"github.com/mendersoftware/mender-connect/codec"
 )
 
 const httpsSchema = "https"
 
+// ProtoTypeProcesses is the process management protocol, it is not part
+// of the vendored ws package; 2 to 4 are taken by the file transfer, port
+// forward and mender-client protocols
+const ProtoTypeProcesses ws.ProtoType = 0x0005
+
+// ProtocolsByName maps the protocol names used in AllowedProtocols
+// to the protocol types
+var ProtocolsByName = map[string]ws.ProtoType{
+	"shell":     ws.ProtoTypeShell,
+	"processes": ProtoTypeProcesses,
+}
+
+// Policies applied when the maximum number of concurrent sessions is reached
+const (
+	SessionsLimitPolicyRejectNew       = "reject-new"
+	SessionsLimitPolicyEvictOldestIdle = "evict-oldest-idle"
+)
+
+// Terminal multiplexers the terminals may attach to
+const (
+	MultiplexerTmux   = "tmux"
+	MultiplexerScreen = "screen"
+)
+
+// Backends the device JWT comes from
+const (
+	AuthBackendDBus = "dbus"
+	AuthBackendFile = "file"
+	AuthBackendHTTP = "http"
+)
+
+// Policies applied to the operator of a terminal taken over by another
+// session
+const (
+	TakeoverPolicyDisconnect = "disconnect"
+	TakeoverPolicyObserve    = "observe"
+)
+
+// Actions taken when the JWT token authorizing the sessions expires
+const (
+	TokenExpiryActionTerminate   = "terminate"
+	TokenExpiryActionReauthorize = "reauthorize"
+)
+
 type TerminalConfig struct {
 	Width  uint16
 	Height uint16
+	// Glob patterns of the TERM values the server may request for a
+	// terminal, e.g. "xterm*"; empty allows DefaultAllowedTerminalTypes
+	AllowedTypes []string
+	// Glob patterns of the LANG and LC_* values the server may request
+	// for a terminal, e.g. "*.UTF-8"; empty allows DefaultAllowedLocales
+	AllowedLocales []string
+	// Number of idle shells started ahead of the terminals, which the
+	// terminals with the default settings take over instead of starting
+	// their own shell; 0 disables them
+	WarmShells uint32
+	// Max bytes per second of output sent by a terminal, the output above
+	// it is dropped; 0 means no limit
+	MaxOutputBytesPerSecond uint32
 }
 
 type SessionsConfig struct {
@@ -44,8 +109,380 @@ type SessionsConfig struct {
 	ExpireAfter uint32
 	// Seconds after last activity of a sessions that will make it expire
 	ExpireAfterIdle uint32
+	// Seconds without terminal input or output after which the shell is
+	// hung up, independently of ExpireAfterIdle; 0 disables it
+	ShellIdleTimeout uint32
+	// Seconds the idle shell is given to exit after the hang up, before
+	// it is killed
+	ShellIdleGracePeriod uint32
+	// Seconds before ShellIdleTimeout at which a warning is written to
+	// the terminal, 0 hangs up the shell without warning
+	ShellIdleWarning uint32
+	// Text of the warning, by default it tells the time left
+	ShellIdleWarningText string
 	// Max sessions per user
 	MaxPerUser uint32
+	// Max shells running at the same time per user, 0 means no limit
+	MaxShellSessionsPerUser uint32
+	// Max terminals open at the same time in a session, as streams of
+	// the session, 0 means no limit
+	MaxTerminalsPerSession uint32
+	// Number of sessions per hour above which an alert is logged
+	AlertAfterPerHour uint32
+	// Seconds to wait for the sessions to close when shutting down
+	DrainTimeout uint32
+	// Seconds to wait for a protocol handler to close
+	HandlerCloseTimeout uint32
+	// Seconds after the last message of a protocol handler that will
+	// make it close, 0 keeps it until the session closes
+	HandlerIdleTimeout uint32
+	// Seconds the message ids are remembered for, to detect the
+	// messages received twice
+	DedupWindow uint32
+	// Max concurrent sessions, 0 means no limit
+	MaxConcurrent uint32
+	// What to do when MaxConcurrent is reached: "reject-new" (default)
+	// or "evict-oldest-idle"
+	MaxConcurrentPolicy string
+	// Max messages per second a session may send for a protocol,
+	// 0 means no limit
+	MaxMessagesPerSecond uint32
+	// Per protocol overrides of MaxMessagesPerSecond, keyed by protocol name
+	ProtocolMaxMessagesPerSecond map[string]uint32
+	// What to do when the JWT token which authorized a session expires:
+	// nothing (default), "terminate" the session, or "reauthorize" it
+	// with a refreshed token, terminating it if none comes in time
+	TokenExpiryAction string
+	// Seconds a refreshed token may take to come before the sessions
+	// are terminated, with the "reauthorize" action
+	TokenExpiryGracePeriod uint32
+}
+
+// HooksConfig holds the scripts executed on the session lifecycle events,
+// an empty path disables the hook
+type HooksConfig struct {
+	// Script executed when a session is opened
+	SessionOpen string
+	// Script executed when a protocol handler starts within a session
+	HandlerStart string
+	// Script executed when a session is closed
+	SessionClose string
+	// Seconds after which a running hook is killed
+	TimeoutSeconds uint32
+	// Script which must approve the shells before they spawn, exiting
+	// with 0, e.g. asking for the consent of the local user on an HMI
+	Consent string
+	// Seconds the Consent script is given to approve a shell, 60 by
+	// default
+	ConsentTimeoutSeconds uint32
+}
+
+// CommandPolicyConfig holds the regular expressions the command lines
+// typed in the shells are matched against
+type CommandPolicyConfig struct {
+	// If not empty, the command lines must match one of these
+	Allow []string
+	// The command lines matching any of these are refused
+	Deny []string
+}
+
+// RecordingConfig holds the settings of the recording of the terminal
+// output of the shells
+type RecordingConfig struct {
+	// Record the terminal output
+	Enabled bool
+	// Directory the recordings are written to
+	Directory string
+	// Upload the recordings to the server when the sessions close,
+	// removing them from the device
+	Upload bool
+}
+
+// RestrictedShellConfig holds the settings of the restricted shells, which
+// the support users get instead of a full shell: rbash, by default, keeps
+// them from changing directory, changing PATH and redirecting the output
+type RestrictedShellConfig struct {
+	// Restricted shell, DefaultRestrictedShell by default
+	Shell string
+	// PATH of the restricted shells, e.g. a directory holding links to
+	// the commands allowed; empty keeps the default PATH
+	Path string
+	// Users, by id, who get the restricted shell
+	Users []string
+	// Roles, as given by the server when spawning the shell, which get
+	// the restricted shell
+	Roles []string
+}
+
+// CommandAuditConfig holds the settings of the audit of the command lines
+// entered at the shell prompts
+type CommandAuditConfig struct {
+	// Log the command lines
+	Enabled bool
+	// File the command lines are logged to, in JSON; empty logs them
+	// to the log of the daemon
+	File string
+	// Report the command lines to the server too
+	Upload bool
+}
+
+// MultiplexerConfig holds the settings of the terminals attached to named
+// sessions of a terminal multiplexer, which outlive the connection and
+// which several terminals may share
+type MultiplexerConfig struct {
+	// Terminal multiplexer: "tmux" or "screen", empty disables attaching
+	// the terminals to its sessions
+	Type string
+	// Path of the multiplexer, DefaultTmuxPath or DefaultScreenPath by
+	// default
+	Path string
+}
+
+// TakeoverConfig holds the settings of the adoption of the running
+// terminals by other sessions, e.g. for support escalations
+type TakeoverConfig struct {
+	// What happens to the operator of the terminal taken over:
+	// "disconnect" or "observe", empty disables taking over the terminals
+	Policy string
+	// Users, by id, who may take over the terminals of the others, empty
+	// allows any
+	Users []string
+}
+
+// ObserveConfig holds the settings of the read-only observers of the
+// running terminals, e.g. for a senior engineer to watch a support case
+type ObserveConfig struct {
+	// Let the sessions attach to the terminals of the others, receiving
+	// their output only
+	Enabled bool
+	// Users, by id, who may observe the terminals of the others, empty
+	// allows any
+	Users []string
+	// Maximum number of observers of a terminal, 0 means no limit
+	MaxObservers uint32
+}
+
+// DebugShellConfig holds the settings of the debug shell, served to root
+// over a local Unix socket to exercise the terminals without a server
+type DebugShellConfig struct {
+	// Serve the debug shell
+	Enabled bool
+	// Unix socket the debug shell is served on, DefaultDebugShellSocket
+	// by default
+	Socket string
+}
+
+// ProcessesConfig holds the settings of the process management protocol,
+// which lists the processes of the device and sends signals to them
+type ProcessesConfig struct {
+	// Handle the process management protocol
+	Enabled bool
+	// Signals which may be sent, by name, e.g. "TERM"; empty only allows
+	// listing the processes
+	AllowedSignals []string
+	// Local users whose processes may be signaled, empty allows none;
+	// the init process may only be signaled if "root" is listed
+	AllowedUsers []string
+}
+
+// CgroupConfig holds the resources limits of the shells; each shell and
+// its descendants run in a dedicated cgroup v2 group
+type CgroupConfig struct {
+	// Run the shells in resource limited cgroups
+	Enabled bool
+	// cgroup v2 directory the groups of the shells are created in
+	Root string
+	// Relative share of CPU time, 1-10000, 0 keeps the default (100)
+	CPUWeight uint32
+	// Max memory usage in bytes, 0 means no limit
+	MemoryMax uint64
+	// Max number of processes, 0 means no limit
+	PidsMax uint32
+}
+
+// SystemdScopeConfig holds the settings of the systemd transient scope
+// units the shells run in
+type SystemdScopeConfig struct {
+	// Run the shells in systemd scope units
+	Enabled bool
+	// Slice the scopes are placed in, e.g. "mender-connect.slice"; empty
+	// uses the default one of systemd
+	Slice string
+}
+
+// BannerConfig holds the banner printed to the terminals before the shell
+// starts, e.g. a legal notice; it is a text/template, given the DeviceID,
+// UserID, SessionID and Hostname
+type BannerConfig struct {
+	// Text of the banner
+	Text string
+	// File the banner is read from, instead of Text
+	File string
+}
+
+// HardeningConfig holds the restrictions applied to the shells
+type HardeningConfig struct {
+	// Set no_new_privs on the shells, so that the programs run in them
+	// cannot gain privileges, e.g. through setuid binaries
+	NoNewPrivs bool
+	// Path of a compiled seccomp BPF filter, as exported by
+	// seccomp_export_bpf(3), loaded into the shells; requires NoNewPrivs
+	SeccompProfile string
+}
+
+// TracingConfig holds the settings of the export of the message handling
+// traces to an OpenTelemetry collector
+type TracingConfig struct {
+	// Export the traces
+	Enabled bool
+	// URL of the OTLP/HTTP traces endpoint of the collector
+	Endpoint string
+	// Name of the service the traces are reported for
+	ServiceName string
+}
+
+// ServerFailoverConfig holds the settings of the failover between the
+// Servers, tried in turn when connecting
+type ServerFailoverConfig struct {
+	// Reconnect to the server connected to last first, instead of going
+	// back to the first of the Servers
+	Sticky bool
+}
+
+// ProxyConfig holds the HTTP proxy the connections to the server are
+// tunneled through; without it the HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+// environment variables apply
+type ProxyConfig struct {
+	// URL of the proxy, http:// or https://, empty for none
+	URL string
+	// Credentials answering the basic or digest authentication of the
+	// proxy, if any
+	Username string
+	Password string
+	// Hosts, domains and CIDRs reached without the proxy; "*" matches all
+	NoProxy []string
+}
+
+// BindConfig holds the network interface and the source address the
+// connections to the server are made from, on the devices with several
+// uplinks, e.g. cellular and ethernet
+type BindConfig struct {
+	// Network interface, e.g. "wwan0"; binding to it requires the
+	// CAP_NET_RAW capability
+	Interface string
+	// Source IP address
+	Address string
+}
+
+// CompressionConfig holds the settings of the permessage-deflate
+// compression of the messages exchanged with the server
+type CompressionConfig struct {
+	// Negotiate the compression with the server
+	Enabled bool
+	// Flate level, from 1 (fastest) to 9 (smallest); 0 for the default, 1.
+	// No context is kept between the messages, so the memory used is
+	// bounded by the size of the messages
+	Level int
+}
+
+// HandshakeConfig holds the HTTP headers sent with the websocket handshake
+// to the servers
+type HandshakeConfig struct {
+	// User-Agent header; empty for the default of the Go HTTP client
+	UserAgent string
+	// Additional headers, e.g. the environment tags required by the
+	// corporate gateways; Authorization, Host and the ones of the
+	// websocket protocol cannot be set
+	Headers map[string]string
+}
+
+// CircuitBreakerConfig holds the settings of the circuit breaker of the
+// reconnects: during the long outages of the server it spaces them by a
+// long quiet period, sparing the flash from the log writes and the radio
+type CircuitBreakerConfig struct {
+	// Consecutive failed reconnects opening the breaker, 0 disables it
+	Failures int
+	// Seconds between the reconnects while open; 0 for the default, 1800
+	QuietPeriodSeconds int
+}
+
+// TCPKeepAliveConfig holds the TCP keepalive settings of the connections
+// to the server; shorter than the timeouts of the NATs on the path, they
+// keep the mappings open
+type TCPKeepAliveConfig struct {
+	// Do not send keepalive probes
+	Disabled bool
+	// Seconds the connection is idle before the first probe; 0 for the
+	// default, 15
+	IdleSeconds int
+	// Seconds between the probes; 0 for the default, 15
+	IntervalSeconds int
+	// Unanswered probes before the connection is dropped; 0 for the
+	// system default
+	Count int
+}
+
+// BandwidthConfig holds the budgets of the bytes exchanged with the
+// server on the wire: the messages of all the protocols, with the
+// websocket and TLS framing and the control messages. Once a budget is
+// exhausted the device disconnects until the hour or the day is over.
+type BandwidthConfig struct {
+	// Bytes sent and received per hour, 0 for unlimited
+	HourlyBytes uint64
+	// Bytes sent and received per day, 0 for unlimited
+	DailyBytes uint64
+}
+
+// StatusFileConfig holds the settings of the file the state of the
+// connection is written to, for the monitoring agents
+type StatusFileConfig struct {
+	// Path of the file, empty for none
+	Path string
+	// Interval between the writes, in seconds; 0 for the default, 10
+	IntervalSeconds uint32
+}
+
+// TLSReloadConfig holds the settings of the reloading of the client
+// certificate and key and of the server certificate; SIGHUP reloads them
+// regardless
+type TLSReloadConfig struct {
+	// Watch the files and reload them when they change
+	Watch bool
+	// Interval between the checks of the files, in seconds; 0 for the
+	// default, 30
+	IntervalSeconds uint32
+}
+
+// OfflineQueueConfig holds the settings of the queue the messages the
+// device originates, e.g. the audit events and the notifications, wait in
+// while the server is unreachable
+type OfflineQueueConfig struct {
+	// Queue the messages instead of dropping them
+	Enabled bool
+	// File the queue is kept in across restarts; empty for the default
+	File string
+	// Maximum number of messages queued, the oldest are dropped first;
+	// 0 for the default, 1000
+	MaxMessages int
+}
+
+// AuthConfig holds where the device JWT authorizing the connection to the
+// server comes from
+type AuthConfig struct {
+	// "dbus" (the default) asks the mender-client over D-Bus; "file" reads
+	// the JWT from TokenFile, for the systems without the mender-client;
+	// "http" asks the local API of mender-auth at URL, for the containers
+	// without D-Bus
+	Backend string
+	// File holding the JWT, kept up to date by another agent; re-read
+	// when it changes
+	TokenFile string
+	// File holding the server URL the JWT was issued by, overriding
+	// ServerURL and Servers; optional
+	ServerURLFile string
+	// URL of the local API of mender-auth: http://, https:// or unix://
+	// followed by the path of the socket
+	URL string
 }
 
 // MenderShellConfigFromFile holds the configuration settings read from the config file
@@ -58,20 +495,112 @@ type MenderShellConfigFromFile struct {
 	SkipVerify bool
 	// Path to server SSL certificate
 	ServerCertificate string
+	// Reloading of the client certificate and key and of the server
+	// certificate when they change
+	TLSReload TLSReloadConfig `json:"TLSReload"`
 	// Server URL (For single server conf)
 	ServerURL string
 	// List of available servers, to which client can fall over
 	Servers []https.MenderServer
+	// Failover between the Servers
+	ServerFailover ServerFailoverConfig `json:"ServerFailover"`
+	// HTTP proxy to the servers
+	Proxy ProxyConfig `json:"Proxy"`
+	// Interface and source address of the connections to the servers
+	Bind BindConfig `json:"Bind"`
+	// Compression of the messages exchanged with the server
+	Compression CompressionConfig `json:"Compression"`
+	// HTTP headers of the websocket handshake
+	Handshake HandshakeConfig `json:"Handshake"`
+	// Budgets of the traffic with the servers
+	Bandwidth BandwidthConfig `json:"Bandwidth"`
+	// Source of the device JWT
+	Auth AuthConfig `json:"Auth"`
 	// The command to run as shell
 	ShellCommand string
+	// Shell of each user, keyed by user id; the users not listed get
+	// ShellCommand
+	UserShells map[string]string
+	// Shells ShellCommand and UserShells may use, empty allows any of
+	// the shells listed in /etc/shells
+	AllowedShells []string
+	// Restricted shells of some users and roles
+	RestrictedShell RestrictedShellConfig `json:"RestrictedShell"`
+	// Start the shells as login shells
+	LoginShell bool
+	// Extra environment variables of the shells, e.g. MENDER_REMOTE=1
+	// for the scripts to tell they run in a remote terminal
+	ShellEnvironment map[string]string
+	// Banner printed to the terminals before the shells start
+	Banner BannerConfig `json:"Banner"`
+	// Commands allowed and denied in the shells
+	CommandPolicy CommandPolicyConfig `json:"CommandPolicy"`
+	// Recording of the terminal output of the shells
+	Recording RecordingConfig `json:"Recording"`
+	// Audit of the command lines entered at the shell prompts
+	CommandAudit CommandAuditConfig `json:"CommandAudit"`
+	// Local debug shell
+	DebugShell DebugShellConfig `json:"DebugShell"`
+	// Terminal multiplexer the terminals may attach to
+	Multiplexer MultiplexerConfig `json:"Multiplexer"`
+	// Process management protocol
+	Processes ProcessesConfig `json:"Processes"`
+	// Takeover of the terminals by other sessions
+	Takeover TakeoverConfig `json:"Takeover"`
+	// Read-only observers of the terminals
+	Observe ObserveConfig `json:"Observe"`
+	// Resources limits of the shells; if SystemdScope is enabled the
+	// limits apply to the scopes instead of the own cgroups
+	Cgroup CgroupConfig `json:"Cgroup"`
+	// Systemd transient scope units of the shells
+	SystemdScope SystemdScopeConfig `json:"SystemdScope"`
+	// Restrictions applied to the shells
+	Hardening HardeningConfig `json:"Hardening"`
 	// Name of the user who owns the shell process
 	User string
+	// Local users the server may request the shells to run as instead
+	// of User, empty denies all such requests
+	AllowedRunAsUsers []string
 	// Terminal settings
 	Terminal TerminalConfig `json:"Terminal"`
 	// User sessions settings
 	Sessions SessionsConfig `json:"Sessions"`
 	// Reconnect interval
 	ReconnectIntervalSeconds int
+	// Circuit breaker of the reconnects
+	ReconnectCircuitBreaker CircuitBreakerConfig `json:"ReconnectCircuitBreaker"`
+	// Interval between the websocket ping messages sent to the server
+	PingIntervalSeconds int
+	// Time to wait for the pong message on top of the ping interval
+	PongTimeoutSeconds int
+	// TCP keepalive of the connections to the servers
+	TCPKeepAlive TCPKeepAliveConfig `json:"TCPKeepAlive"`
+	// Maximum size in bytes of a message received from the server
+	MaxMessageSize int64
+	// Protocols the device accepts (e.g. "shell"), empty or not set allows
+	// all
+	AllowedProtocols []string
+	// Per user overrides of AllowedProtocols, keyed by user id; unlike
+	// AllowedProtocols, an empty list allows the user no protocol. There
+	// are no per role overrides: the roles come with the spawn shell
+	// messages only, not with the messages of the other protocols
+	UserAllowedProtocols map[string][]string
+	// Session lifecycle hooks
+	Hooks HooksConfig `json:"Hooks"`
+	// Preferred encoding of the message bodies, "msgpack" (default),
+	// "json" or "cbor"; used only if the server supports it
+	BodyEncoding string
+	// Report the session lifecycle events to the server
+	AuditTrail bool
+	// Export the status of the sessions over D-Bus, readable by root and
+	// the mender group with support/io.mender.Connect.conf installed
+	DBusStatus bool
+	// File the state of the connection is written to
+	StatusFile StatusFileConfig `json:"StatusFile"`
+	// Queue of the messages sent while the server is unreachable
+	OfflineQueue OfflineQueueConfig `json:"OfflineQueue"`
+	// Tracing of the message handling
+	Tracing TracingConfig `json:"Tracing"`
 }
 
 // MenderShellConfig holds the configuration settings for the Mender shell client
@@ -144,6 +673,12 @@ func isInShells(path string) bool {
 	return found
 }
 
+// SignalByName returns the signal named name, with or without the SIG
+// prefix, e.g. "TERM"; 0 if there is no such signal
+func SignalByName(name string) syscall.Signal {
+	return unix.SignalNum("SIG" + strings.TrimPrefix(strings.ToUpper(name), "SIG"))
+}
+
 func validateUser(c *MenderShellConfig) (err error) {
 	if c.User == "" {
 		return errors.New("please provide a user to run the shell as")
@@ -155,6 +690,74 @@ func validateUser(c *MenderShellConfig) (err error) {
 	if err != nil {
 		return err
 	}
+	for _, name := range c.AllowedRunAsUsers {
+		if _, err = user.Lookup(name); err != nil {
+			return errors.Wrap(err, "invalid AllowedRunAsUsers user")
+		}
+	}
+	return nil
+}
+
+// validateShell checks that shell is an executable listed in /etc/shells
+// and, if allowedShells is not empty, one of them
+func validateShell(shell string, allowedShells []string) error {
+	if !filepath.IsAbs(shell) {
+		return errors.New("given shell (" + shell + ") is not an absolute path")
+	}
+	if !isExecutable(shell) {
+		return errors.New("given shell (" + shell + ") is not executable")
+	}
+	if !isInShells(shell) {
+		return errors.New("given shell (" + shell + ") is not present in /etc/shells")
+	}
+	if len(allowedShells) == 0 {
+		return nil
+	}
+	for _, allowed := range allowedShells {
+		if shell == allowed {
+			return nil
+		}
+	}
+	return errors.New("given shell (" + shell + ") is not in AllowedShells")
+}
+
+// handshakeHeaderName matches the valid HTTP header names
+var handshakeHeaderName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// reservedHandshakeHeaders are set by the connection itself
+var reservedHandshakeHeaders = map[string]bool{
+	"authorization":            true,
+	"host":                     true,
+	"user-agent":               true,
+	"upgrade":                  true,
+	"connection":               true,
+	"sec-websocket-key":        true,
+	"sec-websocket-version":    true,
+	"sec-websocket-extensions": true,
+	"sec-websocket-protocol":   true,
+}
+
+func validateHandshakeHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		if !handshakeHeaderName.MatchString(name) {
+			return errors.New("invalid header name in Handshake.Headers: " + name)
+		}
+		if reservedHandshakeHeaders[strings.ToLower(name)] {
+			return errors.New("header cannot be set in Handshake.Headers: " + name)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return errors.New("invalid value of the header in Handshake.Headers: " + name)
+		}
+	}
+	return nil
+}
+
+func validateProtocols(names []string) error {
+	for _, name := range names {
+		if _, ok := ProtocolsByName[name]; !ok {
+			return errors.New("unknown protocol in AllowedProtocols: " + name)
+		}
+	}
 	return nil
 }
 
@@ -193,18 +796,51 @@ func (c *MenderShellConfig) Validate() (err error) {
 		}
 	}
 
+	if c.Proxy.URL != "" {
+		u, err := url.Parse(c.Proxy.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("Proxy.URL is not an http:// or https:// URL: " + c.Proxy.URL)
+		}
+	}
+
+	if c.Bind.Address != "" && net.ParseIP(c.Bind.Address) == nil {
+		return errors.New("Bind.Address is not an IP address: " + c.Bind.Address)
+	}
+
+	if c.Compression.Level < 0 || c.Compression.Level > 9 {
+		return errors.New("Compression.Level must be between 0 and 9")
+	}
+
+	if strings.ContainsAny(c.Handshake.UserAgent, "\r\n\x00") {
+		return errors.New("invalid Handshake.UserAgent")
+	}
+	if err = validateHandshakeHeaders(c.Handshake.Headers); err != nil {
+		return err
+	}
+
+	switch c.Auth.Backend {
+	case "", AuthBackendDBus:
+	case AuthBackendFile:
+		if c.Auth.TokenFile == "" {
+			return errors.New("Auth.TokenFile is required by the file backend")
+		}
+	case AuthBackendHTTP:
+		u, err := url.Parse(c.Auth.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "unix") {
+			return errors.New("Auth.URL is not an http://, https:// or unix:// URL: " + c.Auth.URL)
+		}
+	default:
+		return errors.New("unknown Auth.Backend: " + c.Auth.Backend)
+	}
+
 	//check if shell is given, if not, defaulting to /bin/sh
 	if c.ShellCommand == "" {
 		log.Warnf("ShellCommand is empty, defaulting to %s", DefaultShellCommand)
 		c.ShellCommand = DefaultShellCommand
 	}
 
-	if !filepath.IsAbs(c.ShellCommand) {
-		return errors.New("given shell (" + c.ShellCommand + ") is not an absolute path")
-	}
-
-	if !isExecutable(c.ShellCommand) {
-		return errors.New("given shell (" + c.ShellCommand + ") is not executable")
+	if err = validateShell(c.ShellCommand, c.AllowedShells); err != nil {
+		return err
 	}
 
 	err = validateUser(c)
@@ -212,9 +848,15 @@ func (c *MenderShellConfig) Validate() (err error) {
 		return err
 	}
 
-	if !isInShells(c.ShellCommand) {
-		log.Errorf("ShellCommand %s is not present in /etc/shells", c.ShellCommand)
-		return errors.New("ShellCommand " + c.ShellCommand + " is not present in /etc/shells")
+	for _, shell := range c.AllowedShells {
+		if err = validateShell(shell, nil); err != nil {
+			return err
+		}
+	}
+	for _, shell := range c.UserShells {
+		if err = validateShell(shell, c.AllowedShells); err != nil {
+			return err
+		}
 	}
 
 	if c.Terminal.Width == 0 {
@@ -225,6 +867,12 @@ func (c *MenderShellConfig) Validate() (err error) {
 		c.Terminal.Height = DefaultTerminalHeight
 	}
 
+	for _, pattern := range append(c.Terminal.AllowedTypes, c.Terminal.AllowedLocales...) {
+		if _, err = filepath.Match(pattern, ""); err != nil {
+			return errors.New("invalid Terminal pattern: '" + pattern + "'")
+		}
+	}
+
 	if !c.Sessions.StopExpired {
 		c.Sessions.ExpireAfter = 0
 		c.Sessions.ExpireAfterIdle = 0
@@ -234,10 +882,237 @@ func (c *MenderShellConfig) Validate() (err error) {
 		}
 	}
 
+	if err = validateProtocols(c.AllowedProtocols); err != nil {
+		return err
+	}
+	for _, protocols := range c.UserAllowedProtocols {
+		if err = validateProtocols(protocols); err != nil {
+			return err
+		}
+	}
+
+	for name := range c.Sessions.ProtocolMaxMessagesPerSecond {
+		if err = validateProtocols([]string{name}); err != nil {
+			return err
+		}
+	}
+
+	for _, hook := range []string{c.Hooks.SessionOpen, c.Hooks.HandlerStart, c.Hooks.SessionClose,
+		c.Hooks.Consent} {
+		if hook == "" {
+			continue
+		}
+		if !filepath.IsAbs(hook) {
+			return errors.New("given hook (" + hook + ") is not an absolute path")
+		}
+		if !isExecutable(hook) {
+			return errors.New("given hook (" + hook + ") is not executable")
+		}
+	}
+
+	for _, expressions := range [][]string{c.CommandPolicy.Allow, c.CommandPolicy.Deny} {
+		for _, expression := range expressions {
+			if _, err = regexp.Compile(expression); err != nil {
+				return errors.New("invalid CommandPolicy expression: " + err.Error())
+			}
+		}
+	}
+
+	if c.Recording.Enabled {
+		if c.Recording.Directory == "" {
+			c.Recording.Directory = DefaultRecordingsDir
+		}
+		if !filepath.IsAbs(c.Recording.Directory) {
+			return errors.New("given recordings directory (" + c.Recording.Directory +
+				") is not an absolute path")
+		}
+	}
+
+	if c.OfflineQueue.Enabled {
+		if c.OfflineQueue.File == "" {
+			c.OfflineQueue.File = DefaultOfflineQueueFile
+		}
+		if !filepath.IsAbs(c.OfflineQueue.File) {
+			return errors.New("given offline queue file (" + c.OfflineQueue.File +
+				") is not an absolute path")
+		}
+		if c.OfflineQueue.MaxMessages < 0 {
+			return errors.New("OfflineQueue.MaxMessages must not be negative")
+		} else if c.OfflineQueue.MaxMessages == 0 {
+			c.OfflineQueue.MaxMessages = DefaultOfflineQueueMaxMessages
+		}
+	}
+
+	if c.CommandAudit.File != "" && !filepath.IsAbs(c.CommandAudit.File) {
+		return errors.New("given command audit file (" + c.CommandAudit.File +
+			") is not an absolute path")
+	}
+
+	switch c.Multiplexer.Type {
+	case "":
+	case MultiplexerTmux, MultiplexerScreen:
+		if c.Multiplexer.Path == "" {
+			c.Multiplexer.Path = DefaultTmuxPath
+			if c.Multiplexer.Type == MultiplexerScreen {
+				c.Multiplexer.Path = DefaultScreenPath
+			}
+		}
+		if !filepath.IsAbs(c.Multiplexer.Path) {
+			return errors.New("given multiplexer path (" + c.Multiplexer.Path +
+				") is not an absolute path")
+		}
+	default:
+		return errors.New("unknown Multiplexer.Type: " + c.Multiplexer.Type)
+	}
+
+	switch c.Takeover.Policy {
+	case "", TakeoverPolicyDisconnect, TakeoverPolicyObserve:
+	default:
+		return errors.New("unknown Takeover.Policy: " + c.Takeover.Policy)
+	}
+
+	for _, name := range c.Processes.AllowedSignals {
+		if SignalByName(name) == 0 {
+			return errors.New("unknown Processes signal: " + name)
+		}
+	}
+	for _, name := range c.Processes.AllowedUsers {
+		if _, err = user.Lookup(name); err != nil {
+			return errors.Wrap(err, "invalid Processes AllowedUsers user")
+		}
+	}
+
+	if c.DebugShell.Enabled {
+		if c.DebugShell.Socket == "" {
+			c.DebugShell.Socket = DefaultDebugShellSocket
+		}
+		if !filepath.IsAbs(c.DebugShell.Socket) {
+			return errors.New("given debug shell socket (" + c.DebugShell.Socket +
+				") is not an absolute path")
+		}
+	}
+
+	if c.Cgroup.Enabled {
+		if c.Cgroup.Root == "" {
+			c.Cgroup.Root = DefaultCgroupRoot
+		}
+		if !filepath.IsAbs(c.Cgroup.Root) {
+			return errors.New("given cgroup root (" + c.Cgroup.Root +
+				") is not an absolute path")
+		}
+		if c.Cgroup.CPUWeight > 10000 {
+			return errors.New("given cgroup CPUWeight (" +
+				strconv.Itoa(int(c.Cgroup.CPUWeight)) + ") is not in the 1-10000 range")
+		}
+	}
+
+	if c.SystemdScope.Enabled && c.SystemdScope.Slice != "" &&
+		!strings.HasSuffix(c.SystemdScope.Slice, ".slice") {
+		return errors.New("given systemd slice (" + c.SystemdScope.Slice +
+			") is not a slice unit")
+	}
+
+	for name := range c.ShellEnvironment {
+		if name == "" || strings.ContainsAny(name, "= \t\n") {
+			return errors.New("invalid ShellEnvironment variable name: '" + name + "'")
+		}
+	}
+
+	if len(c.RestrictedShell.Users) > 0 || len(c.RestrictedShell.Roles) > 0 {
+		if c.RestrictedShell.Shell == "" {
+			c.RestrictedShell.Shell = DefaultRestrictedShell
+		}
+		if err = validateShell(c.RestrictedShell.Shell, c.AllowedShells); err != nil {
+			return err
+		}
+		if _, ok := c.ShellEnvironment["PATH"]; ok && c.RestrictedShell.Path != "" {
+			// the environment of the shells would override the PATH
+			return errors.New("both ShellEnvironment PATH and RestrictedShell Path given")
+		}
+	}
+
+	if c.Banner.Text != "" && c.Banner.File != "" {
+		return errors.New("both Text and File given in Banner")
+	}
+	if c.Banner.File != "" && !filepath.IsAbs(c.Banner.File) {
+		return errors.New("given banner file (" + c.Banner.File + ") is not an absolute path")
+	}
+	if _, err = template.New("banner").Parse(c.Banner.Text); err != nil {
+		return errors.Wrap(err, "invalid Banner text")
+	}
+
+	if c.Hardening.SeccompProfile != "" {
+		if !filepath.IsAbs(c.Hardening.SeccompProfile) {
+			return errors.New("given seccomp profile (" + c.Hardening.SeccompProfile +
+				") is not an absolute path")
+		}
+		if !c.Hardening.NoNewPrivs {
+			return errors.New("SeccompProfile requires NoNewPrivs")
+		}
+	}
+
+	if c.BodyEncoding != "" {
+		if _, err = codec.Get(c.BodyEncoding); err != nil {
+			return errors.New("unknown BodyEncoding: " + c.BodyEncoding)
+		}
+	}
+
+	if c.Tracing.Enabled {
+		if c.Tracing.Endpoint == "" {
+			c.Tracing.Endpoint = DefaultTracingEndpoint
+		}
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.New("given tracing endpoint (" + c.Tracing.Endpoint + ") is not a valid URL")
+		}
+		if c.Tracing.ServiceName == "" {
+			c.Tracing.ServiceName = DefaultTracingServiceName
+		}
+	}
+
+	if c.Sessions.ShellIdleWarning > 0 && c.Sessions.ShellIdleWarning >= c.Sessions.ShellIdleTimeout {
+		return errors.New("Sessions.ShellIdleWarning must be shorter than Sessions.ShellIdleTimeout")
+	}
+
+	switch c.Sessions.MaxConcurrentPolicy {
+	case "", SessionsLimitPolicyRejectNew, SessionsLimitPolicyEvictOldestIdle:
+	default:
+		return errors.New("unknown Sessions.MaxConcurrentPolicy: " + c.Sessions.MaxConcurrentPolicy)
+	}
+
+	switch c.Sessions.TokenExpiryAction {
+	case "", TokenExpiryActionTerminate, TokenExpiryActionReauthorize:
+	default:
+		return errors.New("unknown Sessions.TokenExpiryAction: " + c.Sessions.TokenExpiryAction)
+	}
+
 	if c.ReconnectIntervalSeconds == 0 {
 		c.ReconnectIntervalSeconds = DefaultReconnectIntervalsSeconds
 	}
 
+	if c.ReconnectCircuitBreaker.Failures < 0 || c.ReconnectCircuitBreaker.QuietPeriodSeconds < 0 {
+		return errors.New("ReconnectCircuitBreaker settings must not be negative")
+	} else if c.ReconnectCircuitBreaker.Failures > 0 &&
+		c.ReconnectCircuitBreaker.QuietPeriodSeconds == 0 {
+		c.ReconnectCircuitBreaker.QuietPeriodSeconds = DefaultQuietPeriodSeconds
+	}
+
+	if c.PingIntervalSeconds == 0 {
+		c.PingIntervalSeconds = DefaultPingIntervalSeconds
+	}
+
+	if c.PongTimeoutSeconds == 0 {
+		c.PongTimeoutSeconds = DefaultPongTimeoutSeconds
+	}
+
+	if c.TCPKeepAlive.IdleSeconds < 0 || c.TCPKeepAlive.IntervalSeconds < 0 ||
+		c.TCPKeepAlive.Count < 0 {
+		return errors.New("TCPKeepAlive settings must not be negative")
+	}
+
+	if c.MaxMessageSize == 0 {
+		c.MaxMessageSize = DefaultMaxMessageSize
+	}
+
 	c.HTTPSClient.Validate()
 	log.Debugf("Verified configuration = %#v", c)
 
@@ -115,6 +115,269 @@ const testTooManyServerDefsConfig = `{
   "Servers": [{"ServerURL": "https://hosted.mender.io"}]
 }`
 
+const testUnknownSessionsPolicyConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Sessions": {
+          "MaxConcurrent": 2,
+          "MaxConcurrentPolicy": "evict-everyone"
+        }
+}`
+
+const testShellIdleWarningTooLongConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Sessions": {
+          "ShellIdleTimeout": 60,
+          "ShellIdleWarning": 60
+        }
+}`
+
+const testUnknownTokenExpiryActionConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Sessions": {
+          "TokenExpiryAction": "ignore"
+        }
+}`
+
+const testUnknownAllowedProtocolConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "AllowedProtocols": ["shell", "telnet"]
+}`
+
+const testRelativeHookConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Hooks": {
+          "SessionOpen": "hooks/session-open.sh"
+        }
+}`
+
+const testUnknownBodyEncodingConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "BodyEncoding": "xml"
+}`
+
+const testInvalidTracingEndpointConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Tracing": {
+          "Enabled": true,
+          "Endpoint": "localhost:4318"
+        }
+}`
+
+const testRelativeUserShellConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "UserShells": {
+          "support": "rbash"
+        }
+}`
+
+const testInvalidCommandPolicyConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "CommandPolicy": {
+          "Deny": ["(reboot"]
+        }
+}`
+
+const testRelativeRecordingsDirConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Recording": {
+          "Enabled": true,
+          "Directory": "recordings"
+        }
+}`
+
+const testUnknownRunAsUserConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "AllowedRunAsUsers": ["mender-connect-no-such-user"]
+}`
+
+const testInvalidTerminalPatternConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Terminal": {
+          "AllowedLocales": ["[en_US.UTF-8"]
+        }
+}`
+
+const testRestrictedShellPathConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "ShellEnvironment": {
+          "PATH": "/usr/bin:/bin"
+        },
+        "RestrictedShell": {
+          "Path": "/usr/lib/mender-connect/rbin",
+          "Roles": ["support"]
+        }
+}`
+
+const testRelativeCommandAuditFileConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "CommandAudit": {
+          "Enabled": true,
+          "File": "commands.log"
+        }
+}`
+
+const testRelativeDebugShellSocketConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "DebugShell": {
+          "Enabled": true,
+          "Socket": "debug-shell.sock"
+        }
+}`
+
+const testUnknownMultiplexerConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Multiplexer": {
+          "Type": "byobu"
+        }
+}`
+
+const testUnknownTakeoverPolicyConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Takeover": {
+          "Policy": "share"
+        }
+}`
+
+const testInvalidProxyURLConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Proxy": {
+          "URL": "socks5://proxy.local:1080"
+        }
+}`
+
+const testUnknownAuthBackendConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Auth": {
+          "Backend": "keyring"
+        }
+}`
+
+const testMissingAuthTokenFileConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Auth": {
+          "Backend": "file"
+        }
+}`
+
+const testInvalidAuthURLConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Auth": {
+          "Backend": "http",
+          "URL": "/run/mender/auth.sock"
+        }
+}`
+
+const testRelativeOfflineQueueFileConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "OfflineQueue": {
+          "Enabled": true,
+          "File": "connect-queue"
+        }
+}`
+
+const testInvalidBindAddressConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Bind": {
+          "Interface": "wwan0",
+          "Address": "wwan0"
+        }
+}`
+
+const testInvalidCompressionLevelConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Compression": {
+          "Enabled": true,
+          "Level": 11
+        }
+}`
+
+const testReservedHandshakeHeaderConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Handshake": {
+          "UserAgent": "mender-connect",
+          "Headers": {
+            "X-Environment": "production",
+            "Authorization": "Basic Zm9vOmJhcg=="
+          }
+        }
+}`
+
+const testUnknownProcessesSignalConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Processes": {
+          "Enabled": true,
+          "AllowedSignals": ["TERM", "SIGBOGUS"]
+        }
+}`
+
+const testInvalidCgroupCPUWeightConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Cgroup": {
+          "Enabled": true,
+          "CPUWeight": 20000
+        }
+}`
+
+const testInvalidSystemdSliceConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "SystemdScope": {
+          "Enabled": true,
+          "Slice": "mender-connect.service"
+        }
+}`
+
+const testSeccompWithoutNoNewPrivsConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Hardening": {
+          "SeccompProfile": "/etc/mender/shell.bpf"
+        }
+}`
+
+const testInvalidShellEnvironmentConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "ShellEnvironment": {
+          "MENDER_REMOTE=1": "1"
+        }
+}`
+
+const testInvalidBannerConfig = `{
+		"ShellCommand": "/bin/sh",
+        "User": "root",
+        "Banner": {
+          "Text": "Device {{.DeviceID"
+        }
+}`
+
 const testEmptyServerURL = `{
   "ServerURL": "",
   "User":"root"
@@ -172,6 +435,9 @@ func validateConfiguration(t *testing.T, actual *MenderShellConfig) {
 			MaxPerUser:      4,
 		},
 		ReconnectIntervalSeconds: DefaultReconnectIntervalsSeconds,
+		PingIntervalSeconds:      DefaultPingIntervalSeconds,
+		PongTimeoutSeconds:       DefaultPongTimeoutSeconds,
+		MaxMessageSize:           DefaultMaxMessageSize,
 	}
 	if !assert.True(t, reflect.DeepEqual(actual, expectedConfig)) {
 		t.Logf("got:      %+v", actual)
@@ -400,6 +666,352 @@ func Test_LoadConfig_various_errors(t *testing.T) {
 	err = config.Validate()
 	assert.Error(t, err)
 
+	//unknown sessions limit policy
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testUnknownSessionsPolicyConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.Error(t, err)
+
+	//idle warning not ahead of the idle timeout
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testShellIdleWarningTooLongConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "Sessions.ShellIdleWarning must be shorter than Sessions.ShellIdleTimeout")
+
+	//unknown action on the token expiry
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testUnknownTokenExpiryActionConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "unknown Sessions.TokenExpiryAction: ignore")
+
+	//unknown protocol in AllowedProtocols
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testUnknownAllowedProtocolConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.Error(t, err)
+
+	//relative path of a hook
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testRelativeHookConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "given hook (hooks/session-open.sh) is not an absolute path")
+
+	//unknown body encoding
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testUnknownBodyEncodingConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "unknown BodyEncoding: xml")
+
+	//relative user shell
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testRelativeUserShellConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "given shell (rbash) is not an absolute path")
+
+	//invalid command policy expression
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testInvalidCommandPolicyConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "invalid CommandPolicy expression: "+
+		"error parsing regexp: missing closing ): `(reboot`")
+
+	//relative recordings directory
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testRelativeRecordingsDirConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "given recordings directory (recordings) is not an absolute path")
+
+	//unknown run as user
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testUnknownRunAsUserConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid AllowedRunAsUsers user")
+
+	//invalid terminal pattern
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testInvalidTerminalPatternConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "invalid Terminal pattern: '[en_US.UTF-8'")
+
+	//restricted shell PATH overridden
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testRestrictedShellPathConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "both ShellEnvironment PATH and RestrictedShell Path given")
+	assert.Equal(t, DefaultRestrictedShell, config.RestrictedShell.Shell)
+
+	//relative command audit file
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testRelativeCommandAuditFileConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "given command audit file (commands.log) is not an absolute path")
+
+	//relative debug shell socket
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testRelativeDebugShellSocketConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "given debug shell socket (debug-shell.sock) is not an absolute path")
+
+	//unknown terminal multiplexer
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testUnknownMultiplexerConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "unknown Multiplexer.Type: byobu")
+
+	//unknown takeover policy
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testUnknownTakeoverPolicyConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "unknown Takeover.Policy: share")
+
+	//proxy URL which is not an HTTP one
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testInvalidProxyURLConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "Proxy.URL is not an http:// or https:// URL: socks5://proxy.local:1080")
+
+	//compression level out of the flate range
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testInvalidCompressionLevelConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "Compression.Level must be between 0 and 9")
+
+	//header set by the connection itself
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testReservedHandshakeHeaderConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "header cannot be set in Handshake.Headers: Authorization")
+
+	//unknown auth backend
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testUnknownAuthBackendConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "unknown Auth.Backend: keyring")
+
+	//file auth backend without the token file
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testMissingAuthTokenFileConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "Auth.TokenFile is required by the file backend")
+
+	//http auth backend without a URL
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testInvalidAuthURLConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "Auth.URL is not an http://, https:// or unix:// URL: /run/mender/auth.sock")
+
+	//source address not an IP address
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testInvalidBindAddressConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "Bind.Address is not an IP address: wwan0")
+
+	//relative offline queue file
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testRelativeOfflineQueueFileConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "given offline queue file (connect-queue) is not an absolute path")
+
+	//unknown signal of the process management protocol
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testUnknownProcessesSignalConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "unknown Processes signal: SIGBOGUS")
+
+	//cgroup CPU weight out of range
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testInvalidCgroupCPUWeightConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "given cgroup CPUWeight (20000) is not in the 1-10000 range")
+	assert.Equal(t, DefaultCgroupRoot, config.Cgroup.Root)
+
+	//systemd slice which is not a slice
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testInvalidSystemdSliceConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "given systemd slice (mender-connect.service) is not a slice unit")
+
+	//invalid environment variable name
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testInvalidShellEnvironmentConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "invalid ShellEnvironment variable name: 'MENDER_REMOTE=1'")
+
+	//invalid banner template
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testInvalidBannerConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid Banner text")
+
+	//seccomp profile without no_new_privs
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testSeccompWithoutNoNewPrivsConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "SeccompProfile requires NoNewPrivs")
+
+	//invalid tracing endpoint
+	configFile, err = os.Create(configPath)
+	assert.NoError(t, err)
+	configFile.WriteString(testInvalidTracingEndpointConfig)
+
+	config, err = LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	err = config.Validate()
+	assert.EqualError(t, err, "given tracing endpoint (localhost:4318) is not a valid URL")
+
 	//parsing error
 	configFile, err = os.Create(configPath)
 	assert.NoError(t, err)
@@ -422,3 +1034,14 @@ func TestConfigurationNeitherFileExistsIsNotError(t *testing.T) {
 	assert.NoError(t, err)
 	assert.IsType(t, &MenderShellConfig{}, config)
 }
+
+func TestValidateShell(t *testing.T) {
+	assert.NoError(t, validateShell("/bin/sh", nil))
+	assert.NoError(t, validateShell("/bin/sh", []string{"/bin/rbash", "/bin/sh"}))
+	assert.EqualError(t, validateShell("/bin/sh", []string{"/bin/rbash"}),
+		"given shell (/bin/sh) is not in AllowedShells")
+	assert.EqualError(t, validateShell("sh", nil),
+		"given shell (sh) is not an absolute path")
+	assert.EqualError(t, validateShell("/etc/shells", nil),
+		"given shell (/etc/shells) is not executable")
+}
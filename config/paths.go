@@ -26,12 +26,18 @@ var (
 	DefaultDataStore   = "/var/lib/mender"
 
 	DefaultShellCommand      = "/bin/sh"
+	DefaultRestrictedShell   = "/bin/rbash"
 	DefaultDeviceConnectPath = "/api/devices/v1/deviceconnect/connect"
 
 	DefaultTerminalString = "xterm-256color"
 	DefaultTerminalHeight = uint16(40)
 	DefaultTerminalWidth  = uint16(80)
 
+	DefaultAllowedTerminalTypes = []string{
+		"xterm*", "screen*", "tmux*", "rxvt*", "vt100", "vt220", "linux", "dumb",
+	}
+	DefaultAllowedLocales = []string{"C", "POSIX", "*.UTF-8", "*.utf8"}
+
 	DefaultConfFile         = path.Join(GetConfDirPath(), "mender-connect.conf")
 	DefaultFallbackConfFile = path.Join(GetStateDirPath(), "mender-connect.conf")
 
@@ -39,8 +45,33 @@ var (
 
 	MaxReconnectAttempts             = uint(0) // 0 means to reconnect forever
 	DefaultReconnectIntervalsSeconds = 5
+	DefaultQuietPeriodSeconds        = 1800
+	DefaultPingIntervalSeconds       = 54
+	DefaultPongTimeoutSeconds        = 6
+	DefaultTCPKeepAlive              = 15 * time.Second
+	DefaultMaxMessageSize            = int64(8192)
 	MessageWriteTimeout              = 2 * time.Second
 	MaxShellsSpawned                 = uint(16)
+	DefaultDrainSessionsTimeout      = 10 * time.Second
+	DefaultHandlerCloseTimeout       = 5 * time.Second
+	DefaultConsentTimeout            = 60 * time.Second
+	DefaultDedupWindow               = 60 * time.Second
+	DefaultTokenExpiryGracePeriod    = 60 * time.Second
+
+	DefaultRecordingsDir = path.Join(DefaultDataStore, "connect-recordings")
+
+	DefaultOfflineQueueFile        = path.Join(DefaultDataStore, "connect-queue")
+	DefaultOfflineQueueMaxMessages = 1000
+
+	DefaultTracingEndpoint    = "http://localhost:4318/v1/traces"
+	DefaultTracingServiceName = "mender-connect"
+
+	DefaultCgroupRoot = "/sys/fs/cgroup/mender-connect"
+
+	DefaultDebugShellSocket = "/run/mender-connect/debug-shell.sock"
+
+	DefaultTmuxPath   = "/usr/bin/tmux"
+	DefaultScreenPath = "/usr/bin/screen"
 )
 
 // GetStateDirPath returns the default data store directory
@@ -0,0 +1,74 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// network interface and source address the connections are made from,
+// on the devices with several uplinks
+var bindInterface string
+var bindAddress net.IP
+
+// SetBind sets the network interface, e.g. "wwan0", and the source
+// address the connections to the server and to the proxy are made from;
+// empty values leave the choice to the routing of the system. Binding to
+// the interface requires the CAP_NET_RAW capability.
+func SetBind(iface string, address net.IP) {
+	bindInterface = iface
+	bindAddress = address
+}
+
+// newDialer returns the dialer of the connections, bound as set with
+// SetBind and with the keepalive set with SetKeepAlive
+func newDialer() *net.Dialer {
+	dialer := &net.Dialer{}
+	if bindAddress != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: bindAddress}
+	}
+	iface := bindInterface
+	k := keepAlive
+	if k != nil {
+		// set on the socket by the control function instead
+		dialer.KeepAlive = -1
+	}
+	if iface == "" && k == nil {
+		return dialer
+	}
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		var err error
+		controlErr := c.Control(func(fd uintptr) {
+			if iface != "" {
+				if err = unix.BindToDevice(int(fd), iface); err != nil {
+					err = &net.OpError{Op: "bind", Net: network, Err: err}
+					return
+				}
+			}
+			if k != nil {
+				if err = k.set(int(fd)); err != nil {
+					err = &net.OpError{Op: "keepalive", Net: network, Err: err}
+				}
+			}
+		})
+		if controlErr != nil {
+			return controlErr
+		}
+		return err
+	}
+	return dialer
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetBind(t *testing.T) {
+	remoteAddr := make(chan string, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr <- r.RemoteAddr
+		var upgrade = websocket.Upgrader{}
+		c, err := upgrade.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c.Close()
+	}))
+	defer s.Close()
+	parsedUrl, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+	u := url.URL{Scheme: "ws", Host: parsedUrl.Host, Path: "/"}
+
+	SetBind("", net.ParseIP("127.0.0.2"))
+	defer SetBind("", nil)
+	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, pingInterval, pongWait, true, "")
+	assert.NoError(t, err)
+	if assert.NotNil(t, c) {
+		c.Close()
+	}
+	host, _, err := net.SplitHostPort(<-remoteAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.2", host)
+
+	SetBind("no-such-interface", nil)
+	c, err = NewConnection(u, "some-token", writeWait, maxMessageSize, pingInterval, pongWait, true, "")
+	assert.Error(t, err)
+	assert.Nil(t, c)
+}
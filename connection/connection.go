@@ -15,10 +15,14 @@
 package connection
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -26,6 +30,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 	"github.com/vmihailenco/msgpack"
 
@@ -41,18 +46,86 @@ const (
 		"mender-connect.conf, or make sure that CA certificates are installed on the system"
 )
 
+var (
+	ErrMessageTooLarge = errors.New("message exceeds the maximum message size")
+)
+
+// certificate and key the connections authenticate with to the server,
+// in addition to the JWT; loaded at every dial
+var clientCertFile, clientKeyFile string
+
+// permessage-deflate compression of the messages, and its level
+var compressionEnabled bool
+var compressionLevel int
+
+// SetCompression sets if the connections negotiate the permessage-deflate
+// compression of the messages, and its flate level; 0 keeps the default
+// level, the fastest one. The compression keeps no context between the
+// messages, bounding its memory to the message being compressed.
+func SetCompression(enabled bool, level int) {
+	compressionEnabled = enabled
+	compressionLevel = level
+}
+
+// headers sent with the websocket handshake, besides the ones of the protocol
+var handshakeHeaders = http.Header{}
+
+// SetHandshakeHeaders sets the User-Agent, unless empty, and the
+// additional headers sent with the websocket handshake, e.g. the tags
+// the corporate gateways require
+func SetHandshakeHeaders(userAgent string, headers map[string]string) {
+	handshakeHeaders = http.Header{}
+	for name, value := range headers {
+		handshakeHeaders.Set(name, value)
+	}
+	if userAgent != "" {
+		handshakeHeaders.Set("User-Agent", userAgent)
+	}
+}
+
+// SetClientCertificate sets the PEM files of the certificate and key
+// presented to the server; empty paths disable the client certificate
+func SetClientCertificate(certFile, keyFile string) {
+	clientCertFile = certFile
+	clientKeyFile = keyFile
+}
+
+// RTTStats holds the round-trip times measured from the ping messages
+// to the corresponding pong messages
+type RTTStats struct {
+	Count uint64
+	Min   time.Duration
+	Max   time.Duration
+	Avg   time.Duration
+	Last  time.Duration
+}
+
 type Connection struct {
 	writeMutex sync.Mutex
+	// connection id generated at dial time, used to correlate log entries
+	id string
 	// the connection handler
 	connection *websocket.Conn
+	// the messages and bytes exchanged
+	traffic *trafficCounter
+	// time the dial took, the TLS and websocket handshakes included
+	handshakeLatency time.Duration
 	// Time allowed to write a message to the peer.
 	writeWait time.Duration
 	// Maximum message size allowed from peer.
 	maxMessageSize int64
-	// Time allowed to read the next pong message from the peer.
-	defaultPingWait time.Duration
+	// Time between the ping messages sent to the peer.
+	pingInterval time.Duration
+	// Time allowed to read the next pong message from the peer, on top of
+	// the ping interval.
+	pongWait time.Duration
 	// Channel to stop the go routines
 	done chan bool
+	// time the last ping was sent at, zero once the pong arrived
+	pingSentAt time.Time
+	rttStats   RTTStats
+	rttTotal   time.Duration
+	rttMutex   sync.Mutex
 }
 
 func loadServerTrust(serverCertFilePath string) *x509.CertPool {
@@ -106,34 +179,78 @@ func NewConnection(u url.URL,
 	token string,
 	writeWait time.Duration,
 	maxMessageSize int64,
-	defaultPingWait time.Duration,
+	pingInterval time.Duration,
+	pongWait time.Duration,
 	skipVerify bool,
 	serverCertFilePath string) (*Connection, error) {
+	if budget := getBudget(); budget != nil && budget.Exceeded() {
+		return nil, ErrBudgetExceeded
+	}
 	// skip verification of HTTPS certificate if skipVerify is set in the config file
 
-	websocket.DefaultDialer.TLSClientConfig = &tls.Config{
+	tlsConfig := &tls.Config{
 		RootCAs:            loadServerTrust(serverCertFilePath),
 		InsecureSkipVerify: skipVerify,
 	}
+	if clientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+		if err != nil {
+			return nil, errors.New("failed to load the client certificate: " + err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	websocket.DefaultDialer.TLSClientConfig = tlsConfig
 
 	var ws *websocket.Conn
 	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = compressionEnabled
+	netDial := newDialer().DialContext
+	if proxy != nil {
+		dialer.Proxy = nil
+		if proxy.useFor(u.Hostname()) {
+			netDial = proxy.dialContext
+		}
+	} else if p := environmentProxy(u); p != nil {
+		dialer.Proxy = nil
+		netDial = p.dialContext
+	}
+	traffic := &trafficCounter{}
+	dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := netDial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: conn, traffic: traffic}, nil
+	}
 
-	headers := http.Header{}
+	headers := handshakeHeaders.Clone()
 	headers.Set("Authorization", "Bearer "+token)
-	ws, _, err := dialer.Dial(u.String(), headers)
-	if err != nil {
+	dialedAt := time.Now()
+	ws, resp, err := dialer.Dial(u.String(), headers)
+	if err == websocket.ErrBadHandshake && resp != nil {
+		return nil, newHandshakeError(u, resp)
+	} else if err != nil {
 		return nil, err
 	}
+	if compressionEnabled {
+		ws.EnableWriteCompression(true)
+		if compressionLevel != 0 {
+			_ = ws.SetCompressionLevel(compressionLevel)
+		}
+	}
 
 	c := &Connection{
-		connection:      ws,
-		writeWait:       writeWait,
-		maxMessageSize:  maxMessageSize,
-		defaultPingWait: defaultPingWait,
-		done:            make(chan bool),
+		id:               uuid.NewV4().String(),
+		connection:       ws,
+		traffic:          traffic,
+		handshakeLatency: time.Since(dialedAt),
+		writeWait:        writeWait,
+		maxMessageSize:   maxMessageSize,
+		pingInterval:     pingInterval,
+		pongWait:         pongWait,
+		done:             make(chan bool),
 	}
-	ws.SetReadLimit(maxMessageSize)
+	log.WithField("connection_id", c.id).Infof("connected to %s", u.Host)
 
 	go c.pingPongHandler()
 
@@ -142,27 +259,28 @@ func NewConnection(u url.URL,
 
 func (c *Connection) pingPongHandler() {
 	// handle the ping-pong connection health check
-	err := c.connection.SetReadDeadline(time.Now().Add(c.defaultPingWait))
+	pingWait := c.pingInterval + c.pongWait
+	err := c.connection.SetReadDeadline(time.Now().Add(pingWait))
 	if err != nil {
 		return
 	}
 
-	pingPeriod := (c.defaultPingWait * 9) / 10
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.pingInterval)
 	defer ticker.Stop()
 
 	c.connection.SetPongHandler(func(string) error {
-		log.Debug("PongHandler called")
+		log.WithField("connection_id", c.id).Debug("PongHandler called")
+		c.recordPong(time.Now())
 		// requires go >= 1.15
-		// ticker.Reset(pingPeriod)
-		return c.connection.SetReadDeadline(time.Now().Add(c.defaultPingWait))
+		// ticker.Reset(c.pingInterval)
+		return c.connection.SetReadDeadline(time.Now().Add(pingWait))
 	})
 
 	c.connection.SetPingHandler(func(msg string) error {
-		log.Debug("PingHandler called")
+		log.WithField("connection_id", c.id).Debug("PingHandler called")
 		// requires go >= 1.15
-		// ticker.Reset(pingPeriod)
-		err := c.connection.SetReadDeadline(time.Now().Add(c.defaultPingWait))
+		// ticker.Reset(c.pingInterval)
+		err := c.connection.SetReadDeadline(time.Now().Add(pingWait))
 		if err != nil {
 			return err
 		}
@@ -182,19 +300,74 @@ func (c *Connection) pingPongHandler() {
 			running = false
 			break
 		case <-ticker.C:
-			log.Debug("ping message")
-			pongWaitString := strconv.Itoa(int(c.defaultPingWait.Seconds()))
+			log.WithField("connection_id", c.id).Debug("ping message")
+			pongWaitString := strconv.Itoa(int(pingWait.Seconds()))
 			c.writeMutex.Lock()
-			_ = c.connection.WriteControl(
+			err := c.connection.WriteControl(
 				websocket.PingMessage,
 				[]byte(pongWaitString),
-				time.Now().Add(c.defaultPingWait),
+				time.Now().Add(c.pongWait),
 			)
 			c.writeMutex.Unlock()
+			if err == nil {
+				c.recordPing(time.Now())
+			}
 		}
 	}
 }
 
+func (c *Connection) recordPing(sentAt time.Time) {
+	c.rttMutex.Lock()
+	defer c.rttMutex.Unlock()
+	c.pingSentAt = sentAt
+}
+
+// recordPong accounts the round-trip time of the outstanding ping, pongs
+// not matching a ping (e.g.: unsolicited ones) are ignored
+func (c *Connection) recordPong(receivedAt time.Time) {
+	c.rttMutex.Lock()
+	defer c.rttMutex.Unlock()
+	if c.pingSentAt.IsZero() {
+		return
+	}
+	rtt := receivedAt.Sub(c.pingSentAt)
+	c.pingSentAt = time.Time{}
+
+	stats := &c.rttStats
+	if stats.Count == 0 || rtt < stats.Min {
+		stats.Min = rtt
+	}
+	if rtt > stats.Max {
+		stats.Max = rtt
+	}
+	stats.Count++
+	c.rttTotal += rtt
+	stats.Avg = c.rttTotal / time.Duration(stats.Count)
+	stats.Last = rtt
+}
+
+// RTTStats returns the round-trip time statistics of the connection
+func (c *Connection) RTTStats() RTTStats {
+	c.rttMutex.Lock()
+	defer c.rttMutex.Unlock()
+	return c.rttStats
+}
+
+// TrafficStats returns the messages and bytes exchanged on the connection
+func (c *Connection) TrafficStats() TrafficStats {
+	return c.traffic.get()
+}
+
+// HandshakeLatency returns the time the dial took, the TLS and websocket
+// handshakes included
+func (c *Connection) HandshakeLatency() time.Duration {
+	return c.handshakeLatency
+}
+
+func (c *Connection) GetID() string {
+	return c.id
+}
+
 func (c *Connection) GetWriteTimeout() time.Duration {
 	return c.writeWait
 }
@@ -207,15 +380,40 @@ func (c *Connection) WriteMessage(m *ws.ProtoMsg) (err error) {
 	c.writeMutex.Lock()
 	defer c.writeMutex.Unlock()
 	_ = c.connection.SetWriteDeadline(time.Now().Add(c.writeWait))
-	return c.connection.WriteMessage(websocket.BinaryMessage, data)
+	err = c.connection.WriteMessage(websocket.BinaryMessage, data)
+	if err == nil {
+		c.traffic.messageSent(len(data))
+	}
+	return err
 }
 
+// ReadMessage reads the next message from the peer; messages larger than
+// maxMessageSize are discarded and ErrMessageTooLarge is returned, leaving
+// the connection usable
 func (c *Connection) ReadMessage() (*ws.ProtoMsg, error) {
-	_, data, err := c.connection.ReadMessage()
+	_, messageReader, err := c.connection.NextReader()
 	if err != nil {
 		return nil, err
 	}
 
+	r := messageReader
+	if c.maxMessageSize > 0 {
+		r = io.LimitReader(messageReader, c.maxMessageSize+1)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if c.maxMessageSize > 0 && int64(len(data)) > c.maxMessageSize {
+		// discard the rest of the message, so the next read starts clean
+		_, err = io.Copy(ioutil.Discard, messageReader)
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrMessageTooLarge
+	}
+	c.traffic.messageReceived(len(data))
+
 	m := &ws.ProtoMsg{}
 	err = msgpack.Unmarshal(data, m)
 	if err != nil {
@@ -15,6 +15,7 @@
 package connection
 
 import (
+	"crypto/tls"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -27,6 +28,8 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
+
+	"github.com/mendersoftware/mender-connect/limits"
 )
 
 const (
@@ -34,8 +37,10 @@ const (
 	writeWait = 4 * time.Second
 	// Maximum message size allowed from peer.
 	maxMessageSize = 8192
+	// Time between the ping messages sent to the peer.
+	pingInterval = 54 * time.Second
 	// Time allowed to read the next pong message from the peer.
-	defaultPingWait = time.Minute
+	pongWait = 6 * time.Second
 )
 
 func sleepyHandler(w http.ResponseWriter, r *http.Request) {
@@ -53,11 +58,13 @@ func sleepyHandler(w http.ResponseWriter, r *http.Request) {
 
 func writeMessage(c *websocket.Conn, body []byte) {
 	conn := &Connection{
-		writeMutex:      sync.Mutex{},
-		connection:      c,
-		writeWait:       writeWait,
-		maxMessageSize:  maxMessageSize,
-		defaultPingWait: defaultPingWait,
+		writeMutex:     sync.Mutex{},
+		connection:     c,
+		traffic:        &trafficCounter{},
+		writeWait:      writeWait,
+		maxMessageSize: maxMessageSize,
+		pingInterval:   pingInterval,
+		pongWait:       pongWait,
 	}
 
 	m := &ws.ProtoMsg{
@@ -105,7 +112,7 @@ func TestNewConnection(t *testing.T) {
 
 	u := url.URL{Scheme: parsedUrl.Scheme, Host: parsedUrl.Host, Path: "/"}
 
-	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait, true, "")
+	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, pingInterval, pongWait, true, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, c)
 }
@@ -134,7 +141,7 @@ func TestConnection_ReadMessage(t *testing.T) {
 
 	u := url.URL{Scheme: parsedUrl.Scheme, Host: parsedUrl.Host, Path: "/"}
 
-	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait, true, "")
+	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, pingInterval, pongWait, true, "")
 	time.Sleep(time.Second)
 	m, err := c.ReadMessage()
 	assert.NoError(t, err)
@@ -144,6 +151,29 @@ func TestConnection_ReadMessage(t *testing.T) {
 	assert.Equal(t, expectedMessage, m)
 }
 
+func TestConnection_ReadMessageTooLarge(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(helloHandler))
+	assert.NotNil(t, s)
+	defer s.Close()
+
+	wsUrl := "ws" + strings.TrimPrefix(s.URL, "http")
+	parsedUrl, err := url.Parse(wsUrl)
+	assert.NoError(t, err)
+
+	u := url.URL{Scheme: parsedUrl.Scheme, Host: parsedUrl.Host, Path: "/"}
+
+	c, err := NewConnection(u, "some-token", writeWait, 16, pingInterval, pongWait, true, "")
+	assert.NoError(t, err)
+	m, err := c.ReadMessage()
+	assert.Equal(t, ErrMessageTooLarge, err)
+	assert.Nil(t, m)
+
+	// the connection is still usable after an oversized message
+	m, err = c.ReadMessage()
+	assert.Equal(t, ErrMessageTooLarge, err)
+	assert.Nil(t, m)
+}
+
 func TestConnection_WriteMessage(t *testing.T) {
 	t.Log("starting mock httpd with websockets")
 	s := httptest.NewServer(http.HandlerFunc(helloHandler))
@@ -156,7 +186,7 @@ func TestConnection_WriteMessage(t *testing.T) {
 
 	u := url.URL{Scheme: parsedUrl.Scheme, Host: parsedUrl.Host, Path: "/"}
 
-	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait, true, "")
+	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, pingInterval, pongWait, true, "")
 	time.Sleep(time.Second)
 	m, err := c.ReadMessage()
 	assert.NoError(t, err)
@@ -180,7 +210,7 @@ func TestConnection_Close(t *testing.T) {
 
 	u := url.URL{Scheme: parsedUrl.Scheme, Host: parsedUrl.Host, Path: "/"}
 
-	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait, true, "")
+	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, pingInterval, pongWait, true, "")
 	assert.NotNil(t, c)
 
 	assert.True(t, c.GetWriteTimeout() > 0)
@@ -190,6 +220,186 @@ func TestConnection_Close(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestConnection_Compression(t *testing.T) {
+	defer SetCompression(false, 0)
+
+	body := []byte(strings.Repeat("compressible ", 512))
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrade = websocket.Upgrader{EnableCompression: true}
+		c, err := upgrade.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.EnableWriteCompression(true)
+		writeMessage(c, body)
+		_, _, _ = c.ReadMessage()
+	}))
+	defer s.Close()
+
+	parsedUrl, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+	u := url.URL{Scheme: "ws", Host: parsedUrl.Host, Path: "/"}
+
+	for _, enabled := range []bool{false, true} {
+		SetCompression(enabled, 9)
+		c, err := NewConnection(u, "some-token", writeWait, 16384, pingInterval, pongWait, true, "")
+		assert.NoError(t, err)
+		m, err := c.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, body, m.Body)
+		assert.NoError(t, c.WriteMessage(m))
+
+		stats := c.TrafficStats()
+		assert.Equal(t, uint64(1), stats.MessagesReceived)
+		assert.Equal(t, uint64(1), stats.MessagesSent)
+		assert.True(t, stats.PayloadBytesReceived > uint64(len(body)))
+		assert.Equal(t, stats.PayloadBytesReceived, stats.PayloadBytesSent)
+		if enabled {
+			assert.True(t, stats.BytesReceived < stats.PayloadBytesReceived/4, "%+v", stats)
+			assert.True(t, stats.BytesSent < stats.PayloadBytesSent/4, "%+v", stats)
+		} else {
+			assert.True(t, stats.BytesReceived > stats.PayloadBytesReceived, "%+v", stats)
+		}
+		c.Close()
+	}
+}
+
+func TestNewConnectionHandshakeHeaders(t *testing.T) {
+	defer SetHandshakeHeaders("", nil)
+
+	headers := make(chan http.Header, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		var upgrade = websocket.Upgrader{}
+		c, err := upgrade.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _, _ = c.ReadMessage()
+	}))
+	defer s.Close()
+
+	parsedUrl, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+	u := url.URL{Scheme: "ws", Host: parsedUrl.Host, Path: "/"}
+
+	SetHandshakeHeaders("mender-connect/test", map[string]string{
+		"X-Environment": "production",
+	})
+	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, pingInterval, pongWait, true, "")
+	assert.NoError(t, err)
+	c.Close()
+	h := <-headers
+	assert.Equal(t, "mender-connect/test", h.Get("User-Agent"))
+	assert.Equal(t, "production", h.Get("X-Environment"))
+	assert.Equal(t, "Bearer some-token", h.Get("Authorization"))
+
+	// the headers are not left over between the dials
+	SetHandshakeHeaders("", nil)
+	c, err = NewConnection(u, "other-token", writeWait, maxMessageSize, pingInterval, pongWait, true, "")
+	assert.NoError(t, err)
+	c.Close()
+	h = <-headers
+	assert.NotEqual(t, "mender-connect/test", h.Get("User-Agent"))
+	assert.Empty(t, h.Get("X-Environment"))
+	assert.Equal(t, "Bearer other-token", h.Get("Authorization"))
+}
+
+func TestConnection_Budget(t *testing.T) {
+	body := []byte(strings.Repeat("x", 8192))
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrade = websocket.Upgrader{}
+		c, err := upgrade.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		writeMessage(c, body)
+		writeMessage(c, body)
+		_, _, _ = c.ReadMessage()
+	}))
+	defer s.Close()
+
+	parsedUrl, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+	u := url.URL{Scheme: "ws", Host: parsedUrl.Host, Path: "/"}
+
+	b := limits.NewBudget(0, 16000)
+	SetBudget(b)
+	defer SetBudget(nil)
+	c, err := NewConnection(u, "some-token", writeWait, 16384, pingInterval, pongWait, true, "")
+	assert.NoError(t, err)
+	_, err = c.ReadMessage()
+	assert.NoError(t, err)
+	_, err = c.ReadMessage()
+	assert.Error(t, err)
+	c.Close()
+
+	// the handshake and the message are accounted
+	assert.True(t, b.Usage().Day > uint64(len(body)))
+	_, err = NewConnection(u, "some-token", writeWait, 16384, pingInterval, pongWait, true, "")
+	assert.Equal(t, ErrBudgetExceeded, err)
+}
+
+func TestConnection_RTTStats(t *testing.T) {
+	c := &Connection{}
+	now := time.Now()
+
+	c.recordPong(now)
+	assert.Equal(t, RTTStats{}, c.RTTStats())
+
+	c.recordPing(now)
+	c.recordPong(now.Add(10 * time.Millisecond))
+	c.recordPong(now.Add(50 * time.Millisecond))
+	c.recordPing(now.Add(time.Second))
+	c.recordPong(now.Add(time.Second + 30*time.Millisecond))
+	assert.Equal(t, RTTStats{
+		Count: 2,
+		Min:   10 * time.Millisecond,
+		Max:   30 * time.Millisecond,
+		Avg:   20 * time.Millisecond,
+		Last:  30 * time.Millisecond,
+	}, c.RTTStats())
+}
+
+func TestNewConnectionClientCertificate(t *testing.T) {
+	defer SetClientCertificate("", "")
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "device" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		helloHandler(w, r)
+	}))
+	s.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	s.StartTLS()
+	defer s.Close()
+
+	parsedUrl, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+	u := url.URL{Scheme: "wss", Host: parsedUrl.Host, Path: "/"}
+
+	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, pingInterval, pongWait, true, "")
+	assert.Error(t, err)
+	assert.Nil(t, c)
+
+	SetClientCertificate("testdata/client.crt", "testdata/missing.key")
+	_, err = NewConnection(u, "some-token", writeWait, maxMessageSize, pingInterval, pongWait, true, "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to load the client certificate")
+
+	SetClientCertificate("testdata/client.crt", "testdata/client.key")
+	c, err = NewConnection(u, "some-token", writeWait, maxMessageSize, pingInterval, pongWait, true, "")
+	assert.NoError(t, err)
+	defer c.Close()
+	m, err := c.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(helloMessage), m.Body)
+}
+
 func TestMenderShellConnectionLoadServerTrust(t *testing.T) {
 	testCases := map[string]struct {
 		certificate string
@@ -0,0 +1,167 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Reasons of the failures to connect, as given by FailureReason
+const (
+	FailureDNS             = "dns"
+	FailureTCP             = "tcp"
+	FailureTLS             = "tls"
+	FailureTLSCertificate  = "tls-certificate"
+	FailureUnauthorized    = "unauthorized"
+	FailureForbidden       = "forbidden"
+	FailureHTTP            = "http"
+	FailureProxy           = "proxy"
+	FailureCaptivePortal   = "captive-portal"
+	FailureBandwidthBudget = "bandwidth-budget"
+	FailureUnknown         = "unknown"
+)
+
+// Reasons of the losses of the connection, as given by DisconnectReason,
+// besides the Failure* ones
+const (
+	DisconnectClosed       = "closed"
+	DisconnectServerClosed = "server-closed"
+	DisconnectTimeout      = "timeout"
+)
+
+// HandshakeError is returned when the server answers the websocket
+// handshake with an HTTP response other than the protocol switch
+type HandshakeError struct {
+	StatusCode int
+	Status     string
+	// the Location header of the redirections
+	Location string
+	// host the handshake was sent to
+	host string
+}
+
+func newHandshakeError(u url.URL, resp *http.Response) *HandshakeError {
+	return &HandshakeError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Location:   resp.Header.Get("Location"),
+		host:       u.Hostname(),
+	}
+}
+
+func (e *HandshakeError) Error() string {
+	status := e.Status
+	if status == "" {
+		status = strconv.Itoa(e.StatusCode)
+	}
+	return "websocket: bad handshake: " + status
+}
+
+// captivePortal tells if the response looks like the one of a captive
+// portal rather than of the server, which only answers the handshake with
+// the protocol switch or with an error: a success, a redirection to
+// another host, or the network authentication required
+func (e *HandshakeError) captivePortal() bool {
+	switch {
+	case e.StatusCode == http.StatusNetworkAuthenticationRequired:
+		return true
+	case e.StatusCode >= 200 && e.StatusCode < 300:
+		return true
+	case e.StatusCode >= 300 && e.StatusCode < 400:
+		location, err := url.Parse(e.Location)
+		return err != nil || (location.Host != "" && location.Hostname() != e.host)
+	}
+	return false
+}
+
+// ProxyError is returned when the tunnel through the proxy could not be
+// opened
+type ProxyError struct {
+	Err error
+}
+
+func (e *ProxyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// FailureReason classifies the error of a failed dial into one of the
+// Failure* reasons, for the monitoring to tell the causes apart
+func FailureReason(err error) string {
+	var handshakeErr *HandshakeError
+	var proxyErr *ProxyError
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateErr x509.CertificateInvalidError
+	var recordHeaderErr tls.RecordHeaderError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrBudgetExceeded):
+		return FailureBandwidthBudget
+	case errors.As(err, &proxyErr):
+		return FailureProxy
+	case errors.As(err, &handshakeErr):
+		switch {
+		case handshakeErr.StatusCode == http.StatusUnauthorized:
+			return FailureUnauthorized
+		case handshakeErr.StatusCode == http.StatusForbidden:
+			return FailureForbidden
+		case handshakeErr.captivePortal():
+			return FailureCaptivePortal
+		}
+		return FailureHTTP
+	case errors.As(err, &unknownAuthorityErr), errors.As(err, &hostnameErr),
+		errors.As(err, &certificateErr):
+		return FailureTLSCertificate
+	case errors.As(err, &recordHeaderErr), strings.HasPrefix(err.Error(), "tls:"):
+		return FailureTLS
+	case errors.As(err, &dnsErr):
+		return FailureDNS
+	case errors.As(err, &opErr):
+		return FailureTCP
+	}
+	return FailureUnknown
+}
+
+// DisconnectReason classifies the error the connection was lost with into
+// one of the Disconnect* or Failure* reasons; no error means the
+// connection was closed on purpose
+func DisconnectReason(err error) string {
+	var closeErr *websocket.CloseError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return DisconnectClosed
+	case errors.As(err, &closeErr):
+		return DisconnectServerClosed
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return DisconnectTimeout
+	}
+	return FailureReason(err)
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailureReason(t *testing.T) {
+	handshake := func(statusCode int, location string) error {
+		return &HandshakeError{StatusCode: statusCode, Location: location, host: "hosted.mender.io"}
+	}
+	testCases := map[string]struct {
+		err    error
+		reason string
+	}{
+		"none":            {nil, ""},
+		"budget":          {ErrBudgetExceeded, FailureBandwidthBudget},
+		"proxy":           {&ProxyError{Err: ErrProxyAuthentication}, FailureProxy},
+		"unauthorized":    {handshake(http.StatusUnauthorized, ""), FailureUnauthorized},
+		"forbidden":       {handshake(http.StatusForbidden, ""), FailureForbidden},
+		"server error":    {handshake(http.StatusBadGateway, ""), FailureHTTP},
+		"redirect":        {handshake(http.StatusFound, "https://hosted.mender.io/login"), FailureHTTP},
+		"portal redirect": {handshake(http.StatusFound, "http://portal.example.com/"), FailureCaptivePortal},
+		"portal page":     {handshake(http.StatusOK, ""), FailureCaptivePortal},
+		"portal auth":     {handshake(http.StatusNetworkAuthenticationRequired, ""), FailureCaptivePortal},
+		"certificate":     {fmt.Errorf("x509: %w", x509.UnknownAuthorityError{}), FailureTLSCertificate},
+		"tls":             {errors.New("tls: handshake failure"), FailureTLS},
+		"dns":             {&net.OpError{Op: "dial", Err: &net.DNSError{Name: "hosted.mender.io"}}, FailureDNS},
+		"tcp":             {&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, FailureTCP},
+		"something else":  {errors.New("something else"), FailureUnknown},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.reason, FailureReason(tc.err))
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestDisconnectReason(t *testing.T) {
+	testCases := map[string]struct {
+		err    error
+		reason string
+	}{
+		"closed":         {nil, DisconnectClosed},
+		"server closed":  {&websocket.CloseError{Code: websocket.CloseAbnormalClosure}, DisconnectServerClosed},
+		"timeout":        {&net.OpError{Op: "read", Err: timeoutError{}}, DisconnectTimeout},
+		"reset":          {&net.OpError{Op: "read", Err: syscall.ECONNRESET}, FailureTCP},
+		"budget":         {ErrBudgetExceeded, FailureBandwidthBudget},
+		"something else": {errors.New("something else"), FailureUnknown},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.reason, DisconnectReason(tc.err))
+		})
+	}
+}
+
+func TestNewConnectionFailureReason(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	parsedUrl, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+	u := url.URL{Scheme: "ws", Host: parsedUrl.Host, Path: "/"}
+
+	_, err = NewConnection(u, "some-token", writeWait, maxMessageSize, pingInterval, pongWait, true, "")
+	assert.EqualError(t, err, "websocket: bad handshake: 401 Unauthorized")
+	assert.Equal(t, FailureUnauthorized, FailureReason(err))
+
+	s.Close()
+	_, err = NewConnection(u, "some-token", writeWait, maxMessageSize, pingInterval, pongWait, true, "")
+	assert.Equal(t, FailureTCP, FailureReason(err))
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// KeepAlive holds the TCP keepalive settings of the connections
+type KeepAlive struct {
+	// Do not send keepalive probes
+	Disabled bool
+	// Time the connection is idle before the first probe; 0 for the
+	// system default
+	Idle time.Duration
+	// Time between the probes; 0 for the system default
+	Interval time.Duration
+	// Unanswered probes before the connection is dropped; 0 for the
+	// system default
+	Count int
+}
+
+// the keepalive set with SetKeepAlive, nil for the Go defaults
+var keepAlive *KeepAlive
+
+// SetKeepAlive sets the TCP keepalive of the connections to the server
+// and to the proxy; nil keeps the Go defaults, probes every 15 seconds
+func SetKeepAlive(k *KeepAlive) {
+	keepAlive = k
+}
+
+// set applies the keepalive settings to the socket
+func (k *KeepAlive) set(fd int) error {
+	if k.Disabled {
+		return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 0)
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1); err != nil {
+		return err
+	}
+	if k.Idle > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE,
+			seconds(k.Idle)); err != nil {
+			return err
+		}
+	}
+	if k.Interval > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL,
+			seconds(k.Interval)); err != nil {
+			return err
+		}
+	}
+	if k.Count > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, k.Count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seconds rounds d up to whole seconds, the unit of the socket options
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,60 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func getsockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	assert.NoError(t, err)
+	var value int
+	err = raw.Control(func(fd uintptr) {
+		value, err = unix.GetsockoptInt(int(fd), level, opt)
+	})
+	assert.NoError(t, err)
+	return value
+}
+
+func TestSetKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	SetKeepAlive(&KeepAlive{
+		Idle:     30 * time.Second,
+		Interval: 1500 * time.Millisecond,
+		Count:    3,
+	})
+	defer SetKeepAlive(nil)
+	conn, err := newDialer().Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, getsockopt(t, conn, unix.SOL_SOCKET, unix.SO_KEEPALIVE))
+	assert.Equal(t, 30, getsockopt(t, conn, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE))
+	assert.Equal(t, 2, getsockopt(t, conn, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL))
+	assert.Equal(t, 3, getsockopt(t, conn, unix.IPPROTO_TCP, unix.TCP_KEEPCNT))
+	conn.Close()
+
+	SetKeepAlive(&KeepAlive{Disabled: true})
+	conn, err = newDialer().Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, getsockopt(t, conn, unix.SOL_SOCKET, unix.SO_KEEPALIVE))
+	conn.Close()
+}
@@ -0,0 +1,276 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package connection
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Time allowed to connect to the proxy and have it open the tunnel
+const proxyConnectTimeout = 45 * time.Second
+
+var (
+	ErrProxyAuthentication = errors.New("the proxy authentication scheme is not supported")
+)
+
+// Proxy holds the HTTP proxy the connections are tunneled through with
+// CONNECT requests
+type Proxy struct {
+	// URL of the proxy, http or https, with the credentials if any
+	URL *url.URL
+	// Hosts, domains and CIDRs reached without the proxy; "*" matches all
+	NoProxy []string
+}
+
+// the proxy set with SetProxy, nil to use the proxy of the environment
+var proxy *Proxy
+
+// SetProxy sets the proxy the connections are tunneled through; nil
+// uses the one given by the HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+// environment variables, if any
+func SetProxy(p *Proxy) {
+	proxy = p
+}
+
+// environmentProxy returns the proxy of the environment to reach u
+// through, nil if none or if it is not an HTTP proxy
+func environmentProxy(u url.URL) *Proxy {
+	switch u.Scheme {
+	case "wss":
+		u.Scheme = "https"
+	case "ws":
+		u.Scheme = "http"
+	}
+	proxyURL, err := http.ProxyFromEnvironment(&http.Request{URL: &u})
+	if err != nil || proxyURL == nil {
+		return nil
+	}
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+		return nil
+	}
+	return &Proxy{URL: proxyURL}
+}
+
+// useFor tells if the host is to be reached through the proxy
+func (p *Proxy) useFor(host string) bool {
+	ip := net.ParseIP(host)
+	for _, entry := range p.NoProxy {
+		if entry == "*" || strings.EqualFold(entry, host) {
+			return false
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return false
+			}
+			continue
+		}
+		domain := strings.ToLower(strings.TrimPrefix(entry, "."))
+		if strings.HasSuffix(strings.ToLower(host), "."+domain) {
+			return false
+		}
+	}
+	return true
+}
+
+// dial opens a tunnel to addr through the proxy, answering its basic or
+// digest authentication challenge if the proxy URL carries credentials;
+// the errors are ProxyErrors
+func (p *Proxy) dial(network, addr string) (net.Conn, error) {
+	conn, resp, err := p.connect(network, addr, "")
+	if err != nil {
+		return nil, &ProxyError{Err: err}
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired && p.URL.User != nil {
+		conn.Close()
+		authorization, err := p.authorization(resp.Header.Values("Proxy-Authenticate"), addr)
+		if err != nil {
+			return nil, &ProxyError{Err: err}
+		}
+		conn, resp, err = p.connect(network, addr, authorization)
+		if err != nil {
+			return nil, &ProxyError{Err: err}
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, &ProxyError{
+			Err: errors.New("the proxy refused the connection to " + addr + ": " + resp.Status),
+		}
+	}
+	return conn, nil
+}
+
+// dialContext is dial, for the dialers taking a context
+func (p *Proxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return p.dial(network, addr)
+}
+
+// connect sends the CONNECT request for addr to the proxy
+func (p *Proxy) connect(network, addr string, authorization string) (net.Conn, *http.Response, error) {
+	proxyAddr := p.URL.Host
+	if p.URL.Port() == "" {
+		if p.URL.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(p.URL.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(p.URL.Hostname(), "80")
+		}
+	}
+	dialer := newDialer()
+	dialer.Timeout = proxyConnectTimeout
+	conn, err := dialer.Dial(network, proxyAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.URL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: p.URL.Hostname()})
+	}
+	_ = conn.SetDeadline(time.Now().Add(proxyConnectTimeout))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if authorization != "" {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	// the server does not speak before the client, nothing is buffered
+	// past the response
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, resp, nil
+}
+
+// authorization answers the first supported of the challenges
+func (p *Proxy) authorization(challenges []string, addr string) (string, error) {
+	username := p.URL.User.Username()
+	password, _ := p.URL.User.Password()
+	for _, challenge := range challenges {
+		fields := strings.SplitN(challenge, " ", 2)
+		switch strings.ToLower(fields[0]) {
+		case "basic":
+			return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+		case "digest":
+			if len(fields) < 2 {
+				continue
+			}
+			if authorization, ok := digestAuthorization(parseChallenge(fields[1]),
+				username, password, addr); ok {
+				return authorization, nil
+			}
+		}
+	}
+	return "", ErrProxyAuthentication
+}
+
+// parseChallenge returns the parameters of an authentication challenge
+func parseChallenge(s string) map[string]string {
+	params := map[string]string{}
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, "\"") {
+			end := strings.Index(s[1:], "\"")
+			if end < 0 {
+				end = len(s) - 1
+			}
+			value = s[1 : end+1]
+			s = s[end+1:]
+			if len(s) > 0 {
+				s = s[1:]
+			}
+		} else {
+			end := strings.Index(s, ",")
+			if end < 0 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// digestAuthorization computes the MD5 digest authorization (RFC 2617)
+// of the CONNECT request for addr; false if the challenge asks for
+// something else
+func digestAuthorization(challenge map[string]string, username, password, addr string) (string, bool) {
+	algorithm := challenge["algorithm"]
+	if algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+		return "", false
+	}
+	hash := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	realm, nonce := challenge["realm"], challenge["nonce"]
+	ha1 := hash(username + ":" + realm + ":" + password)
+	ha2 := hash(http.MethodConnect + ":" + addr)
+
+	authorization := `Digest username="` + username + `", realm="` + realm +
+		`", nonce="` + nonce + `", uri="` + addr + `"`
+	qopAuth := false
+	for _, qop := range strings.Split(challenge["qop"], ",") {
+		if strings.TrimSpace(qop) == "auth" {
+			qopAuth = true
+		}
+	}
+	if qopAuth {
+		buf := make([]byte, 8)
+		_, _ = rand.Read(buf)
+		cnonce := hex.EncodeToString(buf)
+		response := hash(ha1 + ":" + nonce + ":00000001:" + cnonce + ":auth:" + ha2)
+		authorization += `, qop=auth, nc=00000001, cnonce="` + cnonce + `", response="` + response + `"`
+	} else if challenge["qop"] == "" {
+		authorization += `, response="` + hash(ha1+":"+nonce+":"+ha2) + `"`
+	} else {
+		return "", false
+	}
+	if algorithm != "" {
+		authorization += ", algorithm=" + algorithm
+	}
+	if opaque, ok := challenge["opaque"]; ok {
+		authorization += `, opaque="` + opaque + `"`
+	}
+	return authorization, true
+}
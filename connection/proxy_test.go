@@ -0,0 +1,206 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package connection
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeProxy tunnels the CONNECT requests, challenging them with the
+// authentication scheme if set
+type fakeProxy struct {
+	listener net.Listener
+	scheme   string
+	password string
+	connects int32
+}
+
+func newFakeProxy(t *testing.T, scheme string, password string) *fakeProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	p := &fakeProxy{listener: listener, scheme: scheme, password: password}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *fakeProxy) authorized(authorization string) bool {
+	switch p.scheme {
+	case "":
+		return true
+	case "Basic":
+		return authorization == "Basic "+base64.StdEncoding.EncodeToString([]byte("user:"+p.password))
+	case "Digest":
+		if !strings.HasPrefix(authorization, "Digest ") {
+			return false
+		}
+		params := parseChallenge(strings.TrimPrefix(authorization, "Digest "))
+		hash := func(s string) string {
+			sum := md5.Sum([]byte(s))
+			return hex.EncodeToString(sum[:])
+		}
+		ha1 := hash(params["username"] + ":test:" + p.password)
+		ha2 := hash("CONNECT:" + params["uri"])
+		return params["nonce"] == "abc" && params["opaque"] == "xyz" &&
+			params["response"] == hash(ha1+":abc:"+params["nc"]+":"+params["cnonce"]+":auth:"+ha2)
+	}
+	return false
+}
+
+func (p *fakeProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	if !p.authorized(req.Header.Get("Proxy-Authorization")) {
+		challenge := "Basic realm=\"test\""
+		if p.scheme == "Digest" {
+			challenge = "Digest realm=\"test\", nonce=\"abc\", qop=\"auth,auth-int\", opaque=\"xyz\""
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n" +
+			"Proxy-Authenticate: " + challenge + "\r\nContent-Length: 0\r\n\r\n"))
+		return
+	}
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
+		return
+	}
+	defer target.Close()
+	atomic.AddInt32(&p.connects, 1)
+	_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go func() {
+		_, _ = io.Copy(target, conn)
+	}()
+	_, _ = io.Copy(conn, target)
+}
+
+func TestProxyUseFor(t *testing.T) {
+	p := &Proxy{NoProxy: []string{"localhost", ".internal", "example.com", "10.0.0.0/8"}}
+	assert.True(t, p.useFor("hosted.mender.io"))
+	assert.False(t, p.useFor("localhost"))
+	assert.False(t, p.useFor("server.internal"))
+	assert.False(t, p.useFor("eu.example.com"))
+	assert.True(t, p.useFor("notexample.com"))
+	assert.False(t, p.useFor("10.1.2.3"))
+	assert.True(t, p.useFor("192.168.1.1"))
+	assert.False(t, (&Proxy{NoProxy: []string{"*"}}).useFor("hosted.mender.io"))
+}
+
+func TestNewConnectionProxy(t *testing.T) {
+	defer SetProxy(nil)
+
+	s := httptest.NewServer(http.HandlerFunc(helloHandler))
+	defer s.Close()
+	parsedUrl, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+	u := url.URL{Scheme: "ws", Host: parsedUrl.Host, Path: "/"}
+
+	testCases := map[string]struct {
+		scheme   string
+		user     *url.Userinfo
+		noProxy  []string
+		err      bool
+		connects int32
+	}{
+		"no authentication": {
+			connects: 1,
+		},
+		"basic": {
+			scheme:   "Basic",
+			user:     url.UserPassword("user", "secret"),
+			connects: 1,
+		},
+		"digest": {
+			scheme:   "Digest",
+			user:     url.UserPassword("user", "secret"),
+			connects: 1,
+		},
+		"wrong password": {
+			scheme: "Digest",
+			user:   url.UserPassword("user", "wrong"),
+			err:    true,
+		},
+		"no credentials": {
+			scheme: "Basic",
+			err:    true,
+		},
+		"no proxy": {
+			scheme:  "Basic",
+			noProxy: []string{"127.0.0.0/8"},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fake := newFakeProxy(t, tc.scheme, "secret")
+			defer fake.listener.Close()
+			SetProxy(&Proxy{
+				URL:     &url.URL{Scheme: "http", Host: fake.listener.Addr().String(), User: tc.user},
+				NoProxy: tc.noProxy,
+			})
+
+			c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, pingInterval, pongWait, true, "")
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			defer c.Close()
+			m, err := c.ReadMessage()
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(helloMessage), m.Body)
+			assert.Equal(t, tc.connects, atomic.LoadInt32(&fake.connects))
+		})
+	}
+}
+
+func TestDigestAuthorization(t *testing.T) {
+	authorization, ok := digestAuthorization(map[string]string{
+		"realm": "test",
+		"nonce": "abc",
+	}, "user", "secret", "hosted.mender.io:443")
+	assert.True(t, ok)
+	params := parseChallenge(strings.TrimPrefix(authorization, "Digest "))
+	assert.Equal(t, "user", params["username"])
+	assert.Equal(t, "hosted.mender.io:443", params["uri"])
+	assert.Equal(t, "", params["qop"])
+	assert.Len(t, params["response"], 32)
+
+	_, ok = digestAuthorization(map[string]string{"algorithm": "SHA-256"}, "user", "secret", "a:1")
+	assert.False(t, ok)
+	_, ok = digestAuthorization(map[string]string{"qop": "auth-int"}, "user", "secret", "a:1")
+	assert.False(t, ok)
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package connection
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mendersoftware/mender-connect/limits"
+)
+
+var (
+	ErrBudgetExceeded = errors.New("the bandwidth budget is exhausted")
+)
+
+var (
+	// bytes on the wire allowed per hour and per day, across the
+	// connections
+	budget *limits.Budget
+	// guards budget, set by the daemon while the connections use it
+	budgetMutex sync.Mutex
+)
+
+// SetBudget sets the budget all the bytes on the wire, sent and received,
+// are accounted against; once exhausted the connections fail and no new
+// ones are made until the hour or the day is over. Nil disables it.
+func SetBudget(b *limits.Budget) {
+	budgetMutex.Lock()
+	defer budgetMutex.Unlock()
+	budget = b
+}
+
+// getBudget returns the budget the bytes on the wire are accounted
+// against, nil if there is none
+func getBudget() *limits.Budget {
+	budgetMutex.Lock()
+	defer budgetMutex.Unlock()
+	return budget
+}
+
+// TrafficStats holds the messages and bytes exchanged on a connection
+type TrafficStats struct {
+	MessagesSent     uint64
+	MessagesReceived uint64
+	// bytes of the messages, before compression
+	PayloadBytesSent     uint64
+	PayloadBytesReceived uint64
+	// bytes on the wire: compressed, with the websocket and TLS framing
+	// and the control messages
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// trafficCounter counts the traffic atomically; allocated on its own so
+// that the counters are 64-bit aligned
+type trafficCounter struct {
+	stats TrafficStats
+}
+
+func (t *trafficCounter) get() TrafficStats {
+	return TrafficStats{
+		MessagesSent:         atomic.LoadUint64(&t.stats.MessagesSent),
+		MessagesReceived:     atomic.LoadUint64(&t.stats.MessagesReceived),
+		PayloadBytesSent:     atomic.LoadUint64(&t.stats.PayloadBytesSent),
+		PayloadBytesReceived: atomic.LoadUint64(&t.stats.PayloadBytesReceived),
+		BytesSent:            atomic.LoadUint64(&t.stats.BytesSent),
+		BytesReceived:        atomic.LoadUint64(&t.stats.BytesReceived),
+	}
+}
+
+func (t *trafficCounter) messageSent(size int) {
+	atomic.AddUint64(&t.stats.MessagesSent, 1)
+	atomic.AddUint64(&t.stats.PayloadBytesSent, uint64(size))
+}
+
+func (t *trafficCounter) messageReceived(size int) {
+	atomic.AddUint64(&t.stats.MessagesReceived, 1)
+	atomic.AddUint64(&t.stats.PayloadBytesReceived, uint64(size))
+}
+
+// countingConn counts the bytes on the wire of the connection
+type countingConn struct {
+	net.Conn
+	traffic *trafficCounter
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	budget := getBudget()
+	if budget != nil && budget.Exceeded() {
+		return 0, ErrBudgetExceeded
+	}
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.traffic.stats.BytesReceived, uint64(n))
+	if budget != nil {
+		budget.Use(n)
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	budget := getBudget()
+	if budget != nil && budget.Exceeded() {
+		return 0, ErrBudgetExceeded
+	}
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.traffic.stats.BytesSent, uint64(n))
+	if budget != nil {
+		budget.Use(n)
+	}
+	return n, err
+}
@@ -29,8 +29,6 @@ import (
 const (
 	// Time allowed to write a message to the peer.
 	writeWait = 4 * time.Second
-	// Maximum message size allowed from peer.
-	maxMessageSize = 8192
 
 	httpsProtocol = "https"
 	httpProtocol  = "http"
@@ -48,12 +46,61 @@ type ProtocolHandler struct {
 	proto      ws.ProtoType
 	connection *connection.Connection
 	mutex      *sync.Mutex
+	// the server the connection was established to
+	serverUrl string
+}
+
+// Status is the state of the connection of a protocol
+type Status struct {
+	Connected bool
+	// the server connected to
+	ServerURL string
+	// when the connection was established, or lost
+	Since time.Time
+	// the last error connecting or reading, if any
+	LastError   string
+	LastErrorAt time.Time
+	// one of the connection.Failure* reasons of the last error
+	LastErrorReason string
+	// end of the quiet period of the reconnects, once the circuit
+	// breaker opened; zero otherwise
+	QuietUntil time.Time
+	// connections established, the first one included, and lost
+	Connects    uint64
+	Disconnects uint64
+	// when and why the connection was lost last, one of the
+	// connection.Disconnect* or connection.Failure* reasons
+	LastDisconnectAt     time.Time
+	LastDisconnectReason string
+	// time the dial of the last connection took, the handshakes included
+	HandshakeLatency time.Duration
 }
 
 var handlersByTypeMutex = &sync.Mutex{}
 var handlersByType = map[ws.ProtoType]*ProtocolHandler{}
+
+// the states have their own mutex, the handlers one is held while connecting
+var statusMutex = &sync.Mutex{}
+var statusByType = map[ws.ProtoType]*Status{}
 var reconnectIntervalSeconds = 5
-var defaultPingWait = time.Minute
+var maxMessageSize int64 = 8192
+var pingInterval = 54 * time.Second
+var pongWait = 6 * time.Second
+
+// servers the connections fail over between, in order of preference, and
+// the index of the one connected to last
+var failoverServers []string
+var failoverSticky bool
+var failoverServerIndex int
+
+// circuit breaker of the reconnects: after breakerFailures consecutive
+// failed rounds of dials, the rounds are a quiet period apart instead of
+// the reconnect interval, until a dial succeeds
+var breakerMutex = &sync.Mutex{}
+var breakerFailures int
+var breakerQuietPeriod time.Duration
+var consecutiveFailures int
+var quietUntil time.Time
 
 func GetWriteTimeout() time.Duration {
 	return writeWait
@@ -63,52 +110,238 @@ func SetReconnectIntervalSeconds(i int) {
 	reconnectIntervalSeconds = i
 }
 
+// SetDefaultPingWait sets the total time allowed between two pong messages,
+// nine tenths of it being the ping interval and the rest the pong timeout
 func SetDefaultPingWait(wait time.Duration) {
-	defaultPingWait = wait
+	pingInterval = (wait * 9) / 10
+	pongWait = wait - pingInterval
 }
 
-func connect(proto ws.ProtoType, serverUrl, connectUrl, token string, skipVerify bool, serverCertificate string, retries uint, stop <-chan bool) error {
-	parsedUrl, err := url.Parse(serverUrl)
-	if err != nil {
-		return err
+// SetMaxMessageSize sets the maximum size of a message read from the peer
+func SetMaxMessageSize(size int64) {
+	maxMessageSize = size
+}
+
+func SetPingInterval(interval time.Duration) {
+	pingInterval = interval
+}
+
+func SetPongTimeout(timeout time.Duration) {
+	pongWait = timeout
+}
+
+// SetFailoverServers sets the servers the connections fail over between,
+// in order of preference, overriding the server given to Connect and
+// Reconnect. A failed dial moves on to the next server; with sticky the
+// reconnects start from the server connected to last, otherwise from the
+// first one, so that the connections go back to it once it is healthy.
+func SetFailoverServers(serverUrls []string, sticky bool) {
+	handlersByTypeMutex.Lock()
+	defer handlersByTypeMutex.Unlock()
+	failoverServers = serverUrls
+	failoverSticky = sticky
+	failoverServerIndex = 0
+}
+
+// SetCircuitBreaker sets the number of consecutive failed rounds of dials
+// after which the next rounds are quietPeriod apart, sparing the logs and
+// the radio during long outages; 0 failures disables the breaker
+func SetCircuitBreaker(failures int, quietPeriod time.Duration) {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+	breakerFailures = failures
+	breakerQuietPeriod = quietPeriod
+	consecutiveFailures = 0
+	quietUntil = time.Time{}
+}
+
+// breakerOpen tells if the failures opened the circuit breaker
+func breakerOpen() bool {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+	return breakerFailures > 0 && consecutiveFailures >= breakerFailures
+}
+
+// roundFailed records a failed round of dials and returns the time to wait
+// before the next one, and if the circuit breaker just opened
+func roundFailed() (time.Duration, bool) {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+	consecutiveFailures++
+	if breakerFailures == 0 || consecutiveFailures < breakerFailures {
+		return time.Second * time.Duration(reconnectIntervalSeconds), false
 	}
+	quietUntil = time.Now().Add(breakerQuietPeriod)
+	return breakerQuietPeriod, consecutiveFailures == breakerFailures
+}
 
-	scheme := getWebSocketScheme(parsedUrl.Scheme)
-	u := url.URL{Scheme: scheme, Host: parsedUrl.Host, Path: connectUrl}
+// dialSucceeded closes the circuit breaker
+func dialSucceeded() {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+	if breakerFailures > 0 && consecutiveFailures >= breakerFailures {
+		log.Infof("connection manager: connected after %d failed rounds, "+
+			"leaving the quiet period", consecutiveFailures)
+	}
+	consecutiveFailures = 0
+	quietUntil = time.Time{}
+}
+
+// serversToDial returns the servers to dial in turn
+func serversToDial(serverUrl string) []string {
+	if len(failoverServers) == 0 {
+		return []string{serverUrl}
+	}
+	start := 0
+	if failoverSticky {
+		start = failoverServerIndex
+	}
+	servers := make([]string, 0, len(failoverServers))
+	servers = append(servers, failoverServers[start:]...)
+	return append(servers, failoverServers[:start]...)
+}
+
+// dial connects to the first of the servers which accepts the
+// connection, retrying until the retries are exhausted; failed, if given,
+// gets the error of every failed dial
+func dial(servers []string, connectUrl, token string, skipVerify bool, serverCertificate string, retries uint, stop <-chan bool, failed func(error)) (*connection.Connection, string, error) {
+	urls := make([]url.URL, len(servers))
+	for j, server := range servers {
+		parsedUrl, err := url.Parse(server)
+		if err != nil {
+			return nil, "", err
+		}
+		scheme := getWebSocketScheme(parsedUrl.Scheme)
+		urls[j] = url.URL{Scheme: scheme, Host: parsedUrl.Host, Path: connectUrl}
+	}
 
 	var c *connection.Connection
+	var err error
 	var i uint = 0
 	for {
+		// every server is tried in turn before waiting to retry
+		j := int(i) % len(servers)
 		i++
-		c, err = connection.NewConnection(u, token, writeWait, maxMessageSize, defaultPingWait, skipVerify, serverCertificate)
+		c, err = connection.NewConnection(urls[j], token, writeWait, maxMessageSize, pingInterval, pongWait, skipVerify, serverCertificate)
 		if err != nil || c == nil {
+			if err == nil {
+				err = errors.New("unknown error: connection was nil but no error provided by connection.NewConnection")
+			}
+			if failed != nil {
+				failed(err)
+			}
 			if retries == 0 || i < retries {
-				if err == nil {
-					err = errors.New("unknown error: connection was nil but no error provided by connection.NewConnection")
+				// quiet once the circuit breaker opened
+				logf := log.Errorf
+				if breakerOpen() {
+					logf = log.Debugf
+				}
+				reason := connection.FailureReason(err)
+				if j+1 < len(servers) {
+					logf("connection manager failed to connect to %s%s (%s): %s; "+
+						"failing over to %s (try %d/%d)", servers[j], connectUrl,
+						reason, err.Error(), servers[j+1], i, retries)
+					continue
+				}
+				wait, opened := roundFailed()
+				if opened {
+					log.Warnf("connection manager failed to connect to %s%s (%s): %s; "+
+						"%d consecutive failures, going quiet for %s", servers[j], connectUrl,
+						reason, err.Error(), breakerFailures, wait)
+				} else {
+					logf("connection manager failed to connect to %s%s (%s): %s; "+
+						"reconnecting in %s (try %d/%d); len(token)=%d", servers[j], connectUrl,
+						reason, err.Error(), wait, i, retries, len(token))
 				}
-				log.Errorf("connection manager failed to connect to %s%s: %s; "+
-					"reconnecting in %ds (try %d/%d); len(token)=%d", serverUrl, connectUrl,
-					err.Error(), reconnectIntervalSeconds, i, retries, len(token))
 				select {
 				case <-stop:
-					return nil
-				case <-time.After(time.Second * time.Duration(reconnectIntervalSeconds)):
+					return nil, "", nil
+				case <-time.After(wait):
 					break
 				}
 				continue
 			} else if i >= retries {
-				return ErrConnectionRetriesExhausted
+				return nil, "", ErrConnectionRetriesExhausted
 			}
-			return err
+			return nil, "", err
 		} else {
 			break
 		}
 	}
+	dialSucceeded()
+	return c, servers[int(i-1)%len(servers)], nil
+}
+
+// connected records the server connected to, for the sticky failover
+func connected(server string) {
+	for k, failoverServer := range failoverServers {
+		if failoverServer == server {
+			failoverServerIndex = k
+		}
+	}
+}
 
+// setStatus records the state of the connection of proto; the error, if
+// any, is kept until the next one
+func setStatus(proto ws.ProtoType, connected bool, server string, err error) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	status := statusByType[proto]
+	if status == nil {
+		status = &Status{}
+		statusByType[proto] = status
+	}
+	now := time.Now()
+	if connected != status.Connected || server != status.ServerURL {
+		status.Since = now
+	}
+	if connected && !status.Connected {
+		status.Connects++
+	} else if !connected && status.Connected {
+		status.Disconnects++
+		status.LastDisconnectAt = now
+		status.LastDisconnectReason = connection.DisconnectReason(err)
+	}
+	status.Connected = connected
+	status.ServerURL = server
+	if err != nil {
+		status.LastError = err.Error()
+		status.LastErrorAt = now
+		status.LastErrorReason = connection.FailureReason(err)
+	}
+}
+
+// setHandshakeLatency records the time the dial of the connection of
+// proto took
+func setHandshakeLatency(proto ws.ProtoType, c *connection.Connection) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	if status := statusByType[proto]; status != nil {
+		status.HandshakeLatency = c.HandshakeLatency()
+	}
+}
+
+func connect(proto ws.ProtoType, serverUrl, connectUrl, token string, skipVerify bool, serverCertificate string, retries uint, stop <-chan bool) error {
+	c, server, err := dial(serversToDial(serverUrl), connectUrl, token, skipVerify, serverCertificate, retries, stop,
+		func(err error) {
+			setStatus(proto, false, "", err)
+		})
+	if err != nil || c == nil {
+		if err != ErrConnectionRetriesExhausted {
+			// otherwise the error of the last dial is kept
+			setStatus(proto, false, "", err)
+		}
+		return err
+	}
+
+	connected(server)
+	setStatus(proto, true, server, nil)
+	setHandshakeLatency(proto, c)
 	handlersByType[proto] = &ProtocolHandler{
 		proto:      proto,
 		connection: c,
 		mutex:      &sync.Mutex{},
+		serverUrl:  server,
 	}
 	return nil
 }
@@ -138,16 +371,81 @@ func Reconnect(proto ws.ProtoType, serverUrl, connectUrl, token string, skipVeri
 	return connect(proto, serverUrl, connectUrl, token, skipVerify, serverCertificate, retries, stop)
 }
 
-func Read(proto ws.ProtoType) (*ws.ProtoMsg, error) {
+// Refresh dials a new connection for proto with the token, e.g. a
+// rotated JWT, and swaps it in place of the registered one, which is
+// closed only then: the readers and writers carry on with the new
+// connection without seeing an error. On failure the registered
+// connection is kept.
+func Refresh(proto ws.ProtoType, serverUrl, connectUrl, token string, skipVerify bool, serverCertificate string, retries uint, stop <-chan bool) error {
 	handlersByTypeMutex.Lock()
 	h := handlersByType[proto]
+	servers := serversToDial(serverUrl)
+	handlersByTypeMutex.Unlock()
 	if h == nil {
+		return ErrHandlerNotRegistered
+	}
+
+	c, server, err := dial(servers, connectUrl, token, skipVerify, serverCertificate, retries, stop, nil)
+	if err != nil || c == nil {
+		return err
+	}
+
+	handlersByTypeMutex.Lock()
+	defer handlersByTypeMutex.Unlock()
+	if handlersByType[proto] != h {
+		// closed or reconnected meanwhile
+		c.Close()
+		return ErrHandlerNotRegistered
+	}
+	connected(server)
+	setStatus(proto, true, server, nil)
+	setHandshakeLatency(proto, c)
+	h.mutex.Lock()
+	previous := h.connection
+	h.connection = c
+	h.serverUrl = server
+	h.mutex.Unlock()
+	previous.Close()
+	return nil
+}
+
+func Read(proto ws.ProtoType) (*ws.ProtoMsg, error) {
+	for {
+		handlersByTypeMutex.Lock()
+		h := handlersByType[proto]
+		if h == nil {
+			handlersByTypeMutex.Unlock()
+			return nil, ErrHandlerNotRegistered
+		}
+		c := h.connection
 		handlersByTypeMutex.Unlock()
-		return nil, ErrHandlerNotRegistered
+
+		m, err := c.ReadMessage()
+		if err != nil && replaced(proto, h, c) {
+			// refreshed, carry on with the new connection
+			continue
+		} else if err != nil && err != connection.ErrMessageTooLarge {
+			lost(proto, h, err)
+		}
+		return m, err
 	}
+}
 
-	handlersByTypeMutex.Unlock()
-	return h.connection.ReadMessage()
+// lost records the connection of the handler was lost, unless it was
+// reconnected meanwhile
+func lost(proto ws.ProtoType, h *ProtocolHandler, err error) {
+	handlersByTypeMutex.Lock()
+	defer handlersByTypeMutex.Unlock()
+	if handlersByType[proto] == h {
+		setStatus(proto, false, "", err)
+	}
+}
+
+// replaced tells if the connection of the handler was refreshed
+func replaced(proto ws.ProtoType, h *ProtocolHandler, c *connection.Connection) bool {
+	handlersByTypeMutex.Lock()
+	defer handlersByTypeMutex.Unlock()
+	return handlersByType[proto] == h && h.connection != c
 }
 
 func Write(proto ws.ProtoType, m *ws.ProtoMsg) error {
@@ -165,6 +463,79 @@ func Write(proto ws.ProtoType, m *ws.ProtoMsg) error {
 	return h.connection.WriteMessage(m)
 }
 
+// GetConnectionID returns the id of the connection registered for proto,
+// or an empty string if there is none
+func GetConnectionID(proto ws.ProtoType) string {
+	handlersByTypeMutex.Lock()
+	defer handlersByTypeMutex.Unlock()
+
+	h := handlersByType[proto]
+	if h == nil || h.connection == nil {
+		return ""
+	}
+
+	return h.connection.GetID()
+}
+
+// GetServerURL returns the server the connection registered for proto
+// was established to, or an empty string if there is none
+func GetServerURL(proto ws.ProtoType) string {
+	handlersByTypeMutex.Lock()
+	defer handlersByTypeMutex.Unlock()
+
+	h := handlersByType[proto]
+	if h == nil {
+		return ""
+	}
+
+	return h.serverUrl
+}
+
+// GetRTTStats returns the ping round-trip time statistics of the
+// connection registered for proto
+func GetRTTStats(proto ws.ProtoType) (connection.RTTStats, error) {
+	handlersByTypeMutex.Lock()
+	defer handlersByTypeMutex.Unlock()
+
+	h := handlersByType[proto]
+	if h == nil || h.connection == nil {
+		return connection.RTTStats{}, ErrHandlerNotRegistered
+	}
+
+	return h.connection.RTTStats(), nil
+}
+
+// GetTrafficStats returns the messages and bytes exchanged on the
+// connection registered for proto
+func GetTrafficStats(proto ws.ProtoType) (connection.TrafficStats, error) {
+	handlersByTypeMutex.Lock()
+	defer handlersByTypeMutex.Unlock()
+
+	h := handlersByType[proto]
+	if h == nil || h.connection == nil {
+		return connection.TrafficStats{}, ErrHandlerNotRegistered
+	}
+
+	return h.connection.TrafficStats(), nil
+}
+
+// GetStatus returns the state of the connection of proto
+func GetStatus(proto ws.ProtoType) Status {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+
+	status := Status{}
+	if s := statusByType[proto]; s != nil {
+		status = *s
+	}
+	if !status.Connected {
+		breakerMutex.Lock()
+		status.QuietUntil = quietUntil
+		breakerMutex.Unlock()
+	}
+	return status
+}
+
 func Close(proto ws.ProtoType) error {
 	handlersByTypeMutex.Lock()
 	defer handlersByTypeMutex.Unlock()
@@ -174,6 +545,7 @@ func Close(proto ws.ProtoType) error {
 		return ErrHandlerNotRegistered
 	}
 
+	setStatus(proto, false, "", nil)
 	return h.connection.Close()
 }
 
@@ -15,10 +15,17 @@
 package connectionmanager
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/mendersoftware/go-lib-micro/ws"
 	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack"
+
+	"github.com/mendersoftware/mender-connect/connection"
 )
 
 func init() {
@@ -30,6 +37,19 @@ func TestSetReconnectIntervalSeconds(t *testing.T) {
 	assert.Equal(t, 15, reconnectIntervalSeconds)
 }
 
+func TestSetPingPong(t *testing.T) {
+	defer SetDefaultPingWait(10 * time.Second)
+
+	SetDefaultPingWait(time.Minute)
+	assert.Equal(t, 54*time.Second, pingInterval)
+	assert.Equal(t, 6*time.Second, pongWait)
+
+	SetPingInterval(30 * time.Second)
+	SetPongTimeout(15 * time.Second)
+	assert.Equal(t, 30*time.Second, pingInterval)
+	assert.Equal(t, 15*time.Second, pongWait)
+}
+
 func TestGetWriteTimeout(t *testing.T) {
 	timeOut := GetWriteTimeout()
 	assert.Equal(t, writeWait, timeOut)
@@ -41,3 +61,191 @@ func TestGetWsScheme(t *testing.T) {
 	assert.Equal(t, "wss", getWebSocketScheme("wss"))
 	assert.Equal(t, "ws", getWebSocketScheme("ws"))
 }
+
+func TestServersToDial(t *testing.T) {
+	defer SetFailoverServers(nil, false)
+
+	SetFailoverServers(nil, false)
+	assert.Equal(t, []string{"https://one"}, serversToDial("https://one"))
+
+	servers := []string{"https://one", "https://two", "https://three"}
+	SetFailoverServers(servers, false)
+	failoverServerIndex = 1
+	assert.Equal(t, servers, serversToDial("https://one"))
+
+	SetFailoverServers(servers, true)
+	failoverServerIndex = 1
+	assert.Equal(t, []string{"https://two", "https://three", "https://one"},
+		serversToDial("https://one"))
+}
+
+func TestConnectFailover(t *testing.T) {
+	defer SetFailoverServers(nil, false)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrade = websocket.Upgrader{}
+		c, err := upgrade.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _, _ = c.ReadMessage()
+	}))
+	defer server.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	SetReconnectIntervalSeconds(1)
+	SetFailoverServers([]string{down.URL, server.URL}, true)
+	const proto ws.ProtoType = 0x7fff
+	defer Close(proto)
+	err := Connect(proto, down.URL, "/connect", "token", false, "", 2, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, server.URL, GetServerURL(proto))
+	assert.Equal(t, 1, failoverServerIndex)
+
+	// sticky, the reconnects start from the server connected to last
+	assert.Equal(t, []string{server.URL, down.URL}, serversToDial(down.URL))
+	err = Reconnect(proto, down.URL, "/connect", "token", false, "", 1, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, server.URL, GetServerURL(proto))
+	assert.Equal(t, "", GetServerURL(proto+1))
+
+	_, err = GetTrafficStats(proto)
+	assert.NoError(t, err)
+	_, err = GetTrafficStats(proto + 1)
+	assert.Equal(t, ErrHandlerNotRegistered, err)
+}
+
+func TestRefresh(t *testing.T) {
+	tokens := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrade = websocket.Upgrader{}
+		c, err := upgrade.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		token := r.Header.Get("Authorization")
+		tokens <- token
+		if token == "Bearer rotated" {
+			data, _ := msgpack.Marshal(&ws.ProtoMsg{Body: []byte(token)})
+			_ = c.WriteMessage(websocket.BinaryMessage, data)
+		}
+		_, _, _ = c.ReadMessage()
+	}))
+	defer server.Close()
+
+	const proto ws.ProtoType = 0x7ffe
+	assert.Equal(t, ErrHandlerNotRegistered,
+		Refresh(proto, server.URL, "/connect", "rotated", false, "", 1, nil))
+
+	err := Connect(proto, server.URL, "/connect", "initial", false, "", 1, nil)
+	assert.NoError(t, err)
+	defer Close(proto)
+	assert.Equal(t, "Bearer initial", <-tokens)
+	id := GetConnectionID(proto)
+
+	// the reader blocked on the initial connection carries on with the new one
+	messages := make(chan *ws.ProtoMsg)
+	go func() {
+		m, err := Read(proto)
+		assert.NoError(t, err)
+		messages <- m
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	err = Refresh(proto, server.URL, "/connect", "rotated", false, "", 1, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer rotated", <-tokens)
+	assert.NotEqual(t, id, GetConnectionID(proto))
+	select {
+	case m := <-messages:
+		assert.Equal(t, []byte("Bearer rotated"), m.Body)
+	case <-time.After(5 * time.Second):
+		t.Error("no message read from the refreshed connection")
+	}
+}
+
+func TestGetStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrade = websocket.Upgrader{}
+		c, err := upgrade.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		// the connection is lost right away
+		c.Close()
+	}))
+	defer server.Close()
+
+	const proto ws.ProtoType = 0x7ffd
+	assert.Equal(t, Status{}, GetStatus(proto))
+
+	err := Connect(proto, "http://127.0.0.1:1", "/connect", "token", false, "", 1, nil)
+	assert.Error(t, err)
+	status := GetStatus(proto)
+	assert.False(t, status.Connected)
+	assert.NotEmpty(t, status.LastError)
+	assert.Equal(t, connection.FailureTCP, status.LastErrorReason)
+	assert.False(t, status.LastErrorAt.IsZero())
+
+	err = Connect(proto, server.URL, "/connect", "token", false, "", 1, nil)
+	assert.NoError(t, err)
+	defer Close(proto)
+	status = GetStatus(proto)
+	assert.True(t, status.Connected)
+	assert.Equal(t, server.URL, status.ServerURL)
+	assert.False(t, status.Since.IsZero())
+	assert.Equal(t, uint64(1), status.Connects)
+	assert.Equal(t, uint64(0), status.Disconnects)
+	assert.True(t, status.HandshakeLatency > 0)
+
+	_, err = Read(proto)
+	assert.Error(t, err)
+	status = GetStatus(proto)
+	assert.False(t, status.Connected)
+	assert.Equal(t, err.Error(), status.LastError)
+	assert.Equal(t, uint64(1), status.Disconnects)
+	assert.Equal(t, connection.DisconnectServerClosed, status.LastDisconnectReason)
+	assert.False(t, status.LastDisconnectAt.IsZero())
+
+	err = Reconnect(proto, server.URL, "/connect", "token", false, "", 1, nil)
+	assert.NoError(t, err)
+	status = GetStatus(proto)
+	assert.True(t, status.Connected)
+	assert.Equal(t, uint64(2), status.Connects)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	defer SetCircuitBreaker(0, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrade = websocket.Upgrader{}
+		c, err := upgrade.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _, _ = c.ReadMessage()
+	}))
+	defer server.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	SetReconnectIntervalSeconds(0)
+	SetCircuitBreaker(2, 200*time.Millisecond)
+	const proto ws.ProtoType = 0x7ffc
+	start := time.Now()
+	err := Connect(proto, down.URL, "/connect", "token", false, "", 4, nil)
+	assert.Equal(t, ErrConnectionRetriesExhausted, err)
+	// the third round waited for the quiet period
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+	assert.True(t, breakerOpen())
+	assert.False(t, GetStatus(proto).QuietUntil.IsZero())
+
+	err = Connect(proto, server.URL, "/connect", "token", false, "", 1, nil)
+	assert.NoError(t, err)
+	defer Close(proto)
+	assert.False(t, breakerOpen())
+	assert.True(t, GetStatus(proto).QuietUntil.IsZero())
+}
@@ -16,5 +16,6 @@ require (
 	github.com/stretchr/testify v1.6.1
 	github.com/urfave/cli/v2 v2.2.0
 	github.com/vmihailenco/msgpack v4.0.4+incompatible
+	golang.org/x/sys v0.0.0-20200116001909-b77594299b42
 	google.golang.org/appengine v1.6.7 // indirect
 )
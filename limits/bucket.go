@@ -0,0 +1,65 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package limits
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket lets through up to rate units, e.g. bytes, per second, in
+// bursts of at most burst units
+type TokenBucket struct {
+	mutex     sync.Mutex
+	rate      float64
+	burst     float64
+	tokens    float64
+	updatedAt time.Time
+	now       func() time.Time
+}
+
+// NewTokenBucket creates a full bucket letting through rate units per
+// second, in bursts of at most burst units
+func NewTokenBucket(rate uint64, burst uint64) *TokenBucket {
+	b := &TokenBucket{
+		rate:  float64(rate),
+		burst: float64(burst),
+		now:   time.Now,
+	}
+	b.tokens = b.burst
+	b.updatedAt = b.now()
+	return b
+}
+
+func (b *TokenBucket) refill() {
+	now := b.now()
+	b.tokens += now.Sub(b.updatedAt).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.updatedAt = now
+}
+
+// Take takes up to n units out of the bucket, returning how many it took
+func (b *TokenBucket) Take(n int) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill()
+	taken := n
+	if float64(taken) > b.tokens {
+		taken = int(b.tokens)
+	}
+	b.tokens -= float64(taken)
+	return taken
+}
@@ -0,0 +1,42 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package limits
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(100, 200)
+	now := b.updatedAt
+	b.now = func() time.Time {
+		return now
+	}
+
+	// full at first
+	assert.Equal(t, 150, b.Take(150))
+	assert.Equal(t, 50, b.Take(150))
+	assert.Equal(t, 0, b.Take(1))
+
+	// refilled at the rate
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, 50, b.Take(150))
+
+	// up to the burst
+	now = now.Add(time.Minute)
+	assert.Equal(t, 200, b.Take(1000))
+}
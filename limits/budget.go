@@ -0,0 +1,100 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package limits
+
+import (
+	"sync"
+	"time"
+)
+
+// Budget caps the units, e.g. bytes, used within each hour and within
+// each day of the local calendar; a zero cap is unlimited
+type Budget struct {
+	mutex    sync.Mutex
+	hourly   uint64
+	daily    uint64
+	hourUsed uint64
+	dayUsed  uint64
+	hour     time.Time
+	day      time.Time
+	now      func() time.Time
+}
+
+// BudgetUsage holds the units used within the current hour and day, and
+// the caps
+type BudgetUsage struct {
+	Hour   uint64
+	Day    uint64
+	Hourly uint64
+	Daily  uint64
+}
+
+// NewBudget creates a budget of hourly units per hour and daily units
+// per day
+func NewBudget(hourly uint64, daily uint64) *Budget {
+	return &Budget{
+		hourly: hourly,
+		daily:  daily,
+		now:    time.Now,
+	}
+}
+
+// roll starts the new hour and day windows once reached
+func (b *Budget) roll() {
+	now := b.now()
+	if hour := now.Truncate(time.Hour); !hour.Equal(b.hour) {
+		b.hour = hour
+		b.hourUsed = 0
+	}
+	y, m, d := now.Date()
+	if day := time.Date(y, m, d, 0, 0, 0, 0, now.Location()); !day.Equal(b.day) {
+		b.day = day
+		b.dayUsed = 0
+	}
+}
+
+// Use accounts n units
+func (b *Budget) Use(n int) {
+	if n <= 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.roll()
+	b.hourUsed += uint64(n)
+	b.dayUsed += uint64(n)
+}
+
+// Exceeded tells if the units used reached the cap of the hour or of the
+// day
+func (b *Budget) Exceeded() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.roll()
+	return (b.hourly > 0 && b.hourUsed >= b.hourly) ||
+		(b.daily > 0 && b.dayUsed >= b.daily)
+}
+
+// Usage returns the units used within the current hour and day
+func (b *Budget) Usage() BudgetUsage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.roll()
+	return BudgetUsage{
+		Hour:   b.hourUsed,
+		Day:    b.dayUsed,
+		Hourly: b.hourly,
+		Daily:  b.daily,
+	}
+}
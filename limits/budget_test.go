@@ -0,0 +1,54 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package limits
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBudget(t *testing.T) {
+	b := NewBudget(100, 250)
+	now := time.Date(2021, 3, 1, 22, 30, 0, 0, time.UTC)
+	b.now = func() time.Time {
+		return now
+	}
+
+	b.Use(60)
+	assert.False(t, b.Exceeded())
+	b.Use(40)
+	assert.True(t, b.Exceeded())
+	assert.Equal(t, BudgetUsage{Hour: 100, Day: 100, Hourly: 100, Daily: 250}, b.Usage())
+
+	// the hour is over, not the day
+	now = now.Add(time.Hour)
+	assert.False(t, b.Exceeded())
+	b.Use(100)
+	now = now.Add(10 * time.Minute)
+	b.Use(50)
+	assert.True(t, b.Exceeded())
+	assert.Equal(t, uint64(250), b.Usage().Day)
+
+	// a new day
+	now = now.Add(time.Hour)
+	assert.False(t, b.Exceeded())
+	assert.Equal(t, BudgetUsage{Hourly: 100, Daily: 250}, b.Usage())
+
+	// unlimited
+	b = NewBudget(0, 0)
+	b.Use(1 << 30)
+	assert.False(t, b.Exceeded())
+}
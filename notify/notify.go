@@ -0,0 +1,71 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package notify lets the protocol handlers and the other subsystems push
+// unsolicited messages to the server, outside of any request/response
+// exchange. The daemon installs the Notifier writing the notifications on
+// the connection; until then, Notify returns ErrNoNotifier.
+package notify
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrNoNotifier = errors.New("no notifier available")
+
+// Kinds of the notifications sent by the daemon itself
+const (
+	KindSessionsRate = "sessions-rate"
+)
+
+// Notification is an unsolicited message from the device to the server
+type Notification struct {
+	// Kind of the notification, e.g. KindSessionsRate
+	Kind string `msgpack:"kind" json:"kind"`
+	// Human readable description of the notification
+	Message string `msgpack:"message" json:"message"`
+	// Optional machine readable details
+	Details map[string]interface{} `msgpack:"details,omitempty" json:"details,omitempty"`
+}
+
+// Notifier sends the notifications to the server
+type Notifier interface {
+	// Notify sends the notification in the context of the session, or of
+	// the device if sessionID is empty
+	Notify(sessionID string, n *Notification) error
+}
+
+var (
+	notifierMutex sync.Mutex
+	notifier      Notifier
+)
+
+// SetNotifier installs the Notifier used by Notify, nil removes it
+func SetNotifier(n Notifier) {
+	notifierMutex.Lock()
+	defer notifierMutex.Unlock()
+	notifier = n
+}
+
+// Notify sends the notification with the installed Notifier
+func Notify(sessionID string, n *Notification) error {
+	notifierMutex.Lock()
+	current := notifier
+	notifierMutex.Unlock()
+	if current == nil {
+		return ErrNoNotifier
+	}
+	return current.Notify(sessionID, n)
+}
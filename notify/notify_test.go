@@ -0,0 +1,47 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package notify
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingNotifier struct {
+	sessionIDs    []string
+	notifications []*Notification
+}
+
+func (r *recordingNotifier) Notify(sessionID string, n *Notification) error {
+	r.sessionIDs = append(r.sessionIDs, sessionID)
+	r.notifications = append(r.notifications, n)
+	return nil
+}
+
+func TestNotify(t *testing.T) {
+	n := &Notification{
+		Kind:    "tx-budget",
+		Message: "90% of the transmit budget consumed",
+	}
+	assert.Equal(t, ErrNoNotifier, Notify("session-id", n))
+
+	recorder := &recordingNotifier{}
+	SetNotifier(recorder)
+	defer SetNotifier(nil)
+	assert.NoError(t, Notify("session-id", n))
+	assert.NoError(t, Notify("", n))
+	assert.Equal(t, []string{"session-id", ""}, recorder.sessionIDs)
+	assert.Equal(t, []*Notification{n, n}, recorder.notifications)
+}
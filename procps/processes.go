@@ -0,0 +1,174 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package procps
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// clock ticks per second of the times in /proc/<pid>/stat, USER_HZ is
+// 100 on all the architectures
+const clockTicks = 100
+
+// Process describes a process running on the device
+type Process struct {
+	Pid int `json:"pid" msgpack:"pid"`
+	// Name of the user the process runs as, its uid if it has no name
+	User string `json:"user" msgpack:"user"`
+	// Percentage of a CPU used since the process started, as ps shows it
+	CPU float64 `json:"cpu" msgpack:"cpu"`
+	// Percentage of the memory of the device resident
+	Memory float64 `json:"mem" msgpack:"mem"`
+	// Resident memory in bytes
+	RSS uint64 `json:"rss" msgpack:"rss"`
+	// Command line, or the command name in brackets for the kernel
+	// threads
+	Cmdline string `json:"cmdline" msgpack:"cmdline"`
+}
+
+var errMalformedStat = errors.New("malformed process stat")
+
+// ProcessUid returns the id of the user the process runs as
+func ProcessUid(pid int) (uint32, error) {
+	info, err := os.Stat("/proc/" + strconv.Itoa(pid))
+	if err != nil {
+		return 0, err
+	}
+	return info.Sys().(*syscall.Stat_t).Uid, nil
+}
+
+// ListProcesses returns the processes running on the device; the ones
+// exiting while they are listed are left out
+func ListProcesses() ([]Process, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	uptime, err := readUptime()
+	if err != nil {
+		return nil, err
+	}
+	memTotal, err := readMemTotal()
+	if err != nil {
+		return nil, err
+	}
+
+	userNames := map[uint32]string{}
+	processes := []Process{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		p, err := readProcess(pid, uptime, memTotal)
+		if err != nil {
+			continue
+		}
+		uid := entry.Sys().(*syscall.Stat_t).Uid
+		name, ok := userNames[uid]
+		if !ok {
+			name = strconv.FormatUint(uint64(uid), 10)
+			if u, err := user.LookupId(name); err == nil {
+				name = u.Username
+			}
+			userNames[uid] = name
+		}
+		p.User = name
+		processes = append(processes, *p)
+	}
+	return processes, nil
+}
+
+func readProcess(pid int, uptime float64, memTotal uint64) (*Process, error) {
+	dir := "/proc/" + strconv.Itoa(pid)
+	data, err := ioutil.ReadFile(dir + "/stat")
+	if err != nil {
+		return nil, err
+	}
+	// the fields follow the command name, which is in parentheses
+	start := bytes.IndexByte(data, '(')
+	end := bytes.LastIndexByte(data, ')')
+	if start < 0 || end < start {
+		return nil, errMalformedStat
+	}
+	comm := string(data[start+1 : end])
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 22 {
+		return nil, errMalformedStat
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	startTime, _ := strconv.ParseUint(fields[19], 10, 64)
+	rssPages, _ := strconv.ParseUint(fields[21], 10, 64)
+
+	p := &Process{
+		Pid: pid,
+		RSS: rssPages * uint64(os.Getpagesize()),
+	}
+	if elapsed := uptime - float64(startTime)/clockTicks; elapsed > 0 {
+		p.CPU = float64(utime+stime) / clockTicks / elapsed * 100
+	}
+	if memTotal > 0 {
+		p.Memory = float64(p.RSS) / float64(memTotal) * 100
+	}
+
+	cmdline, err := ioutil.ReadFile(dir + "/cmdline")
+	if err != nil {
+		return nil, err
+	}
+	p.Cmdline = strings.TrimSpace(string(bytes.Replace(cmdline, []byte{0}, []byte{' '}, -1)))
+	if p.Cmdline == "" {
+		p.Cmdline = "[" + comm + "]"
+	}
+	return p, nil
+}
+
+// readUptime returns the seconds elapsed since the boot
+func readUptime() (float64, error) {
+	data, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, errors.New("malformed /proc/uptime")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// readMemTotal returns the bytes of memory of the device
+func readMemTotal() (uint64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			return kb * 1024, err
+		}
+	}
+	return 0, errors.New("MemTotal not found in /proc/meminfo")
+}
@@ -0,0 +1,60 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package procps
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListProcesses(t *testing.T) {
+	cmd := exec.Command("sleep", "16")
+	assert.NoError(t, cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+
+	processes, err := ListProcesses()
+	assert.NoError(t, err)
+	var sleep, self *Process
+	for i := range processes {
+		switch processes[i].Pid {
+		case cmd.Process.Pid:
+			sleep = &processes[i]
+		case os.Getpid():
+			self = &processes[i]
+		}
+	}
+	if assert.NotNil(t, sleep) {
+		assert.Equal(t, "sleep 16", sleep.Cmdline)
+		assert.Equal(t, currentUser.Username, sleep.User)
+	}
+	if assert.NotNil(t, self) {
+		assert.True(t, self.RSS > 0)
+		assert.True(t, self.Memory > 0 && self.Memory < 100)
+	}
+
+	uid, err := ProcessUid(cmd.Process.Pid)
+	assert.NoError(t, err)
+	assert.Equal(t, currentUser.Uid, strconv.FormatUint(uint64(uid), 10))
+}
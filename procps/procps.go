@@ -14,7 +14,9 @@
 package procps
 
 import (
+	"bytes"
 	"errors"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"strconv"
@@ -28,6 +30,22 @@ func ProcessExists(pid int) bool {
 	return err == nil
 }
 
+// ProcessRunning tells if the process exists and did not exit, i.e.: it
+// is not a zombie waiting to be reaped
+func ProcessRunning(pid int) bool {
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	// the state follows the command name, which is in parentheses
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 || i+2 >= len(data) {
+		return false
+	}
+	state := data[i+2]
+	return state != 'Z' && state != 'X'
+}
+
 func TerminateAndWait(pid int, command *exec.Cmd, waitTimeout time.Duration) (err error) {
 	p, _ := os.FindProcess(pid)
 	p.Signal(syscall.SIGTERM)
@@ -49,3 +67,28 @@ func TerminateAndWait(pid int, command *exec.Cmd, waitTimeout time.Duration) (er
 
 	return nil
 }
+
+// HangUpAndWait sends SIGHUP to the process, as if its terminal went away,
+// and SIGKILL if it is still running after gracePeriod
+func HangUpAndWait(pid int, command *exec.Cmd, gracePeriod time.Duration, waitTimeout time.Duration) (err error) {
+	p, _ := os.FindProcess(pid)
+	p.Signal(syscall.SIGHUP)
+	done := make(chan error, 1)
+	go func() {
+		done <- command.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(gracePeriod):
+		p.Signal(syscall.SIGKILL)
+		select {
+		case err = <-done:
+		case <-time.After(waitTimeout):
+			return errors.New("waiting for pid " + strconv.Itoa(pid) + " timeout. the process will remain as zombie.")
+		}
+	}
+	if err != nil && err.Error() != "signal: killed" && err.Error() != "signal: hangup" {
+		return errors.New("error waiting for the process: " + err.Error())
+	}
+	return nil
+}
@@ -34,3 +34,41 @@ func TestMenderShellProcPs(t *testing.T) {
 
 	assert.False(t, ProcessExists(cmd.Process.Pid))
 }
+
+func TestProcessRunning(t *testing.T) {
+	cmd := exec.Command("sleep", "16")
+	err := cmd.Start()
+	assert.NoError(t, err)
+	assert.True(t, ProcessRunning(cmd.Process.Pid))
+
+	// exited, but not reaped yet
+	assert.NoError(t, cmd.Process.Kill())
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, ProcessExists(cmd.Process.Pid))
+	assert.False(t, ProcessRunning(cmd.Process.Pid))
+
+	_ = cmd.Wait()
+	assert.False(t, ProcessRunning(cmd.Process.Pid))
+}
+
+func TestMenderShellProcPsHangUp(t *testing.T) {
+	cmd := exec.Command("sleep", "16")
+	err := cmd.Start()
+	assert.NoError(t, err)
+
+	err = HangUpAndWait(cmd.Process.Pid, cmd, time.Second, time.Second)
+	assert.NoError(t, err)
+	assert.False(t, ProcessExists(cmd.Process.Pid))
+
+	// ignores the hang up, killed after the grace period
+	cmd = exec.Command("sh", "-c", "trap '' HUP; sleep 16")
+	err = cmd.Start()
+	assert.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	startedAt := time.Now()
+	err = HangUpAndWait(cmd.Process.Pid, cmd, 500*time.Millisecond, time.Second)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(startedAt) >= 500*time.Millisecond)
+	assert.False(t, ProcessExists(cmd.Process.Pid))
+}
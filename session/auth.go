@@ -0,0 +1,95 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/procps"
+)
+
+var (
+	// time at which the token authorizing the new sessions expires, zero
+	// if it does not
+	authExpiresAt time.Time
+	// guards authExpiresAt and the expiry of the sessions, which are set
+	// from the main loop while the message loop opens the sessions
+	authMutex sync.Mutex
+)
+
+// SetAuthExpiry sets the expiry of the token which authorizes the new
+// sessions, the zero time if the token does not expire
+func SetAuthExpiry(expiresAt time.Time) {
+	authMutex.Lock()
+	defer authMutex.Unlock()
+	authExpiresAt = expiresAt
+}
+
+// MenderSessionReauthorize sets the expiry of the token authorizing all the
+// sessions, open or new, when a refreshed token replaces the expiring one
+func MenderSessionReauthorize(expiresAt time.Time) {
+	authMutex.Lock()
+	defer authMutex.Unlock()
+	authExpiresAt = expiresAt
+	for _, s := range sessionsMap {
+		s.authExpiresAt = expiresAt
+	}
+}
+
+// authorize sets the expiry of the session to the one of the token
+// authorizing the new sessions
+func (s *MenderShellSession) authorize() {
+	authMutex.Lock()
+	defer authMutex.Unlock()
+	s.authExpiresAt = authExpiresAt
+}
+
+// IsAuthExpired tells if the token which authorized the session expired
+// before t
+func (s *MenderShellSession) IsAuthExpired(t time.Time) bool {
+	authMutex.Lock()
+	defer authMutex.Unlock()
+	return !s.authExpiresAt.IsZero() && s.authExpiresAt.Before(t)
+}
+
+// MenderSessionTerminateAuthExpired terminates the sessions authorized by
+// a token which expired before t; shellCount is the number of shells gone,
+// stopped or exited before, whose slots are free
+func MenderSessionTerminateAuthExpired(t time.Time) (shellCount int, sessionCount int, err error) {
+	for id, s := range sessionsMap {
+		if !s.IsAuthExpired(t) {
+			continue
+		}
+		if s.shell != nil {
+			e := s.StopShellWithReason(CloseReasonAuthExpired)
+			if e != nil && procps.ProcessExists(s.shellPid) {
+				log.Debugf("auth expired: failed to stop shell for session: %s: %s", id, e.Error())
+				err = e
+			} else {
+				shellCount++
+			}
+		}
+		e := MenderShellDeleteById(id)
+		if e == nil {
+			sessionCount++
+		} else {
+			log.Debugf("auth expired: failed to remove session: %s: %s", id, e.Error())
+			err = e
+		}
+	}
+	return shellCount, sessionCount, err
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/procps"
+)
+
+func TestMenderSessionTerminateAuthExpired(t *testing.T) {
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+	defer SetAuthExpiry(time.Time{})
+
+	now := time.Now()
+	SetAuthExpiry(time.Time{})
+	noExpiry, err := NewMenderShellSession("auth-no-expiry", "auth-user-1", NoExpirationTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	SetAuthExpiry(now.Add(time.Minute))
+	expiring, err := NewMenderShellSession("auth-expiring", "auth-user-2", NoExpirationTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	err = expiring.StartShell(expiring.GetId(), MenderShellTerminalSettings{
+		Uid:            500,
+		Gid:            501,
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         24,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	SetAuthExpiry(now.Add(2 * time.Minute))
+	later, err := NewMenderShellSession("auth-later", "auth-user-3", NoExpirationTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+
+	assert.False(t, noExpiry.IsAuthExpired(now.Add(time.Hour)))
+	assert.False(t, expiring.IsAuthExpired(now))
+	assert.True(t, expiring.IsAuthExpired(now.Add(90*time.Second)))
+
+	shells, sessions, err := MenderSessionTerminateAuthExpired(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, shells)
+	assert.Equal(t, 0, sessions)
+
+	// stopping the shell fails if it is interrupted before it ignores SIGINT
+	_, sessions, _ = MenderSessionTerminateAuthExpired(now.Add(90 * time.Second))
+	assert.Equal(t, 1, sessions)
+	assert.Equal(t, CloseReasonAuthExpired, expiring.GetCloseReason())
+	assert.False(t, procps.ProcessExists(expiring.shellPid))
+	assert.Nil(t, MenderShellSessionGetById(expiring.GetId()))
+	assert.NotNil(t, MenderShellSessionGetById(later.GetId()))
+
+	// a refreshed token authorizes the open sessions
+	MenderSessionReauthorize(now.Add(time.Hour))
+	shells, sessions, err = MenderSessionTerminateAuthExpired(now.Add(30 * time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, shells)
+	assert.Equal(t, 0, sessions)
+	assert.NotNil(t, MenderShellSessionGetById(later.GetId()))
+	assert.NotNil(t, MenderShellSessionGetById(noExpiry.GetId()))
+
+	shells, sessions, err = MenderSessionTerminateAuthExpired(now.Add(2 * time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, shells)
+	assert.Equal(t, 2, sessions)
+}
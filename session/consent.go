@@ -0,0 +1,60 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+)
+
+// HookEventConsent is the event the consent script is executed on, before
+// a shell spawns
+const HookEventConsent = "consent"
+
+var (
+	ErrConsentRefused = errors.New("the local user refused the remote terminal")
+	ErrConsentTimeout = errors.New("the local user did not approve the remote terminal in time")
+)
+
+// AskConsent runs the consent script, e.g. prompting the local user on an
+// HMI, and waits for it to approve the shell of the session by exiting
+// with 0 within timeout; the script gets the details of the session in the
+// environment, like the hooks do
+func AskConsent(script string, sessionId string, streamId string, userId string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, script, HookEventConsent)
+	cmd.Env = append(os.Environ(),
+		hookEnvEvent+"="+HookEventConsent,
+		hookEnvSessionID+"="+sessionId,
+		hookEnvStreamID+"="+streamId,
+		hookEnvUserID+"="+userId,
+		hookEnvProtocol+"="+strconv.Itoa(int(ws.ProtoTypeShell)),
+	)
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrConsentTimeout
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		return ErrConsentRefused
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAskConsent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestAskConsent")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	testCases := map[string]struct {
+		script string
+		err    error
+	}{
+		"approved": {
+			script: "#!/bin/sh\n" +
+				"test \"$1\" = consent -a \"$MENDER_CONNECT_USER_ID\" = user-id\n",
+		},
+		"refused": {
+			script: "#!/bin/sh\nexit 1\n",
+			err:    ErrConsentRefused,
+		},
+		"timeout": {
+			script: "#!/bin/sh\nexec sleep 10\n",
+			err:    ErrConsentTimeout,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			script := path.Join(dir, name)
+			err := ioutil.WriteFile(script, []byte(tc.script), 0755)
+			assert.NoError(t, err)
+
+			err = AskConsent(script, "session-id", "", "user-id", time.Second)
+			assert.Equal(t, tc.err, err)
+		})
+	}
+
+	err = AskConsent(path.Join(dir, "missing"), "session-id", "", "user-id", time.Second)
+	assert.Error(t, err)
+}
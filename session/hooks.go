@@ -0,0 +1,154 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+)
+
+// Session lifecycle events the hooks are executed on
+const (
+	HookEventSessionOpen  = "session-open"
+	HookEventHandlerStart = "handler-start"
+	HookEventSessionClose = "session-close"
+	// the terminal of a session was taken over by another session, the
+	// session given is the one which took it over
+	HookEventSessionTakeover = "session-takeover"
+)
+
+// Environment variables passed to the hooks
+const (
+	hookEnvEvent     = "MENDER_CONNECT_EVENT"
+	hookEnvSessionID = "MENDER_CONNECT_SESSION_ID"
+	hookEnvStreamID  = "MENDER_CONNECT_STREAM_ID"
+	hookEnvUserID    = "MENDER_CONNECT_USER_ID"
+	hookEnvProtocol  = "MENDER_CONNECT_PROTOCOL"
+)
+
+var (
+	// scripts executed on the lifecycle events, keyed by event; events
+	// without a script are not hooked
+	Hooks = map[string]string{}
+	// time after which a running hook gets killed
+	HookTimeout = 10 * time.Second
+)
+
+// EventListener is notified of the session lifecycle events
+type EventListener func(event string, s *MenderShellSession, proto ws.ProtoType)
+
+type eventListenerEntry struct {
+	id       uint64
+	listener EventListener
+}
+
+var (
+	eventListeners      = []eventListenerEntry{}
+	eventListenersMutex sync.Mutex
+	eventListenersID    uint64
+)
+
+// AddEventListener registers a listener notified of the session lifecycle
+// events, after the hooks were started; calling the function returned
+// unregisters it
+func AddEventListener(listener EventListener) func() {
+	eventListenersMutex.Lock()
+	defer eventListenersMutex.Unlock()
+	eventListenersID++
+	id := eventListenersID
+	eventListeners = append(eventListeners, eventListenerEntry{id: id, listener: listener})
+	return func() {
+		eventListenersMutex.Lock()
+		defer eventListenersMutex.Unlock()
+		for i, entry := range eventListeners {
+			if entry.id == id {
+				listeners := make([]eventListenerEntry, 0, len(eventListeners)-1)
+				listeners = append(listeners, eventListeners[:i]...)
+				eventListeners = append(listeners, eventListeners[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// CommandListener is notified of the command lines entered at the shell
+// prompts; denied tells if the CommandPolicy denied the line
+type CommandListener func(s *MenderShellSession, commandLine string, denied bool)
+
+var commandListeners = []CommandListener{}
+
+// AddCommandListener registers a listener notified of the command lines
+// entered in the shells started afterwards
+func AddCommandListener(listener CommandListener) {
+	commandListeners = append(commandListeners, listener)
+}
+
+// commandEntered notifies the listeners of a command line
+func commandEntered(s *MenderShellSession, commandLine string, denied bool) {
+	for _, listener := range commandListeners {
+		listener(s, commandLine, denied)
+	}
+}
+
+// lifecycleEvent runs the hook of the event and notifies the listeners
+func lifecycleEvent(event string, s *MenderShellSession, proto ws.ProtoType) {
+	runHook(event, s, proto)
+	eventListenersMutex.Lock()
+	listeners := eventListeners
+	eventListenersMutex.Unlock()
+	for _, entry := range listeners {
+		entry.listener(event, s, proto)
+	}
+}
+
+// runHook executes the script hooked to event, if any, without waiting
+// for it to finish; the session details are passed to the script in the
+// environment and the event as the first argument
+func runHook(event string, s *MenderShellSession, proto ws.ProtoType) {
+	script := Hooks[event]
+	if script == "" {
+		return
+	}
+
+	cmd := exec.Command(script, event)
+	cmd.Env = append(os.Environ(),
+		hookEnvEvent+"="+event,
+		hookEnvSessionID+"="+s.sessionId,
+		hookEnvStreamID+"="+s.streamId,
+		hookEnvUserID+"="+s.userId,
+		hookEnvProtocol+"="+strconv.Itoa(int(proto)),
+	)
+	if err := cmd.Start(); err != nil {
+		log.Errorf("session %s: failed to run the %s hook %s: %s", s.id, event, script, err.Error())
+		return
+	}
+
+	go func() {
+		timer := time.AfterFunc(HookTimeout, func() {
+			log.Warnf("session %s: the %s hook %s timed out, killing it", s.id, event, script)
+			cmd.Process.Kill()
+		})
+		defer timer.Stop()
+		if err := cmd.Wait(); err != nil {
+			log.Warnf("session %s: the %s hook %s failed: %s", s.id, event, script, err.Error())
+		}
+	}()
+}
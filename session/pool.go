@@ -0,0 +1,187 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/procps"
+	"github.com/mendersoftware/mender-connect/shell"
+)
+
+// warmShell is an idle shell started ahead of the sessions
+type warmShell struct {
+	pid       int
+	pseudoTTY *os.File
+	command   *exec.Cmd
+}
+
+// ShellPool keeps up to size idle shells started with the same terminal
+// settings; the sessions starting a shell with these settings claim one of
+// them instead of waiting for a new shell to start
+type ShellPool struct {
+	mutex    sync.Mutex
+	terminal MenderShellTerminalSettings
+	size     int
+	shells   []*warmShell
+	filling  bool
+	closed   bool
+	execute  func(terminal MenderShellTerminalSettings) (int, *os.File, *exec.Cmd, error)
+}
+
+// NewShellPool creates a pool of size shells started with the terminal
+// settings, call Fill to start them
+func NewShellPool(terminal MenderShellTerminalSettings, size int) *ShellPool {
+	return &ShellPool{
+		terminal: terminal,
+		size:     size,
+		execute: func(terminal MenderShellTerminalSettings) (int, *os.File, *exec.Cmd, error) {
+			return shell.ExecuteShellWithArgs(
+				terminal.Uid,
+				terminal.Gid,
+				terminal.HomeDir,
+				terminal.Shell,
+				terminal.Args,
+				terminal.TerminalString,
+				terminal.Env,
+				terminal.Height,
+				terminal.Width)
+		},
+	}
+}
+
+// Count returns the number of idle shells in the pool
+func (p *ShellPool) Count() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.shells)
+}
+
+// Fill starts shells until the pool is full, one at a time so that the
+// device is not loaded with all of them at once; it returns when the pool
+// is full or a shell fails to start
+func (p *ShellPool) Fill() {
+	p.mutex.Lock()
+	if p.filling {
+		p.mutex.Unlock()
+		return
+	}
+	p.filling = true
+	p.mutex.Unlock()
+	defer func() {
+		p.mutex.Lock()
+		p.filling = false
+		p.mutex.Unlock()
+	}()
+
+	for {
+		p.mutex.Lock()
+		full := p.closed || len(p.shells) >= p.size
+		p.mutex.Unlock()
+		if full {
+			return
+		}
+		pid, pseudoTTY, cmd, err := p.execute(p.terminal)
+		if err != nil {
+			log.Errorf("failed to start a warm shell: %s", err.Error())
+			return
+		}
+		log.Debugf("started the warm shell pid %d", pid)
+		warm := &warmShell{pid: pid, pseudoTTY: pseudoTTY, command: cmd}
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			warm.kill()
+			return
+		}
+		p.shells = append(p.shells, warm)
+		p.mutex.Unlock()
+	}
+}
+
+// matches tells if the shells of the pool are started with the terminal
+// settings, but the size of the terminal
+func (p *ShellPool) matches(terminal MenderShellTerminalSettings) bool {
+	if terminal.Uid != p.terminal.Uid || terminal.Gid != p.terminal.Gid ||
+		terminal.Shell != p.terminal.Shell || terminal.HomeDir != p.terminal.HomeDir ||
+		terminal.TerminalString != p.terminal.TerminalString {
+		return false
+	}
+	return equalStrings(terminal.Env, p.terminal.Env) &&
+		equalStrings(terminal.Args, p.terminal.Args)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// claim takes an idle shell started with the terminal settings out of the
+// pool, resized to the terminal, and refills the pool in the background;
+// it returns nil if there is none
+func (p *ShellPool) claim(terminal MenderShellTerminalSettings) *warmShell {
+	if p == nil || !p.matches(terminal) {
+		return nil
+	}
+	p.mutex.Lock()
+	defer func() {
+		p.mutex.Unlock()
+		go p.Fill()
+	}()
+	for len(p.shells) > 0 {
+		warm := p.shells[0]
+		p.shells = p.shells[1:]
+		if !procps.ProcessRunning(warm.pid) {
+			log.Debugf("discarding the warm shell pid %d, it exited", warm.pid)
+			warm.kill()
+			continue
+		}
+		if err := shell.ResizeShell(warm.pseudoTTY, terminal.Height, terminal.Width); err != nil {
+			log.Debugf("discarding the warm shell pid %d: %s", warm.pid, err.Error())
+			warm.kill()
+			continue
+		}
+		return warm
+	}
+	return nil
+}
+
+// Close stops the idle shells, the pool is not refilled after
+func (p *ShellPool) Close() {
+	p.mutex.Lock()
+	shells := p.shells
+	p.shells = nil
+	p.closed = true
+	p.mutex.Unlock()
+	for _, warm := range shells {
+		warm.kill()
+	}
+}
+
+func (w *warmShell) kill() {
+	w.pseudoTTY.Close()
+	_ = w.command.Process.Kill()
+	_ = w.command.Wait()
+}
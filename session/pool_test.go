@@ -0,0 +1,104 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"os/user"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/procps"
+)
+
+func TestShellPool(t *testing.T) {
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+	terminal := MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+	}
+
+	pool := NewShellPool(terminal, 2)
+	pool.Fill()
+	assert.Equal(t, 2, pool.Count())
+	pids := map[int]bool{}
+	for _, warm := range pool.shells {
+		pids[warm.pid] = true
+	}
+
+	WarmShells = pool
+	defer func() {
+		WarmShells = nil
+		pool.Close()
+	}()
+
+	// the terminal with the settings of the pool takes a warm shell over
+	s, err := NewMenderShellSession("pool-session-1", "pool-user-1", NoExpirationTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	claimed := terminal
+	claimed.Height = 24
+	err = s.StartShell(s.GetId(), claimed)
+	assert.NoError(t, err)
+	defer s.StopShell()
+	assert.True(t, pids[s.shellPid])
+
+	// the pool refills in the background
+	for i := 0; i < 50 && pool.Count() < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, 2, pool.Count())
+
+	// the terminals with other settings start their own shell
+	other := terminal
+	other.TerminalString = "vt100"
+	s, err = NewMenderShellSession("pool-session-2", "pool-user-2", NoExpirationTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	err = s.StartShell(s.GetId(), other)
+	assert.NoError(t, err)
+	defer s.StopShell()
+	for _, warm := range pool.shells {
+		assert.NotEqual(t, warm.pid, s.shellPid)
+	}
+	assert.Equal(t, 2, pool.Count())
+
+	// the warm shells which exited are discarded
+	exited := pool.shells[0]
+	assert.NoError(t, exited.command.Process.Kill())
+	time.Sleep(100 * time.Millisecond)
+	warm := pool.claim(terminal)
+	if assert.NotNil(t, warm) {
+		assert.NotEqual(t, exited.pid, warm.pid)
+		warm.kill()
+	}
+
+	pool.Close()
+	assert.Equal(t, 0, pool.Count())
+	assert.False(t, procps.ProcessRunning(exited.pid))
+	assert.Nil(t, pool.claim(terminal))
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RecordingFormat is the format of the terminal recordings, see
+// https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md
+const RecordingFormat = "asciicast-v2"
+
+// directory the terminal output of the shells is recorded to, empty
+// disables the recording
+var RecordingsDir = ""
+
+type recordingHeader struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// recording writes the output of a shell to a file, in RecordingFormat
+type recording struct {
+	mutex     sync.Mutex
+	path      string
+	file      *os.File
+	startedAt time.Time
+}
+
+func newRecording(dir string, name string, terminal MenderShellTerminalSettings) (*recording, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, name+".cast")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := &recording{
+		path:      path,
+		file:      file,
+		startedAt: timeNow(),
+	}
+	header, _ := json.Marshal(recordingHeader{
+		Version:   2,
+		Width:     terminal.Width,
+		Height:    terminal.Height,
+		Timestamp: r.startedAt.Unix(),
+		Env: map[string]string{
+			"SHELL": terminal.Shell,
+			"TERM":  terminal.TerminalString,
+		},
+	})
+	if _, err = file.Write(append(header, '\n')); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return r, nil
+}
+
+// writeOutput records output of the shell; it does nothing once the
+// recording is closed
+func (r *recording) writeOutput(output []byte) error {
+	return r.writeEvent("o", string(output))
+}
+
+// writeResize records the new size of the terminal
+func (r *recording) writeResize(height uint16, width uint16) error {
+	return r.writeEvent("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+func (r *recording) writeEvent(eventType string, data string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	event, err := json.Marshal([]interface{}{
+		timeNow().Sub(r.startedAt).Seconds(),
+		eventType,
+		data,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.file.Write(append(event, '\n'))
+	return err
+}
+
+func (r *recording) close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
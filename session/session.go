@@ -15,15 +15,23 @@ package session
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/mendersoftware/mender-connect/cgroup"
+	"github.com/mendersoftware/mender-connect/connectionmanager"
+	"github.com/mendersoftware/mender-connect/notify"
 	"github.com/mendersoftware/mender-connect/procps"
 	"github.com/mendersoftware/mender-connect/shell"
 )
@@ -48,8 +56,46 @@ const (
 	NewSession
 )
 
+// MenderSessionCloseReason tells why a session was closed, it is sent to
+// the peer with the stop message and logged on session teardown
+type MenderSessionCloseReason string
+
+const (
+	CloseReasonNone            MenderSessionCloseReason = ""
+	CloseReasonIdleTimeout     MenderSessionCloseReason = "idle-timeout"
+	CloseReasonExpired         MenderSessionCloseReason = "expired"
+	CloseReasonOperatorClose   MenderSessionCloseReason = "operator-close"
+	CloseReasonPolicyViolation MenderSessionCloseReason = "policy-violation"
+	CloseReasonQuota           MenderSessionCloseReason = "quota"
+	CloseReasonShutdown        MenderSessionCloseReason = "shutdown"
+	CloseReasonShellIdle       MenderSessionCloseReason = "shell-idle-timeout"
+	CloseReasonShellExit       MenderSessionCloseReason = "shell-exit"
+	CloseReasonTransportError  MenderSessionCloseReason = "transport-error"
+	CloseReasonUnauthorized    MenderSessionCloseReason = "unauthorized"
+	CloseReasonAuthExpired     MenderSessionCloseReason = "auth-expired"
+	CloseReasonTakeover        MenderSessionCloseReason = "takeover"
+)
+
+// PropertyCloseReason is the message property carrying the close reason
+const PropertyCloseReason = "reason"
+
+// Properties of the stop message telling how the shell exited: the exit
+// code, or the name of the signal which killed it (e.g. "SIGKILL")
+const (
+	PropertyExitCode   = "exit_code"
+	PropertyExitSignal = "exit_signal"
+)
+
+// PropertyStreamID is the message property carrying the identifier of
+// a stream, i.e.: one of several logical sessions of the same protocol
+// multiplexed within a session
+const PropertyStreamID = "stream_id"
+
 const (
 	NoExpirationTimeout = time.Second * 0
+	// time to wait for the processes left in the cgroup of a shell to
+	// exit once killed
+	cgroupRemoveTimeout = 2 * time.Second
 )
 
 var (
@@ -58,6 +104,9 @@ var (
 	ErrSessionShellTooManySessionsPerUser = errors.New("user has too many open sessions")
 	ErrSessionNotFound                    = errors.New("session not found")
 	ErrSessionTooManyShellsAlreadyRunning = errors.New("too many shells spawned")
+	ErrSessionTooManySessions             = errors.New("too many concurrent sessions")
+	ErrSessionTooManyShellsPerUser        = errors.New("user has too many shells running")
+	ErrSessionTooManyStreams              = errors.New("session has too many terminals open")
 )
 
 var (
@@ -65,6 +114,45 @@ var (
 	defaultSessionIdleExpiredTimeout = NoExpirationTimeout
 	defaultTimeFormat                = "Mon Jan 2 15:04:05 -0700 MST 2006"
 	MaxUserSessions                  = 1
+	// maximum number of shells a user may run at the same time, 0 means
+	// no limit
+	MaxUserShells = 0
+	// maximum number of terminals, i.e. the session and its streams, open
+	// in a session at the same time, 0 means no limit
+	MaxSessionStreams = 0
+	// maximum bytes per second of output sent by a shell, the output
+	// above it is dropped; 0 means no limit
+	MaxOutputBytesPerSecond uint64 = 0
+	// number of sessions created within an hour above which an alert
+	// is logged, 0 disables the alert
+	SessionsPerHourAlertThreshold = 0
+	// maximum number of concurrent sessions, 0 means no limit
+	MaxSessions = 0
+	// when the limit is reached, evict the oldest idle session instead
+	// of rejecting the new one
+	MaxSessionsEvictOldestIdle = false
+	// time without terminal input or output after which the shell is
+	// hung up, independently of the session idle timeout; 0 disables it
+	ShellIdleTimeout = NoExpirationTimeout
+	// time the idle shells are given to exit after the hang up, before
+	// they are killed
+	ShellIdleGracePeriod = 5 * time.Second
+	// time before ShellIdleTimeout at which the terminals of the idle
+	// shells are warned about the hang up, 0 disables the warning
+	ShellIdleWarning = time.Duration(0)
+	// text of the warning, empty tells the time left before the hang up
+	ShellIdleWarningText = ""
+	// cgroups the shells run in, nil runs them in the cgroup of the daemon
+	Cgroups *cgroup.Hierarchy
+	// systemd scope units the shells run in, nil runs them as plain
+	// children of the daemon
+	SystemdScope *shell.SystemdScope
+	// policy the command lines typed in the shells are checked against,
+	// nil allows all of them
+	CommandPolicy *shell.CommandPolicy
+	// idle shells started ahead of the sessions, nil starts the shells
+	// on demand; it is not used with SystemdScope
+	WarmShells *ShellPool
 )
 
 type MenderShellTerminalSettings struct {
@@ -75,14 +163,35 @@ type MenderShellTerminalSettings struct {
 	TerminalString string
 	Height         uint16
 	Width          uint16
+	// text printed to the terminal before the shell starts
+	Banner string
+	// extra environment of the shell, as "NAME=value"
+	Env []string
+	// arguments of the shell, e.g. "-c" and a command
+	Args []string
+}
+
+// MenderShellSessionProtoStats holds the message and byte counters
+// of a single protocol within a session
+type MenderShellSessionProtoStats struct {
+	MessagesReceived uint64
+	BytesReceived    uint64
+	MessagesSent     uint64
+	BytesSent        uint64
 }
 
 type MenderShellSession struct {
 	//mender shell represents a process of passing data between a running shell
 	//subprocess running
 	shell *shell.MenderShell
-	//session id, generated
+	//session id, generated; when the session is a stream it is the key
+	//built from the session and stream ids (see StreamKey)
 	id string
+	//id of the session the stream belongs to, same as id for the
+	//sessions without streams
+	sessionId string
+	//stream id given with the MessageTypeSpawnShell message, if any
+	streamId string
 	//user id given with the MessageTypeSpawnShell message
 	userId string
 	//time at which session was created
@@ -91,6 +200,9 @@ type MenderShellSession struct {
 	expiresAt time.Time
 	//time of a last received message used to determine if the session is active
 	activeAt time.Time
+	//time at which the token which authorized the session expires, zero
+	//if it does not
+	authExpiresAt time.Time
 	//type of the session
 	sessionType MenderSessionType
 	//status of the session
@@ -106,25 +218,109 @@ type MenderShellSession struct {
 	writer    io.Writer
 	pseudoTTY *os.File
 	command   *exec.Cmd
+	//the reason the session was closed for, empty while it is running
+	closeReason MenderSessionCloseReason
+	//serializes detaching the shell, which both stopping the shell and
+	//the shell exiting do
+	detachMutex sync.Mutex
+	//guards the status, the close reason and the terminal settings, which
+	//the shell exiting changes from the goroutine passing its output, and
+	//the ids and the logger it reads, which a takeover changes
+	statusMutex sync.Mutex
+	//the session is not tracked with the sessions of the server, see
+	//NewDebugSession
+	untracked bool
+	//writes the messages to the peer, the server connection if nil
+	write func(msg *ws.ProtoMsg) error
+	//logger carrying the session, stream and user ids
+	logger *log.Entry
+	//applies CommandPolicy to the input of the shell and reports the
+	//command lines to the listeners, nil if there are neither
+	commandFilter *shell.CommandFilter
+	//terminal output of the shell, nil if it is not recorded
+	recording *recording
+	//cgroup of the shell and its descendants, nil if there is none
+	cgroup *cgroup.Cgroup
+	//messages and bytes handled, per protocol
+	stats map[ws.ProtoType]*MenderShellSessionProtoStats
+	//time of the last input or output of the terminal
+	terminalActiveAt time.Time
+	//the terminal was warned about the hang up since it was last active
+	idleWarned bool
+	statsMutex sync.Mutex
 }
 
 var sessionsMap = map[string]*MenderShellSession{}
 var sessionsByUserIdMap = map[string][]*MenderShellSession{}
+var sessionsCreatedAt = []time.Time{}
 
 func timeNow() time.Time {
 	return time.Now().UTC()
 }
 
+// StreamKey returns the key the stream streamId of session sessionId
+// is stored with, the session id itself if streamId is empty
+func StreamKey(sessionId string, streamId string) string {
+	if streamId == "" {
+		return sessionId
+	}
+	return sessionId + "/" + streamId
+}
+
 func NewMenderShellSession(sessionId string, userId string, expireAfter time.Duration, expireAfterIdle time.Duration) (s *MenderShellSession, err error) {
-	if userSessions, ok := sessionsByUserIdMap[userId]; ok {
-		log.Debugf("user %s has %d sessions.", userId, len(userSessions))
-		if len(userSessions) >= MaxUserSessions {
+	return NewMenderShellSessionStream(sessionId, "", userId, expireAfter, expireAfterIdle)
+}
+
+// NewDebugSession creates a session which is not tracked with the sessions
+// of the server: it does not count towards the limits, does not expire and
+// is not reported to the lifecycle listeners; its messages are written to
+// the peer with write. It serves e.g. the local debug shell.
+func NewDebugSession(sessionId string, userId string, write func(msg *ws.ProtoMsg) error) *MenderShellSession {
+	createdAt := timeNow()
+	s := &MenderShellSession{
+		id:          sessionId,
+		sessionId:   sessionId,
+		userId:      userId,
+		createdAt:   createdAt,
+		expiresAt:   createdAt.Add(defaultSessionExpiredTimeout),
+		sessionType: RemoteDebugSession,
+		status:      NewSession,
+		stats:       map[ws.ProtoType]*MenderShellSessionProtoStats{},
+		untracked:   true,
+		write:       write,
+	}
+	s.logger = NewLogger(sessionId, "", userId, ws.ProtoTypeShell)
+	return s
+}
+
+// NewMenderShellSessionStream creates a new stream of a session; streams of
+// an existing session do not count towards the sessions limits
+func NewMenderShellSessionStream(sessionId string, streamId string, userId string, expireAfter time.Duration, expireAfterIdle time.Duration) (s *MenderShellSession, err error) {
+	streams := MenderShellSessionGetStreams(sessionId)
+	isNewSession := len(streams) == 0
+	if MaxSessionStreams > 0 && len(streams) >= MaxSessionStreams {
+		return nil, ErrSessionTooManyStreams
+	}
+	if _, ok := sessionsByUserIdMap[userId]; ok {
+		userSessions := userSessionsOpen(userId)
+		log.Debugf("user %s has %d sessions.", userId, userSessions)
+		if isNewSession && userSessions >= MaxUserSessions {
 			return nil, ErrSessionShellTooManySessionsPerUser
 		}
 	} else {
 		sessionsByUserIdMap[userId] = []*MenderShellSession{}
 	}
 
+	if isNewSession && MaxSessions > 0 && len(sessionsMap) >= MaxSessions {
+		if !MaxSessionsEvictOldestIdle {
+			return nil, ErrSessionTooManySessions
+		}
+		if err := evictOldestIdleSession(); err != nil {
+			log.Errorf("failed to evict the oldest idle session: %s", err.Error())
+			return nil, ErrSessionTooManySessions
+		}
+	}
+
 	if expireAfter == NoExpirationTimeout {
 		expireAfter = defaultSessionExpiredTimeout
 	}
@@ -135,18 +331,82 @@ func NewMenderShellSession(sessionId string, userId string, expireAfter time.Dur
 
 	createdAt := timeNow()
 	s = &MenderShellSession{
-		id:          sessionId,
+		id:          StreamKey(sessionId, streamId),
+		sessionId:   sessionId,
+		streamId:    streamId,
 		userId:      userId,
 		createdAt:   createdAt,
 		expiresAt:   createdAt.Add(expireAfter),
 		sessionType: ShellInteractiveSession,
 		status:      NewSession,
+		stats:       map[ws.ProtoType]*MenderShellSessionProtoStats{},
 	}
-	sessionsMap[sessionId] = s
+	s.authorize()
+	s.logger = NewLogger(sessionId, streamId, userId, ws.ProtoTypeShell)
+	sessionsMap[s.id] = s
 	sessionsByUserIdMap[userId] = append(sessionsByUserIdMap[userId], s)
+	sessionsRateAlert(createdAt)
+	lifecycleEvent(HookEventSessionOpen, s, ws.ProtoTypeShell)
 	return s, nil
 }
 
+// evictOldestIdleSession closes the session which has been inactive
+// for the longest time to make room for a new one
+func evictOldestIdleSession() error {
+	var oldest *MenderShellSession
+	for _, s := range sessionsMap {
+		if oldest == nil || s.activeAt.Before(oldest.activeAt) {
+			oldest = s
+		}
+	}
+	if oldest == nil {
+		return ErrSessionNotFound
+	}
+
+	log.Infof("evicting session %s, last active at %s", oldest.id, oldest.GetActiveAtFmt())
+	err := oldest.StopShellWithReason(CloseReasonQuota)
+	if err != nil && err != ErrSessionShellNotRunning && procps.ProcessExists(oldest.shellPid) {
+		return err
+	}
+	return MenderShellDeleteById(oldest.id)
+}
+
+// sessionsRateAlert records the creation of a session and logs an alert,
+// also notified to the server, when more than
+// SessionsPerHourAlertThreshold sessions were created within the last
+// hour; an unusual number of sessions may mean that operator credentials
+// got compromised
+func sessionsRateAlert(createdAt time.Time) bool {
+	if SessionsPerHourAlertThreshold < 1 {
+		return false
+	}
+
+	hourAgo := createdAt.Add(-time.Hour)
+	i := 0
+	for i < len(sessionsCreatedAt) && sessionsCreatedAt[i].Before(hourAgo) {
+		i++
+	}
+	sessionsCreatedAt = append(sessionsCreatedAt[i:], createdAt)
+	if len(sessionsCreatedAt) > SessionsPerHourAlertThreshold {
+		message := fmt.Sprintf("%d sessions created within the last hour, threshold is %d",
+			len(sessionsCreatedAt), SessionsPerHourAlertThreshold)
+		log.Warnf("alert: %s", message)
+		err := notify.Notify("", &notify.Notification{
+			Kind:    notify.KindSessionsRate,
+			Message: message,
+			Details: map[string]interface{}{
+				"sessions":  len(sessionsCreatedAt),
+				"threshold": SessionsPerHourAlertThreshold,
+			},
+		})
+		if err != nil && err != notify.ErrNoNotifier {
+			log.Errorf("failed to notify the sessions rate alert: %s", err.Error())
+		}
+		return true
+	}
+	return false
+}
+
 func MenderShellSessionGetCount() int {
 	return len(sessionsMap)
 }
@@ -168,6 +428,18 @@ func MenderShellSessionGetById(id string) *MenderShellSession {
 	}
 }
 
+// MenderShellSessionGetStreams returns the session sessionId and all its
+// streams
+func MenderShellSessionGetStreams(sessionId string) []*MenderShellSession {
+	streams := []*MenderShellSession{}
+	for _, s := range sessionsMap {
+		if s.sessionId == sessionId {
+			streams = append(streams, s)
+		}
+	}
+	return streams
+}
+
 func MenderShellDeleteById(id string) error {
 	if v, ok := sessionsMap[id]; ok {
 		userSessions := sessionsByUserIdMap[v.userId]
@@ -178,6 +450,7 @@ func MenderShellDeleteById(id string) error {
 			}
 		}
 		delete(sessionsMap, id)
+		lifecycleEvent(HookEventSessionClose, v, ws.ProtoTypeShell)
 		return nil
 	} else {
 		return ErrSessionNotFound
@@ -192,6 +465,27 @@ func MenderShellSessionsGetByUserId(userId string) []*MenderShellSession {
 	}
 }
 
+// userSessionsOpen returns the number of sessions the user has open, the
+// streams of a session count as one
+func userSessionsOpen(userId string) int {
+	sessionIds := map[string]bool{}
+	for _, s := range sessionsByUserIdMap[userId] {
+		sessionIds[s.sessionId] = true
+	}
+	return len(sessionIds)
+}
+
+// userShellsRunning returns the number of shells the user is running
+func userShellsRunning(userId string) int {
+	count := 0
+	for _, s := range sessionsByUserIdMap[userId] {
+		if s.shellRunning() {
+			count++
+		}
+	}
+	return count
+}
+
 func MenderShellStopByUserId(userId string) (count uint, err error) {
 	a := sessionsByUserIdMap[userId]
 	log.Debugf("stopping all shells of user %s.", userId)
@@ -204,23 +498,24 @@ func MenderShellStopByUserId(userId string) (count uint, err error) {
 		if s.shell == nil {
 			continue
 		}
-		e := s.StopShell()
+		e := s.StopShellWithReason(CloseReasonOperatorClose)
 		if e != nil && procps.ProcessExists(s.shellPid) {
 			err = e
 			continue
 		}
 		delete(sessionsMap, s.id)
+		lifecycleEvent(HookEventSessionClose, s, ws.ProtoTypeShell)
 		count++
 	}
 	delete(sessionsByUserIdMap, userId)
 	return count, err
 }
 
-func MenderSessionTerminateAll() (shellCount int, sessionCount int, err error) {
+func MenderSessionTerminateAll(reason MenderSessionCloseReason) (shellCount int, sessionCount int, err error) {
 	shellCount = 0
 	sessionCount = 0
 	for id, s := range sessionsMap {
-		e := s.StopShell()
+		e := s.StopShellWithReason(reason)
 		if e == nil {
 			shellCount++
 		} else {
@@ -239,13 +534,52 @@ func MenderSessionTerminateAll() (shellCount int, sessionCount int, err error) {
 	return shellCount, sessionCount, err
 }
 
+// MenderSessionWarnIdleShells warns the terminals of the shells about to be
+// hung up for being idle
+func MenderSessionWarnIdleShells() (shellCount int, err error) {
+	for id, s := range sessionsMap {
+		warned, e := s.WarnShellIdle()
+		if warned {
+			shellCount++
+		}
+		if e != nil {
+			log.Debugf("idle shells: failed to warn shell for session: %s: %s", id, e.Error())
+			err = e
+		}
+	}
+	return shellCount, err
+}
+
+// MenderSessionHangUpIdleShells hangs up the shells idle for longer than
+// ShellIdleTimeout, keeping their sessions open; if ShellIdleWarning is
+// set, only the shells whose terminals were warned are hung up
+func MenderSessionHangUpIdleShells() (shellCount int, err error) {
+	for id, s := range sessionsMap {
+		if !s.IsShellIdle() || (ShellIdleWarning > 0 && !s.isIdleWarned()) {
+			continue
+		}
+		e := s.HangUpShell(CloseReasonShellIdle)
+		if e == nil {
+			shellCount++
+		} else {
+			log.Debugf("idle shells: failed to hang up shell for session: %s: %s", id, e.Error())
+			err = e
+		}
+	}
+	return shellCount, err
+}
+
 func MenderSessionTerminateExpired() (shellCount int, sessionCount int, totalExpiredLeft int, err error) {
 	shellCount = 0
 	sessionCount = 0
 	totalExpiredLeft = 0
+	reason := CloseReasonExpired
+	if defaultSessionIdleExpiredTimeout != NoExpirationTimeout {
+		reason = CloseReasonIdleTimeout
+	}
 	for id, s := range sessionsMap {
 		if s.IsExpired(false) {
-			e := s.StopShell()
+			e := s.StopShellWithReason(reason)
 			if e == nil {
 				shellCount++
 			} else {
@@ -267,9 +601,25 @@ func MenderSessionTerminateExpired() (shellCount int, sessionCount int, totalExp
 }
 
 func (s *MenderShellSession) GetStatus() MenderSessionStatus {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
 	return s.status
 }
 
+// shellRunning tells if the session has a shell running, hung or not
+func (s *MenderShellSession) shellRunning() bool {
+	status := s.GetStatus()
+	return status == ActiveSession || status == HangedSession
+}
+
+func (s *MenderShellSession) GetStartedAt() time.Time {
+	return s.createdAt
+}
+
+func (s *MenderShellSession) GetActiveAt() time.Time {
+	return s.activeAt
+}
+
 func (s *MenderShellSession) GetStartedAtFmt() string {
 	return s.createdAt.Format(defaultTimeFormat)
 }
@@ -287,48 +637,174 @@ func (s *MenderShellSession) GetShellCommandPath() string {
 }
 
 func (s *MenderShellSession) StartShell(sessionId string, terminal MenderShellTerminalSettings) error {
-	if s.status == ActiveSession || s.status == HangedSession {
+	if s.shellRunning() {
 		return ErrSessionShellAlreadyRunning
 	}
+	if !s.untracked && MaxUserShells > 0 && userShellsRunning(s.userId) >= MaxUserShells {
+		return ErrSessionTooManyShellsPerUser
+	}
 
-	pid, pseudoTTY, cmd, err := shell.ExecuteShell(
-		terminal.Uid,
-		terminal.Gid,
-		terminal.HomeDir,
-		terminal.Shell,
-		terminal.TerminalString,
-		terminal.Height,
-		terminal.Width)
+	name := strings.Replace(s.id, "/", "_", -1)
+	var pid int
+	var pseudoTTY *os.File
+	var cmd *exec.Cmd
+	var err error
+	if SystemdScope != nil {
+		pid, pseudoTTY, cmd, err = shell.ExecuteShellInScope(
+			SystemdScope,
+			shell.ScopeUnitName(name),
+			terminal.Uid,
+			terminal.Gid,
+			terminal.HomeDir,
+			terminal.Shell,
+			terminal.Args,
+			terminal.TerminalString,
+			terminal.Env,
+			terminal.Height,
+			terminal.Width)
+	} else if warm := WarmShells.claim(terminal); warm != nil {
+		s.Logger().Debugf("claimed the warm shell pid %d", warm.pid)
+		pid, pseudoTTY, cmd = warm.pid, warm.pseudoTTY, warm.command
+	} else {
+		pid, pseudoTTY, cmd, err = shell.ExecuteShellWithArgs(
+			terminal.Uid,
+			terminal.Gid,
+			terminal.HomeDir,
+			terminal.Shell,
+			terminal.Args,
+			terminal.TerminalString,
+			terminal.Env,
+			terminal.Height,
+			terminal.Width)
+	}
 	if err != nil {
 		return err
 	}
 
+	// the shell is moved to its cgroup once running: what it forks before,
+	// e.g. running the profile of a login shell, escapes the limits
+	if Cgroups != nil {
+		if s.cgroup, err = Cgroups.Add(s.id, pid); err != nil {
+			s.Logger().Errorf("failed to move the shell to its cgroup: %s", err.Error())
+			pseudoTTY.Close()
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+			return err
+		}
+	}
+
 	//MenderShell represents a process of passing messages between backend
 	//and the shell subprocess (started above via shell.ExecuteShell) over
 	//the websocket connection
-	log.Infof("mender-connect starting shell command passing process, pid: %d", pid)
+	s.Logger().WithField(
+		"connection_id", connectionmanager.GetConnectionID(ws.ProtoTypeShell),
+	).Infof("mender-connect starting shell command passing process, pid: %d", pid)
+	if RecordingsDir != "" {
+		if s.recording, err = newRecording(RecordingsDir, name, terminal); err != nil {
+			s.Logger().Errorf("failed to start the recording of the shell: %s", err.Error())
+		}
+	}
 	s.shell = shell.NewMenderShell(sessionId, pseudoTTY, pseudoTTY)
-	s.shell.Start()
+	s.shell.SetLogger(s.Logger())
+	s.shell.SetStreamId(s.streamId)
+	s.shell.OnMessageSent(s.RecordMessageSent)
+	s.shell.OnExit(s.shellExited)
+	if s.write != nil {
+		s.shell.SetWriter(s.write)
+	}
+	if MaxOutputBytesPerSecond > 0 {
+		s.shell.SetOutputLimit(MaxOutputBytesPerSecond)
+	}
+	if terminal.Banner != "" {
+		if err := s.shell.WriteOutput([]byte(terminal.Banner)); err != nil {
+			s.Logger().Errorf("failed to send the banner: %s", err.Error())
+		}
+	}
 
 	s.shellPid = pid
 	s.reader = pseudoTTY
 	s.writer = pseudoTTY
+	s.statusMutex.Lock()
 	s.status = ActiveSession
 	s.terminal = terminal
+	s.statusMutex.Unlock()
 	s.pseudoTTY = pseudoTTY
 	s.command = cmd
 	s.activeAt = timeNow()
+	s.setTerminalActiveAt(s.activeAt)
+	if CommandPolicy != nil || len(commandListeners) > 0 {
+		s.commandFilter = shell.NewCommandFilter(CommandPolicy)
+		s.commandFilter.OnLine(func(commandLine string, denied bool) {
+			commandEntered(s, commandLine, denied)
+		})
+	}
+	s.shell.Start()
+	if !s.untracked {
+		lifecycleEvent(HookEventHandlerStart, s, ws.ProtoTypeShell)
+	}
 	return nil
 }
 
 func (s *MenderShellSession) GetId() string {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
 	return s.id
 }
 
+// GetSessionId returns the id of the session the stream belongs to
+func (s *MenderShellSession) GetSessionId() string {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+	return s.sessionId
+}
+
+func (s *MenderShellSession) GetStreamId() string {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+	return s.streamId
+}
+
+func (s *MenderShellSession) GetUserId() string {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+	return s.userId
+}
+
+// NewLogger returns a logger carrying the ids of the session, the stream,
+// the user and the protocol, so that the logs correlate to the session
+func NewLogger(sessionId string, streamId string, userId string, proto ws.ProtoType) *log.Entry {
+	fields := log.Fields{
+		"session_id": sessionId,
+		"user_id":    userId,
+		"protocol":   proto,
+	}
+	if streamId != "" {
+		fields["stream_id"] = streamId
+	}
+	return log.WithFields(fields)
+}
+
+// Logger returns the logger of the session
+func (s *MenderShellSession) Logger() *log.Entry {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+	if s.logger == nil {
+		s.logger = NewLogger(s.sessionId, s.streamId, s.userId, ws.ProtoTypeShell)
+	}
+	return s.logger
+}
+
 func (s *MenderShellSession) GetShellPid() int {
 	return s.shellPid
 }
 
+// GetShellUid returns the uid the shell runs as
+func (s *MenderShellSession) GetShellUid() uint32 {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+	return s.terminal.Uid
+}
+
 func (s *MenderShellSession) IsExpired(setStatus bool) bool {
 	if defaultSessionIdleExpiredTimeout != NoExpirationTimeout {
 		idleTimeoutReached := s.activeAt.Add(defaultSessionIdleExpiredTimeout)
@@ -336,58 +812,373 @@ func (s *MenderShellSession) IsExpired(setStatus bool) bool {
 	}
 	e := timeNow().After(s.expiresAt)
 	if e && setStatus {
+		s.statusMutex.Lock()
 		s.status = ExpiredSession
+		s.statusMutex.Unlock()
 	}
 	return e
 }
 
 func (s *MenderShellSession) ShellCommand(m *ws.ProtoMsg) error {
 	s.activeAt = timeNow()
+	s.setTerminalActiveAt(s.activeAt)
 	data := m.Body
+	var deniedErr error
+	if s.commandFilter != nil {
+		var denied []string
+		data, denied = s.commandFilter.Filter(data)
+		for _, line := range denied {
+			s.Logger().Warnf("command denied by the policy: '%s'", line)
+			deniedErr = shell.ErrCommandDenied
+		}
+	}
 	commandLine := string(data)
 	n, err := s.writer.Write(data)
 	if err != nil && n != len(data) {
 		err = shell.ErrExecWriteBytesShort
 	}
 	if err != nil {
-		log.Debugf("error: '%s' while running '%s'.", err.Error(), commandLine)
+		s.Logger().Debugf("error: '%s' while running '%s'.", err.Error(), commandLine)
 	} else {
-		log.Debugf("executed: '%s'", commandLine)
+		s.Logger().Debugf("executed: '%s'", commandLine)
+		err = deniedErr
 	}
 	return err
 }
 
-func (s *MenderShellSession) ResizeShell(height, width uint16) {
-	shell.ResizeShell(s.pseudoTTY, height, width)
+// ResizeShell sets the size of the terminal of the shell
+func (s *MenderShellSession) ResizeShell(height, width uint16) error {
+	if !s.shellRunning() {
+		return ErrSessionShellNotRunning
+	}
+	if err := shell.ResizeShell(s.pseudoTTY, height, width); err != nil {
+		return err
+	}
+	s.statusMutex.Lock()
+	s.terminal.Height = height
+	s.terminal.Width = width
+	s.statusMutex.Unlock()
+	if s.recording != nil {
+		if err := s.recording.writeResize(height, width); err != nil {
+			s.Logger().Errorf("failed to record the terminal resize: %s", err.Error())
+		}
+	}
+	return nil
 }
 
-func (s *MenderShellSession) StopShell() (err error) {
-	log.Infof("session %s status:%d stopping shell", s.id, s.status)
-	if s.status != ActiveSession && s.status != HangedSession {
-		return ErrSessionShellNotRunning
+// RecordMessageReceived accounts a message received from the peer
+func (s *MenderShellSession) RecordMessageReceived(m *ws.ProtoMsg) {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	stats := s.protoStats(m.Header.Proto)
+	stats.MessagesReceived++
+	stats.BytesReceived += uint64(len(m.Body))
+}
+
+// RecordMessageSent accounts a message sent to the peer
+func (s *MenderShellSession) RecordMessageSent(m *ws.ProtoMsg) {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	stats := s.protoStats(m.Header.Proto)
+	stats.MessagesSent++
+	stats.BytesSent += uint64(len(m.Body))
+
+	if m.Header.MsgType != wsshell.MessageTypeShellCommand {
+		return
+	}
+	s.terminalActiveAt = timeNow()
+	s.idleWarned = false
+	if s.recording != nil {
+		if err := s.recording.writeOutput(m.Body); err != nil {
+			s.Logger().Errorf("failed to record the shell output: %s", err.Error())
+		}
 	}
+}
 
-	s.shell.Stop()
-	s.terminal = MenderShellTerminalSettings{}
-	s.status = EmptySession
+// GetRecordingPath returns the path of the recording of the terminal
+// output, empty if the shell was not recorded
+func (s *MenderShellSession) GetRecordingPath() string {
+	if s.recording == nil {
+		return ""
+	}
+	return s.recording.path
+}
+
+func (s *MenderShellSession) setTerminalActiveAt(t time.Time) {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+	s.terminalActiveAt = t
+	s.idleWarned = false
+}
+
+// IsShellIdle tells if the shell has been running without terminal input
+// or output for longer than ShellIdleTimeout
+func (s *MenderShellSession) IsShellIdle() bool {
+	return s.isShellIdleFor(ShellIdleTimeout)
+}
+
+func (s *MenderShellSession) isShellIdleFor(timeout time.Duration) bool {
+	if ShellIdleTimeout == NoExpirationTimeout {
+		return false
+	}
+	if !s.shellRunning() {
+		return false
+	}
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+	return timeNow().After(s.terminalActiveAt.Add(timeout))
+}
+
+func (s *MenderShellSession) isIdleWarned() bool {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+	return s.idleWarned
+}
+
+// WarnShellIdle writes the idle warning to the terminal if the shell is
+// to be hung up within ShellIdleWarning and the terminal was not warned
+// yet; it returns true if it wrote the warning. The warning does not
+// count as terminal output, any input or output afterwards keeps the
+// shell running.
+func (s *MenderShellSession) WarnShellIdle() (bool, error) {
+	if ShellIdleWarning <= 0 || ShellIdleWarning >= ShellIdleTimeout ||
+		!s.isShellIdleFor(ShellIdleTimeout-ShellIdleWarning) {
+		return false, nil
+	}
+	s.statsMutex.Lock()
+	if s.idleWarned {
+		s.statsMutex.Unlock()
+		return false, nil
+	}
+	s.idleWarned = true
+	left := s.terminalActiveAt.Add(ShellIdleTimeout).Sub(timeNow())
+	s.statsMutex.Unlock()
+
+	text := ShellIdleWarningText
+	if text == "" {
+		text = fmt.Sprintf("the session will close in %s due to inactivity, press any key to keep it open",
+			left.Round(time.Second))
+	}
+	msg := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeShellCommand,
+			SessionID: s.sessionId,
+			Properties: map[string]interface{}{
+				"status": wsshell.NormalMessage,
+			},
+		},
+		Body: []byte("\r\n" + text + "\r\n"),
+	}
+	if s.streamId != "" {
+		msg.Header.Properties[PropertyStreamID] = s.streamId
+	}
+	return true, s.writeMessage(msg)
+}
+
+func (s *MenderShellSession) protoStats(proto ws.ProtoType) *MenderShellSessionProtoStats {
+	if s.stats == nil {
+		s.stats = map[ws.ProtoType]*MenderShellSessionProtoStats{}
+	}
+	stats, ok := s.stats[proto]
+	if !ok {
+		stats = &MenderShellSessionProtoStats{}
+		s.stats[proto] = stats
+	}
+	return stats
+}
+
+// Stats returns a copy of the per protocol message counters of the session
+func (s *MenderShellSession) Stats() map[ws.ProtoType]MenderShellSessionProtoStats {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	stats := make(map[ws.ProtoType]MenderShellSessionProtoStats, len(s.stats))
+	for proto, protoStats := range s.stats {
+		stats[proto] = *protoStats
+	}
+	return stats
+}
+
+func (s *MenderShellSession) GetCloseReason() MenderSessionCloseReason {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+	return s.closeReason
+}
+
+// StopShell stops the shell on request of the operator
+func (s *MenderShellSession) StopShell() (err error) {
+	return s.StopShellWithReason(CloseReasonOperatorClose)
+}
+
+// StopShellWithReason stops the shell and, unless the operator asked for it,
+// notifies the peer about why the session is going away
+func (s *MenderShellSession) StopShellWithReason(reason MenderSessionCloseReason) (err error) {
+	s.Logger().Infof("session %s status:%d stopping shell, reason: %s", s.GetId(), s.GetStatus(), reason)
+	if err = s.detachShell(reason); err != nil {
+		return err
+	}
+	if reason != CloseReasonOperatorClose {
+		defer s.sendCloseMessage(reason)
+	}
+	defer s.removeCgroup()
 
 	p, err := os.FindProcess(s.shellPid)
 	if err != nil {
-		log.Errorf("session %s, shell pid %d, find process error: %s", s.id, s.shellPid, err.Error())
+		s.Logger().Errorf("session %s, shell pid %d, find process error: %s", s.GetId(), s.shellPid, err.Error())
 		return err
 	}
 	err = p.Signal(syscall.SIGINT)
 	if err != nil {
-		log.Errorf("session %s, shell pid %d, signal error: %s", s.id, s.shellPid, err.Error())
+		s.Logger().Errorf("session %s, shell pid %d, signal error: %s", s.GetId(), s.shellPid, err.Error())
 		return err
 	}
 	s.pseudoTTY.Close()
 
 	err = procps.TerminateAndWait(s.shellPid, s.command, 2*time.Second)
 	if err != nil {
-		log.Errorf("session %s, shell pid %d, termination error: %s", s.id, s.shellPid, err.Error())
+		s.Logger().Errorf("session %s, shell pid %d, termination error: %s", s.GetId(), s.shellPid, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// HangUpShell stops the shell the way a terminal going away does: the
+// shell gets SIGHUP, and SIGKILL if it is still running after
+// ShellIdleGracePeriod; the session itself is left open
+func (s *MenderShellSession) HangUpShell(reason MenderSessionCloseReason) (err error) {
+	s.Logger().Infof("session %s status:%d hanging up shell, reason: %s", s.GetId(), s.GetStatus(), reason)
+	if err = s.detachShell(reason); err != nil {
+		return err
+	}
+	defer s.sendCloseMessage(reason)
+	defer s.removeCgroup()
+	s.pseudoTTY.Close()
+
+	err = procps.HangUpAndWait(s.shellPid, s.command, ShellIdleGracePeriod, 2*time.Second)
+	if err != nil {
+		s.Logger().Errorf("session %s, shell pid %d, termination error: %s", s.GetId(), s.shellPid, err.Error())
 		return err
 	}
+	return nil
+}
+
+// shellExited handles the shell exiting on its own, e.g. the user typed
+// exit or a resources limit killed it: the shell is reaped and the peer
+// told how it exited; the session itself is left open
+func (s *MenderShellSession) shellExited(err error) {
+	if s.detachShell(CloseReasonShellExit) != nil {
+		// the shell was stopped meanwhile
+		return
+	}
+	defer s.sendCloseMessage(CloseReasonShellExit)
+	defer s.removeCgroup()
+	s.pseudoTTY.Close()
+
+	// the process normally is gone already, the hang up only takes care
+	// of the shells which closed the terminal but keep running
+	err = procps.HangUpAndWait(s.shellPid, s.command, ShellIdleGracePeriod, 2*time.Second)
+	if err != nil {
+		s.Logger().Debugf("session %s, shell pid %d: %s", s.GetId(), s.shellPid, err.Error())
+	}
+	s.Logger().Infof("session %s, shell pid %d exited: %s", s.GetId(), s.shellPid, s.command.ProcessState)
+}
+
+// detachShell stops passing the messages between the peer and the shell
+// and marks the session as having no shell
+func (s *MenderShellSession) detachShell(reason MenderSessionCloseReason) error {
+	s.detachMutex.Lock()
+	defer s.detachMutex.Unlock()
+	if !s.shellRunning() {
+		return ErrSessionShellNotRunning
+	}
 
+	s.statusMutex.Lock()
+	s.closeReason = reason
+	s.statusMutex.Unlock()
+	s.shell.Stop()
+	s.closeObservers(reason)
+	if s.recording != nil {
+		if err := s.recording.close(); err != nil {
+			s.Logger().Errorf("failed to close the recording of the shell: %s", err.Error())
+		}
+	}
+	s.statusMutex.Lock()
+	s.terminal = MenderShellTerminalSettings{}
+	s.status = EmptySession
+	s.statusMutex.Unlock()
 	return nil
 }
+
+// removeCgroup kills the processes the shell left behind in its cgroup
+// and removes the cgroup
+func (s *MenderShellSession) removeCgroup() {
+	if s.cgroup == nil {
+		return
+	}
+	if err := s.cgroup.Remove(cgroupRemoveTimeout); err != nil {
+		s.Logger().Errorf("failed to remove the cgroup %s: %s", s.cgroup.Path(), err.Error())
+	}
+	s.cgroup = nil
+}
+
+// exitProperties returns the properties telling how the process exited,
+// none if it was not reaped
+func exitProperties(state *os.ProcessState) map[string]interface{} {
+	properties := map[string]interface{}{}
+	if state == nil {
+		return properties
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		properties[PropertyExitSignal] = unix.SignalName(status.Signal())
+	} else {
+		properties[PropertyExitCode] = state.ExitCode()
+	}
+	return properties
+}
+
+// sendCloseMessage tells the peer the shell is gone, why, and how it
+// exited
+func (s *MenderShellSession) sendCloseMessage(reason MenderSessionCloseReason) {
+	s.sendCloseMessageTo(shell.Peer{SessionId: s.GetSessionId(), StreamId: s.GetStreamId()}, reason)
+}
+
+// sendCloseMessageTo tells the peer, e.g. an observer, the shell is gone
+// for it
+func (s *MenderShellSession) sendCloseMessageTo(peer shell.Peer, reason MenderSessionCloseReason) {
+	msg := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeStopShell,
+			SessionID: peer.SessionId,
+			Properties: map[string]interface{}{
+				"status":            wsshell.ControlMessage,
+				PropertyCloseReason: string(reason),
+			},
+		},
+		Body: []byte{},
+	}
+	if peer.StreamId != "" {
+		msg.Header.Properties[PropertyStreamID] = peer.StreamId
+	}
+	if s.command != nil {
+		for name, value := range exitProperties(s.command.ProcessState) {
+			msg.Header.Properties[name] = value
+		}
+	}
+	err := s.writeMessage(msg)
+	if err != nil {
+		s.Logger().Debugf("session %s: failed to send the close reason: %s", s.GetId(), err.Error())
+	}
+}
+
+// writeMessage writes the message to the peer of the session
+func (s *MenderShellSession) writeMessage(msg *ws.ProtoMsg) error {
+	if s.write != nil {
+		return s.write(msg)
+	}
+	return connectionmanager.Write(ws.ProtoTypeShell, msg)
+}
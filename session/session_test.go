@@ -14,27 +14,37 @@
 package session
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"os/exec"
 	"os/user"
+	"path"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/creack/pty"
 	"github.com/gorilla/websocket"
 	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
 	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
 
+	"github.com/mendersoftware/mender-connect/cgroup"
 	"github.com/mendersoftware/mender-connect/connection"
 	"github.com/mendersoftware/mender-connect/connectionmanager"
+	"github.com/mendersoftware/mender-connect/notify"
 	"github.com/mendersoftware/mender-connect/procps"
+	"github.com/mendersoftware/mender-connect/shell"
 )
 
 func newShellTransaction(w http.ResponseWriter, r *http.Request) {
@@ -67,7 +77,7 @@ func TestMenderShellStartStopShell(t *testing.T) {
 
 	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, 16*time.Second, true, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
@@ -160,7 +170,7 @@ func TestMenderShellCommand(t *testing.T) {
 
 	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
 
-	conn, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	conn, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, 16*time.Second, true, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, conn)
 
@@ -224,6 +234,76 @@ func TestMenderShellCommand(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestMenderShellCommandDenied(t *testing.T) {
+	policy, err := shell.NewCommandPolicy(nil, []string{`^reboot\b`})
+	assert.NoError(t, err)
+	buffer := &bytes.Buffer{}
+	s := &MenderShellSession{
+		id:            "denied-session-id",
+		writer:        buffer,
+		commandFilter: shell.NewCommandFilter(policy),
+	}
+
+	err = s.ShellCommand(&ws.ProtoMsg{Body: []byte("reboot -f\n")})
+	assert.Equal(t, shell.ErrCommandDenied, err)
+	err = s.ShellCommand(&ws.ProtoMsg{Body: []byte("uptime\n")})
+	assert.NoError(t, err)
+	assert.Equal(t, "reboot -f\x03uptime\n", buffer.String())
+}
+
+func TestMenderShellCommandListener(t *testing.T) {
+	type entered struct {
+		sessionID   string
+		commandLine string
+	}
+	var lines []entered
+	AddCommandListener(func(s *MenderShellSession, commandLine string, denied bool) {
+		assert.False(t, denied)
+		lines = append(lines, entered{sessionID: s.GetId(), commandLine: commandLine})
+	})
+	defer func() {
+		commandListeners = []CommandListener{}
+	}()
+
+	MaxUserSessions = 2
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+
+	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
+	defer server.Close()
+	u := "ws" + strings.TrimPrefix(server.URL, "http")
+	connectionmanager.Reconnect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	defer connectionmanager.Close(ws.ProtoTypeShell)
+
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	s, err := NewMenderShellSession(uuid.NewV4().String(), uuid.NewV4().String(), defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	defer s.StopShell()
+
+	err = s.ShellCommand(&ws.ProtoMsg{Body: []byte("echo one\n\necho two\n")})
+	assert.NoError(t, err)
+	assert.Equal(t, []entered{
+		{sessionID: s.GetId(), commandLine: "echo one"},
+		{sessionID: s.GetId(), commandLine: "echo two"},
+	}, lines)
+}
+
 func TestMenderShellShellAlreadyStartedFailedToStart(t *testing.T) {
 	MaxUserSessions = 2
 	t.Log("starting mock httpd with websockets")
@@ -237,7 +317,7 @@ func TestMenderShellShellAlreadyStartedFailedToStart(t *testing.T) {
 
 	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, 16*time.Second, true, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
@@ -329,7 +409,7 @@ func TestMenderShellSessionExpire(t *testing.T) {
 
 	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, 16*time.Second, true, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
@@ -359,7 +439,7 @@ func TestMenderShellSessionUpdateWS(t *testing.T) {
 
 	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, 16*time.Second, true, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
@@ -386,7 +466,7 @@ func TestMenderShellSessionGetByUserId(t *testing.T) {
 
 	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, 16*time.Second, true, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
@@ -431,7 +511,7 @@ func TestMenderShellSessionGetById(t *testing.T) {
 
 	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, 16*time.Second, true, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
@@ -487,7 +567,7 @@ func TestMenderShellDeleteById(t *testing.T) {
 
 	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, 16*time.Second, true, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
@@ -562,7 +642,7 @@ func TestMenderShellNewMenderShellSession(t *testing.T) {
 
 	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, 16*time.Second, true, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
@@ -591,6 +671,562 @@ func TestMenderShellNewMenderShellSession(t *testing.T) {
 	assert.ElementsMatch(t, createdSessonsIds, sessionsIds)
 }
 
+func TestMenderShellSessionsRateAlert(t *testing.T) {
+	defer func() {
+		SessionsPerHourAlertThreshold = 0
+		sessionsCreatedAt = []time.Time{}
+	}()
+
+	now := timeNow()
+	SessionsPerHourAlertThreshold = 0
+	assert.False(t, sessionsRateAlert(now))
+
+	SessionsPerHourAlertThreshold = 2
+	sessionsCreatedAt = []time.Time{}
+	assert.False(t, sessionsRateAlert(now.Add(-2*time.Hour)))
+	assert.False(t, sessionsRateAlert(now.Add(-30*time.Minute)))
+	assert.False(t, sessionsRateAlert(now.Add(-10*time.Minute)))
+	assert.True(t, sessionsRateAlert(now))
+	assert.Equal(t, 3, len(sessionsCreatedAt))
+
+	notifier := &recordingNotifier{}
+	notify.SetNotifier(notifier)
+	defer notify.SetNotifier(nil)
+	assert.True(t, sessionsRateAlert(now))
+	if assert.Len(t, notifier.notifications, 1) {
+		assert.Equal(t, notify.KindSessionsRate, notifier.notifications[0].Kind)
+		assert.Equal(t, 4, notifier.notifications[0].Details["sessions"])
+	}
+}
+
+type recordingNotifier struct {
+	notifications []*notify.Notification
+}
+
+func (r *recordingNotifier) Notify(sessionID string, n *notify.Notification) error {
+	r.notifications = append(r.notifications, n)
+	return nil
+}
+
+func TestMenderShellNewMenderShellSessionLimit(t *testing.T) {
+	defer func() {
+		MaxSessions = 0
+		MaxSessionsEvictOldestIdle = false
+	}()
+	MaxUserSessions = 2
+	MaxSessions = 2
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+
+	s0, err := NewMenderShellSession(uuid.NewV4().String(), uuid.NewV4().String(), defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	s0.activeAt = timeNow().Add(-time.Minute)
+	s1, err := NewMenderShellSession(uuid.NewV4().String(), uuid.NewV4().String(), defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	s1.activeAt = timeNow()
+
+	s, err := NewMenderShellSession(uuid.NewV4().String(), uuid.NewV4().String(), defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.Equal(t, ErrSessionTooManySessions, err)
+	assert.Nil(t, s)
+	assert.Equal(t, 2, MenderShellSessionGetCount())
+
+	MaxSessionsEvictOldestIdle = true
+	s, err = NewMenderShellSession(uuid.NewV4().String(), uuid.NewV4().String(), defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	assert.NotNil(t, s)
+	assert.Equal(t, 2, MenderShellSessionGetCount())
+	assert.Nil(t, MenderShellSessionGetById(s0.GetId()))
+	assert.NotNil(t, MenderShellSessionGetById(s1.GetId()))
+}
+
+func TestMenderShellStartShellUserLimit(t *testing.T) {
+	defer func() {
+		MaxUserShells = 0
+	}()
+	MaxUserSessions = 3
+	MaxUserShells = 1
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+
+	userId := uuid.NewV4().String()
+	s0, err := NewMenderShellSession(uuid.NewV4().String(), userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	s1, err := NewMenderShellSession(uuid.NewV4().String(), userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, userShellsRunning(userId))
+
+	s0.status = ActiveSession
+	assert.Equal(t, 1, userShellsRunning(userId))
+	err = s1.StartShell(s1.GetSessionId(), MenderShellTerminalSettings{})
+	assert.Equal(t, ErrSessionTooManyShellsPerUser, err)
+	assert.Equal(t, NewSession, s1.status)
+
+	s0.status = HangedSession
+	err = s1.StartShell(s1.GetSessionId(), MenderShellTerminalSettings{})
+	assert.Equal(t, ErrSessionTooManyShellsPerUser, err)
+
+	assert.Equal(t, 0, userShellsRunning(uuid.NewV4().String()))
+}
+
+func TestMenderShellSessionStreamsLimit(t *testing.T) {
+	defer func() {
+		MaxSessionStreams = 0
+	}()
+	MaxUserSessions = 2
+	MaxSessionStreams = 2
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+
+	userId := uuid.NewV4().String()
+	_, err := NewMenderShellSession("limited-session-id", userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	stream, err := NewMenderShellSessionStream("limited-session-id", "stream-1", userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	_, err = NewMenderShellSessionStream("limited-session-id", "stream-2", userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.Equal(t, ErrSessionTooManyStreams, err)
+
+	// the limit is per session
+	_, err = NewMenderShellSessionStream("other-session-id", "stream-1", userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+
+	// closing a terminal makes room for another one
+	assert.NoError(t, MenderShellDeleteById(stream.GetId()))
+	_, err = NewMenderShellSessionStream("limited-session-id", "stream-2", userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	assert.Len(t, MenderShellSessionGetStreams("limited-session-id"), 2)
+}
+
+func TestExitProperties(t *testing.T) {
+	exited := exec.Command("/bin/sh", "-c", "exit 3")
+	_ = exited.Run()
+	killed := exec.Command("/bin/sh", "-c", "kill -KILL $$")
+	_ = killed.Run()
+
+	testCases := map[string]struct {
+		state      *os.ProcessState
+		properties map[string]interface{}
+	}{
+		"exited": {
+			state:      exited.ProcessState,
+			properties: map[string]interface{}{PropertyExitCode: 3},
+		},
+		"killed": {
+			state:      killed.ProcessState,
+			properties: map[string]interface{}{PropertyExitSignal: "SIGKILL"},
+		},
+		"not reaped": {
+			properties: map[string]interface{}{},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.properties, exitProperties(tc.state))
+		})
+	}
+}
+
+func TestMenderShellShellExited(t *testing.T) {
+	MaxUserSessions = 2
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+
+	stopMessages := make(chan *ws.ProtoMsg, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrader = websocket.Upgrader{}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg := &ws.ProtoMsg{}
+			if msgpack.Unmarshal(data, msg) == nil && msg.Header.MsgType == wsshell.MessageTypeStopShell {
+				stopMessages <- msg
+			}
+		}
+	}))
+	defer server.Close()
+	u := "ws" + strings.TrimPrefix(server.URL, "http")
+	connectionmanager.Reconnect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	defer connectionmanager.Close(ws.ProtoTypeShell)
+
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	s, err := NewMenderShellSessionStream(uuid.NewV4().String(), "exit-stream-id", uuid.NewV4().String(),
+		defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, s.ShellCommand(&ws.ProtoMsg{Body: []byte("exit 7\n")}))
+
+	select {
+	case msg := <-stopMessages:
+		assert.Equal(t, s.GetSessionId(), msg.Header.SessionID)
+		assert.Equal(t, "exit-stream-id", msg.Header.Properties[PropertyStreamID])
+		assert.Equal(t, string(CloseReasonShellExit), msg.Header.Properties[PropertyCloseReason])
+		assert.EqualValues(t, 7, msg.Header.Properties[PropertyExitCode])
+	case <-time.After(10 * time.Second):
+		t.Fatal("the stop message was not sent")
+	}
+	assert.Equal(t, EmptySession, s.status)
+	assert.Equal(t, CloseReasonShellExit, s.GetCloseReason())
+	assert.Equal(t, ErrSessionShellNotRunning, s.StopShell())
+}
+
+func TestMenderShellOutputLimit(t *testing.T) {
+	MaxOutputBytesPerSecond = 1000
+	defer func() {
+		MaxOutputBytesPerSecond = 0
+	}()
+
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	messages := make(chan *ws.ProtoMsg, 1024)
+	s := NewDebugSession("output-limit-session", "output-limit-user", func(msg *ws.ProtoMsg) error {
+		messages <- msg
+		return nil
+	})
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, s.ShellCommand(&ws.ProtoMsg{Body: []byte("yes | head -c 100000; sleep 1; echo done; exit\n")}))
+
+	var output bytes.Buffer
+	for stopped := false; !stopped; {
+		select {
+		case msg := <-messages:
+			if msg.Header.MsgType == wsshell.MessageTypeStopShell {
+				stopped = true
+			} else {
+				output.Write(msg.Body)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("the shell did not exit")
+		}
+	}
+	assert.Less(t, output.Len(), 10000)
+	assert.Contains(t, output.String(), "[output rate limit exceeded, dropping output]")
+	assert.Regexp(t, `\[output rate limit exceeded, \d+ bytes dropped\]\r\n(.|\s)*done`, output.String())
+}
+
+func TestMenderShellWarnShellIdle(t *testing.T) {
+	defer func() {
+		ShellIdleTimeout = NoExpirationTimeout
+		ShellIdleWarning = 0
+		ShellIdleWarningText = ""
+	}()
+
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	messages := make(chan *ws.ProtoMsg, 1024)
+	s := NewDebugSession("idle-warning-session", "idle-warning-user", func(msg *ws.ProtoMsg) error {
+		messages <- msg
+		return nil
+	})
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	defer s.StopShell()
+	// let the prompt, which is terminal output, be sent
+	time.Sleep(500 * time.Millisecond)
+
+	ShellIdleTimeout = 5 * time.Minute
+	warned, err := s.WarnShellIdle()
+	assert.NoError(t, err)
+	assert.False(t, warned)
+
+	ShellIdleWarning = time.Minute
+	s.setTerminalActiveAt(timeNow().Add(-4*time.Minute - 30*time.Second))
+	warned, err = s.WarnShellIdle()
+	assert.NoError(t, err)
+	assert.True(t, warned)
+	// once per idle period
+	warned, err = s.WarnShellIdle()
+	assert.NoError(t, err)
+	assert.False(t, warned)
+	assert.True(t, s.isIdleWarned())
+
+	var warning *ws.ProtoMsg
+	for warning == nil {
+		select {
+		case msg := <-messages:
+			if strings.Contains(string(msg.Body), "inactivity") {
+				warning = msg
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the idle warning was not sent")
+		}
+	}
+	assert.Equal(t, wsshell.MessageTypeShellCommand, warning.Header.MsgType)
+	assert.Equal(t, "\r\nthe session will close in 30s due to inactivity, press any key to keep it open\r\n",
+		string(warning.Body))
+	// the warning is not terminal activity
+	assert.True(t, s.isShellIdleFor(4*time.Minute))
+
+	// activity clears the warning
+	ShellIdleWarningText = "closing soon"
+	s.setTerminalActiveAt(timeNow())
+	assert.False(t, s.isIdleWarned())
+	s.setTerminalActiveAt(timeNow().Add(-4*time.Minute - 30*time.Second))
+	warned, err = s.WarnShellIdle()
+	assert.NoError(t, err)
+	assert.True(t, warned)
+}
+
+func TestMenderShellHangUpIdleShells(t *testing.T) {
+	defer func() {
+		ShellIdleTimeout = NoExpirationTimeout
+	}()
+	MaxUserSessions = 2
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+
+	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
+	defer server.Close()
+	u := "ws" + strings.TrimPrefix(server.URL, "http")
+	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	s, err := NewMenderShellSession(uuid.NewV4().String(), uuid.NewV4().String(), defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	pid := s.GetShellPid()
+
+	assert.False(t, s.IsShellIdle())
+	ShellIdleTimeout = time.Minute
+	assert.False(t, s.IsShellIdle())
+	count, err := MenderSessionHangUpIdleShells()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	s.setTerminalActiveAt(timeNow().Add(-2 * time.Minute))
+	assert.True(t, s.IsShellIdle())
+	count, err = MenderSessionHangUpIdleShells()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.False(t, procps.ProcessExists(pid))
+	assert.Equal(t, EmptySession, s.GetStatus())
+	assert.Equal(t, CloseReasonShellIdle, s.GetCloseReason())
+	assert.False(t, s.IsShellIdle())
+
+	// the session stays open
+	assert.NotNil(t, MenderShellSessionGetById(s.GetId()))
+	connectionmanager.Close(ws.ProtoTypeShell)
+}
+
+func TestMenderShellResizeShell(t *testing.T) {
+	MaxUserSessions = 2
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+
+	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
+	defer server.Close()
+	u := "ws" + strings.TrimPrefix(server.URL, "http")
+	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	defer connectionmanager.Close(ws.ProtoTypeShell)
+
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	s, err := NewMenderShellSession(uuid.NewV4().String(), uuid.NewV4().String(), defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	err = s.ResizeShell(40, 80)
+	assert.Equal(t, ErrSessionShellNotRunning, err)
+
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	defer s.StopShell()
+
+	err = s.ResizeShell(50, 132)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(50), s.terminal.Height)
+	assert.Equal(t, uint16(132), s.terminal.Width)
+	rows, cols, err := pty.Getsize(s.pseudoTTY)
+	assert.NoError(t, err)
+	assert.Equal(t, 50, rows)
+	assert.Equal(t, 132, cols)
+}
+
+func TestMenderShellStartShellCgroupError(t *testing.T) {
+	root, err := ioutil.TempDir("", "TestMenderShellStartShellCgroupError")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	assert.NoError(t, ioutil.WriteFile(path.Join(root, "cgroup.subtree_control"), []byte{}, 0644))
+
+	Cgroups, err = cgroup.NewHierarchy(root, cgroup.Limits{PidsMax: 16})
+	assert.NoError(t, err)
+	defer func() {
+		Cgroups = nil
+	}()
+
+	MaxUserSessions = 2
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	// the fake cgroup lacks the interface files, the shell must not
+	// run outside of it
+	s, err := NewMenderShellSession(uuid.NewV4().String(), uuid.NewV4().String(), defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+	})
+	assert.Error(t, err)
+	assert.Equal(t, NewSession, s.GetStatus())
+	assert.Nil(t, s.cgroup)
+}
+
+func TestMenderShellStartShellBanner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMenderShellStartShellBanner")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	RecordingsDir = dir
+	defer func() {
+		RecordingsDir = ""
+	}()
+
+	MaxUserSessions = 2
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+
+	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
+	defer server.Close()
+	u := "ws" + strings.TrimPrefix(server.URL, "http")
+	connectionmanager.Reconnect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	defer connectionmanager.Close(ws.ProtoTypeShell)
+
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	s, err := NewMenderShellSession(uuid.NewV4().String(), uuid.NewV4().String(), defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+		Banner:         "Authorized use only\r\n",
+	})
+	assert.NoError(t, err)
+	s.StopShell()
+
+	data, err := ioutil.ReadFile(s.GetRecordingPath())
+	assert.NoError(t, err)
+	lines := strings.Split(string(data), "\n")
+	if assert.True(t, len(lines) > 1) {
+		assert.Contains(t, lines[1], `"Authorized use only\r\n"`)
+	}
+}
+
+func TestMenderShellSessionStats(t *testing.T) {
+	s := &MenderShellSession{}
+	assert.Empty(t, s.Stats())
+
+	m := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto: ws.ProtoTypeShell,
+		},
+		Body: []byte("ls -al\n"),
+	}
+	s.RecordMessageReceived(m)
+	s.RecordMessageReceived(m)
+	s.RecordMessageSent(m)
+
+	stats := s.Stats()
+	assert.Equal(t, MenderShellSessionProtoStats{
+		MessagesReceived: 2,
+		BytesReceived:    14,
+		MessagesSent:     1,
+		BytesSent:        7,
+	}, stats[ws.ProtoTypeShell])
+}
+
 func TestMenderSessionTerminateExpired(t *testing.T) {
 	defaultSessionExpiredTimeout = 8 * time.Second
 	sessionsMap = map[string]*MenderShellSession{}
@@ -606,7 +1242,7 @@ func TestMenderSessionTerminateExpired(t *testing.T) {
 
 	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, 16*time.Second, true, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
@@ -658,7 +1294,7 @@ func TestMenderSessionTerminateAll(t *testing.T) {
 
 	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, 16*time.Second, true, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
@@ -694,9 +1330,11 @@ func TestMenderSessionTerminateAll(t *testing.T) {
 	})
 	assert.NoError(t, err)
 
-	MenderSessionTerminateAll()
+	MenderSessionTerminateAll(CloseReasonShutdown)
 	assert.True(t, !procps.ProcessExists(s0.shellPid))
 	assert.True(t, !procps.ProcessExists(s1.shellPid))
+	assert.Equal(t, CloseReasonShutdown, s0.GetCloseReason())
+	assert.Equal(t, CloseReasonShutdown, s1.GetCloseReason())
 }
 
 func TestMenderSessionTerminateIdle(t *testing.T) {
@@ -715,7 +1353,7 @@ func TestMenderSessionTerminateIdle(t *testing.T) {
 
 	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, 16*time.Second, true, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
@@ -757,8 +1395,191 @@ func TestMenderSessionTerminateIdle(t *testing.T) {
 	assert.Equal(t, 1, sessions)
 	assert.Equal(t, 0, total)
 	assert.True(t, !procps.ProcessExists(s.shellPid))
+	assert.Equal(t, CloseReasonIdleTimeout, s.GetCloseReason())
 }
 
 func TestMenderSessionTimeNow(t *testing.T) {
 	assert.Equal(t, timeNow().Format(defaultTimeFormat), time.Now().UTC().Format(defaultTimeFormat))
 }
+
+func TestMenderShellSessionHooks(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	defer func() {
+		Hooks = map[string]string{}
+	}()
+
+	output := path.Join(tdir, "events")
+	script := path.Join(tdir, "hook.sh")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\n"+
+		"echo \"$1 $MENDER_CONNECT_SESSION_ID $MENDER_CONNECT_USER_ID $MENDER_CONNECT_PROTOCOL\" >> "+
+		output+"\n"), 0755)
+	assert.NoError(t, err)
+	Hooks = map[string]string{
+		HookEventSessionOpen:  script,
+		HookEventSessionClose: script,
+	}
+
+	MaxUserSessions = 2
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+	s, err := NewMenderShellSession("session-id", "user-id", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		data, _ := ioutil.ReadFile(output)
+		return string(data) == "session-open session-id user-id 1\n"
+	}, 5*time.Second, 100*time.Millisecond)
+
+	assert.NoError(t, MenderShellDeleteById(s.GetId()))
+	assert.Eventually(t, func() bool {
+		data, _ := ioutil.ReadFile(output)
+		return string(data) == "session-open session-id user-id 1\n"+
+			"session-close session-id user-id 1\n"
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestMenderShellSessionEventListeners(t *testing.T) {
+	var first, second []string
+	removeFirst := AddEventListener(func(event string, s *MenderShellSession, proto ws.ProtoType) {
+		first = append(first, event)
+	})
+	removeSecond := AddEventListener(func(event string, s *MenderShellSession, proto ws.ProtoType) {
+		second = append(second, event)
+	})
+	defer removeSecond()
+
+	s := &MenderShellSession{id: "session-id"}
+	lifecycleEvent(HookEventSessionOpen, s, ws.ProtoTypeShell)
+	removeFirst()
+	removeFirst()
+	lifecycleEvent(HookEventSessionClose, s, ws.ProtoTypeShell)
+	assert.Equal(t, []string{HookEventSessionOpen}, first)
+	assert.Equal(t, []string{HookEventSessionOpen, HookEventSessionClose}, second)
+}
+
+func TestMenderShellSessionStreams(t *testing.T) {
+	MaxUserSessions = 1
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+
+	assert.Equal(t, "session-id", StreamKey("session-id", ""))
+	assert.Equal(t, "session-id/stream-id", StreamKey("session-id", "stream-id"))
+
+	s, err := NewMenderShellSession("session-id", "user-id", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	assert.Equal(t, "session-id", s.GetId())
+
+	stream, err := NewMenderShellSessionStream("session-id", "stream-id", "user-id", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	assert.Equal(t, "session-id/stream-id", stream.GetId())
+	assert.Equal(t, "session-id", stream.GetSessionId())
+	assert.Equal(t, "stream-id", stream.GetStreamId())
+	assert.Equal(t, stream, MenderShellSessionGetById(StreamKey("session-id", "stream-id")))
+	assert.Len(t, MenderShellSessionGetStreams("session-id"), 2)
+
+	_, err = NewMenderShellSessionStream("other-session-id", "stream-id", "user-id", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.Equal(t, ErrSessionShellTooManySessionsPerUser, err)
+
+	assert.NoError(t, MenderShellDeleteById(stream.GetId()))
+	assert.Len(t, MenderShellSessionGetStreams("session-id"), 1)
+}
+
+func TestMenderShellSessionLogger(t *testing.T) {
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+
+	s, err := NewMenderShellSessionStream("session-id", "stream-id", "user-id", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	assert.Equal(t, log.Fields{
+		"session_id": "session-id",
+		"stream_id":  "stream-id",
+		"user_id":    "user-id",
+		"protocol":   ws.ProtoTypeShell,
+	}, s.Logger().Data)
+
+	s = &MenderShellSession{sessionId: "session-id", userId: "user-id"}
+	assert.Equal(t, log.Fields{
+		"session_id": "session-id",
+		"user_id":    "user-id",
+		"protocol":   ws.ProtoTypeShell,
+	}, s.Logger().Data)
+}
+
+func TestRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRecording")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r, err := newRecording(path.Join(dir, "recordings"), "recording-session-id", MenderShellTerminalSettings{
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, path.Join(dir, "recordings", "recording-session-id.cast"), r.path)
+	assert.NoError(t, r.writeOutput([]byte("$ ls\r\n")))
+	assert.NoError(t, r.writeResize(24, 100))
+	assert.NoError(t, r.close())
+	assert.NoError(t, r.writeOutput([]byte("after close")))
+	assert.NoError(t, r.close())
+
+	data, err := ioutil.ReadFile(r.path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Len(t, lines, 3) {
+		var header recordingHeader
+		assert.NoError(t, json.Unmarshal([]byte(lines[0]), &header))
+		assert.Equal(t, 2, header.Version)
+		assert.Equal(t, uint16(80), header.Width)
+		assert.Equal(t, uint16(40), header.Height)
+		assert.Equal(t, "xterm-256color", header.Env["TERM"])
+
+		var event []interface{}
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &event))
+		if assert.Len(t, event, 3) {
+			assert.Equal(t, "o", event[1])
+			assert.Equal(t, "$ ls\r\n", event[2])
+		}
+		assert.NoError(t, json.Unmarshal([]byte(lines[2]), &event))
+		if assert.Len(t, event, 3) {
+			assert.Equal(t, "r", event[1])
+			assert.Equal(t, "100x24", event[2])
+		}
+	}
+}
+
+func TestRecordMessageSentRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRecordMessageSentRecording")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r, err := newRecording(dir, "recorded", MenderShellTerminalSettings{})
+	assert.NoError(t, err)
+	s := &MenderShellSession{
+		id:        "recorded",
+		recording: r,
+	}
+	assert.Equal(t, path.Join(dir, "recorded.cast"), s.GetRecordingPath())
+	s.RecordMessageSent(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:   ws.ProtoTypeShell,
+			MsgType: wsshell.MessageTypeShellCommand,
+		},
+		Body: []byte("output"),
+	})
+	s.RecordMessageSent(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:   ws.ProtoTypeShell,
+			MsgType: wsshell.MessageTypeStopShell,
+		},
+	})
+	assert.NoError(t, r.close())
+
+	data, err := ioutil.ReadFile(s.GetRecordingPath())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "\n"))
+	assert.Contains(t, string(data), `"output"`)
+	assert.Equal(t, "", (&MenderShellSession{}).GetRecordingPath())
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"errors"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+
+	"github.com/mendersoftware/mender-connect/shell"
+)
+
+var (
+	ErrSessionReadOnly         = errors.New("the terminal is read-only for its observers")
+	ErrSessionObserving        = errors.New("the session is observing a terminal already")
+	ErrSessionTooManyObservers = errors.New("the terminal has too many observers")
+)
+
+// maximum number of observers of a terminal, 0 means no limit
+var MaxObservers = 0
+
+// sessions whose terminals are observed, keyed by the key of the observer
+// (see StreamKey)
+var observedMap = map[string]*MenderShellSession{}
+
+// MenderShellSessionGetObserved returns the session whose terminal the
+// session or stream id observes, nil if it observes none
+func MenderShellSessionGetObserved(id string) *MenderShellSession {
+	return observedMap[id]
+}
+
+// AddObserver sends a copy of the terminal output to the stream streamId
+// of the session sessionId of userId, which may not write to the
+// terminal; the operator of the terminal is told it is watched
+func (s *MenderShellSession) AddObserver(sessionId string, streamId string, userId string) error {
+	if !s.shellRunning() {
+		return ErrSessionShellNotRunning
+	}
+	key := StreamKey(sessionId, streamId)
+	if _, ok := observedMap[key]; ok {
+		return ErrSessionObserving
+	}
+	if _, ok := sessionsMap[key]; ok {
+		return ErrSessionShellAlreadyRunning
+	}
+	if MaxObservers > 0 && len(s.shell.Observers()) >= MaxObservers {
+		return ErrSessionTooManyObservers
+	}
+	observedMap[key] = s
+	s.shell.AddObserver(shell.Peer{SessionId: sessionId, StreamId: streamId})
+	s.Logger().Infof("session %s of user %s is observing the terminal", key, userId)
+	_ = s.writeNotice(shell.Peer{SessionId: s.sessionId, StreamId: s.streamId},
+		userId+" is watching the terminal")
+	return nil
+}
+
+// RemoveObserver stops sending the terminal output to the observer
+func (s *MenderShellSession) RemoveObserver(sessionId string, streamId string) error {
+	key := StreamKey(sessionId, streamId)
+	if observedMap[key] != s {
+		return ErrSessionNotFound
+	}
+	delete(observedMap, key)
+	s.shell.RemoveObserver(shell.Peer{SessionId: sessionId, StreamId: streamId})
+	s.Logger().Infof("session %s stopped observing the terminal", key)
+	return nil
+}
+
+// closeObservers tells the observers the terminal is gone and forgets them
+func (s *MenderShellSession) closeObservers(reason MenderSessionCloseReason) {
+	for _, observer := range s.shell.Observers() {
+		s.shell.RemoveObserver(observer)
+		delete(observedMap, StreamKey(observer.SessionId, observer.StreamId))
+		s.sendCloseMessageTo(observer, reason)
+	}
+}
+
+// writeNotice writes a notice to the terminal of the peer only, it does
+// not count as terminal output
+func (s *MenderShellSession) writeNotice(peer shell.Peer, text string) error {
+	msg := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeShellCommand,
+			SessionID: peer.SessionId,
+			Properties: map[string]interface{}{
+				"status": wsshell.NormalMessage,
+			},
+		},
+		Body: []byte("\r\n[" + text + "]\r\n"),
+	}
+	if peer.StreamId != "" {
+		msg.Header.Properties[PropertyStreamID] = peer.StreamId
+	}
+	return s.writeMessage(msg)
+}
+
+// TakeOver moves the running terminal of the session, or stream, id to
+// the stream streamId of the session sessionId of userId, e.g. for a
+// senior engineer to take over a support case. The former operator is
+// told and, if observe is set, keeps watching the terminal read-only;
+// otherwise its terminal is closed. The session keeps its shell, settings
+// and limits, it only changes hands.
+func TakeOver(id string, sessionId string, streamId string, userId string, observe bool) (*MenderShellSession, error) {
+	s := sessionsMap[id]
+	if s == nil {
+		return nil, ErrSessionNotFound
+	}
+	if !s.shellRunning() {
+		return nil, ErrSessionShellNotRunning
+	}
+	key := StreamKey(sessionId, streamId)
+	if _, ok := sessionsMap[key]; ok {
+		return nil, ErrSessionShellAlreadyRunning
+	}
+	if _, ok := observedMap[key]; ok {
+		return nil, ErrSessionObserving
+	}
+	if err := checkAdoptLimits(s, sessionId, userId); err != nil {
+		return nil, err
+	}
+
+	former := shell.Peer{SessionId: s.sessionId, StreamId: s.streamId}
+	s.Logger().Infof("the terminal is taken over by session %s of user %s", key, userId)
+	userSessions := sessionsByUserIdMap[s.userId]
+	for i, userSession := range userSessions {
+		if userSession == s {
+			sessionsByUserIdMap[s.userId] = append(userSessions[:i], userSessions[i+1:]...)
+			break
+		}
+	}
+	delete(sessionsMap, s.id)
+
+	s.statusMutex.Lock()
+	s.id = key
+	s.sessionId = sessionId
+	s.streamId = streamId
+	s.userId = userId
+	s.logger = NewLogger(sessionId, streamId, userId, ws.ProtoTypeShell)
+	s.statusMutex.Unlock()
+	s.activeAt = timeNow()
+	s.shell.SetPeer(sessionId, streamId)
+	sessionsMap[key] = s
+	sessionsByUserIdMap[userId] = append(sessionsByUserIdMap[userId], s)
+
+	if observe {
+		_ = s.writeNotice(former, "the terminal was taken over by "+userId+", it is read-only now")
+		observedMap[StreamKey(former.SessionId, former.StreamId)] = s
+		s.shell.AddObserver(former)
+	} else {
+		_ = s.writeNotice(former, "the terminal was taken over by "+userId)
+		s.sendCloseMessageTo(former, CloseReasonTakeover)
+	}
+	lifecycleEvent(HookEventSessionTakeover, s, ws.ProtoTypeShell)
+	return s, nil
+}
+
+// checkAdoptLimits tells if userId may adopt the shell of s in the session
+// sessionId within MaxUserSessions and MaxUserShells, the way it may open
+// a session and start a shell
+func checkAdoptLimits(s *MenderShellSession, sessionId string, userId string) error {
+	sessionIds := map[string]bool{}
+	shells := 0
+	for _, userSession := range sessionsByUserIdMap[userId] {
+		if userSession == s {
+			continue
+		}
+		sessionIds[userSession.sessionId] = true
+		if userSession.shellRunning() {
+			shells++
+		}
+	}
+	if !sessionIds[sessionId] && len(sessionIds) >= MaxUserSessions {
+		return ErrSessionShellTooManySessionsPerUser
+	}
+	if MaxUserShells > 0 && shells >= MaxUserShells {
+		return ErrSessionTooManyShellsPerUser
+	}
+	return nil
+}
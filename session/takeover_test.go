@@ -0,0 +1,204 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/stretchr/testify/assert"
+)
+
+// peerMessages records the messages sent to the peers of the sessions
+type peerMessages struct {
+	mutex    sync.Mutex
+	messages []*ws.ProtoMsg
+}
+
+func (p *peerMessages) write(msg *ws.ProtoMsg) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// the shell reuses its read buffer for the bodies
+	copied := *msg
+	copied.Body = append([]byte(nil), msg.Body...)
+	p.messages = append(p.messages, &copied)
+	return nil
+}
+
+// of returns the bodies of the messages of the type sent to the session
+func (p *peerMessages) of(sessionId string, msgType string) string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	bodies := ""
+	for _, msg := range p.messages {
+		if msg.Header.SessionID == sessionId && msg.Header.MsgType == msgType {
+			bodies += string(msg.Body) + "|"
+		}
+	}
+	return bodies
+}
+
+func startTestShell(t *testing.T, sessionId string, userId string, messages *peerMessages) *MenderShellSession {
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	s, err := NewMenderShellSession(sessionId, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	s.write = messages.write
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	return s
+}
+
+func TestTakeOverDisconnect(t *testing.T) {
+	MaxUserSessions = 2
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+	messages := &peerMessages{}
+
+	s := startTestShell(t, "takeover-former", "junior", messages)
+	defer s.StopShell()
+	pid := s.GetShellPid()
+
+	_, err := TakeOver("takeover-missing", "takeover-new", "", "senior", false)
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	taken, err := TakeOver("takeover-former", "takeover-new", "", "senior", false)
+	assert.NoError(t, err)
+	assert.Equal(t, s, taken)
+	assert.Equal(t, pid, taken.GetShellPid())
+	assert.Equal(t, "takeover-new", taken.GetId())
+	assert.Equal(t, "senior", taken.GetUserId())
+	assert.Nil(t, MenderShellSessionGetById("takeover-former"))
+	assert.Equal(t, s, MenderShellSessionGetById("takeover-new"))
+	assert.Empty(t, MenderShellSessionsGetByUserId("junior"))
+	assert.Len(t, MenderShellSessionsGetByUserId("senior"), 1)
+	assert.Nil(t, MenderShellSessionGetObserved("takeover-former"))
+
+	assert.Contains(t, messages.of("takeover-former", wsshell.MessageTypeShellCommand),
+		"[the terminal was taken over by senior]")
+	assert.Equal(t, "|", messages.of("takeover-former", wsshell.MessageTypeStopShell))
+
+	// the terminal answers the new operator
+	assert.NoError(t, taken.ShellCommand(&ws.ProtoMsg{Body: []byte("echo taken-over\n")}))
+	time.Sleep(500 * time.Millisecond)
+	assert.Contains(t, messages.of("takeover-new", wsshell.MessageTypeShellCommand), "taken-over")
+
+	// a session with a terminal may not take over another one
+	_, err = TakeOver("takeover-new", "takeover-new", "", "senior", false)
+	assert.Equal(t, ErrSessionShellAlreadyRunning, err)
+}
+
+func TestTakeOverUserLimits(t *testing.T) {
+	MaxUserSessions = 1
+	defer func() {
+		MaxUserSessions = 2
+		MaxUserShells = 0
+	}()
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+	messages := &peerMessages{}
+
+	s := startTestShell(t, "limits-former", "junior", messages)
+	defer s.StopShell()
+	own := startTestShell(t, "limits-own", "senior", messages)
+	defer own.StopShell()
+
+	_, err := TakeOver("limits-former", "limits-new", "", "senior", false)
+	assert.Equal(t, ErrSessionShellTooManySessionsPerUser, err)
+
+	MaxUserSessions = 2
+	MaxUserShells = 1
+	_, err = TakeOver("limits-former", "limits-new", "", "senior", false)
+	assert.Equal(t, ErrSessionTooManyShellsPerUser, err)
+	assert.Equal(t, s, MenderShellSessionGetById("limits-former"))
+
+	MaxUserShells = 2
+	_, err = TakeOver("limits-former", "limits-new", "", "senior", false)
+	assert.NoError(t, err)
+}
+
+func TestTakeOverObserve(t *testing.T) {
+	MaxUserSessions = 2
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+	messages := &peerMessages{}
+
+	s := startTestShell(t, "observe-former", "junior", messages)
+	taken, err := TakeOver("observe-former", "observe-new", "", "senior", true)
+	assert.NoError(t, err)
+	assert.Equal(t, taken, MenderShellSessionGetObserved("observe-former"))
+	assert.Contains(t, messages.of("observe-former", wsshell.MessageTypeShellCommand),
+		"[the terminal was taken over by senior, it is read-only now]")
+	assert.Empty(t, messages.of("observe-former", wsshell.MessageTypeStopShell))
+
+	// the output reaches both
+	assert.NoError(t, taken.ShellCommand(&ws.ProtoMsg{Body: []byte("echo observed\n")}))
+	time.Sleep(500 * time.Millisecond)
+	assert.Contains(t, messages.of("observe-new", wsshell.MessageTypeShellCommand), "observed")
+	assert.Equal(t, strings.Count(messages.of("observe-new", wsshell.MessageTypeShellCommand), "observed"),
+		strings.Count(messages.of("observe-former", wsshell.MessageTypeShellCommand), "observed"))
+
+	// the observers are closed with the terminal
+	assert.NoError(t, s.StopShell())
+	assert.Nil(t, MenderShellSessionGetObserved("observe-former"))
+	assert.Equal(t, "|", messages.of("observe-former", wsshell.MessageTypeStopShell))
+}
+
+func TestAddObserver(t *testing.T) {
+	MaxUserSessions = 2
+	MaxObservers = 1
+	defer func() {
+		MaxObservers = 0
+	}()
+	sessionsMap = map[string]*MenderShellSession{}
+	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+	messages := &peerMessages{}
+
+	s := startTestShell(t, "observed-session", "junior", messages)
+	assert.NoError(t, s.AddObserver("observer-session", "", "senior"))
+	assert.Equal(t, s, MenderShellSessionGetObserved("observer-session"))
+	assert.Contains(t, messages.of("observed-session", wsshell.MessageTypeShellCommand),
+		"[senior is watching the terminal]")
+
+	assert.Equal(t, ErrSessionObserving, s.AddObserver("observer-session", "", "senior"))
+	assert.Equal(t, ErrSessionTooManyObservers, s.AddObserver("another-observer", "", "lead"))
+	assert.Equal(t, ErrSessionShellAlreadyRunning, s.AddObserver("observed-session", "", "junior"))
+
+	assert.NoError(t, s.ShellCommand(&ws.ProtoMsg{Body: []byte("echo watched\n")}))
+	time.Sleep(500 * time.Millisecond)
+	assert.Contains(t, messages.of("observer-session", wsshell.MessageTypeShellCommand), "watched")
+
+	assert.NoError(t, s.RemoveObserver("observer-session", ""))
+	assert.Equal(t, ErrSessionNotFound, s.RemoveObserver("observer-session", ""))
+	assert.Nil(t, MenderShellSessionGetObserved("observer-session"))
+
+	assert.NoError(t, s.StopShell())
+	assert.Empty(t, messages.of("observer-session", wsshell.MessageTypeStopShell))
+}
@@ -16,7 +16,10 @@ package shell
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
@@ -24,19 +27,48 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/mendersoftware/mender-connect/connectionmanager"
+	"github.com/mendersoftware/mender-connect/limits"
 )
 
 var (
 	ErrExecWriteBytesShort = errors.New("failed to write the whole message")
+	ErrTerminalClosed      = errors.New("the terminal is closed")
 )
 
 const pipStdoutBufferSize = 255
 
+// Peer is a session, and stream within it, the messages of the shell are
+// sent to
+type Peer struct {
+	SessionId string
+	StreamId  string
+}
+
 type MenderShell struct {
 	sessionId string
 	r         io.Reader
 	w         io.Writer
-	running   bool
+	// set while the output of the shell is passed to the peer, accessed
+	// atomically: the shell exiting stops it from the goroutine passing it
+	running int32
+	// stream of the session the shell belongs to, if any
+	streamId string
+	// peers getting a copy of the terminal output, without writing to it
+	observers []Peer
+	// guards the session and stream ids and the observers, which change
+	// when the terminal is taken over
+	peersMutex sync.Mutex
+	logger     *log.Entry
+	// called for every message sent to the peer, if set
+	messageSent func(m *ws.ProtoMsg)
+	// called when the output of the shell can no longer be read, if set
+	exited func(err error)
+	// writes the messages to the peer, the server connection by default
+	write func(msg *ws.ProtoMsg) error
+	// caps the bytes of output sent per second, nil means no limit
+	outputLimit *limits.TokenBucket
+	// bytes of output dropped since the limit was last exceeded
+	outputDropped int
 }
 
 //Create a new shell, note that we assume that r Reader and w Writer
@@ -48,26 +80,167 @@ func NewMenderShell(sessionId string, r io.Reader, w io.Writer) *MenderShell {
 		sessionId: sessionId,
 		r:         r,
 		w:         w,
-		running:   false,
+		running:   0,
 	}
 	return &shell
 }
 
+// OnMessageSent sets a callback invoked for every message the shell sends
+// to the peer; it must be set before Start
+func (s *MenderShell) OnMessageSent(callback func(m *ws.ProtoMsg)) {
+	s.messageSent = callback
+}
+
+// SetWriter sets the function writing the messages to the peer, instead
+// of the server connection; it must be set before Start
+func (s *MenderShell) SetWriter(write func(msg *ws.ProtoMsg) error) {
+	s.write = write
+}
+
+func (s *MenderShell) writeMessage(msg *ws.ProtoMsg) error {
+	if s.write != nil {
+		return s.write(msg)
+	}
+	return connectionmanager.Write(ws.ProtoTypeShell, msg)
+}
+
+// SetOutputLimit caps the output sent to bytesPerSecond, in bursts of at
+// most one second worth of output; the output above the limit is dropped
+// and the terminal shows how much of it was; it must be set before Start
+func (s *MenderShell) SetOutputLimit(bytesPerSecond uint64) {
+	s.outputLimit = limits.NewTokenBucket(bytesPerSecond, bytesPerSecond)
+}
+
+// limitOutput returns the part of data within the output limit, with the
+// indicators of the output dropped
+func (s *MenderShell) limitOutput(data []byte) []byte {
+	allowed := s.outputLimit.Take(len(data))
+	if allowed == len(data) && s.outputDropped == 0 {
+		return data
+	}
+	output := []byte{}
+	if s.outputDropped > 0 && allowed > 0 {
+		output = append(output, fmt.Sprintf("\r\n[output rate limit exceeded, %d bytes dropped]\r\n",
+			s.outputDropped)...)
+		s.outputDropped = 0
+	}
+	output = append(output, data[:allowed]...)
+	if allowed < len(data) {
+		if s.outputDropped == 0 {
+			output = append(output, "\r\n[output rate limit exceeded, dropping output]\r\n"...)
+		}
+		s.outputDropped += len(data) - allowed
+	}
+	return output
+}
+
+// OnExit sets a callback invoked when the output of the running shell can
+// no longer be read, i.e. the shell exited, instead of sending the error
+// stop message; it must be set before Start
+func (s *MenderShell) OnExit(callback func(err error)) {
+	s.exited = callback
+}
+
+// SetLogger sets the logger of the shell, e.g.: the one of the session;
+// it must be set before Start
+func (s *MenderShell) SetLogger(logger *log.Entry) {
+	s.logger = logger
+}
+
+// Logger returns the logger of the shell
+func (s *MenderShell) Logger() *log.Entry {
+	if s.logger == nil {
+		s.logger = log.WithField("session_id", s.sessionId)
+	}
+	return s.logger
+}
+
+// SetStreamId sets the stream id sent along with the messages; it must
+// be set before Start
+func (s *MenderShell) SetStreamId(streamId string) {
+	s.streamId = streamId
+}
+
+// SetPeer makes the shell send its messages to the stream streamId of
+// the session sessionId from now on, e.g. when the terminal is taken over
+func (s *MenderShell) SetPeer(sessionId string, streamId string) {
+	s.peersMutex.Lock()
+	defer s.peersMutex.Unlock()
+	s.sessionId = sessionId
+	s.streamId = streamId
+}
+
+// AddObserver sends a copy of the terminal output to the observer from
+// now on
+func (s *MenderShell) AddObserver(observer Peer) {
+	s.peersMutex.Lock()
+	defer s.peersMutex.Unlock()
+	s.observers = append(s.observers, observer)
+}
+
+// RemoveObserver stops sending the terminal output to the observer,
+// returning false if it was not observing the terminal
+func (s *MenderShell) RemoveObserver(observer Peer) bool {
+	s.peersMutex.Lock()
+	defer s.peersMutex.Unlock()
+	for i, o := range s.observers {
+		if o == observer {
+			s.observers = append(s.observers[:i], s.observers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Observers returns the peers observing the terminal
+func (s *MenderShell) Observers() []Peer {
+	s.peersMutex.Lock()
+	defer s.peersMutex.Unlock()
+	return append([]Peer{}, s.observers...)
+}
+
+// newMessage returns a shell message of the session and stream
+func (s *MenderShell) newMessage(msgType string, status wsshell.MenderShellMessageStatus, body []byte) *ws.ProtoMsg {
+	s.peersMutex.Lock()
+	peer := Peer{SessionId: s.sessionId, StreamId: s.streamId}
+	s.peersMutex.Unlock()
+	return newPeerMessage(peer, msgType, status, body)
+}
+
+// newPeerMessage returns a shell message of the peer
+func newPeerMessage(peer Peer, msgType string, status wsshell.MenderShellMessageStatus, body []byte) *ws.ProtoMsg {
+	msg := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   msgType,
+			SessionID: peer.SessionId,
+			Properties: map[string]interface{}{
+				"status": status,
+			},
+		},
+		Body: body,
+	}
+	if peer.StreamId != "" {
+		msg.Header.Properties["stream_id"] = peer.StreamId
+	}
+	return msg
+}
+
 func (s *MenderShell) GetWriteTimeout() time.Duration {
 	return connectionmanager.GetWriteTimeout()
 }
 
 func (s *MenderShell) Start() {
+	atomic.StoreInt32(&s.running, 1)
 	go s.pipeStdout()
-	s.running = true
 }
 
 func (s *MenderShell) Stop() {
-	s.running = false
+	atomic.StoreInt32(&s.running, 0)
 }
 
 func (s *MenderShell) IsRunning() bool {
-	return s.running
+	return atomic.LoadInt32(&s.running) == 1
 }
 
 func (s *MenderShell) sendStopMessage(err error) {
@@ -77,20 +250,10 @@ func (s *MenderShell) sendStopMessage(err error) {
 		body = []byte(err.Error())
 		status = wsshell.ErrorMessage
 	}
-	msg := &ws.ProtoMsg{
-		Header: ws.ProtoHdr{
-			Proto:     ws.ProtoTypeShell,
-			MsgType:   wsshell.MessageTypeStopShell,
-			SessionID: s.sessionId,
-			Properties: map[string]interface{}{
-				"status": status,
-			},
-		},
-		Body: body,
-	}
-	err = connectionmanager.Write(ws.ProtoTypeShell, msg)
+	msg := s.newMessage(wsshell.MessageTypeStopShell, status, body)
+	err = s.writeMessage(msg)
 	if err != nil {
-		log.Debugf("error on write: %s", err.Error())
+		s.Logger().Debugf("error on write: %s", err.Error())
 	}
 }
 
@@ -102,29 +265,45 @@ func (s *MenderShell) pipeStdout() {
 			return
 		}
 		n, err := sr.Read(raw)
-		if err != nil {
-			log.Errorf("error reading stdout: %s", err)
+		if err != nil && s.exited != nil {
+			if s.IsRunning() {
+				s.Logger().Debugf("error reading stdout: %s", err)
+				s.exited(err)
+			}
+			return
+		} else if err != nil {
+			s.Logger().Errorf("error reading stdout: %s", err)
 			s.sendStopMessage(err)
 			return
 		} else if !s.IsRunning() {
 			return
 		}
 
-		msg := &ws.ProtoMsg{
-			Header: ws.ProtoHdr{
-				Proto:     ws.ProtoTypeShell,
-				MsgType:   wsshell.MessageTypeShellCommand,
-				SessionID: s.sessionId,
-				Properties: map[string]interface{}{
-					"status": wsshell.NormalMessage,
-				},
-			},
-			Body: raw[:n],
+		output := raw[:n]
+		if s.outputLimit != nil {
+			if output = s.limitOutput(output); len(output) == 0 {
+				continue
+			}
 		}
+		if err = s.WriteOutput(output); err != nil {
+			s.Logger().Debugf("error on write: %s", err.Error())
+		}
+	}
+}
 
-		err = connectionmanager.Write(ws.ProtoTypeShell, msg)
-		if err != nil {
-			log.Debugf("error on write: %s", err.Error())
+// WriteOutput sends the data to the peer, and to the observers, as
+// terminal output, the way the output of the shell is sent
+func (s *MenderShell) WriteOutput(data []byte) error {
+	msg := s.newMessage(wsshell.MessageTypeShellCommand, wsshell.NormalMessage, data)
+	err := s.writeMessage(msg)
+	if err == nil && s.messageSent != nil {
+		s.messageSent(msg)
+	}
+	for _, observer := range s.Observers() {
+		observerMsg := newPeerMessage(observer, wsshell.MessageTypeShellCommand, wsshell.NormalMessage, data)
+		if e := s.writeMessage(observerMsg); e != nil {
+			s.Logger().Debugf("error on write to the observer %s: %s", observer.SessionId, e.Error())
 		}
 	}
+	return err
 }
@@ -33,6 +33,7 @@ import (
 	"github.com/vmihailenco/msgpack"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
 	"github.com/mendersoftware/mender-connect/connection"
 	"github.com/mendersoftware/mender-connect/connectionmanager"
 )
@@ -44,6 +45,76 @@ func TestNewMenderShell(t *testing.T) {
 	assert.NotNil(t, s)
 }
 
+func TestMenderShellNewMessage(t *testing.T) {
+	s := NewMenderShell("session-id", nil, nil)
+	msg := s.newMessage(wsshell.MessageTypeShellCommand, wsshell.NormalMessage, []byte("ls"))
+	assert.Equal(t, "session-id", msg.Header.SessionID)
+	assert.NotContains(t, msg.Header.Properties, "stream_id")
+
+	s.SetStreamId("stream-id")
+	msg = s.newMessage(wsshell.MessageTypeShellCommand, wsshell.NormalMessage, []byte("ls"))
+	assert.Equal(t, "session-id", msg.Header.SessionID)
+	assert.Equal(t, "stream-id", msg.Header.Properties["stream_id"])
+}
+
+func TestMenderShellSetWriter(t *testing.T) {
+	var written []*ws.ProtoMsg
+	s := NewMenderShell("session-id", nil, nil)
+	s.SetWriter(func(msg *ws.ProtoMsg) error {
+		written = append(written, msg)
+		return nil
+	})
+	assert.NoError(t, s.WriteOutput([]byte("output")))
+	s.sendStopMessage(nil)
+	if assert.Len(t, written, 2) {
+		assert.Equal(t, wsshell.MessageTypeShellCommand, written[0].Header.MsgType)
+		assert.Equal(t, []byte("output"), written[0].Body)
+		assert.Equal(t, wsshell.MessageTypeStopShell, written[1].Header.MsgType)
+	}
+}
+
+func TestMenderShellObservers(t *testing.T) {
+	var written []*ws.ProtoMsg
+	s := NewMenderShell("session-id", nil, nil)
+	s.SetWriter(func(msg *ws.ProtoMsg) error {
+		written = append(written, msg)
+		return nil
+	})
+	observer := Peer{SessionId: "observer-id", StreamId: "observer-stream"}
+	s.AddObserver(observer)
+	assert.Equal(t, []Peer{observer}, s.Observers())
+
+	assert.NoError(t, s.WriteOutput([]byte("output")))
+	if assert.Len(t, written, 2) {
+		assert.Equal(t, "session-id", written[0].Header.SessionID)
+		assert.Equal(t, "observer-id", written[1].Header.SessionID)
+		assert.Equal(t, "observer-stream", written[1].Header.Properties["stream_id"])
+		assert.Equal(t, []byte("output"), written[1].Body)
+	}
+
+	written = nil
+	s.SetPeer("new-session-id", "")
+	assert.True(t, s.RemoveObserver(observer))
+	assert.False(t, s.RemoveObserver(observer))
+	assert.NoError(t, s.WriteOutput([]byte("output")))
+	if assert.Len(t, written, 1) {
+		assert.Equal(t, "new-session-id", written[0].Header.SessionID)
+	}
+}
+
+func TestMenderShellLimitOutput(t *testing.T) {
+	s := NewMenderShell("session-id", nil, nil)
+	s.SetOutputLimit(10)
+
+	assert.Equal(t, "0123456789\r\n[output rate limit exceeded, dropping output]\r\n",
+		string(s.limitOutput([]byte("0123456789abcdef"))))
+	assert.Empty(t, s.limitOutput([]byte("xyz")))
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, "\r\n[output rate limit exceeded, 9 bytes dropped]\r\nxyz",
+		string(s.limitOutput([]byte("xyz"))))
+}
+
 func readMessage(webSock *websocket.Conn) (*ws.ProtoMsg, error) {
 	_, data, err := webSock.ReadMessage()
 	if err != nil {
@@ -117,7 +188,7 @@ func TestNewMenderShellReadStdIn(t *testing.T) {
 	err = connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
 	assert.NoError(t, err)
 
-	webSock, err := connection.NewConnection(*urlString, "token", time.Second, 526, time.Second, false, "")
+	webSock, err := connection.NewConnection(*urlString, "token", time.Second, 526, time.Second, time.Second, false, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, webSock)
 
@@ -162,7 +233,7 @@ func TestPipeStdout(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	webSock, err := connection.NewConnection(*urlString, "token", time.Second, 526, time.Second, true, "")
+	webSock, err := connection.NewConnection(*urlString, "token", time.Second, 526, time.Second, time.Second, true, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, webSock)
 
@@ -170,7 +241,6 @@ func TestPipeStdout(t *testing.T) {
 		sessionId: "unit-tests-sessions-id",
 		r:         reader,
 		w:         writer,
-		running:   false,
 	}
 
 	rc := shell.IsRunning()
@@ -191,7 +261,7 @@ func TestPipeStdout(t *testing.T) {
 	reader.Close()
 	writer.Close()
 
-	shell.running = false
+	shell.Stop()
 	time.Sleep(4 * time.Second)
 	rc = shell.IsRunning()
 	assert.False(t, rc)
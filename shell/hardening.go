@@ -0,0 +1,150 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// ExecShellCommand is the command of the mender-connect binary which
+// hardens the process and executes the shell
+const ExecShellCommand = "exec-shell"
+
+// prctl(2) and seccomp(2) constants, not all of them are defined by the
+// syscall package on every architecture
+const (
+	prSetNoNewPrivs   = 38
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+	// BPF_MAXINSNS, the maximum length of a filter
+	bpfMaxInstructions = 4096
+)
+
+var ErrSeccompProfileInvalid = errors.New("invalid seccomp profile")
+
+// ShellHardening is applied to the shells ExecuteShell and
+// ExecuteShellInScope start, nil applies none
+var ShellHardening *Hardening
+
+// Hardening restricts what the shells, and the programs the remote
+// operators run in them, can do
+type Hardening struct {
+	// path of the mender-connect binary, which applies the restrictions
+	// to itself and executes the shell
+	Executable string
+	// set PR_SET_NO_NEW_PRIVS, so that no program run in the shell can
+	// gain privileges, e.g. through setuid binaries
+	NoNewPrivs bool
+	// path of a compiled seccomp BPF filter, as exported by
+	// seccomp_export_bpf(3); loading it requires NoNewPrivs
+	SeccompProfile string
+	// execute the shell as a login shell
+	Login bool
+}
+
+// sockFilter is the struct sock_filter of linux/filter.h
+type sockFilter struct {
+	Code uint16
+	Jt   uint8
+	Jf   uint8
+	K    uint32
+}
+
+// sockFprog is the struct sock_fprog of linux/filter.h
+type sockFprog struct {
+	Len    uint16
+	Filter *sockFilter
+}
+
+// arguments returns the command line executing the shell through the
+// ExecShellCommand of the mender-connect binary
+func (h *Hardening) arguments(shell string) []string {
+	args := []string{h.Executable, ExecShellCommand}
+	if h.NoNewPrivs {
+		args = append(args, "--no-new-privs")
+	}
+	if h.SeccompProfile != "" {
+		args = append(args, "--seccomp-profile", h.SeccompProfile)
+	}
+	if LoginShell {
+		args = append(args, "--login")
+	}
+	return append(args, "--", shell)
+}
+
+// LoadSeccompProfile reads a compiled seccomp BPF filter, in the native
+// byte order
+func LoadSeccompProfile(path string) ([]sockFilter, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	size := int(unsafe.Sizeof(sockFilter{}))
+	if len(data) == 0 || len(data)%size != 0 || len(data)/size > bpfMaxInstructions {
+		return nil, ErrSeccompProfileInvalid
+	}
+	filter := make([]sockFilter, len(data)/size)
+	copy((*[bpfMaxInstructions * 8]byte)(unsafe.Pointer(&filter[0]))[:len(data)], data)
+	return filter, nil
+}
+
+// ExecHardened applies the restrictions to the calling process and
+// replaces it with argv; it returns only on errors
+func (h *Hardening) ExecHardened(argv []string) error {
+	if len(argv) == 0 {
+		return errors.New("no command to execute")
+	}
+	var filter []sockFilter
+	if h.SeccompProfile != "" {
+		if !h.NoNewPrivs {
+			return errors.New("loading a seccomp profile requires no-new-privs")
+		}
+		var err error
+		if filter, err = LoadSeccompProfile(h.SeccompProfile); err != nil {
+			return err
+		}
+	}
+
+	// the restrictions apply to the calling thread, which must be the
+	// one calling execve
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if h.NoNewPrivs {
+		if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+			return errno
+		}
+	}
+	if filter != nil {
+		prog := sockFprog{
+			Len:    uint16(len(filter)),
+			Filter: &filter[0],
+		}
+		_, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter,
+			uintptr(unsafe.Pointer(&prog)), 0, 0, 0)
+		runtime.KeepAlive(filter)
+		if errno != 0 {
+			return errno
+		}
+	}
+	path := argv[0]
+	if h.Login {
+		argv = append([]string{loginArgv0(path)}, argv[1:]...)
+	}
+	return syscall.Exec(path, argv, os.Environ())
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// seccomp filter returning EPERM from uname(2)
+var denyUnameFilter = []sockFilter{
+	{Code: 0x20, K: 0}, // ld [nr]
+	{Code: 0x15, Jt: 0, Jf: 1, K: syscall.SYS_UNAME},    // jeq uname
+	{Code: 0x06, K: 0x00050000 | uint32(syscall.EPERM)}, // ret errno
+	{Code: 0x06, K: 0x7fff0000},                         // ret allow
+}
+
+func writeSeccompProfile(t *testing.T, path string, filter []sockFilter) {
+	size := len(filter) * int(unsafe.Sizeof(sockFilter{}))
+	data := (*[bpfMaxInstructions * 8]byte)(unsafe.Pointer(&filter[0]))[:size]
+	assert.NoError(t, ioutil.WriteFile(path, data, 0644))
+}
+
+func TestLoadSeccompProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestLoadSeccompProfile")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	profile := path.Join(dir, "profile.bpf")
+	_, err = LoadSeccompProfile(profile)
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(profile, []byte{}, 0644))
+	_, err = LoadSeccompProfile(profile)
+	assert.Equal(t, ErrSeccompProfileInvalid, err)
+
+	assert.NoError(t, ioutil.WriteFile(profile, []byte{1, 2, 3}, 0644))
+	_, err = LoadSeccompProfile(profile)
+	assert.Equal(t, ErrSeccompProfileInvalid, err)
+
+	writeSeccompProfile(t, profile, denyUnameFilter)
+	filter, err := LoadSeccompProfile(profile)
+	assert.NoError(t, err)
+	assert.Equal(t, denyUnameFilter, filter)
+}
+
+func TestHardeningArguments(t *testing.T) {
+	h := &Hardening{Executable: "/usr/bin/mender-connect"}
+	assert.Equal(t, []string{"/usr/bin/mender-connect", "exec-shell", "--", "/bin/sh"},
+		h.arguments("/bin/sh"))
+
+	h.NoNewPrivs = true
+	h.SeccompProfile = "/etc/mender/shell.bpf"
+	assert.Equal(t, []string{"/usr/bin/mender-connect", "exec-shell", "--no-new-privs",
+		"--seccomp-profile", "/etc/mender/shell.bpf", "--", "/bin/sh"},
+		h.arguments("/bin/sh"))
+}
+
+// TestExecHardenedHelper is not a real test, it is the process
+// TestExecHardened runs to call ExecHardened
+func TestExecHardenedHelper(t *testing.T) {
+	if os.Getenv("TEST_EXEC_HARDENED") != "1" {
+		return
+	}
+	h := &Hardening{
+		NoNewPrivs:     true,
+		SeccompProfile: os.Getenv("TEST_EXEC_HARDENED_PROFILE"),
+	}
+	err := h.ExecHardened(strings.Fields(os.Getenv("TEST_EXEC_HARDENED_COMMAND")))
+	t.Fatal(err)
+}
+
+func runExecHardened(profile string, command string) ([]byte, error) {
+	cmd := exec.Command(os.Args[0], "-test.run=TestExecHardenedHelper")
+	cmd.Env = append(os.Environ(),
+		"TEST_EXEC_HARDENED=1",
+		"TEST_EXEC_HARDENED_PROFILE="+profile,
+		"TEST_EXEC_HARDENED_COMMAND="+command)
+	return cmd.CombinedOutput()
+}
+
+func TestExecHardened(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestExecHardened")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	output, err := runExecHardened("", "/bin/grep NoNewPrivs /proc/self/status")
+	assert.NoError(t, err)
+	assert.Contains(t, string(output), "NoNewPrivs:\t1")
+
+	profile := path.Join(dir, "profile.bpf")
+	writeSeccompProfile(t, profile, denyUnameFilter)
+	output, err = runExecHardened("", "/bin/uname")
+	assert.NoError(t, err)
+	assert.Equal(t, "Linux\n", string(output))
+	_, err = runExecHardened(profile, "/bin/uname")
+	assert.Error(t, err)
+
+	err = (&Hardening{}).ExecHardened(nil)
+	assert.Error(t, err)
+	err = (&Hardening{SeccompProfile: profile}).ExecHardened([]string{"/bin/true"})
+	assert.Error(t, err)
+}
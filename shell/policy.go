@@ -0,0 +1,165 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var ErrCommandDenied = errors.New("command denied by the policy")
+
+// control characters of the terminal input
+const (
+	keyInterrupt = 0x03
+	keyBackspace = 0x08
+	keyLineFeed  = '\n'
+	keyReturn    = '\r'
+	keyKillLine  = 0x15
+	keyEscape    = 0x1b
+	keyDelete    = 0x7f
+)
+
+// CommandPolicy decides which command lines may run, matching them
+// against regular expressions
+type CommandPolicy struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+func compileAll(expressions []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, len(expressions))
+	for i, expression := range expressions {
+		re, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, err
+		}
+		compiled[i] = re
+	}
+	return compiled, nil
+}
+
+// NewCommandPolicy compiles the allow and deny lists of the policy
+func NewCommandPolicy(allow []string, deny []string) (*CommandPolicy, error) {
+	allowRes, err := compileAll(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyRes, err := compileAll(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &CommandPolicy{
+		allow: allowRes,
+		deny:  denyRes,
+	}, nil
+}
+
+// Allowed tells if the command line may run: it must not match any of
+// the deny expressions and, if there are allow expressions, it must match
+// one of them; blank lines are always allowed, and so are all the lines
+// if there is no policy
+func (p *CommandPolicy) Allowed(commandLine string) bool {
+	commandLine = strings.TrimSpace(commandLine)
+	if p == nil || commandLine == "" {
+		return true
+	}
+	for _, re := range p.deny {
+		if re.MatchString(commandLine) {
+			return false
+		}
+	}
+	if len(p.allow) == 0 {
+		return true
+	}
+	for _, re := range p.allow {
+		if re.MatchString(commandLine) {
+			return true
+		}
+	}
+	return false
+}
+
+// CommandFilter applies a CommandPolicy to the interactive input of a
+// shell. The command line is rebuilt from the keystrokes, taking into
+// account erasing and killing the line; the lines recalled from the
+// history or completed by the shell are not seen by the filter, so a
+// strict policy should be paired with a restricted shell.
+type CommandFilter struct {
+	policy *CommandPolicy
+	line   []byte
+	escape bool
+	// called for every command line entered, if set
+	onLine func(line string, denied bool)
+}
+
+// NewCommandFilter returns a filter of the input of a shell, a nil
+// policy allows all the lines
+func NewCommandFilter(policy *CommandPolicy) *CommandFilter {
+	return &CommandFilter{
+		policy: policy,
+	}
+}
+
+// OnLine sets a callback invoked for every non blank command line
+// entered, e.g. to audit them
+func (f *CommandFilter) OnLine(callback func(line string, denied bool)) {
+	f.onLine = callback
+}
+
+// Filter returns the input to write to the shell and the lines the policy
+// denied: the keystrokes pass through, but the end of a denied line is
+// replaced with an interrupt, so that the shell discards the line
+func (f *CommandFilter) Filter(input []byte) (output []byte, denied []string) {
+	output = make([]byte, 0, len(input))
+	for _, b := range input {
+		if f.escape {
+			// escape sequences, e.g. the arrow keys, end with a
+			// letter or a tilde
+			if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || b == '~' {
+				f.escape = false
+			}
+			output = append(output, b)
+			continue
+		}
+		switch b {
+		case keyReturn, keyLineFeed:
+			line := string(f.line)
+			f.line = f.line[:0]
+			allowed := f.policy.Allowed(line)
+			if !allowed {
+				denied = append(denied, line)
+				b = keyInterrupt
+			}
+			if f.onLine != nil && strings.TrimSpace(line) != "" {
+				f.onLine(line, !allowed)
+			}
+		case keyBackspace, keyDelete:
+			if len(f.line) > 0 {
+				f.line = f.line[:len(f.line)-1]
+			}
+		case keyInterrupt, keyKillLine:
+			f.line = f.line[:0]
+		case keyEscape:
+			f.escape = true
+		default:
+			if b >= 0x20 {
+				f.line = append(f.line, b)
+			}
+		}
+		output = append(output, b)
+	}
+	return output, denied
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandPolicyAllowed(t *testing.T) {
+	testCases := map[string]struct {
+		allow   []string
+		deny    []string
+		allowed map[string]bool
+	}{
+		"no lists": {
+			allowed: map[string]bool{
+				"rm -rf /": true,
+			},
+		},
+		"deny list": {
+			deny: []string{`^rm\b`, `reboot`},
+			allowed: map[string]bool{
+				"ls -l":       true,
+				"rm -rf /":    false,
+				"  rm file":   false,
+				"sudo reboot": false,
+				"":            true,
+			},
+		},
+		"allow list": {
+			allow: []string{`^ls\b`, `^cat /var/log/`},
+			deny:  []string{`\.\.`},
+			allowed: map[string]bool{
+				"ls -l":                         true,
+				"cat /var/log/syslog":           true,
+				"cat /var/log/../../etc/shadow": false,
+				"cat /etc/shadow":               false,
+				"   ":                           true,
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			policy, err := NewCommandPolicy(tc.allow, tc.deny)
+			assert.NoError(t, err)
+			for commandLine, allowed := range tc.allowed {
+				assert.Equal(t, allowed, policy.Allowed(commandLine), commandLine)
+			}
+		})
+	}
+}
+
+func TestNewCommandPolicyError(t *testing.T) {
+	_, err := NewCommandPolicy([]string{"("}, nil)
+	assert.Error(t, err)
+	_, err = NewCommandPolicy(nil, []string{"["})
+	assert.Error(t, err)
+}
+
+func TestCommandFilter(t *testing.T) {
+	policy, err := NewCommandPolicy(nil, []string{`^rm\b`})
+	assert.NoError(t, err)
+	filter := NewCommandFilter(policy)
+
+	output, denied := filter.Filter([]byte("ls\r"))
+	assert.Equal(t, []byte("ls\r"), output)
+	assert.Empty(t, denied)
+
+	// typed one key at a time
+	for _, b := range []byte("rm -rf /") {
+		output, denied = filter.Filter([]byte{b})
+		assert.Equal(t, []byte{b}, output)
+		assert.Empty(t, denied)
+	}
+	output, denied = filter.Filter([]byte("\r"))
+	assert.Equal(t, []byte{keyInterrupt}, output)
+	assert.Equal(t, []string{"rm -rf /"}, denied)
+
+	// erased and killed lines
+	output, denied = filter.Filter([]byte("rx\x7fm file\x15ls\r"))
+	assert.Equal(t, []byte("rx\x7fm file\x15ls\r"), output)
+	assert.Empty(t, denied)
+	output, denied = filter.Filter([]byte("lx\x7f\x7frm file\n"))
+	assert.Equal(t, []byte("lx\x7f\x7frm file\x03"), output)
+	assert.Equal(t, []string{"rm file"}, denied)
+
+	// escape sequences are not part of the line
+	output, denied = filter.Filter([]byte("\x1b[Arm x\r"))
+	assert.Equal(t, []byte("\x1b[Arm x\x03"), output)
+	assert.Equal(t, []string{"rm x"}, denied)
+
+	// pasted lines
+	output, denied = filter.Filter([]byte("ls\nrm a\nrm b\n"))
+	assert.Equal(t, []byte("ls\nrm a\x03rm b\x03"), output)
+	assert.Equal(t, []string{"rm a", "rm b"}, denied)
+}
+
+func TestCommandFilterOnLine(t *testing.T) {
+	type entered struct {
+		line   string
+		denied bool
+	}
+	var lines []entered
+	filter := NewCommandFilter(nil)
+	filter.OnLine(func(line string, denied bool) {
+		lines = append(lines, entered{line: line, denied: denied})
+	})
+	output, denied := filter.Filter([]byte("ls\r\r  \rrm -rf /\r"))
+	assert.Equal(t, []byte("ls\r\r  \rrm -rf /\r"), output)
+	assert.Empty(t, denied)
+	assert.Equal(t, []entered{{line: "ls"}, {line: "rm -rf /"}}, lines)
+
+	policy, err := NewCommandPolicy(nil, []string{`^rm\b`})
+	assert.NoError(t, err)
+	lines = nil
+	filter = NewCommandFilter(policy)
+	filter.OnLine(func(line string, denied bool) {
+		lines = append(lines, entered{line: line, denied: denied})
+	})
+	filter.Filter([]byte("ls\nrm a\n"))
+	assert.Equal(t, []entered{{line: "ls"}, {line: "rm a", denied: true}}, lines)
+}
@@ -19,6 +19,8 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
+	"strconv"
 	"syscall"
 	"unsafe"
 
@@ -28,6 +30,13 @@ import (
 
 const defaultCmdDir = "/"
 
+var (
+	// start the shells as login shells
+	LoginShell = false
+	// extra environment of the shells, as "NAME=value"
+	ShellEnv []string
+)
+
 func ExecuteShell(uid uint32,
 	gid uint32,
 	homeDir string,
@@ -35,8 +44,63 @@ func ExecuteShell(uid uint32,
 	termString string,
 	height uint16,
 	width uint16) (pid int, pseudoTTY *os.File, cmd *exec.Cmd, err error) {
-	cmd = exec.Command(shell)
+	return executeShell(nil, "", uid, gid, homeDir, shell, nil, termString, nil, height, width)
+}
+
+// ExecuteShellWithEnv starts the shell like ExecuteShell does, with the
+// extra environment env, as "NAME=value"; ShellEnv takes precedence
+func ExecuteShellWithEnv(uid uint32,
+	gid uint32,
+	homeDir string,
+	shell string,
+	termString string,
+	env []string,
+	height uint16,
+	width uint16) (pid int, pseudoTTY *os.File, cmd *exec.Cmd, err error) {
+	return executeShell(nil, "", uid, gid, homeDir, shell, nil, termString, env, height, width)
+}
 
+// ExecuteShellWithArgs starts the shell like ExecuteShellWithEnv does,
+// with the arguments args, e.g. "-c" and a command
+func ExecuteShellWithArgs(uid uint32,
+	gid uint32,
+	homeDir string,
+	shell string,
+	args []string,
+	termString string,
+	env []string,
+	height uint16,
+	width uint16) (pid int, pseudoTTY *os.File, cmd *exec.Cmd, err error) {
+	return executeShell(nil, "", uid, gid, homeDir, shell, args, termString, env, height, width)
+}
+
+// ExecuteShellInScope starts the shell like ExecuteShellWithArgs does, in
+// the transient scope unit of systemd named unit
+func ExecuteShellInScope(scope *SystemdScope,
+	unit string,
+	uid uint32,
+	gid uint32,
+	homeDir string,
+	shell string,
+	args []string,
+	termString string,
+	env []string,
+	height uint16,
+	width uint16) (pid int, pseudoTTY *os.File, cmd *exec.Cmd, err error) {
+	return executeShell(scope, unit, uid, gid, homeDir, shell, args, termString, env, height, width)
+}
+
+func executeShell(scope *SystemdScope,
+	unit string,
+	uid uint32,
+	gid uint32,
+	homeDir string,
+	shell string,
+	args []string,
+	termString string,
+	env []string,
+	height uint16,
+	width uint16) (pid int, pseudoTTY *os.File, cmd *exec.Cmd, err error) {
 	currentUser, err := user.Current()
 	if err != nil {
 		log.Debugf("cant get current user: %s", err.Error())
@@ -45,9 +109,30 @@ func ExecuteShell(uid uint32,
 
 	//in order to set uid and gid we have to be root, at the moment lets check
 	//if our uid is 0
+	var credential *syscall.Credential
 	if currentUser.Uid == "0" {
-		cmd.SysProcAttr = &syscall.SysProcAttr{}
-		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+		credential = &syscall.Credential{Uid: uid, Gid: gid}
+	}
+	argv := []string{shell}
+	if ShellHardening != nil {
+		argv = ShellHardening.arguments(shell)
+	} else if LoginShell && scope != nil {
+		//systemd-run executes the shell with argv[0] set to its path
+		argv = append(argv, "-l")
+	}
+	argv = append(argv, args...)
+	if scope != nil {
+		//systemd-run sets up the scope and drops the privileges itself
+		cmd = exec.Command(scope.Command, scope.arguments(unit, credential, argv)...)
+	} else {
+		cmd = exec.Command(argv[0], argv[1:]...)
+		if LoginShell && ShellHardening == nil {
+			cmd.Args[0] = loginArgv0(shell)
+		}
+		if credential != nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+			cmd.SysProcAttr.Credential = credential
+		}
 	}
 
 	if _, err := os.Stat(homeDir); !os.IsNotExist(err) {
@@ -58,13 +143,22 @@ func ExecuteShell(uid uint32,
 
 	cmd.Env = append(cmd.Env, fmt.Sprintf("HOME=%s", homeDir))
 	cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", termString))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("SHELL=%s", shell))
+	if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("USER=%s", u.Username))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("LOGNAME=%s", u.Username))
+	}
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Env = append(cmd.Env, ShellEnv...)
 
 	pseudoTTY, err = pty.Start(cmd)
 	if err != nil {
 		return -1, nil, nil, err
 	}
 
-	ResizeShell(pseudoTTY, height, width)
+	if err = ResizeShell(pseudoTTY, height, width); err != nil {
+		log.Debugf("failed to set the initial size of the terminal: %s", err.Error())
+	}
 
 	pid = cmd.Process.Pid
 	log.Debugf("started shell: %s pid:%d", shell, pid)
@@ -72,15 +166,38 @@ func ExecuteShell(uid uint32,
 	return pid, pseudoTTY, cmd, nil
 }
 
-func ResizeShell(pseudoTTY *os.File, height uint16, width uint16) {
-	log.Debugf("resizing terminal %v to %dx%d", *pseudoTTY, height, width)
-	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, pseudoTTY.Fd(), uintptr(syscall.TIOCSWINSZ),
-		uintptr(unsafe.Pointer(&struct {
-			h, w, x, y uint16
-		}{
-			height, width, 0, 0,
-		})))
+// loginArgv0 returns the argv[0] which makes the shell a login shell,
+// e.g. -bash for /bin/bash
+func loginArgv0(shell string) string {
+	return "-" + filepath.Base(shell)
+}
+
+// ResizeShell sets the size of the terminal and delivers SIGWINCH to the
+// foreground process group of the terminal, so that the programs running
+// in it redraw themselves
+func ResizeShell(pseudoTTY *os.File, height uint16, width uint16) error {
+	if pseudoTTY == nil {
+		return ErrTerminalClosed
+	}
+	log.Debugf("resizing terminal %s to %dx%d", pseudoTTY.Name(), height, width)
+	err := pty.Setsize(pseudoTTY, &pty.Winsize{
+		Rows: height,
+		Cols: width,
+	})
+	if err != nil {
+		return err
+	}
+
+	var pgrp int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, pseudoTTY.Fd(), uintptr(syscall.TIOCGPGRP),
+		uintptr(unsafe.Pointer(&pgrp)))
 	if errno != 0 {
-		log.Debugf("failed to resize terminal: %d", errno)
+		return errno
+	}
+	if pgrp > 0 {
+		if err = syscall.Kill(-int(pgrp), syscall.SIGWINCH); err != nil && err != syscall.ESRCH {
+			return err
+		}
 	}
+	return nil
 }
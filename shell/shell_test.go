@@ -14,6 +14,7 @@
 package shell
 
 import (
+	"io/ioutil"
 	"os"
 	"os/user"
 	"strconv"
@@ -21,6 +22,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/creack/pty"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/mendersoftware/mender-connect/procps"
@@ -94,3 +96,115 @@ func TestMenderShellExecShell(t *testing.T) {
 		t.Logf("process is still running after kill -9")
 	}
 }
+
+func TestResizeShell(t *testing.T) {
+	err := ResizeShell(nil, 24, 80)
+	assert.Equal(t, ErrTerminalClosed, err)
+
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	pid, pseudoTTY, cmd, err := ExecuteShell(uint32(uid), uint32(gid), "/tmp", "/bin/sh", "xterm-256color", 24, 80)
+	assert.NoError(t, err)
+	defer func() {
+		pseudoTTY.Close()
+		procps.TerminateAndWait(pid, cmd, time.Second)
+	}()
+
+	rows, cols, err := pty.Getsize(pseudoTTY)
+	assert.NoError(t, err)
+	assert.Equal(t, 24, rows)
+	assert.Equal(t, 80, cols)
+
+	err = ResizeShell(pseudoTTY, 40, 120)
+	assert.NoError(t, err)
+	rows, cols, err = pty.Getsize(pseudoTTY)
+	assert.NoError(t, err)
+	assert.Equal(t, 40, rows)
+	assert.Equal(t, 120, cols)
+}
+
+func TestExecuteLoginShellEnv(t *testing.T) {
+	defer func() {
+		LoginShell = false
+		ShellEnv = nil
+	}()
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	LoginShell = true
+	ShellEnv = []string{"MENDER_REMOTE=1"}
+	pid, pseudoTTY, cmd, err := ExecuteShell(uint32(uid), uint32(gid), "/tmp", "/bin/sh", "xterm-256color", 24, 80)
+	assert.NoError(t, err)
+	assert.Equal(t, "-sh", cmd.Args[0])
+	assert.Contains(t, cmd.Env, "MENDER_REMOTE=1")
+	assert.Contains(t, cmd.Env, "SHELL=/bin/sh")
+	assert.Contains(t, cmd.Env, "LOGNAME="+currentUser.Username)
+
+	_, err = pseudoTTY.Write([]byte("echo \"<$0|$MENDER_REMOTE|$USER>\"; exit\n"))
+	assert.NoError(t, err)
+	output, _ := ioutil.ReadAll(pseudoTTY)
+	assert.Contains(t, string(output), "<-sh|1|"+currentUser.Username+">")
+
+	pseudoTTY.Close()
+	procps.TerminateAndWait(pid, cmd, time.Second)
+}
+
+func TestExecuteShellWithArgs(t *testing.T) {
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	pid, pseudoTTY, cmd, err := ExecuteShellWithArgs(uint32(uid), uint32(gid), "/tmp", "/bin/sh",
+		[]string{"-c", "echo \"<$0|$TERM>\""}, "xterm-256color", nil, 24, 80)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/bin/sh", "-c", "echo \"<$0|$TERM>\""}, cmd.Args)
+
+	output, _ := ioutil.ReadAll(pseudoTTY)
+	assert.Contains(t, string(output), "</bin/sh|xterm-256color>")
+
+	pseudoTTY.Close()
+	procps.TerminateAndWait(pid, cmd, time.Second)
+}
+
+func TestExecuteShellWithEnv(t *testing.T) {
+	defer func() {
+		ShellEnv = nil
+	}()
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	ShellEnv = []string{"LC_TIME=C"}
+	pid, pseudoTTY, cmd, err := ExecuteShellWithEnv(uint32(uid), uint32(gid), "/tmp", "/bin/sh", "screen",
+		[]string{"LANG=C.UTF-8", "LC_TIME=en_GB.UTF-8"}, 24, 80)
+	assert.NoError(t, err)
+	assert.Contains(t, cmd.Env, "TERM=screen")
+
+	_, err = pseudoTTY.Write([]byte("echo \"<$TERM|$LANG|$LC_TIME>\"; exit\n"))
+	assert.NoError(t, err)
+	output, _ := ioutil.ReadAll(pseudoTTY)
+	// ShellEnv takes precedence
+	assert.Contains(t, string(output), "<screen|C.UTF-8|C>")
+
+	pseudoTTY.Close()
+	procps.TerminateAndWait(pid, cmd, time.Second)
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DefaultSystemdRunCommand is the path of systemd-run
+const DefaultSystemdRunCommand = "/usr/bin/systemd-run"
+
+// prefix of the names of the scope units of the shells
+const scopeUnitPrefix = "mender-connect-shell-"
+
+// SystemdScope runs the shells in transient scope units of systemd, see
+// systemd-run(1), so that they show up in systemctl and systemd cleans
+// up after them; systemd-run needs to talk to the system manager, which
+// requires running as root
+type SystemdScope struct {
+	// path of systemd-run
+	Command string
+	// slice the scopes are placed in, empty for the default one
+	Slice string
+	// properties of the scopes, e.g. "MemoryMax=64M"
+	Properties []string
+}
+
+// ScopeUnitName returns the name of the scope unit of the shell of a
+// session, replacing the characters not allowed in unit names
+func ScopeUnitName(name string) string {
+	escaped := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') ||
+			r == '-' || r == '_' || r == '.' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+	return scopeUnitPrefix + escaped + ".scope"
+}
+
+func (s *SystemdScope) arguments(unit string, credential *syscall.Credential, argv []string) []string {
+	args := []string{
+		"--scope",
+		"--quiet",
+		"--collect",
+		"--unit=" + unit,
+		"--description=mender-connect remote shell",
+	}
+	if s.Slice != "" {
+		args = append(args, "--slice="+s.Slice)
+	}
+	for _, property := range s.Properties {
+		args = append(args, "--property="+property)
+	}
+	if credential != nil {
+		args = append(args,
+			"--uid="+strconv.FormatUint(uint64(credential.Uid), 10),
+			"--gid="+strconv.FormatUint(uint64(credential.Gid), 10))
+	}
+	args = append(args, "--")
+	return append(args, argv...)
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/procps"
+)
+
+func TestScopeUnitName(t *testing.T) {
+	assert.Equal(t, "mender-connect-shell-c4993deb-26b4.scope",
+		ScopeUnitName("c4993deb-26b4"))
+	assert.Equal(t, "mender-connect-shell-session_stream_1.scope",
+		ScopeUnitName("session_stream/1"))
+}
+
+func TestSystemdScopeArguments(t *testing.T) {
+	testCases := map[string]struct {
+		scope      *SystemdScope
+		credential *syscall.Credential
+		arguments  []string
+	}{
+		"defaults": {
+			scope: &SystemdScope{},
+			arguments: []string{
+				"--scope", "--quiet", "--collect", "--unit=unit.scope",
+				"--description=mender-connect remote shell",
+				"--", "/bin/sh",
+			},
+		},
+		"slice, properties and credential": {
+			scope: &SystemdScope{
+				Slice:      "mender-connect.slice",
+				Properties: []string{"MemoryMax=1024", "TasksMax=16"},
+			},
+			credential: &syscall.Credential{Uid: 1000, Gid: 100},
+			arguments: []string{
+				"--scope", "--quiet", "--collect", "--unit=unit.scope",
+				"--description=mender-connect remote shell",
+				"--slice=mender-connect.slice",
+				"--property=MemoryMax=1024", "--property=TasksMax=16",
+				"--uid=1000", "--gid=100",
+				"--", "/bin/sh",
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.arguments, tc.scope.arguments("unit.scope", tc.credential, []string{"/bin/sh"}))
+		})
+	}
+}
+
+func TestExecuteShellInScope(t *testing.T) {
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	dir, err := ioutil.TempDir("", "TestExecuteShellInScope")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// fake systemd-run, recording its arguments and running the command
+	systemdRun := path.Join(dir, "systemd-run")
+	arguments := path.Join(dir, "arguments")
+	err = ioutil.WriteFile(systemdRun, []byte("#!/bin/sh\n"+
+		"echo \"$@\" > "+arguments+"\n"+
+		"while [ \"$1\" != \"--\" ]; do shift; done\n"+
+		"shift\n"+
+		"exec \"$@\"\n"), 0755)
+	assert.NoError(t, err)
+
+	scope := &SystemdScope{Command: systemdRun}
+	pid, pseudoTTY, cmd, err := ExecuteShellInScope(scope, "unit.scope", uint32(uid), uint32(gid),
+		"/tmp", "/bin/sh", nil, "xterm-256color", nil, 24, 80)
+	assert.NoError(t, err)
+	assert.NotNil(t, pseudoTTY)
+	assert.True(t, procps.ProcessExists(pid))
+
+	time.Sleep(500 * time.Millisecond)
+	data, err := ioutil.ReadFile(arguments)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "--scope --quiet --collect --unit=unit.scope"))
+	assert.True(t, strings.HasSuffix(strings.TrimSpace(string(data)), "-- /bin/sh"))
+
+	pseudoTTY.Close()
+	procps.TerminateAndWait(pid, cmd, time.Second)
+}
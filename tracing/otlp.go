@@ -0,0 +1,171 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// OTLP span kind and status codes, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusCodeOK     = 1
+	otlpStatusCodeError  = 2
+)
+
+// OTLPExporter exports the spans to an OpenTelemetry collector using OTLP
+// over HTTP with the JSON encoding
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+}
+
+// NewOTLPExporter returns an exporter posting the spans to endpoint,
+// e.g. http://localhost:4318/v1/traces
+func NewOTLPExporter(endpoint string, serviceName string) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func newOTLPAttributes(attributes []Attribute) []otlpAttribute {
+	otlpAttributes := make([]otlpAttribute, len(attributes))
+	for i, attribute := range attributes {
+		otlpAttributes[i] = otlpAttribute{
+			Key:   attribute.Key,
+			Value: otlpValue{StringValue: attribute.Value},
+		}
+	}
+	return otlpAttributes
+}
+
+func newOTLPSpan(span *Span) otlpSpan {
+	s := otlpSpan{
+		TraceID:           span.TraceID.String(),
+		SpanID:            span.SpanID.String(),
+		Name:              span.Name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+		Attributes:        newOTLPAttributes(span.Attributes),
+		Status:            otlpStatus{Code: otlpStatusCodeOK},
+	}
+	if span.ParentID.IsValid() {
+		s.ParentSpanID = span.ParentID.String()
+	}
+	if span.Err != nil {
+		s.Status = otlpStatus{
+			Code:    otlpStatusCodeError,
+			Message: span.Err.Error(),
+		}
+	}
+	return s
+}
+
+func (e *OTLPExporter) newRequest(spans []*Span) *otlpRequest {
+	otlpSpans := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		otlpSpans[i] = newOTLPSpan(span)
+	}
+	return &otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: newOTLPAttributes([]Attribute{{
+					Key:   "service.name",
+					Value: e.serviceName,
+				}}),
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "mender-connect"},
+				Spans: otlpSpans,
+			}},
+		}},
+	}
+}
+
+// Export posts the spans to the collector
+func (e *OTLPExporter) Export(spans []*Span) error {
+	body, err := json.Marshal(e.newRequest(spans))
+	if err != nil {
+		return err
+	}
+	response, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response from %s: %s", e.endpoint, response.Status)
+	}
+	return nil
+}
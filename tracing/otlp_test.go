@@ -0,0 +1,83 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	var request otlpRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+	}))
+	defer server.Close()
+
+	start := time.Unix(1, 0)
+	span := &Span{
+		TraceID:    TraceID{1},
+		SpanID:     SpanID{2},
+		ParentID:   SpanID{3},
+		Name:       "dispatch",
+		StartTime:  start,
+		EndTime:    start.Add(time.Second),
+		Attributes: []Attribute{{Key: "msg_type", Value: "shell"}},
+		Err:        errors.New("failed"),
+	}
+	exporter := NewOTLPExporter(server.URL, "mender-connect")
+	assert.NoError(t, exporter.Export([]*Span{span}))
+
+	if assert.Len(t, request.ResourceSpans, 1) {
+		resourceSpans := request.ResourceSpans[0]
+		assert.Equal(t, []otlpAttribute{{
+			Key:   "service.name",
+			Value: otlpValue{StringValue: "mender-connect"},
+		}}, resourceSpans.Resource.Attributes)
+		assert.Equal(t, []otlpSpan{{
+			TraceID:           "01000000000000000000000000000000",
+			SpanID:            "0200000000000000",
+			ParentSpanID:      "0300000000000000",
+			Name:              "dispatch",
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: "1000000000",
+			EndTimeUnixNano:   "2000000000",
+			Attributes: []otlpAttribute{{
+				Key:   "msg_type",
+				Value: otlpValue{StringValue: "shell"},
+			}},
+			Status: otlpStatus{
+				Code:    otlpStatusCodeError,
+				Message: "failed",
+			},
+		}}, resourceSpans.ScopeSpans[0].Spans)
+	}
+}
+
+func TestOTLPExporterError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	exporter := NewOTLPExporter(server.URL, "mender-connect")
+	assert.Error(t, exporter.Export([]*Span{{Name: "dispatch"}}))
+}
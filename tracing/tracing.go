@@ -0,0 +1,246 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package tracing records the spans of the message handling and of the
+// long lived operations, like the sessions, and exports them in batches.
+// Tracing is disabled until Enable is called: StartSpan then returns a nil
+// span, and all the Span methods are no-ops on a nil span.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// maximum number of spans waiting to be exported, the spans finished
+	// when the queue is full are dropped
+	QueueSize = 2048
+	// maximum number of spans exported at once
+	BatchSize = 512
+	// time after which the queued spans get exported, even if they don't
+	// fill a batch
+	FlushInterval = 5 * time.Second
+)
+
+// TraceID identifies a trace, the tree of spans of an operation
+type TraceID [16]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// IsValid returns false for the zero SpanID, e.g. the parent of a root span
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// Attribute annotates a span
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// Span is a timed operation, part of a trace
+type Span struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	ParentID   SpanID
+	Name       string
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes []Attribute
+	// Err is the error the operation ended with, if any
+	Err error
+}
+
+// Exporter sends the finished spans to a tracing backend
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+var (
+	processorMutex sync.Mutex
+	processor      *batchProcessor
+)
+
+// Enable starts recording the spans and exporting them with exporter
+func Enable(exporter Exporter) {
+	processorMutex.Lock()
+	defer processorMutex.Unlock()
+	if processor != nil {
+		processor.shutdown()
+	}
+	processor = newBatchProcessor(exporter)
+}
+
+// Disable stops recording the spans, exporting the ones already finished
+func Disable() {
+	processorMutex.Lock()
+	defer processorMutex.Unlock()
+	if processor != nil {
+		processor.shutdown()
+		processor = nil
+	}
+}
+
+// Enabled returns true if the spans are being recorded
+func Enabled() bool {
+	processorMutex.Lock()
+	defer processorMutex.Unlock()
+	return processor != nil
+}
+
+// StartSpan starts the root span of a new trace; it returns nil if tracing
+// is disabled
+func StartSpan(name string, attributes ...Attribute) *Span {
+	if !Enabled() {
+		return nil
+	}
+	span := &Span{
+		SpanID:     newSpanID(),
+		Name:       name,
+		StartTime:  time.Now(),
+		Attributes: attributes,
+	}
+	rand.Read(span.TraceID[:])
+	return span
+}
+
+// StartChild starts a span of the same trace, child of s
+func (s *Span) StartChild(name string, attributes ...Attribute) *Span {
+	if s == nil {
+		return StartSpan(name, attributes...)
+	}
+	return &Span{
+		TraceID:    s.TraceID,
+		SpanID:     newSpanID(),
+		ParentID:   s.SpanID,
+		Name:       name,
+		StartTime:  time.Now(),
+		Attributes: attributes,
+	}
+}
+
+// SetAttributes adds attributes to the span
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.Attributes = append(s.Attributes, attributes...)
+}
+
+// Finish ends the span and queues it for export; err is the error the
+// operation ended with, if any
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.EndTime = time.Now()
+	s.Err = err
+	processorMutex.Lock()
+	p := processor
+	processorMutex.Unlock()
+	if p != nil {
+		p.enqueue(s)
+	}
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	rand.Read(id[:])
+	return id
+}
+
+// batchProcessor queues the finished spans and exports them in batches
+type batchProcessor struct {
+	exporter Exporter
+	spans    chan *Span
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newBatchProcessor(exporter Exporter) *batchProcessor {
+	p := &batchProcessor{
+		exporter: exporter,
+		spans:    make(chan *Span, QueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *batchProcessor) enqueue(span *Span) {
+	select {
+	case p.spans <- span:
+	default:
+		log.Debugf("tracing: queue full, dropping span %s", span.Name)
+	}
+}
+
+func (p *batchProcessor) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, BatchSize)
+	for {
+		select {
+		case span := <-p.spans:
+			batch = append(batch, span)
+			if len(batch) >= BatchSize {
+				batch = p.export(batch)
+			}
+		case <-ticker.C:
+			batch = p.export(batch)
+		case <-p.stop:
+			for {
+				select {
+				case span := <-p.spans:
+					batch = append(batch, span)
+				default:
+					p.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// export sends the batch, returning an empty one
+func (p *batchProcessor) export(batch []*Span) []*Span {
+	if len(batch) == 0 {
+		return batch
+	}
+	if err := p.exporter.Export(batch); err != nil {
+		log.Warnf("tracing: failed to export %d spans: %s", len(batch), err.Error())
+	}
+	return make([]*Span, 0, BatchSize)
+}
+
+func (p *batchProcessor) shutdown() {
+	close(p.stop)
+	<-p.done
+}
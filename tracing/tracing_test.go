@@ -0,0 +1,71 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package tracing
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingExporter struct {
+	mutex sync.Mutex
+	spans []*Span
+}
+
+func (e *recordingExporter) Export(spans []*Span) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestSpanDisabled(t *testing.T) {
+	assert.False(t, Enabled())
+	span := StartSpan("disabled")
+	assert.Nil(t, span)
+	span.SetAttributes(Attribute{Key: "key", Value: "value"})
+	assert.Nil(t, span.StartChild("child"))
+	span.Finish(nil)
+}
+
+func TestSpanExport(t *testing.T) {
+	exporter := &recordingExporter{}
+	Enable(exporter)
+	assert.True(t, Enabled())
+
+	root := StartSpan("root", Attribute{Key: "session_id", Value: "1234"})
+	assert.NotNil(t, root)
+	assert.False(t, root.ParentID.IsValid())
+	child := root.StartChild("child")
+	child.SetAttributes(Attribute{Key: "msg_type", Value: "shell"})
+	child.Finish(errors.New("failed"))
+	root.Finish(nil)
+
+	Disable()
+	assert.False(t, Enabled())
+
+	if assert.Len(t, exporter.spans, 2) {
+		assert.Equal(t, "child", exporter.spans[0].Name)
+		assert.Equal(t, root.TraceID, exporter.spans[0].TraceID)
+		assert.Equal(t, root.SpanID, exporter.spans[0].ParentID)
+		assert.Equal(t, []Attribute{{Key: "msg_type", Value: "shell"}}, exporter.spans[0].Attributes)
+		assert.EqualError(t, exporter.spans[0].Err, "failed")
+		assert.Equal(t, "root", exporter.spans[1].Name)
+		assert.NoError(t, exporter.spans[1].Err)
+		assert.False(t, exporter.spans[1].EndTime.Before(exporter.spans[1].StartTime))
+	}
+}